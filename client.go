@@ -27,15 +27,18 @@ package rmux
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/salesforce/rmux/connection"
 	. "github.com/salesforce/rmux/log"
 	"github.com/salesforce/rmux/protocol"
 	. "github.com/salesforce/rmux/writer"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
-	"github.com/salesforce/rmux/graphite"
+	"github.com/salesforce/rmux/metrics"
 )
 
 type readItem struct {
@@ -52,19 +55,57 @@ type Client struct {
 	Connection   net.Conn
 	//The Database that our client thinks we're connected to
 	DatabaseId int
+	//The RESP protocol version that our client has negotiated via HELLO
+	ProtocolVersion int
 	//Whether or not this client connection is active or not
 	//Upon QUIT command, this gets toggled off
 	Active      bool
 	ReadChannel chan readItem
 	HashRing    *connection.HashRing
+	//Decides which commands are allowed.  If nil, the default classification is used
+	CommandPolicy *protocol.CommandPolicy
+	//How many times a read-only command is retried, while its server replies -LOADING.  0 disables retrying
+	LoadingRetries int
+	//How long to wait before each -LOADING retry
+	LoadingRetryDelay time.Duration
+	//If set while multiplexing, SCAN runs across each of these backends in turn, rather than being refused
+	ScanPools []*connection.ConnectionPool
+	//The longest a context-aware write to the client may block for.  0 waits for as long as the context allows
+	writeTimeout time.Duration
 	queued      []protocol.Command
 	Scanner     *protocol.RespScanner
+	//Identifies this client in debug logs
+	logContext *protocol.LogContext
+	//Whether a MULTI or WATCH is open.  Transactions have to run on the master, so replicas aren't used meanwhile
+	inMulti  bool
+	watching bool
+	//The redis connection that an open transaction runs on, and the pool it came from.  While set, every command goes
+	//to it, and no other client is handed it
+	pinned     *connection.Connection
+	pinnedPool *connection.ConnectionPool
+	//When the pinned connection was last used
+	pinnedAt time.Time
+	//Whether the proxy has answered the client's MULTI, without sending it yet.  When multiplexing, the backend that
+	//a transaction runs on is only known once a command is queued in it, so the MULTI is sent ahead of that command
+	pendingMulti bool
+	//The name that the client gave itself with CLIENT SETNAME, which the proxy answers for it (nil if it has none)
+	name []byte
+	//Whether CLIENT subcommands were queued in a transaction, and so sent on the connection it's pinned to.  Whatever
+	//they set there is reset once the connection is released
+	sentClientSubcommands bool
 }
 
+//The most redirects followed for a single command, so that a misconfigured cluster can't redirect us in a loop
+const MAX_CLUSTER_REDIRECTS = 5
+
+//The id given to the most recently connected client, for correlating debug logs
+var lastClientId uint64
+
 var (
-	ERR_QUIT            = errors.New("Client asked to quit")
-	ERR_CONNECTION_DOWN = errors.New(string(CONNECTION_DOWN_RESPONSE))
-	ERR_TIMEOUT         = errors.New("Proxy timeout")
+	ERR_QUIT             = errors.New("Client asked to quit")
+	ERR_CONNECTION_DOWN  = errors.New(string(CONNECTION_DOWN_RESPONSE))
+	ERR_TIMEOUT          = errors.New("Proxy timeout")
+	ERR_TRANSACTION_IDLE = errors.New("Transaction idle for too long")
 )
 
 //Initializes a new client, for the given established net connection, with the specified read/write timeouts
@@ -72,31 +113,98 @@ func NewClient(connection net.Conn, readTimeout, writeTimeout time.Duration, isM
 	newClient = &Client{}
 	newClient.Connection = connection
 	newClient.Writer = NewFlexibleWriter(connection)
+	newClient.writeTimeout = writeTimeout
 	newClient.Active = true
 	newClient.Multiplexing = isMuliplexing
 	newClient.ReadChannel = make(chan readItem, 10000)
 	newClient.queued = make([]protocol.Command, 0, 4)
 	newClient.HashRing = hashRing
 	newClient.DatabaseId = 0
-	newClient.Scanner = protocol.NewRespScanner(connection)
+	newClient.ProtocolVersion = protocol.RESP2
+	newClient.Scanner = protocol.NewCommandScanner(connection)
+	newClient.logContext = &protocol.LogContext{ConnectionId: atomic.AddUint64(&lastClientId, 1)}
+	if connection != nil && connection.RemoteAddr() != nil {
+		newClient.logContext.RemoteAddr = connection.RemoteAddr().String()
+	}
 	return
 }
 
 //Parses the given command
 func (this *Client) ParseCommand(command protocol.Command) ([]byte, error) {
-	//block all unsafe commands
-	if !protocol.IsSupportedFunction(command.GetCommand(), this.Multiplexing, command.GetArgCount() > 2) {
-		return nil, protocol.ERR_COMMAND_UNSUPPORTED
+	//block all unsafe commands.  A SCAN that's fanned out across every backend doesn't need them to be one
+	multiplexing := this.Multiplexing && !this.fansOutScan(command)
+	if err := this.CommandPolicy.CheckCommand(command, multiplexing); err != nil {
+		return nil, err
 	}
 
-	if bytes.Equal(command.GetCommand(), protocol.PING_COMMAND) {
+	if this.Multiplexing && this.pinned == nil {
+		if bytes.Equal(command.GetCommand(), protocol.MULTI_COMMAND) {
+			if this.pendingMulti {
+				return nil, protocol.ERR_NESTED_MULTI
+			}
+			this.pendingMulti = true
+			this.trackTransaction(command.GetCommand())
+			return protocol.OK_RESPONSE, nil
+		}
+
+		if this.pendingMulti && bytes.Equal(command.GetCommand(), protocol.EXEC_COMMAND) {
+			// Nothing was queued, so there's nothing for a backend to run
+			this.pendingMulti = false
+			this.trackTransaction(command.GetCommand())
+			return protocol.EMPTY_ARRAY_RESPONSE, nil
+		}
+
+		if this.pendingMulti && bytes.Equal(command.GetCommand(), protocol.DISCARD_COMMAND) {
+			this.pendingMulti = false
+			this.trackTransaction(command.GetCommand())
+			return protocol.OK_RESPONSE, nil
+		}
+	}
+
+	//A PING with a message is answered with the message, by the server, like any other command.  So is any PING in a
+	//transaction, where the client expects it to be queued, and its reply to be part of the EXEC's
+	if bytes.Equal(command.GetCommand(), protocol.PING_COMMAND) && command.GetArgCount() == 0 &&
+		!this.inMulti && !this.pendingMulti && this.pinned == nil {
 		return protocol.PONG_RESPONSE, nil
 	}
 
+	//CLIENT SETNAME and the like are answered for the client, since its backend connections are shared with others
+	//In a transaction, they're queued like any other command, so that the EXEC's reply has an entry for each
+	if protocol.IsClientSubcommand(command) {
+		if !this.inMulti && !this.pendingMulti {
+			reply, name, err := protocol.AnswerClientSubcommand(command, this.name)
+			if err != nil {
+				return nil, err
+			}
+			this.name = name
+			return reply, nil
+		}
+		this.sentClientSubcommands = true
+	}
+
+	this.trackTransaction(command.GetCommand())
+
 	if bytes.Equal(command.GetCommand(), protocol.QUIT_COMMAND) {
 		return nil, ERR_QUIT
 	}
 
+	if bytes.Equal(command.GetCommand(), protocol.RESET_COMMAND) {
+		// The RESET is still forwarded, so that the client receives the server's reply.  Clients aren't authenticated
+		// by the proxy, so there's no proxy-level auth to require again
+		this.DatabaseId = 0
+		this.ProtocolVersion = protocol.RESP2
+		this.inMulti = false
+		this.watching = false
+		this.pendingMulti = false
+		this.name = nil
+		return nil, nil
+	}
+
+	if this.inMulti && (bytes.Equal(command.GetCommand(), protocol.SELECT_COMMAND) ||
+		bytes.Equal(command.GetCommand(), protocol.HELLO_COMMAND)) {
+		return nil, protocol.ERR_NOT_IN_MULTI
+	}
+
 	if bytes.Equal(command.GetCommand(), protocol.SELECT_COMMAND) {
 		databaseId, err := protocol.ParseInt(command.GetFirstArg())
 		if err != nil {
@@ -107,6 +215,15 @@ func (this *Client) ParseCommand(command protocol.Command) ([]byte, error) {
 		return protocol.OK_RESPONSE, nil
 	}
 
+	if bytes.Equal(command.GetCommand(), protocol.HELLO_COMMAND) {
+		// The HELLO is still forwarded, so that the client receives the server's handshake reply.  The protocol it asks
+		// for (and the name it sets, if any) are only taken up once the server has accepted it, see recordReply
+		if _, err := protocol.ParseHello(command); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
 	return nil, nil
 }
 
@@ -126,6 +243,12 @@ func (this *Client) FlushLine(line []byte) (err error) {
 	return protocol.WriteLine(line, this.Writer, true)
 }
 
+//Writes and flushes the line, giving up once the context is done, or once the client's write timeout has passed.
+//On cancellation, returns ctx.Err(), and the client should be disconnected
+func (this *Client) FlushLineContext(ctx context.Context, line []byte) (err error) {
+	return protocol.FlushLineContext(ctx, line, this.Writer, this.Connection, this.writeTimeout)
+}
+
 // Performs the query against the redis server and responds to the connected client with the response from redis.
 func (this *Client) FlushRedisAndRespond() error {
 	var err error
@@ -134,6 +257,16 @@ func (this *Client) FlushRedisAndRespond() error {
 		return this.Writer.Flush()
 	}
 
+	if this.pinned != nil {
+		if this.Multiplexing {
+			if err := this.checkPinnedRoute(this.queued[0]); err != nil {
+				this.resetQueued()
+				return this.FlushError(err)
+			}
+		}
+		return this.flushToConnection(this.pinnedPool, this.pinned)
+	}
+
 	var connectionPool *connection.ConnectionPool
 	if !this.Multiplexing {
 		connectionPool = this.HashRing.DefaultConnectionPool
@@ -141,73 +274,667 @@ func (this *Client) FlushRedisAndRespond() error {
 		if len(this.queued) != 1 {
 			panic("Should not have multiple commands to flush when multiplexing")
 		}
+		if this.fansOutScan(this.queued[0]) {
+			return this.flushScan(this.queued[0])
+		}
 		connectionPool, err = this.HashRing.GetConnectionPool(this.queued[0])
-		if err != nil {
+		if recErr, ok := err.(*protocol.RecoverableError); ok {
+			// The command can't be routed, ex: a script whose keys live on different backends.  Only it is refused
+			this.resetQueued()
+			return this.FlushError(recErr)
+		} else if err != nil {
 			Error("Failed to retrieve a connection pool from the hashring")
 			this.ReadChannel <- readItem{nil, err}
 			return err
 		}
 	}
 
+	if this.canReadFromReplica() {
+		connectionPool = connectionPool.ReadPool()
+	}
+
 	redisConn, err := connectionPool.GetConnection()
-	if err != nil {
+	if errors.Is(err, connection.ERR_TRIPPED) {
+		// The backend is failing for now, which isn't the client's doing, so only its commands are refused
+		return this.refuseQueued(err)
+	} else if err != nil {
 		Error("Failed to retrieve an active connection from the provided connection pool")
 		this.ReadChannel <- readItem{nil, ERR_CONNECTION_DOWN}
 		return ERR_CONNECTION_DOWN
 	}
-	defer connectionPool.RecycleRemoteConnection(redisConn)
 
-	if redisConn.DatabaseId != this.DatabaseId {
-		if err := redisConn.SelectDatabase(this.DatabaseId); err != nil {
-			// Disconnect the current connection if selecting failed, will auto-reconnect this connection holder when queried later
-			redisConn.Disconnect()
+	return this.flushToConnection(connectionPool, redisConn)
+}
+
+//Writes the queued commands to the given connection, from the given pool, and copies its responses to the client
+//The connection is recycled afterwards, unless the commands left a transaction open on it, in which case it's pinned
+//to this client until the transaction ends
+func (this *Client) flushToConnection(connectionPool *connection.ConnectionPool, redisConn *connection.Connection) (err error) {
+	defer this.releaseConnection(connectionPool, redisConn)
+
+	if err := this.prepareConnection(redisConn); err != nil {
+		return err
+	}
+
+	if this.pendingMulti {
+		// The client already has the proxy's reply to its MULTI, so the server's is only checked
+		this.pendingMulti = false
+		if err := redisConn.Multi(); err != nil {
+			Error("Error when opening a transaction on the server: %s", err)
+			this.resetQueued()
+			this.inMulti = false
+			this.ReadChannel <- readItem{nil, err}
 			return err
 		}
 	}
 
+	spans := redisConn.StartTrace(this.queued)
+	if spans != nil {
+		defer func() {
+			redisConn.EndTrace(spans, err)
+		}()
+	}
+
 	numCommands := len(this.queued)
+	// Kept past resetQueued, so that each command's latency can be recorded once its response has been copied
+	queued := this.queued
 
 	startWrite := time.Now()
 
 	for _, command := range this.queued {
-		_, err := redisConn.Writer.Write(command.GetBuffer())
+		buffer := command.GetBuffer()
+		if bytes.Equal(command.GetCommand(), protocol.HELLO_COMMAND) && command.GetArgCount() > 1 {
+			// Its AUTH and SETNAME are the client's own, and not for a connection that other clients share
+			hello, _ := protocol.ParseHello(command)
+			buffer = protocol.EncodeHello(hello.Version)
+		}
+		_, err := redisConn.Writer.Write(buffer)
 		if err != nil {
 			Error("Error when writing to server: %s. Disconnecting the connection.", err)
-			redisConn.Disconnect()
+			redisConn.Disconnect(connection.DisconnectReasonOf(err))
 			return err
 		}
 	}
 	this.resetQueued()
+	// Which commands are queued inside a MULTI, rather than run straight away
+	var transactional []bool
+	for i, command := range queued {
+		wasInMulti := redisConn.InMulti()
+		redisConn.TrackTransaction(command.GetCommand())
+		if wasInMulti && redisConn.InMulti() {
+			if transactional == nil {
+				transactional = make([]bool, len(queued))
+			}
+			transactional[i] = true
+		}
+	}
 	for redisConn.Writer.Buffered() > 0 {
 		err := redisConn.Writer.Flush()
 		if err != nil {
 			Error("Error when flushing to server: %s. Disconnecting the connection.", err)
-			redisConn.Disconnect()
+			redisConn.RecordReply(protocol.REPLY_UNKNOWN, err)
+			redisConn.Disconnect(connection.DisconnectReasonOf(err))
 			return err
 		}
 	}
 
-	graphite.Timing("redis_write", time.Now().Sub(startWrite))
+	metrics.SampledTiming("redis_write", time.Now().Sub(startWrite))
 
-	if err := protocol.CopyServerResponses(redisConn.Reader, this.Writer, numCommands); err != nil {
+	if this.HashRing.ClusterNodes != nil || redisConn.UsesSentinel() || this.LoadingRetries > 0 {
+		err = this.copyAndInspectServerResponses(redisConn, queued, transactional, spans)
+	} else if spans != nil || hasReplyTimeout(queued) {
+		err = this.copyEachServerResponse(redisConn, queued, spans)
+	} else {
+		err = protocol.CopyObservedServerResponses(redisConn.Reader, this.Writer, numCommands, this.logContext, this.replyObserver(redisConn, queued))
+	}
+	if err != nil {
 		Error("Error when copying redis responses to client: %s. Disconnecting the connection.", err)
-		redisConn.Disconnect()
+		redisConn.RecordReply(protocol.REPLY_UNKNOWN, err)
+		redisConn.Disconnect(connection.DisconnectReasonOf(err))
 		this.ReadChannel <- readItem{nil, err}
 		return err
 	}
 
 	this.Writer.Flush()
 
+	for _, command := range queued {
+		if bytes.Equal(command.GetCommand(), protocol.RESET_COMMAND) {
+			// The server is back on database 0, and no longer authenticated with the proxy's credentials
+			if err := redisConn.HandleReset(); err != nil {
+				Error("Error when restoring the connection after a RESET: %s", err)
+			}
+			break
+		}
+	}
+
+	elapsed := time.Now().Sub(startWrite)
+	metrics.SampledTiming("command", elapsed)
+	// Pipelined commands share a round trip, so each is recorded with the latency of the whole batch
+	for _, command := range queued {
+		metrics.SampledTiming(protocol.CommandTimingMetric(command.GetCommand()), elapsed)
+	}
+
+	return nil
+}
+
+//Returns whether the command is a SCAN to run across the ScanPools.  Inside a WATCH or MULTI, the client's commands
+//all go to one backend, which wouldn't understand the combined cursor, so SCAN is refused there like any other
+//command that can't be multiplexed
+func (this *Client) fansOutScan(command protocol.Command) bool {
+	return this.ScanPools != nil && this.pinned == nil && !this.pendingMulti &&
+		bytes.Equal(command.GetCommand(), protocol.SCAN_COMMAND)
+}
+
+//Runs a SCAN on one of the ScanPools, and replies with a cursor that says which backend it's up to, and where in it
+//Each backend is scanned in turn, so that iterating until the cursor is 0 again covers every backend's keys
+func (this *Client) flushScan(command protocol.Command) error {
+	this.resetQueued()
+
+	if command.GetArgCount() == 0 {
+		return this.FlushError(protocol.ERR_BAD_ARGUMENTS)
+	}
+	index, cursor, err := protocol.DecodeScanCursor(command.GetFirstArg(), len(this.ScanPools))
+	if err != nil {
+		return this.FlushError(err)
+	}
+
+	connectionPool := this.ScanPools[index]
+	redisConn, err := connectionPool.GetConnection()
+	if errors.Is(err, connection.ERR_TRIPPED) {
+		return this.FlushError(err)
+	} else if err != nil {
+		Error("Failed to retrieve an active connection from the provided connection pool")
+		this.ReadChannel <- readItem{nil, ERR_CONNECTION_DOWN}
+		return ERR_CONNECTION_DOWN
+	}
+	defer connectionPool.RecycleRemoteConnection(redisConn)
+
+	if err := this.prepareConnection(redisConn); err != nil {
+		return err
+	}
+
+	if err := protocol.WriteMultibulk(protocol.ScanWithCursor(command, cursor), redisConn.Writer, true); err != nil {
+		Error("Error when writing to server: %s. Disconnecting the connection.", err)
+		redisConn.Disconnect(connection.DisconnectReasonOf(err))
+		return err
+	}
+
+	if err = this.copyScanResponse(redisConn, index); err != nil {
+		Error("Error when copying redis responses to client: %s. Disconnecting the connection.", err)
+		redisConn.Disconnect(connection.DisconnectReasonOf(err))
+		this.ReadChannel <- readItem{nil, err}
+		return err
+	}
+	return this.Writer.Flush()
+}
+
+//Copies the reply to a SCAN that was run on the ScanPools backend with the given index, with its cursor combined
+//with the index.  A backend that's been scanned to the end moves the cursor on to the start of the next one
+func (this *Client) copyScanResponse(redisConn *connection.Connection, index int) error {
+	// An error reply, ex: for an unknown TYPE, is passed on as it is
+	if prefix, err := redisConn.Reader.Peek(1); err == nil && prefix[0] == '-' {
+		return protocol.CopyServerResponses(redisConn.Reader, this.Writer, 1, this.logContext)
+	}
+
+	cursor, err := protocol.ReadScanCursor(redisConn.Reader)
+	if err != nil {
+		return err
+	}
+
+	var combined []byte
+	if cursor != 0 {
+		combined, err = protocol.EncodeScanCursor(index, len(this.ScanPools), cursor)
+	} else if index+1 < len(this.ScanPools) {
+		combined, err = protocol.EncodeScanCursor(index+1, len(this.ScanPools), 0)
+	} else {
+		combined = []byte("0")
+	}
+	if err != nil {
+		// The keys still have to be read, so that the connection can be used again
+		if err := protocol.IgnoreServerResponse(redisConn.Reader); err != nil {
+			return err
+		}
+		return this.WriteError(err, false)
+	}
+
+	if err = protocol.WriteScanCursor(combined, this.Writer); err != nil {
+		return err
+	}
+	_, err = protocol.CopyServerResponse(redisConn.Reader, this.Writer)
+	return err
+}
+
+//Pins the connection to this client while a transaction is open on it, and recycles it back into its pool otherwise
+func (this *Client) releaseConnection(connectionPool *connection.ConnectionPool, redisConn *connection.Connection) {
+	if redisConn.InTransaction() {
+		redisConn.Pinned = true
+		this.pinned = redisConn
+		this.pinnedPool = connectionPool
+		this.pinnedAt = time.Now()
+		return
+	}
+
+	// Once everything queued has been sent, the connection has seen every command the client did.  If it still has no
+	// transaction open, it was disconnected, and the server discarded the transaction along with it
+	if len(this.queued) == 0 {
+		this.inMulti = false
+		this.watching = false
+	}
+	redisConn.Pinned = false
+	this.pinned = nil
+	this.pinnedPool = nil
+	if this.sentClientSubcommands {
+		redisConn.Disconnect(connection.DISCONNECT_CLIENT_STATE)
+		this.sentClientSubcommands = false
+	}
+	connectionPool.RecycleRemoteConnection(redisConn)
+}
+
+//Returns an error if the given command would be routed to another backend than the one the client's transaction is
+//pinned to, since it can't take part in the transaction there.  Commands without keys run on the pinned connection
+func (this *Client) checkPinnedRoute(command protocol.Command) error {
+	if command.GetArgCount() == 0 {
+		return nil
+	}
+	if protocol.IsEvalFunction(command.GetCommand()) {
+		if keys, err := protocol.GetEvalKeys(command); err == nil && len(keys) == 0 {
+			return nil
+		}
+	}
+
+	connectionPool, err := this.HashRing.GetConnectionPool(command)
+	if recErr, ok := err.(*protocol.RecoverableError); ok {
+		return recErr
+	} else if err != nil || connectionPool != this.pinnedPool {
+		return protocol.ERR_KEYS_SPAN_BACKENDS
+	}
 	return nil
 }
 
+//Returns how long the connection that an open transaction is pinned to has gone unused, or 0 if there is none
+func (this *Client) PinnedIdleFor() time.Duration {
+	if this.pinned == nil {
+		return 0
+	}
+	return time.Now().Sub(this.pinnedAt)
+}
+
+//Recycles the connection that an open transaction is pinned to, if any, once the client has gone away
+//The connection is disconnected first, so that the server discards the transaction, and forgets what was watched
+func (this *Client) ReleasePinnedConnection() {
+	if this.pinned == nil {
+		return
+	}
+
+	this.pinned.Disconnect(connection.DISCONNECT_CLIENT)
+	this.pinned.Pinned = false
+	this.pinnedPool.RecycleRemoteConnection(this.pinned)
+	this.pinned = nil
+	this.pinnedPool = nil
+	this.inMulti = false
+	this.watching = false
+	this.sentClientSubcommands = false
+}
+
+//Tracks whether a transaction is open, from the commands that open and close them
+func (this *Client) trackTransaction(command []byte) {
+	if bytes.Equal(command, protocol.MULTI_COMMAND) {
+		this.inMulti = true
+	} else if bytes.Equal(command, protocol.EXEC_COMMAND) || bytes.Equal(command, protocol.DISCARD_COMMAND) {
+		// Both end the transaction, and unwatch every key
+		this.inMulti = false
+		this.watching = false
+	} else if bytes.Equal(command, protocol.WATCH_COMMAND) {
+		this.watching = true
+	} else if bytes.Equal(command, protocol.UNWATCH_COMMAND) && !this.inMulti {
+		this.watching = false
+	}
+}
+
+//Returns whether the queued commands may be sent to a read replica: they all have to be read-only, and not part of
+//a transaction
+func (this *Client) canReadFromReplica() bool {
+	if this.inMulti || this.watching {
+		return false
+	}
+
+	for _, command := range this.queued {
+		if !protocol.IsReadOnlyFunction(command.GetCommand()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Selects the client's database and negotiates its protocol on the given connection, so that it's ready for the
+//client's commands.  The connection is disconnected if either fails
+func (this *Client) prepareConnection(redisConn *connection.Connection) error {
+	if redisConn.DatabaseId != this.DatabaseId {
+		if err := redisConn.SelectDatabase(this.DatabaseId); err != nil {
+			// Disconnect the current connection if selecting failed, will auto-reconnect this connection holder when queried later
+			redisConn.Disconnect(connection.DISCONNECT_HANDSHAKE_FAIL)
+			return err
+		}
+	}
+
+	// Negotiate the client's protocol on the backend, so that replies are framed the way the client expects them
+	if redisConn.ProtocolVersion() != this.ProtocolVersion {
+		if err := redisConn.Hello(this.ProtocolVersion); err != nil {
+			redisConn.Disconnect(connection.DISCONNECT_HANDSHAKE_FAIL)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Copies the responses to the queued commands to the client, like protocol.CopyServerResponses, one at a time so that
+//each traced span (if any) gets the size of its own reply, and each reply that may block on the server gets its own
+//read timeout
+func (this *Client) copyEachServerResponse(redisConn *connection.Connection, queued []protocol.Command,
+	spans []*connection.TraceSpan) error {
+	observe := this.replyObserver(redisConn, queued)
+	for i, command := range queued {
+		consumed := redisConn.BytesConsumed()
+		revert := extendReplyTimeout(redisConn, command)
+		err := protocol.CopyObservedServerResponses(redisConn.Reader, this.Writer, 1, this.logContext, observe)
+		revert()
+		if err != nil {
+			return err
+		}
+		if spans != nil {
+			spans[i].BytesRead = int(redisConn.BytesConsumed() - consumed)
+		}
+	}
+	return nil
+}
+
+//Returns an observer for protocol.CopyObservedServerResponses, that passes each reply to recordReply along with the
+//queued command that it answers
+func (this *Client) replyObserver(redisConn *connection.Connection, queued []protocol.Command) func(kind protocol.ReplyKind, line []byte) {
+	numRead := 0
+	return func(kind protocol.ReplyKind, line []byte) {
+		this.recordReply(redisConn, queued[numRead], kind, line)
+		numRead++
+	}
+}
+
+//Records the reply to the command with the connection's circuit breaker.  Error replies are recorded by their line,
+//since only some say anything about the server
+//A HELLO's protocol is taken up by the client and the connection once the server has accepted it, along with the
+//name it sets, if any.  Until then, they both keep speaking the protocol they did
+func (this *Client) recordReply(redisConn *connection.Connection, command protocol.Command, kind protocol.ReplyKind, line []byte) {
+	if kind.IsError() {
+		redisConn.RecordErrorReply(line)
+		return
+	}
+	redisConn.RecordReply(kind, nil)
+
+	if bytes.Equal(command.GetCommand(), protocol.HELLO_COMMAND) {
+		hello, _ := protocol.ParseHello(command)
+		if hello.Version != 0 {
+			this.ProtocolVersion = hello.Version
+			redisConn.SetProtocolVersion(hello.Version)
+		}
+		if hello.SetsName {
+			this.name = hello.Name
+		}
+	}
+}
+
+//Returns whether any of the commands may take the server longer than the read timeout to reply to (ex: BLPOP)
+func hasReplyTimeout(commands []protocol.Command) bool {
+	for _, command := range commands {
+		if _, ok := protocol.ReplyTimeout(command); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Gives the next read from the connection the command's reply timeout, if it may block on the server.  The returned
+//function reverts it, and must be called once the reply has been read, whether that succeeded or not
+func extendReplyTimeout(redisConn *connection.Connection, command protocol.Command) (revert func()) {
+	if timeout, ok := protocol.ReplyTimeout(command); ok {
+		return redisConn.ExtendNextReadTimeout(timeout)
+	}
+	return func() {}
+}
+
+//A response held back from the client until earlier -LOADING replies have been retried.  Push frames have no command
+type heldResponse struct {
+	command  protocol.Command
+	response []byte
+}
+
+//Copies the responses to the queued commands to the client, like protocol.CopyServerResponses, except that:
+//cluster -MOVED/-ASK redirects are followed (if enabled), and the redirected command's reply is copied in their place,
+//a sentinel-resolved connection is disconnected after the copy if its server says it is no longer the master, so
+//that the master is looked up again when it reconnects,
+//and read-only commands that get a -LOADING reply are retried (if enabled).  Retries can only be sent once every
+//pipelined response has been read, so the responses from the first -LOADING onwards are held back until then
+//Only error replies need inspecting, so the others are streamed through like CopyServerResponses does, unless
+//they're held back.  If the commands are traced, each span is given the size of its reply as it's read
+//Commands queued inside a MULTI (flagged in transactional, which is nil if there are none) are answered with +QUEUED,
+//which is streamed through like any other reply.  Their errors are passed on as they are, since redirecting or
+//retrying them would run them outside of the transaction
+func (this *Client) copyAndInspectServerResponses(redisConn *connection.Connection, queued []protocol.Command,
+	transactional []bool, spans []*connection.TraceSpan) (err error) {
+	numRead := 0
+	isFailedOver := false
+	var held []heldResponse
+	consumed := redisConn.BytesConsumed()
+	replyRead := func() {
+		if spans != nil {
+			spans[numRead].BytesRead = int(redisConn.BytesConsumed() - consumed)
+			consumed = redisConn.BytesConsumed()
+		}
+		numRead++
+	}
+	inspect := func(response []byte) error {
+		var command protocol.Command
+		if response[0] != '>' {
+			isQueued := transactional != nil && transactional[numRead]
+			command = queued[numRead]
+			replyRead()
+			if this.HashRing.ClusterNodes != nil {
+				if redirect, ok := protocol.ParseRedirect(response); ok && !isQueued {
+					response = this.followRedirects(command, redirect, response)
+				}
+			} else if redisConn.UsesSentinel() && protocol.IsFailoverError(response) {
+				isFailedOver = true
+			}
+
+			// A followed redirect is recorded by the reply it led to
+			this.recordReply(redisConn, command, protocol.ReplyKindOf(response[0]), response)
+
+			if isQueued {
+				// Held back like a push frame, if at all, so that it isn't retried
+				command = nil
+			}
+		}
+
+		if held != nil || (command != nil && this.isRetriableLoading(command, response)) {
+			// The response is only valid during the scan, so it's copied out
+			held = append(held, heldResponse{command, append([]byte(nil), response...)})
+			return nil
+		}
+
+		this.Writer.Write(response)
+		this.Writer.Flush()
+		return nil
+	}
+
+	for numRead < len(queued) && err == nil {
+		revert := extendReplyTimeout(redisConn, queued[numRead])
+		if next, peekErr := redisConn.Reader.Peek(1); held == nil && peekErr == nil && next[0] != '-' {
+			var kind protocol.ReplyKind
+			if kind, err = protocol.CopyServerResponse(redisConn.Reader, this.Writer); err == nil && !kind.IsPush() {
+				this.recordReply(redisConn, queued[numRead], kind, nil)
+				replyRead()
+			}
+			revert()
+			continue
+		}
+
+		// Reads the next reply whole, along with any push frames ahead of it
+		err = protocol.ScanServerResponses(redisConn.Reader, 1, this.logContext, inspect)
+		revert()
+	}
+
+	if err == nil {
+		for _, h := range held {
+			response := h.response
+			if h.command != nil && this.isRetriableLoading(h.command, response) {
+				response = this.retryWhileLoading(redisConn, h.command, response)
+			}
+			this.Writer.Write(response)
+		}
+		this.Writer.Flush()
+	}
+
+	if err == nil && isFailedOver {
+		Warn("The backend is no longer the master, reconnecting through sentinel")
+		metrics.Increment("sentinel_failover")
+		redisConn.Disconnect(connection.DISCONNECT_FAILOVER)
+	}
+
+	return err
+}
+
+//Returns whether the response is a -LOADING reply that should be retried: only read-only commands are, since
+//retrying is only safe for idempotent commands
+func (this *Client) isRetriableLoading(command protocol.Command, response []byte) bool {
+	if this.LoadingRetries <= 0 || response[0] != '-' || !protocol.IsReadOnlyFunction(command.GetCommand()) {
+		return false
+	}
+
+	code, _ := protocol.ParseError(response)
+	return code == protocol.ERROR_CODE_LOADING
+}
+
+//Resends the command on the connection, after LoadingRetryDelay, for as long as its server replies -LOADING, up to
+//LoadingRetries times.  Returns the reply to give the client, which is the last -LOADING if the server never finishes
+//loading, or if the connection fails
+func (this *Client) retryWhileLoading(redisConn *connection.Connection, command protocol.Command, response []byte) []byte {
+	for attempt := 0; attempt < this.LoadingRetries; attempt++ {
+		time.Sleep(this.LoadingRetryDelay)
+		if !redisConn.IsConnected() {
+			return response
+		}
+
+		redisConn.Writer.Write(command.GetBuffer())
+		if err := redisConn.Writer.Flush(); err != nil {
+			Error("Error retrying a command while the server is loading: %s", err)
+			redisConn.Disconnect(connection.DisconnectReasonOf(err))
+			return response
+		}
+
+		err := protocol.ScanServerResponses(redisConn.Reader, 1, this.logContext, func(reply []byte) error {
+			if reply[0] == '>' {
+				this.Writer.Write(reply)
+			} else {
+				response = append([]byte(nil), reply...)
+			}
+			return nil
+		})
+		if err != nil {
+			Error("Error retrying a command while the server is loading: %s", err)
+			metrics.Increment("loading_retry_error")
+			redisConn.Disconnect(connection.DisconnectReasonOf(err))
+			return response
+		}
+		metrics.Increment("loading_retry")
+
+		if code, _ := protocol.ParseError(response); code != protocol.ERROR_CODE_LOADING {
+			return response
+		}
+	}
+
+	Warn("Gave up after retrying %d times while the server is loading, returning -LOADING to the client", this.LoadingRetries)
+	return response
+}
+
+//Resends the command to the node that the redirect points at, following up to MAX_CLUSTER_REDIRECTS redirects, and
+//returns the reply to give the client.  If a node can't be reached, the last redirect is returned to the client as-is
+func (this *Client) followRedirects(command protocol.Command, redirect protocol.Redirect, response []byte) []byte {
+	for hops := 0; hops < MAX_CLUSTER_REDIRECTS; hops++ {
+		reply, err := this.sendToClusterNode(command, redirect)
+		if err != nil {
+			Error("Error following a redirect to %s: %s", redirect.Endpoint, err)
+			metrics.Increment("cluster_redirect_error")
+			return response
+		}
+		metrics.Increment("cluster_redirect")
+
+		response = reply
+		var isRedirect bool
+		if redirect, isRedirect = protocol.ParseRedirect(response); !isRedirect {
+			return response
+		}
+	}
+
+	Warn("Gave up after following %d redirects, returning the last one to the client", MAX_CLUSTER_REDIRECTS)
+	return response
+}
+
+//Sends the command to the node that the redirect points at, preceded by ASKING for an ASK redirect, and returns its reply
+func (this *Client) sendToClusterNode(command protocol.Command, redirect protocol.Redirect) (reply []byte, err error) {
+	pool := this.HashRing.ClusterNodes.GetConnectionPool(redirect.Endpoint)
+	nodeConn, err := pool.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.RecycleRemoteConnection(nodeConn)
+
+	if err = this.prepareConnection(nodeConn); err != nil {
+		return nil, err
+	}
+
+	numResponses := 1
+	if redirect.Ask {
+		numResponses++
+		protocol.WriteLine(protocol.ASKING_COMMAND, nodeConn.Writer, false)
+	}
+	nodeConn.Writer.Write(command.GetBuffer())
+	if err = nodeConn.Writer.Flush(); err != nil {
+		nodeConn.Disconnect(connection.DisconnectReasonOf(err))
+		return nil, err
+	}
+
+	askingAcknowledged := !redirect.Ask
+	err = protocol.ScanServerResponses(nodeConn.Reader, numResponses, this.logContext, func(response []byte) error {
+		if response[0] == '>' {
+			this.Writer.Write(response)
+		} else if !askingAcknowledged {
+			if !protocol.IsStatusResponse(response, protocol.OK_RESPONSE) {
+				return fmt.Errorf("Unexpected response to ASKING: %q", response)
+			}
+			askingAcknowledged = true
+		} else {
+			// The response is only valid during the scan, so it's copied out
+			reply = append([]byte(nil), response...)
+		}
+		return nil
+	})
+	if err != nil {
+		nodeConn.Disconnect(connection.DisconnectReasonOf(err))
+		return nil, err
+	}
+
+	return reply, nil
+}
+
 func (this *Client) HasBufferedOutput() bool {
 	return this.Writer.Buffered() > 0
 }
 
 // Read loop for this client - moves commands and channels to the worker loop
+// Active isn't checked here, since the worker loop sets it without any locking.  A client the worker loop is done with
+// has its connection closed, which ends the scan
 func (this *Client) ReadLoop(rmux *RedisMultiplexer) {
-	for rmux.active && this.Active && this.Scanner.Scan() {
+	for rmux.active && this.Scanner.Scan() {
 		bytes := this.Scanner.Bytes()
 		command, err := protocol.ParseCommand(bytes)
 		this.ReadChannel <- readItem{command, err}
@@ -220,6 +947,22 @@ func (this *Client) ReadLoop(rmux *RedisMultiplexer) {
 	}
 }
 
+//Replies to each queued command with the error, instead of sending them to a backend
+//No connection saw them, so unless a MULTI is still waiting for its first command, no transaction is open on one
+func (this *Client) refuseQueued(err error) error {
+	for range this.queued {
+		if writeErr := this.WriteError(err, false); writeErr != nil {
+			return writeErr
+		}
+	}
+	this.resetQueued()
+	if !this.pendingMulti {
+		this.inMulti = false
+		this.watching = false
+	}
+	return this.Writer.Flush()
+}
+
 func (this *Client) resetQueued() {
 	// We make a new one instead of using this.queued=this.queued[:0] so that the command arrays are eligible for GC
 	this.queued = make([]protocol.Command, 0, 4)
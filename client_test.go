@@ -29,8 +29,12 @@ package rmux
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"github.com/salesforce/rmux/connection"
 	"github.com/salesforce/rmux/protocol"
 	"github.com/salesforce/rmux/writer"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -107,6 +111,8 @@ func TestParseCommand(test *testing.T) {
 		{[]byte("+PING\r\n"), protocol.PONG_RESPONSE, nil},
 		//should accept multibulk format
 		{[]byte("*1\r\n$4\r\nping\r\n"), protocol.PONG_RESPONSE, nil},
+		//ping with a message is forwarded, for the server to echo it
+		{[]byte("*2\r\n$4\r\nping\r\n$7\r\npayload\r\n"), nil, nil},
 		//quit in proper format should respond appropriately
 		{[]byte("*1\r\n$4\r\nquit\r\n"), nil, ERR_QUIT},
 		//select without database should err
@@ -119,8 +125,15 @@ func TestParseCommand(test *testing.T) {
 		{[]byte("*1\r\n$4\r\nauth\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
 		//random command on our pubsub list should respond appropriately
 		{[]byte("*1\r\n$6\r\npubsub\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
-		//multi should fail
-		{[]byte("*1\r\n$5\r\nmulti\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
+		//hello should be forwarded, with or without a version
+		{[]byte("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n"), nil, nil},
+		{[]byte("*1\r\n$5\r\nhello\r\n"), nil, nil},
+		//hello with an unknown version should err
+		{[]byte("*2\r\n$5\r\nhello\r\n$1\r\n4\r\n"), nil, protocol.ERR_BAD_ARGUMENTS},
+		//multi is answered by the proxy, until something is queued in it
+		{[]byte("*1\r\n$5\r\nmulti\r\n"), protocol.OK_RESPONSE, nil},
+		{[]byte("*1\r\n$5\r\nmulti\r\n"), nil, protocol.ERR_NESTED_MULTI},
+		{[]byte("*1\r\n$4\r\nexec\r\n"), protocol.EMPTY_ARRAY_RESPONSE, nil},
 	}
 
 	listenSock, err := net.Listen("unix", "/tmp/rmuxTest1.sock")
@@ -166,3 +179,1038 @@ func TestParseCommand(test *testing.T) {
 	}
 }
 
+
+func TestHelloProtocolVersion(test *testing.T) {
+	hello := "*7\r\n$5\r\nHELLO\r\n$1\r\n3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$4\r\npass\r\n$7\r\nSETNAME\r\n$3\r\napp\r\n"
+	refusedHello := "*2\r\n$5\r\nhello\r\n$1\r\n2\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	// The options are the client's own, so only the version is sent on
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{string(protocol.EncodeHello(protocol.RESP3)), "%1\r\n$5\r\nproto\r\n:3\r\n"},
+		{refusedHello, "-NOPROTO unsupported protocol version\r\n"},
+	}
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange.request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+				test.Errorf("Expected %q, got %q", exchange.request, buf)
+				return
+			}
+			fd.Write([]byte(exchange.reply))
+		}
+	}()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	send := func(request string) {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		before := client.ProtocolVersion
+		if _, err := client.ParseCommand(command); err != nil {
+			test.Fatalf("ParseCommand(%q) returned an error: %s", request, err)
+		}
+		// Nothing is taken up until the server has replied
+		if client.ProtocolVersion != before {
+			test.Fatalf("Expected the protocol not to change before the server accepted the HELLO")
+		}
+		client.Queue(command)
+		if err := client.FlushRedisAndRespond(); err != nil {
+			test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+		}
+	}
+
+	send(hello)
+	if client.ProtocolVersion != protocol.RESP3 || string(client.name) != "app" {
+		test.Errorf("Expected the accepted HELLO to negotiate RESP3 and name the client, got %d, %q", client.ProtocolVersion, client.name)
+	}
+
+	// A refused HELLO changes nothing, and the connection already speaks RESP3, so it isn't negotiated again
+	send(refusedHello)
+	if client.ProtocolVersion != protocol.RESP3 {
+		test.Errorf("Expected a refused HELLO to leave the protocol alone, got %d", client.ProtocolVersion)
+	}
+
+	if expected := exchanges[0].reply + exchanges[1].reply; w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+
+	for _, input := range []string{"*2\r\n$5\r\nhello\r\n$1\r\n4\r\n", "*3\r\n$5\r\nhello\r\n$1\r\n3\r\n$5\r\nother\r\n"} {
+		command, _ := protocol.ParseCommand([]byte(input))
+		if _, err := NewClient(nil, time.Millisecond, time.Millisecond, false, nil).ParseCommand(command); err == nil {
+			test.Errorf("ParseCommand(%q) should have been refused", input)
+		}
+	}
+}
+
+//Accepts a single connection on the listener, and answers the expected request with the given reply
+func serveClusterNode(test *testing.T, listener net.Listener, expected, reply string) {
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != expected {
+			test.Errorf("Expected the node at %s to receive %q, got %q", listener.Addr(), expected, buf)
+		}
+		fd.Write([]byte(reply))
+	}()
+}
+
+func TestFollowClusterRedirects(test *testing.T) {
+	get := "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n"
+	testCases := []struct {
+		redirect      string
+		targetRequest string
+		targetReply   string
+	}{
+		{"-MOVED 12182 %s\r\n", get, "$3\r\nbar\r\n"},
+		{"-ASK 12182 %s\r\n", "asking\r\n" + get, "+OK\r\n$3\r\nbar\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		origin, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			test.Fatalf("Failed to listen: %s", err)
+		}
+		target, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			test.Fatalf("Failed to listen: %s", err)
+		}
+
+		serveClusterNode(test, origin, get, fmt.Sprintf(testCase.redirect, target.Addr()))
+		serveClusterNode(test, target, testCase.targetRequest, testCase.targetReply)
+
+		pool := connection.NewConnectionPool("tcp", origin.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+		hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+		if err != nil {
+			test.Fatalf("Failed to create the hash ring: %s", err)
+		}
+		hashRing.ClusterNodes = connection.NewClusterNodes(1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+
+		client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+		w := new(bytes.Buffer)
+		client.Writer = writer.NewFlexibleWriter(w)
+
+		command, err := protocol.ParseCommand([]byte(get))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		client.Queue(command)
+
+		if err := client.FlushRedisAndRespond(); err != nil {
+			test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+		}
+
+		if w.String() != "$3\r\nbar\r\n" {
+			test.Errorf("Expected the redirected reply to be returned for %q, got %q", testCase.redirect, w.String())
+		}
+
+		origin.Close()
+		target.Close()
+	}
+}
+
+func TestRedirectsNotFollowedInsideMulti(test *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	get := "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n"
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	origin, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer origin.Close()
+	target, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer target.Close()
+
+	moved := fmt.Sprintf("-MOVED 12182 %s\r\n", target.Addr())
+	serveClusterNode(test, origin, multi+get+set, "+OK\r\n"+moved+"+QUEUED\r\n")
+	go func() {
+		if fd, err := target.Accept(); err == nil {
+			test.Errorf("Expected a command queued inside a MULTI not to be redirected")
+			fd.Close()
+		}
+	}()
+
+	pool := connection.NewConnectionPool("tcp", origin.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+	hashRing.ClusterNodes = connection.NewClusterNodes(1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	for _, request := range []string{multi, get, set} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		client.Queue(command)
+	}
+
+	if err := client.FlushRedisAndRespond(); err != nil {
+		test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+	}
+
+	// The redirect aborts the transaction on the server, so it's passed on for the client to see
+	if expected := "+OK\r\n" + moved + "+QUEUED\r\n"; w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+	client.ReleasePinnedConnection()
+}
+
+func TestRetryWhileLoading(test *testing.T) {
+	getA := "*2\r\n$3\r\nget\r\n$1\r\na\r\n"
+	setB := "*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n"
+	getC := "*2\r\n$3\r\nget\r\n$1\r\nc\r\n"
+	loading := "-LOADING Redis is loading the dataset in memory\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	// The pipeline is answered first, and then each retry, one at a time.  The set is never retried
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{getA + setB + getC, loading + loading + loading},
+		{getA, "$1\r\na\r\n"},
+		{getC, loading},
+		{getC, "$1\r\nc\r\n"},
+	}
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange.request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+				test.Errorf("Expected %q, got %q", exchange.request, buf)
+				return
+			}
+			fd.Write([]byte(exchange.reply))
+		}
+	}()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	client.LoadingRetries = 2
+	client.LoadingRetryDelay = time.Millisecond
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	for _, request := range []string{getA, setB, getC} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		client.Queue(command)
+	}
+
+	if err := client.FlushRedisAndRespond(); err != nil {
+		test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+	}
+
+	if expected := "$1\r\na\r\n" + loading + "$1\r\nc\r\n"; w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+}
+
+func TestPingWithMessage(test *testing.T) {
+	ping := "*2\r\n$4\r\nping\r\n$7\r\npayload\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		buf := make([]byte, len(ping))
+		if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != ping {
+			test.Errorf("Expected %q, got %q", ping, buf)
+			return
+		}
+		fd.Write([]byte("$7\r\npayload\r\n"))
+	}()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	command, err := protocol.ParseCommand([]byte(ping))
+	if err != nil {
+		test.Fatalf("Failed to parse the command: %s", err)
+	}
+	if response, err := client.ParseCommand(command); response != nil || err != nil {
+		test.Fatalf("Expected the ping to be forwarded, got %q, %v", response, err)
+	}
+	client.Queue(command)
+
+	if err := client.FlushRedisAndRespond(); err != nil {
+		test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+	}
+
+	if expected := "$7\r\npayload\r\n"; w.String() != expected {
+		test.Errorf("Expected the server's reply %q, got %q", expected, w.String())
+	}
+}
+
+func TestCanReadFromReplica(test *testing.T) {
+	testCases := []struct {
+		commands []string
+		expected bool
+	}{
+		{[]string{"get"}, true},
+		{[]string{"get", "hgetall", "zrange"}, true},
+		{[]string{"set"}, false},
+		{[]string{"get", "incr"}, false},
+		{[]string{"notacommand"}, false},
+		//Everything in a transaction goes to the master, read-only or not
+		{[]string{"multi", "get", "exec"}, false},
+		{[]string{"multi", "get"}, false},
+		{[]string{"watch", "get"}, false},
+		{[]string{"watch", "unwatch", "get"}, true},
+		{[]string{"multi", "unwatch", "get"}, false},
+		{[]string{"multi", "exec", "get"}, true},
+		{[]string{"watch", "discard", "get"}, true},
+	}
+
+	for _, testCase := range testCases {
+		client := NewClient(nil, time.Millisecond, time.Millisecond, false, nil)
+		for i, name := range testCase.commands {
+			command, err := protocol.ParseCommand([]byte(fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(name), name)))
+			if err != nil {
+				test.Fatalf("Failed to parse %s: %s", name, err)
+			}
+			client.trackTransaction(command.GetCommand())
+
+			// Only the last command is still queued when the client flushes
+			if i == len(testCase.commands)-1 {
+				client.Queue(command)
+			}
+		}
+
+		if client.canReadFromReplica() != testCase.expected {
+			test.Errorf("Expected canReadFromReplica to be %t after %v", testCase.expected, testCase.commands)
+		}
+	}
+}
+
+func TestTransactionPinsConnection(test *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+	selectDb := "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{multi, "+OK\r\n"},
+		{set, "+QUEUED\r\n"},
+		{exec, "*1\r\n+OK\r\n"},
+		{multi, "+OK\r\n"},
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange.request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+				test.Errorf("Expected %q, got %q", exchange.request, buf)
+				return
+			}
+			fd.Write([]byte(exchange.reply))
+		}
+
+		// The abandoned transaction's connection is closed, rather than handed to anyone else
+		fd.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := fd.Read(make([]byte, 1)); err != io.EOF {
+			test.Errorf("Expected the pinned connection to be closed, got %d bytes and %v", n, err)
+		}
+	}()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	send := func(request string) (immediateResponse []byte, err error) {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		if immediateResponse, err = client.ParseCommand(command); immediateResponse == nil && err == nil {
+			client.Queue(command)
+			if err := client.FlushRedisAndRespond(); err != nil {
+				test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+			}
+		}
+		return
+	}
+
+	send(multi)
+	if client.pinned == nil || pool.Count != 1 {
+		test.Fatalf("Expected the connection to stay pinned during the transaction, got %v with %d in use", client.pinned, pool.Count)
+	}
+
+	if _, err := send(selectDb); err != protocol.ERR_NOT_IN_MULTI {
+		test.Fatalf("Expected SELECT to be refused inside MULTI, got %v", err)
+	}
+
+	send(set)
+	send(exec)
+	if client.pinned != nil || pool.Count != 0 {
+		test.Fatalf("Expected the connection to be recycled after EXEC, got %v with %d in use", client.pinned, pool.Count)
+	}
+
+	if expected := "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n"; w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+
+	send(multi)
+	client.ReleasePinnedConnection()
+	if client.pinned != nil || pool.Count != 0 || client.inMulti {
+		test.Fatalf("Expected releasing to recycle the pinned connection and end the transaction")
+	}
+	<-closed
+}
+
+func TestMultiplexedTransactionPinsConnection(test *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	other, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer other.Close()
+
+	pools := []*connection.ConnectionPool{
+		connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond),
+		connection.NewConnectionPool("tcp", other.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond),
+	}
+	for _, pool := range pools {
+		pool.SetIsConnected(true)
+	}
+	hashRing, err := connection.NewHashRing(pools, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	parse := func(request string) protocol.Command {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		return command
+	}
+	get := func(key string) string {
+		return fmt.Sprintf("*2\r\n$3\r\nget\r\n$%d\r\n%s\r\n", len(key), key)
+	}
+
+	// One key routed to the listener's backend, and one routed to the other
+	key, otherKey := "", ""
+	for i := 0; i < 100 && (key == "" || otherKey == ""); i++ {
+		candidate := fmt.Sprintf("key%d", i)
+		if pool, _ := hashRing.GetConnectionPool(parse(get(candidate))); pool == pools[0] {
+			key = candidate
+		} else {
+			otherKey = candidate
+		}
+	}
+	if key == "" || otherKey == "" {
+		test.Fatal("Expected keys to be routed to both backends")
+	}
+	watch := fmt.Sprintf("*2\r\n$5\r\nwatch\r\n$%d\r\n%s\r\n", len(key), key)
+	set := fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{watch, "+OK\r\n"},
+		{multi, "+OK\r\n"},
+		{set, "+QUEUED\r\n"},
+		{exec, "*1\r\n+OK\r\n"},
+		// The proxy answered the second MULTI itself, so it's only sent along with the first command queued in it
+		{"multi\r\n", "+OK\r\n"},
+		{set, "+QUEUED\r\n"},
+		{exec, "*1\r\n+OK\r\n"},
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange.request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+				test.Errorf("Expected %q, got %q", exchange.request, buf)
+				return
+			}
+			fd.Write([]byte(exchange.reply))
+		}
+	}()
+	go func() {
+		if fd, err := other.Accept(); err == nil {
+			test.Errorf("Expected nothing to be sent to the other backend during the transaction")
+			fd.Close()
+		}
+	}()
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, true, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	send := func(request string) {
+		command := parse(request)
+		immediateResponse, err := client.ParseCommand(command)
+		if immediateResponse != nil {
+			client.FlushLine(immediateResponse)
+		} else if err != nil {
+			client.FlushError(err)
+		} else {
+			client.Queue(command)
+			if err := client.FlushRedisAndRespond(); err != nil {
+				test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+			}
+		}
+	}
+
+	send(watch)
+	if client.pinned == nil || !client.pinned.Pinned {
+		test.Fatalf("Expected the connection to be pinned from the WATCH")
+	}
+	pinned := client.pinned
+
+	// A key on another backend can't be watched by this connection's transaction
+	send(get(otherKey))
+	send(multi)
+	send(set)
+	send(exec)
+	if client.pinned != nil || pinned.Pinned || pools[0].Count != 0 {
+		test.Fatalf("Expected the connection to be recycled after EXEC")
+	}
+
+	send(multi)
+	if client.pinned != nil {
+		test.Fatalf("Expected the MULTI to wait for a command to route it")
+	}
+	send(set)
+	if client.pinned == nil {
+		test.Fatalf("Expected the connection to be pinned once the transaction was sent")
+	}
+	send(exec)
+
+	expected := "+OK\r\n-ERR " + protocol.ERR_KEYS_SPAN_BACKENDS.Error() + "\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n" +
+		"+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n"
+	if w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+	<-closed
+}
+
+func TestPingInsideTransaction(test *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	ping := "*1\r\n$4\r\nping\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+
+	for _, multiplexing := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			test.Fatalf("Failed to listen: %s", err)
+		}
+		defer listener.Close()
+
+		// When multiplexing, the proxy answers the MULTI itself, and only sends it along with the PING
+		sentMulti := multi
+		if multiplexing {
+			sentMulti = "multi\r\n"
+		}
+		exchanges := []struct {
+			request string
+			reply   string
+		}{
+			{sentMulti, "+OK\r\n"},
+			{ping, "+QUEUED\r\n"},
+			{exec, "*1\r\n+PONG\r\n"},
+		}
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			fd, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer fd.Close()
+
+			for _, exchange := range exchanges {
+				buf := make([]byte, len(exchange.request))
+				if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+					test.Errorf("Expected %q, got %q", exchange.request, buf)
+					return
+				}
+				fd.Write([]byte(exchange.reply))
+			}
+		}()
+
+		pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+		pool.SetIsConnected(true)
+		hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+		if err != nil {
+			test.Fatalf("Failed to create the hash ring: %s", err)
+		}
+
+		client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, multiplexing, hashRing)
+		w := new(bytes.Buffer)
+		client.Writer = writer.NewFlexibleWriter(w)
+
+		for _, request := range []string{multi, ping, exec} {
+			command, err := protocol.ParseCommand([]byte(request))
+			if err != nil {
+				test.Fatalf("Failed to parse the command: %s", err)
+			}
+			immediateResponse, err := client.ParseCommand(command)
+			if immediateResponse != nil {
+				client.FlushLine(immediateResponse)
+			} else if err != nil {
+				test.Fatalf("ParseCommand(%q) returned an error: %s", request, err)
+			} else {
+				client.Queue(command)
+				if err := client.FlushRedisAndRespond(); err != nil {
+					test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+				}
+			}
+		}
+
+		// The EXEC's reply has as many entries as there were commands queued
+		if expected := "+OK\r\n+QUEUED\r\n*1\r\n+PONG\r\n"; w.String() != expected {
+			test.Errorf("Expected %q when multiplexing is %t, got %q", expected, multiplexing, w.String())
+		}
+		<-closed
+	}
+}
+
+func TestClientSubcommands(test *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	setName := "*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$3\r\napp\r\n"
+	getName := "*2\r\n$6\r\nclient\r\n$7\r\ngetname\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	// Only the transaction's CLIENT SETNAME reaches the server
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{multi, "+OK\r\n"},
+		{setName, "+QUEUED\r\n"},
+		{exec, "*1\r\n+OK\r\n"},
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, exchange := range exchanges {
+			buf := make([]byte, len(exchange.request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+				test.Errorf("Expected %q, got %q", exchange.request, buf)
+				return
+			}
+			fd.Write([]byte(exchange.reply))
+		}
+
+		// The connection is closed rather than recycled, so that the name doesn't carry over to another client
+		fd.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := fd.Read(make([]byte, 1)); err != io.EOF {
+			test.Errorf("Expected the renamed connection to be closed, got %d bytes and %v", n, err)
+		}
+	}()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	for _, request := range []string{getName, setName, getName, multi, setName, exec} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		immediateResponse, err := client.ParseCommand(command)
+		if immediateResponse != nil {
+			client.FlushLine(immediateResponse)
+		} else if err != nil {
+			test.Fatalf("ParseCommand(%q) returned an error: %s", request, err)
+		} else {
+			client.Queue(command)
+			if err := client.FlushRedisAndRespond(); err != nil {
+				test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+			}
+		}
+	}
+
+	if expected := "$-1\r\n+OK\r\n$3\r\napp\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n"; w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+	<-closed
+	if client.pinned != nil || pool.Count != 0 {
+		test.Fatalf("Expected the connection to be released after EXEC")
+	}
+}
+
+func TestTrippedBackendRefusesCommands(test *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	pool.SetCircuitBreaker(1, time.Minute)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	redisConn, err := pool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	redisConn.RecordReply(protocol.REPLY_UNKNOWN, &protocol.BackendReadError{Err: io.ErrUnexpectedEOF})
+	pool.RecycleRemoteConnection(redisConn)
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+	for _, request := range []string{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", "*2\r\n$3\r\nget\r\n$1\r\nb\r\n"} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		client.Queue(command)
+	}
+
+	if err := client.FlushRedisAndRespond(); err != nil {
+		test.Fatalf("Expected the commands to be refused without an error, got %s", err)
+	}
+
+	refused := "-ERR " + connection.ERR_TRIPPED.Error() + "\r\n"
+	if w.String() != refused+refused {
+		test.Errorf("Expected each command to be refused, got %q", w.String())
+	}
+	if len(client.ReadChannel) != 0 || client.HasQueued() {
+		test.Errorf("Expected the client to stay connected, with nothing left queued")
+	}
+}
+
+func TestScanFanOut(test *testing.T) {
+	scan := func(cursor string) string {
+		return fmt.Sprintf("*4\r\n$4\r\nSCAN\r\n$%d\r\n%s\r\n$5\r\nMATCH\r\n$2\r\nk*\r\n", len(cursor), cursor)
+	}
+	// What the backends are sent, with the cursor they handed out
+	backendScan := func(cursor string) string {
+		return fmt.Sprintf("*4\r\n$4\r\nscan\r\n$%d\r\n%s\r\n$5\r\nMATCH\r\n$2\r\nk*\r\n", len(cursor), cursor)
+	}
+
+	exchanges := [][]struct {
+		request string
+		reply   string
+	}{
+		{
+			{backendScan("0"), "*2\r\n$1\r\n5\r\n*1\r\n$2\r\nk1\r\n"},
+			{backendScan("5"), "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nk2\r\n"},
+		},
+		{
+			{backendScan("0"), "*2\r\n$1\r\n0\r\n*0\r\n"},
+		},
+	}
+
+	var pools []*connection.ConnectionPool
+	closed := make(chan struct{}, len(exchanges))
+	for _, backendExchanges := range exchanges {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			test.Fatalf("Failed to listen: %s", err)
+		}
+		defer listener.Close()
+
+		pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+		pool.SetIsConnected(true)
+		pools = append(pools, pool)
+
+		go func(backendExchanges []struct {
+			request string
+			reply   string
+		}) {
+			defer func() { closed <- struct{}{} }()
+			fd, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer fd.Close()
+
+			for _, exchange := range backendExchanges {
+				buf := make([]byte, len(exchange.request))
+				if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != exchange.request {
+					test.Errorf("Expected %q, got %q", exchange.request, buf)
+					return
+				}
+				fd.Write([]byte(exchange.reply))
+			}
+		}(backendExchanges)
+	}
+
+	hashRing, err := connection.NewHashRing(pools, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, true, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	command, err := protocol.ParseCommand([]byte(scan("0")))
+	if err != nil {
+		test.Fatalf("Failed to parse the command: %s", err)
+	}
+	if _, err := client.ParseCommand(command); err != protocol.ERR_COMMAND_UNSUPPORTED {
+		test.Fatalf("Expected SCAN to be refused while multiplexing without fanning out, got %v", err)
+	}
+	client.ScanPools = pools
+
+	// Each backend is scanned to the end in turn.  The second one's cursor comes back as 0 once it's done
+	for _, cursor := range []string{"0", "10", "1", "x"} {
+		command, err := protocol.ParseCommand([]byte(scan(cursor)))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		if _, err := client.ParseCommand(command); err != nil {
+			test.Fatalf("Expected SCAN to be allowed when fanning out, got %v", err)
+		}
+
+		client.Queue(command)
+		client.FlushRedisAndRespond()
+	}
+
+	expected := "*2\r\n$2\r\n10\r\n*1\r\n$2\r\nk1\r\n" + "*2\r\n$1\r\n1\r\n*1\r\n$2\r\nk2\r\n" +
+		"*2\r\n$1\r\n0\r\n*0\r\n" + "-ERR invalid cursor\r\n"
+	if w.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, w.String())
+	}
+
+	// Inside a WATCH or MULTI, the backend the client is pinned to would be sent the combined cursor
+	client.pendingMulti = true
+	if _, err := client.ParseCommand(command); err != protocol.ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected SCAN to be refused after a MULTI, got %v", err)
+	}
+	client.pendingMulti = false
+	client.pinned = &connection.Connection{}
+	if _, err := client.ParseCommand(command); err != protocol.ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected SCAN to be refused while pinned, got %v", err)
+	}
+	client.pinned = nil
+
+	for _, pool := range pools {
+		if redisConn, err := pool.GetConnection(); err == nil {
+			redisConn.Disconnect(connection.DISCONNECT_RECONNECT)
+		}
+	}
+	for range exchanges {
+		<-closed
+	}
+}
+
+//Records the spans it's called with
+type recordingTraceHook struct {
+	started []string
+	ended   []connection.TraceSpan
+	errs    []error
+}
+
+type traceContextKey struct{}
+
+func (this *recordingTraceHook) OnCommandStart(span *connection.TraceSpan) {
+	this.started = append(this.started, string(span.Command))
+	span.Context = context.WithValue(span.Context, traceContextKey{}, len(this.started))
+}
+
+func (this *recordingTraceHook) OnCommandEnd(span *connection.TraceSpan, err error) {
+	this.ended = append(this.ended, *span)
+	this.errs = append(this.errs, err)
+}
+
+func TestTraceHook(test *testing.T) {
+	get := "*2\r\n$3\r\nget\r\n$1\r\na\r\n"
+	set := "*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n"
+	getReply := "$5\r\nhello\r\n"
+	setReply := "+OK\r\n"
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		fd, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		buf := make([]byte, len(get)+len(set))
+		if _, err := io.ReadFull(fd, buf); err != nil {
+			return
+		}
+		fd.Write([]byte(getReply + setReply))
+	}()
+
+	hook := &recordingTraceHook{}
+	pool := connection.NewConnectionPool("tcp", listener.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	pool.SetTraceHook(hook)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	client := NewClient(nil, 100*time.Millisecond, 100*time.Millisecond, false, hashRing)
+	w := new(bytes.Buffer)
+	client.Writer = writer.NewFlexibleWriter(w)
+
+	for _, request := range []string{get, set} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse the command: %s", err)
+		}
+		client.Queue(command)
+	}
+
+	if err := client.FlushRedisAndRespond(); err != nil {
+		test.Fatalf("FlushRedisAndRespond returned an error: %s", err)
+	}
+
+	if len(hook.started) != 2 || hook.started[0] != "get" || hook.started[1] != "set" {
+		test.Fatalf("Expected both commands to be started, got %v", hook.started)
+	}
+	if len(hook.ended) != 2 {
+		test.Fatalf("Expected both commands to be ended, got %d", len(hook.ended))
+	}
+
+	expected := []struct {
+		written, read int
+	}{{len(get), len(getReply)}, {len(set), len(setReply)}}
+	for i, span := range hook.ended {
+		if hook.errs[i] != nil {
+			test.Errorf("Expected span %d to succeed, got %s", i, hook.errs[i])
+		}
+		if span.BytesWritten != expected[i].written || span.BytesRead != expected[i].read {
+			test.Errorf("Expected span %d to have written %d and read %d bytes, got %d and %d", i,
+				expected[i].written, expected[i].read, span.BytesWritten, span.BytesRead)
+		}
+		if span.Endpoint != listener.Addr().String() || span.DatabaseId != 0 {
+			test.Errorf("Expected span %d to name its backend, got %q and database %d", i, span.Endpoint, span.DatabaseId)
+		}
+		if span.Context.Value(traceContextKey{}) != i+1 {
+			test.Errorf("Expected span %d to keep the context it was started with", i)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"errors"
+	"github.com/salesforce/rmux/metrics"
+	"github.com/salesforce/rmux/protocol"
+	"sync/atomic"
+	"time"
+)
+
+//Returned by ConnectionPool.GetConnection for a connection that is cooling down after too many failures in a row
+var ERR_TRIPPED = errors.New("Connection tripped after too many failures in a row")
+
+//Records the outcome of a reply read from the server: its kind, or the error that kept it from being read (or the
+//command from being written).  An error counts as a failure, and any reply resets the count, error replies included,
+//since those are down to the client's command.  Error replies that say the server itself can't serve commands are
+//recorded with RecordErrorReply instead
+//Failures to write the reply on to the client say nothing about the server, so they're ignored.  Once the circuit
+//breaker's threshold of failures in a row is reached (see WithCircuitBreaker), the connection is Tripped for the
+//cool-down, and each further failure extends it
+func (c *Connection) RecordReply(kind protocol.ReplyKind, err error) {
+	var clientWriteError *protocol.ClientWriteError
+	if errors.As(err, &clientWriteError) {
+		return
+	}
+
+	if err == nil {
+		atomic.StoreInt32(&c.lastReplyKind, int32(kind))
+		atomic.StoreInt32(&c.replyFailures, 0)
+		return
+	}
+
+	atomic.StoreInt32(&c.lastReplyKind, int32(protocol.REPLY_UNKNOWN))
+	c.recordFailure()
+}
+
+//Records an error reply read from the server, given its line, ex: "-LOADING ...".  It counts as a failure if it says
+//that the server can't serve commands for now (see protocol.IsServerStateError), and is recorded like any other reply
+//otherwise, so that one client's bad commands can't trip a connection that others share
+func (c *Connection) RecordErrorReply(line []byte) {
+	if !protocol.IsServerStateError(line) {
+		c.RecordReply(protocol.REPLY_ERROR, nil)
+		return
+	}
+
+	atomic.StoreInt32(&c.lastReplyKind, int32(protocol.REPLY_ERROR))
+	c.recordFailure()
+}
+
+//Counts a failure, and trips the connection if that's as many in a row as the circuit breaker allows
+func (c *Connection) recordFailure() {
+	failures := atomic.AddInt32(&c.replyFailures, 1)
+	if c.tripThreshold > 0 && int(failures) >= c.tripThreshold {
+		if !c.Tripped() {
+			c.logger.Warnf("RecordReply: Tripped the connection to %s after %d failures in a row, for %s", c.endpoint, failures, c.tripCoolDown)
+			metrics.Increment("tripped")
+		}
+		atomic.StoreInt64(&c.trippedUntil, time.Now().Add(c.tripCoolDown).UnixNano())
+	}
+}
+
+//Returns how many replies in a row were failures, as recorded by RecordReply and RecordErrorReply
+func (c *Connection) ConsecutiveFailures() int {
+	return int(atomic.LoadInt32(&c.replyFailures))
+}
+
+//Returns the kind of the last reply recorded by RecordReply.  REPLY_UNKNOWN if it couldn't be read, or if there
+//hasn't been one yet
+func (c *Connection) LastReplyKind() protocol.ReplyKind {
+	return protocol.ReplyKind(atomic.LoadInt32(&c.lastReplyKind))
+}
+
+//Returns whether the connection is cooling down after its circuit breaker tripped, in which case it shouldn't be
+//routed to.  Once the cool-down passes, the next failure trips it again straight away, while a success resets it
+func (c *Connection) Tripped() bool {
+	trippedUntil := atomic.LoadInt64(&c.trippedUntil)
+	return trippedUntil != 0 && time.Now().UnixNano() < trippedUntil
+}
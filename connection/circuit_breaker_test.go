@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"errors"
+	"github.com/salesforce/rmux/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(test *testing.T) {
+	loading := []byte("-LOADING Redis is loading the dataset in memory")
+	connection := NewConnection("unix", "/tmp/rmuxCircuitBreakerTest", WithCircuitBreaker(3, 50*time.Millisecond))
+	if connection.LastReplyKind() != protocol.REPLY_UNKNOWN || connection.ConsecutiveFailures() != 0 || connection.Tripped() {
+		test.Fatal("Expected a new connection to have no replies recorded")
+	}
+
+	connection.RecordErrorReply(loading)
+	connection.RecordReply(protocol.REPLY_UNKNOWN, &protocol.BackendReadError{Err: io.ErrUnexpectedEOF})
+	// The client going away isn't the server's fault
+	connection.RecordReply(protocol.REPLY_UNKNOWN, &protocol.ClientWriteError{Err: errors.New("broken pipe")})
+	if connection.ConsecutiveFailures() != 2 || connection.Tripped() {
+		test.Errorf("Expected 2 failures and not to be tripped, got %d, %t", connection.ConsecutiveFailures(), connection.Tripped())
+	}
+
+	// A success resets the count
+	connection.RecordReply(protocol.REPLY_BULK_STRING, nil)
+	if connection.ConsecutiveFailures() != 0 || connection.LastReplyKind() != protocol.REPLY_BULK_STRING {
+		test.Errorf("Expected a success to reset the failures, got %d, %d", connection.ConsecutiveFailures(), connection.LastReplyKind())
+	}
+
+	// Errors that are down to the client's commands say nothing of the server
+	for i := 0; i < 3; i++ {
+		connection.RecordErrorReply([]byte("-WRONGTYPE Operation against a key holding the wrong kind of value"))
+	}
+	if connection.Tripped() || connection.ConsecutiveFailures() != 0 || connection.LastReplyKind() != protocol.REPLY_ERROR {
+		test.Fatalf("Expected error replies to the client's commands not to count, got %d failures", connection.ConsecutiveFailures())
+	}
+
+	for i := 0; i < 3; i++ {
+		connection.RecordErrorReply(loading)
+	}
+	if !connection.Tripped() || connection.LastReplyKind() != protocol.REPLY_ERROR {
+		test.Fatal("Expected 3 error replies in a row to trip the connection")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if connection.Tripped() {
+		test.Error("Expected the connection to be usable again after the cool-down")
+	}
+
+	// Still failing once the cool-down is over trips it again straight away
+	connection.RecordErrorReply([]byte("-BUSY Redis is busy running a script."))
+	if !connection.Tripped() {
+		test.Error("Expected another failure after the cool-down to trip the connection again")
+	}
+
+	untripped := NewConnection("unix", "/tmp/rmuxCircuitBreakerTest")
+	for i := 0; i < 10; i++ {
+		untripped.RecordErrorReply(loading)
+	}
+	if untripped.Tripped() || untripped.ConsecutiveFailures() != 10 {
+		test.Error("Expected a connection without a circuit breaker to count failures, but never trip")
+	}
+}
+
+func TestTrippedConnectionNotHandedOut(test *testing.T) {
+	testSocket := "/tmp/rmuxCircuitBreakerTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	pool := NewConnectionPool("unix", testSocket, 2, time.Second, time.Second, time.Second)
+	pool.SetCircuitBreaker(1, time.Minute)
+
+	tripped := <-pool.connectionPool
+	tripped.RecordReply(protocol.REPLY_UNKNOWN, &protocol.BackendReadError{Err: io.ErrUnexpectedEOF})
+	pool.connectionPool <- tripped
+
+	// The other connection is handed out instead
+	connection, err := pool.GetConnection()
+	if err != nil || connection == tripped {
+		test.Fatalf("Expected the connection that isn't tripped to be handed out, got %v", err)
+	}
+	if pool.Count != 1 || len(pool.connectionPool) != 1 {
+		test.Errorf("Expected the tripped connection to be back in the pool, got %d out, %d in", pool.Count, len(pool.connectionPool))
+	}
+
+	connection.RecordErrorReply([]byte("-MASTERDOWN Link with MASTER is down"))
+	pool.RecycleRemoteConnection(connection)
+
+	if _, err := pool.GetConnection(); err != ERR_TRIPPED {
+		test.Fatalf("Expected nothing to be handed out once every connection is tripped, got %v", err)
+	}
+	if pool.Count != 0 || len(pool.connectionPool) != 2 {
+		test.Errorf("Expected the tripped connections to be back in the pool, got %d out, %d in", pool.Count, len(pool.connectionPool))
+	}
+}
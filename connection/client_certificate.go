@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+//Returned, wrapping the TLS alert, when the server refuses the client certificate that was presented (or requires one
+//that wasn't).  Under TLS 1.3, the server refuses it after the handshake, so this comes from the first read instead
+var ERR_CLIENT_CERTIFICATE_REJECTED = errors.New("Server rejected the client certificate")
+
+//A client certificate to present to servers that require mutual TLS, which can be reloaded from its files so that it
+//can be rotated.  Each handshake presents whichever certificate is current, so connections that are already up keep
+//theirs until they reconnect
+type ClientCertificate struct {
+	certFile string
+	keyFile  string
+	//The current *tls.Certificate
+	current atomic.Value
+}
+
+//Loads a PEM encoded certificate and its key, to present as a client certificate
+func LoadClientCertificate(certFile, keyFile string) (*ClientCertificate, error) {
+	certificate := &ClientCertificate{certFile: certFile, keyFile: keyFile}
+	if err := certificate.Reload(); err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+//Reads the certificate and key from their files again.  If they can't be loaded, the current certificate is kept
+func (this *ClientCertificate) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(this.certFile, this.keyFile)
+	if err != nil {
+		return err
+	}
+	this.current.Store(&certificate)
+	return nil
+}
+
+//Returns the current certificate, whatever the server asked for.  Fits tls.Config's GetClientCertificate
+func (this *ClientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return this.current.Load().(*tls.Certificate), nil
+}
+
+//Asks for the client certificate to present, like the default selection, but remembers that the server asked for one
+type clientCertificateRequest struct {
+	config    *tls.Config
+	requested bool
+}
+
+func (this *clientCertificateRequest) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	this.requested = true
+	if this.config.GetClientCertificate != nil {
+		return this.config.GetClientCertificate(info)
+	}
+
+	for i := range this.config.Certificates {
+		if info.SupportsCertificate(&this.config.Certificates[i]) == nil {
+			return &this.config.Certificates[i], nil
+		}
+	}
+	// Without a certificate, the server decides whether to carry on
+	return &tls.Certificate{}, nil
+}
+
+//The alerts that a server sends when it won't accept the client's certificate, as crypto/tls describes them
+//Servers on TLS 1.2, including redis, refuse a missing certificate with a generic handshake_failure
+var clientCertificateAlerts = map[string]bool{
+	"tls: handshake failure":             true,
+	"tls: bad certificate":               true,
+	"tls: unsupported certificate":       true,
+	"tls: revoked certificate":           true,
+	"tls: expired certificate":           true,
+	"tls: unknown certificate":           true,
+	"tls: unknown certificate authority": true,
+	"tls: certificate required":          true,
+}
+
+//Wraps the error in ERR_CLIENT_CERTIFICATE_REJECTED, if it's an alert refusing the client certificate
+//Only servers that asked for a certificate can refuse one, so alerts from any other are left alone
+func clientCertificateError(err error, requested bool) error {
+	var opErr *net.OpError
+	if requested && errors.As(err, &opErr) && opErr.Op == "remote error" && clientCertificateAlerts[opErr.Err.Error()] {
+		return fmt.Errorf("%w: %w", ERR_CLIENT_CERTIFICATE_REJECTED, err)
+	}
+	return err
+}
+
+//A TLS connection to a server that asked for a client certificate, whose reads tell a refusal of it apart, for TLS 1.3
+//servers that only refuse it once the handshake is over
+type mutualTLSConn struct {
+	net.Conn
+}
+
+func (this mutualTLSConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	return n, clientCertificateError(err, true)
+}
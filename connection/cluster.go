@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+//Connection pools for the redis cluster nodes that redirects point at, keyed by endpoint
+//Pools are created the first time a node is redirected to, with the same settings as the configured backends
+type ClusterNodes struct {
+	lock           sync.Mutex
+	pools          map[string]*ConnectionPool
+	poolSize       int
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	authUser       string
+	authPassword   string
+}
+
+func NewClusterNodes(poolSize int, connectTimeout, readTimeout, writeTimeout time.Duration) *ClusterNodes {
+	return &ClusterNodes{
+		pools:          make(map[string]*ConnectionPool),
+		poolSize:       poolSize,
+		connectTimeout: connectTimeout,
+		readTimeout:    readTimeout,
+		writeTimeout:   writeTimeout,
+	}
+}
+
+//Returns the pool for the given tcp endpoint, creating it if this is the first redirect to that node
+func (this *ClusterNodes) GetConnectionPool(endpoint string) *ConnectionPool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	pool, ok := this.pools[endpoint]
+	if !ok {
+		pool = NewConnectionPool("tcp", endpoint, this.poolSize, this.connectTimeout, this.readTimeout, this.writeTimeout)
+		if this.authPassword != "" {
+			pool.UpdateCredentials(this.authUser, this.authPassword)
+		}
+		this.pools[endpoint] = pool
+	}
+	return pool
+}
+
+//Replaces the credentials that the nodes' connections AUTH with, including the nodes that haven't been redirected to yet
+func (this *ClusterNodes) UpdateCredentials(user, password string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.authUser = user
+	this.authPassword = password
+	for _, pool := range this.pools {
+		pool.UpdateCredentials(user, password)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+//Returned when a connect gave up waiting for other connections to the same server to finish connecting
+var ERR_CONNECT_LIMITED = errors.New("Timed out waiting for other connects to the same server")
+
+//Caps how many connections may be connecting (dialing, and then handshaking with AUTH and SELECT) to the same endpoint
+//at once, so that a server coming back from an outage isn't knocked over again by every pool reconnecting at once
+//Connections beyond the cap wait their turn, for no longer than their connect timeout.  A limiter may be shared by
+//any number of pools, and a nil limiter doesn't limit anything
+type ConnectLimiter struct {
+	//How many connects may be under way to each endpoint
+	limit int
+	//A semaphore for each endpoint that has been connected to, holding a token per connect under way
+	slots map[string]chan struct{}
+	lock  sync.Mutex
+}
+
+//Initializes a new limiter, allowing limit connects to each endpoint at once.  A limit below 1 doesn't limit anything
+func NewConnectLimiter(limit int) *ConnectLimiter {
+	return &ConnectLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+//Returns the semaphore for the given endpoint, creating it the first time
+func (this *ConnectLimiter) endpointSlots(endpoint string) chan struct{} {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	slots, ok := this.slots[endpoint]
+	if !ok {
+		slots = make(chan struct{}, this.limit)
+		this.slots[endpoint] = slots
+	}
+	return slots
+}
+
+//Waits for a turn to connect to the given endpoint, for up to the given timeout (0 waits as long as ctx allows)
+//Returns the function that ends the turn, or ERR_CONNECT_LIMITED if the timeout passed first, or ctx's error
+func (this *ConnectLimiter) acquire(ctx context.Context, endpoint string, timeout time.Duration) (release func(), err error) {
+	if this == nil || this.limit < 1 {
+		return func() {}, nil
+	}
+
+	slots := this.endpointSlots(endpoint)
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	default:
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-expired:
+		return nil, ERR_CONNECT_LIMITED
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//Returns how many connects are under way to the given endpoint
+func (this *ConnectLimiter) Connecting(endpoint string) int {
+	if this == nil || this.limit < 1 {
+		return 0
+	}
+	return len(this.endpointSlots(endpoint))
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectLimiter(test *testing.T) {
+	limiter := NewConnectLimiter(1)
+
+	endTurn, err := limiter.acquire(context.Background(), "a", 0)
+	if err != nil {
+		test.Fatalf("Expected the first connect to have a turn, got %s", err)
+	}
+	if limiter.Connecting("a") != 1 {
+		test.Errorf("Expected one connect under way, got %d", limiter.Connecting("a"))
+	}
+
+	if _, err := limiter.acquire(context.Background(), "a", 10*time.Millisecond); err != ERR_CONNECT_LIMITED {
+		test.Errorf("Expected a second connect to the same endpoint to time out waiting, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.acquire(ctx, "a", 0); err != context.Canceled {
+		test.Errorf("Expected a cancelled wait to return the context's error, got %v", err)
+	}
+
+	otherTurn, err := limiter.acquire(context.Background(), "b", 10*time.Millisecond)
+	if err != nil {
+		test.Errorf("Expected another endpoint not to be limited, got %s", err)
+	} else {
+		otherTurn()
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		endSecondTurn, err := limiter.acquire(context.Background(), "a", time.Second)
+		if err == nil {
+			endSecondTurn()
+		}
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	endTurn()
+
+	select {
+	case err := <-waited:
+		if err != nil {
+			test.Errorf("Expected the waiting connect to get a turn once the first ended, got %s", err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Timed out waiting for the waiting connect")
+	}
+
+	var nilLimiter *ConnectLimiter
+	if _, err := nilLimiter.acquire(context.Background(), "a", 0); err != nil {
+		test.Errorf("Expected a nil limiter not to limit anything, got %s", err)
+	}
+}
+
+func TestConnectLimiterOnReconnect(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectLimiterTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatalf("Failed to listen on test socket %s: %s", testSocket, err)
+	}
+	defer listenSock.Close()
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			defer fd.Close()
+		}
+	}()
+
+	limiter := NewConnectLimiter(1)
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(10*time.Millisecond),
+		WithReconnectBackoff(time.Second, time.Second),
+		WithConnectLimiter(limiter),
+	)
+
+	endTurn, _ := limiter.acquire(context.Background(), testSocket, 0)
+	if err := connection.ReconnectIfNecessary(); err != ERR_CONNECT_LIMITED {
+		test.Fatalf("Expected the connect to give up waiting for its turn, got %v", err)
+	}
+	endTurn()
+
+	// Waiting isn't the server's fault, so it doesn't back off
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Expected the connect to succeed once it had a turn, got %s", err)
+	}
+	defer connection.Disconnect(DISCONNECT_RECONNECT)
+
+	if limiter.Connecting(testSocket) != 0 {
+		test.Errorf("Expected the turn to end with the connect, got %d under way", limiter.Connecting(testSocket))
+	}
+}
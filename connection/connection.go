@@ -28,93 +28,827 @@ package connection
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	. "github.com/salesforce/rmux/log"
+	"math/rand"
 	"github.com/salesforce/rmux/protocol"
 	. "github.com/salesforce/rmux/writer"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"github.com/salesforce/rmux/graphite"
+	"github.com/salesforce/rmux/metrics"
 )
 
+const (
+	//Protocol suffix that requests a TLS connection, ex: "tcp+tls"
+	TLS_PROTOCOL_SUFFIX = "+tls"
+	//Default delay before redialing after a failed connect.  Doubles with each consecutive failure
+	DEFAULT_RECONNECT_BACKOFF_BASE = time.Millisecond * 50
+	//Default upper bound on the delay between reconnect attempts
+	DEFAULT_RECONNECT_BACKOFF_CAP = time.Second * 2
+	//Default TCP keepalive period, so that idle connections dropped by middleboxes are noticed
+	DEFAULT_KEEPALIVE_PERIOD = time.Second * 30
+	//How long a graceful disconnect waits for the server to acknowledge QUIT, before closing regardless
+	GRACEFUL_DISCONNECT_TIMEOUT = time.Millisecond * 100
+	//Default time CheckConnection waits for a PONG, independent of the connection's read timeout
+	DEFAULT_PROBE_TIMEOUT = time.Millisecond * 100
+)
+
+//Returned when a reconnect is attempted before the backoff from previous failures has elapsed
+var ERR_RECONNECT_BACKOFF = errors.New("Waiting to retry connecting")
+
+//Returned when a connection (or a pool) that is draining, or has been drained, is asked to connect
+var ERR_DRAINING = errors.New("Connection is draining")
+
+//Returned when a PING is answered with anything but a PONG
+var ERR_UNEXPECTED_PONG = errors.New("Unexpected reply to PING")
+
+//Returned when the server doesn't accept the AUTH sent on connect, wrapped with what it replied
+var ERR_INVALID_AUTH_RESPONSE = errors.New("invalid authentication response")
+
+//Returned when the server doesn't accept a SELECT, wrapped with what it replied
+var ERR_INVALID_SELECT_RESPONSE = errors.New("invalid select response")
+
+//Returned by Resync when the connection couldn't be brought back to a reply boundary, wrapped with why
+var ERR_RESYNC_FAILED = errors.New("Could not resync with the server")
+
+//Returned when a SELECT or HELLO would be injected into an open MULTI, where it would be queued as part of the transaction
+var ERR_IN_TRANSACTION = errors.New("Can't change the connection's state inside a transaction")
+
 //An outbound connection to a redis server
 //Maintains its own underlying TimedNetReadWriter, and keeps track of its DatabaseId for select() changes
+//A connection belongs to whoever has it out of its pool (see ConnectionPool.GetConnection), and only they may send
+//commands over it, read its replies, select a database on it or reconnect it.  Disconnect and the health probes may be
+//called from any goroutine, and are serialized with each other and with a reconnect swapping in its new socket, but a
+//probe shares the stream with any command in flight, so background health checks go through a pool's diagnostic
+//connection instead.  The counters (see Stats) and the setters documented as such are safe from any goroutine
 type Connection struct {
 	connection net.Conn
 	//The database that we are currently connected to
 	DatabaseId int
+	//Whether DatabaseId has been confirmed by a select on the current underlying connection
+	databaseSelected bool
+	//The database last asked for with SelectDatabase.  Unlike DatabaseId, it survives a disconnect, and every
+	//reconnect selects it again before the connection is handed back
+	desiredDatabaseId int
 	// The reader from the redis server
 	Reader *bufio.Reader
 	// The writer to the redis server
 	Writer *FlexibleWriter
+	// The timed reader/writer underlying Reader and Writer
+	readWriter *protocol.TimedNetReadWriter
+	// The RESP protocol version negotiated with the redis server via HELLO
+	protocolVersion int
+	// Whether a MULTI or WATCH has been sent on the current underlying connection, and not yet ended
+	inMulti bool
+	watching bool
+	// Whether a client has taken the connection out of its pool for a transaction, from its WATCH or MULTI until it
+	// resolves.  Set and cleared by the client holding it
+	Pinned bool
 
 	protocol string
 	endpoint string
 	connectTimeout time.Duration
 	readTimeout time.Duration
 	writeTimeout time.Duration
+	// If set, connections are wrapped in TLS using this configuration
+	tlsConfig *tls.Config
+
+	// Backoff between failed connects
+	backoffBase time.Duration
+	backoffCap time.Duration
+	// The number of connects that have failed in a row
+	consecutiveFailures uint
+	// Dials are refused until this time
+	nextRetryAt time.Time
+
+	// TCP socket options.  A keepAlivePeriod of 0 disables keepalives
+	keepAlivePeriod time.Duration
+	noDelay bool
+
+	// Credentials sent via AUTH on every new connection.  No AUTH is sent if authPassword is empty
+	authUser string
+	authPassword string
+	// What Stats reports
+	counters *connectionCounters
+
+	// The name set with CLIENT SETNAME on every new connection, so that it can be told apart in CLIENT LIST
+	// No name is set if it is empty
+	clientName string
+
+	// Credentials from UpdateCredentials, waiting to be swapped in by the next ReconnectIfNecessary
+	pendingCredentials *credentials
+	credentialsLock sync.Mutex
+
+	// Where this connection's logs go.  Defaults to the global rmux/log
+	logger Logger
+	// Whether this connection has ever been established, so that later connects are counted as reconnects
+	hasConnected bool
+	// How long CheckConnection waits for a PONG
+	probeTimeout time.Duration
+	// If set, the endpoint is resolved through sentinel before every dial
+	sentinel *SentinelResolver
+	// Resolves the endpoint's host before every tcp dial
+	resolver *net.Resolver
+	// The address that the current (or last) connection was dialed to
+	resolvedAddr string
+	// If set, called around every command proxied over this connection
+	traceHook TraceHook
+	// If set, presented to TLS servers that ask for a client certificate
+	clientCertificate *ClientCertificate
+	// Holds a token while the connection is out of its pool, so that Drain can wait for what's in flight.  A channel
+	// rather than a mutex, so that the wait can be bounded by a context
+	inUse chan struct{}
+	// Set by Drain, after which the connection never connects again
+	draining int32
+	// Set when a write to the server fails, see Poisoned
+	poisoned int32
+	// If set, caps how many connections connect to the same endpoint at once
+	connectLimiter *ConnectLimiter
+	// The circuit breaker, see RecordReply: the failed replies in a row, the kind of the last reply, and the time until
+	// which the connection is tripped, in unix nanoseconds.  A tripThreshold of 0 never trips
+	replyFailures int32
+	lastReplyKind int32
+	trippedUntil int64
+	tripThreshold int
+	tripCoolDown time.Duration
+	// Guards connection, readWriter, Reader and Writer as they're swapped.  Held by Disconnect, by the health probes
+	// (IsConnected, CheckConnection, MeasureRTT and CheckConnections) and by a reconnect while it installs its socket,
+	// so that none of them sees a half-connected or half-disconnected connection
+	socketLock sync.Mutex
 }
 
-//Initializes a new connection, of the given protocol and endpoint, with the given connection timeout
-//ex: "unix", "/tmp/myAwesomeSocket", 50*time.Millisecond
-func NewConnection(Protocol, Endpoint string, ConnectTimeout, ReadTimeout, WriteTimeout time.Duration) *Connection {
+//Initializes a new connection, of the given protocol and endpoint, configured by the given options
+//ex: "unix", "/tmp/myAwesomeSocket", WithConnectTimeout(50*time.Millisecond)
+func NewConnection(Protocol, Endpoint string, opts ...Option) *Connection {
 	c := &Connection{}
 	c.protocol = Protocol
 	c.endpoint = Endpoint
-	c.connectTimeout = ConnectTimeout
-	c.readTimeout = ReadTimeout
-	c.writeTimeout = WriteTimeout
+	c.protocolVersion = protocol.RESP2
+	c.backoffBase = DEFAULT_RECONNECT_BACKOFF_BASE
+	c.backoffCap = DEFAULT_RECONNECT_BACKOFF_CAP
+	c.keepAlivePeriod = DEFAULT_KEEPALIVE_PERIOD
+	c.noDelay = true
+	c.logger = GlobalLogger
+	c.probeTimeout = DEFAULT_PROBE_TIMEOUT
+	c.resolver = net.DefaultResolver
+	c.counters = &connectionCounters{}
+	c.counters.endpoint.Store(Endpoint)
+	c.inUse = make(chan struct{}, 1)
+	c.lastReplyKind = int32(protocol.REPLY_UNKNOWN)
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
-func (c *Connection) Disconnect() {
+//Returns whether this connection finds its endpoint through sentinel, and so should be reconnected when the
+//server reports that it is no longer the master
+func (c *Connection) UsesSentinel() bool {
+	return c.sentinel != nil
+}
+
+//Returns the address that the current (or last) connection was dialed to.  For tcp endpoints, that is the IP that
+//the endpoint's host resolved to.  Empty if the connection has never been dialed
+func (c *Connection) ResolvedAddr() string {
+	return c.resolvedAddr
+}
+
+//Returns the earliest time at which a reconnect will be attempted.  The zero time means immediately
+func (c *Connection) NextRetryAt() time.Time {
+	return c.nextRetryAt
+}
+
+//Closes the connection to the server, if it's open, and forgets the state that came with it
+//Disconnecting again does nothing, and it's safe to disconnect while another goroutine is probing the connection
+//The reason is logged, and counted as "disconnect.<reason>" as well as "disconnect"
+func (c *Connection) Disconnect(reason DisconnectReason) {
+	c.socketLock.Lock()
+	defer c.socketLock.Unlock()
+
+	c.disconnect(reason)
+}
+
+//Disconnects, with the socketLock held
+func (c *Connection) disconnect(reason DisconnectReason) {
 	if c.connection != nil {
 		c.connection.Close()
-		Info("Disconnected a connection")
-		graphite.Increment("disconnect")
+		c.logger.Infof("Disconnected a connection from %s. Reason:%s", c.endpoint, reason)
+		metrics.Increment("disconnect")
+		metrics.Increment("disconnect." + reason.String())
 	}
 	c.connection = nil
+	atomic.StoreInt32(&c.poisoned, 0)
 	c.DatabaseId = 0
+	c.databaseSelected = false
+	c.protocolVersion = protocol.RESP2
+	c.inMulti = false
+	c.watching = false
+	atomic.StoreInt32(&c.counters.connected, 0)
+	atomic.StoreInt64(&c.counters.databaseId, 0)
 	c.Reader = nil
 	c.Writer = nil
+	c.readWriter = nil
+}
+
+//Sends QUIT to the server and waits briefly for its +OK before closing the connection, so that the server
+//sees a clean disconnect.  Falls back to a hard close if the QUIT can't be written or acknowledged in time
+//The reason is recorded as Disconnect records it
+func (c *Connection) GracefulDisconnect(reason DisconnectReason) {
+	if c.connection == nil {
+		c.Disconnect(reason)
+		return
+	}
+
+	// We're closing regardless, so the timeouts don't need restoring
+	if c.readWriter != nil {
+		c.readWriter.ReadTimeout = GRACEFUL_DISCONNECT_TIMEOUT
+		c.readWriter.WriteTimeout = GRACEFUL_DISCONNECT_TIMEOUT
+	}
+
+	if err := protocol.WriteLine(protocol.QUIT_COMMAND, c.Writer, true); err != nil {
+		c.logger.Warnf("GracefulDisconnect: Could not write QUIT, closing. Err:%s", err)
+	} else if line, isPrefix, err := c.Reader.ReadLine(); err != nil || isPrefix || !bytes.Equal(line, protocol.OK_RESPONSE) {
+		c.logger.Warnf("GracefulDisconnect: QUIT was not acknowledged, closing. Err:%v Response:%q", err, line)
+	}
+
+	c.Disconnect(reason)
+}
+
+//Marks the connection as draining, so that it isn't handed out again, then waits for whoever has it out of its pool
+//to give it back (so that a command already sent has its reply copied in full) and disconnects it gracefully
+//If the context ends first, its error is returned and the connection is left to whoever has it.  Either way, the
+//connection refuses to connect from then on
+func (c *Connection) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&c.draining, 1)
+
+	select {
+	case c.inUse <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer c.release()
+
+	c.GracefulDisconnect(DISCONNECT_DRAIN)
+	metrics.Increment("drained")
+	return nil
+}
+
+//Returns whether Drain has been called on the connection
+func (c *Connection) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+//Takes the connection for use, waiting while anyone else has it
+func (c *Connection) acquire() {
+	c.inUse <- struct{}{}
+}
+
+//Gives the connection back, after acquire
+func (c *Connection) release() {
+	<-c.inUse
+}
+
+//A user and password to AUTH with
+type credentials struct {
+	user     string
+	password string
+}
+
+//Replaces the credentials sent via AUTH.  Safe to call from any goroutine, even while the connection is in use
+//The new credentials are swapped in by the next ReconnectIfNecessary (which a pool calls as it hands the connection
+//out, so nothing is in flight).  If the connection is up at that point, it is sent an AUTH right away, and if that
+//fails, it is reconnected.  Clearing the password only stops AUTH on future connects
+func (c *Connection) UpdateCredentials(user, password string) {
+	c.credentialsLock.Lock()
+	defer c.credentialsLock.Unlock()
+
+	c.pendingCredentials = &credentials{user, password}
+}
+
+//Swaps in credentials from UpdateCredentials, if there are any, and returns whether there were
+func (c *Connection) swapCredentials() bool {
+	c.credentialsLock.Lock()
+	defer c.credentialsLock.Unlock()
+
+	if c.pendingCredentials == nil {
+		return false
+	}
+
+	c.authUser = c.pendingCredentials.user
+	c.authPassword = c.pendingCredentials.password
+	c.pendingCredentials = nil
+	return true
 }
 
 func (c *Connection) ReconnectIfNecessary() (err error) {
+	return c.ReconnectWithContext(context.Background())
+}
+
+//Reconnects the connection if it is not connected, like ReconnectIfNecessary
+//Cancelling the context aborts an in-flight dial promptly, returning ctx.Err()
+func (c *Connection) ReconnectWithContext(ctx context.Context) (err error) {
+	if c.Draining() {
+		return ERR_DRAINING
+	}
+
+	if c.swapCredentials() && c.authPassword != "" && c.IsConnected() {
+		// A failed AUTH disconnects, so that the connect below tries again from scratch
+		if err = c.authenticate(); err == nil {
+			c.logger.Infof("Authenticated %s with updated credentials", c.endpoint)
+			return nil
+		}
+	}
+
 	if c.IsConnected() {
 		return nil
 	}
 
 	// If it's not connected, manually disconnect the connection for sanity's sake
-	c.Disconnect()
+	c.Disconnect(DISCONNECT_RECONNECT)
 
-	c.connection, err = net.DialTimeout(c.protocol, c.endpoint, c.connectTimeout)
+	if time.Now().Before(c.nextRetryAt) {
+		return ERR_RECONNECT_BACKOFF
+	}
+
+	if c.sentinel != nil {
+		endpoint, err := c.sentinel.Resolve(ctx)
+		if err != nil {
+			c.logger.Errorf("ReconnectWithContext: Could not resolve master %s: %s", c.sentinel.MasterName, err)
+			if ctx.Err() == nil {
+				c.backoff()
+			}
+			return err
+		}
+
+		if endpoint != c.endpoint {
+			c.logger.Infof("Master %s is at %s", c.sentinel.MasterName, endpoint)
+			c.endpoint = endpoint
+			c.counters.endpoint.Store(endpoint)
+		}
+	}
+
+	// The turn lasts through the handshake, which is what a recovering server struggles with
+	endTurn, err := c.connectLimiter.acquire(ctx, c.endpoint, c.connectTimeout)
 	if err != nil {
-		Error("NewConnection: Error received from dial: %s", err)
-		c.connection = nil
+		// Waiting says nothing about the server, so it doesn't count against it
+		c.logger.Warnf("ReconnectWithContext: Not connecting to %s. Err:%s", c.endpoint, err)
+		metrics.Increment("connect_limited")
 		return err
 	}
+	defer endTurn()
+
+	startConnect := time.Now()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 
-	netReadWriter := protocol.NewTimedNetReadWriter(c.connection, c.readTimeout, c.writeTimeout)
+		c.logger.Errorf("NewConnection: Error received from dial: %s", err)
+		// A cancelled dial says nothing about the server, so it doesn't count against it
+		if ctx.Err() == nil {
+			c.backoff()
+		}
+		return err
+	}
+
+	c.socketLock.Lock()
+	c.connection = conn
+	c.readWriter = protocol.NewTimedNetReadWriter(conn, c.readTimeout, c.writeTimeout)
 	c.DatabaseId = 0
-	c.Writer = NewFlexibleWriter(netReadWriter)
-	c.Reader = bufio.NewReader(netReadWriter)
+	c.databaseSelected = false
+	c.protocolVersion = protocol.RESP2
+	counted := &countingReadWriter{c.readWriter, c.counters, &c.poisoned}
+	c.Writer = NewFlexibleWriter(counted)
+	c.Reader = bufio.NewReader(counted)
+	c.socketLock.Unlock()
+
+	if err = c.authenticate(); err != nil {
+		c.backoff()
+		return err
+	}
+
+	if err = c.setClientName(); err != nil {
+		c.backoff()
+		return err
+	}
+
+	// Whoever selected a database before the disconnect still expects to be on it.  It's cleared first, so that if the
+	// server now refuses it (ex: after a failover to one with fewer databases), SelectDatabase reverts to database 0
+	// rather than failing every later reconnect
+	if desired := c.desiredDatabaseId; desired != 0 {
+		c.desiredDatabaseId = 0
+		if err = c.SelectDatabase(desired); err != nil {
+			c.backoff()
+			return err
+		}
+	}
+
+	c.consecutiveFailures = 0
+	c.nextRetryAt = time.Time{}
+
+	metrics.Timing("connect", time.Now().Sub(startConnect))
+	metrics.Increment("connect")
+	if c.hasConnected {
+		metrics.Increment("reconnect")
+		atomic.AddUint64(&c.counters.reconnects, 1)
+	}
+	c.hasConnected = true
+	atomic.StoreInt32(&c.counters.connected, 1)
+	atomic.StoreInt64(&c.counters.lastUsed, time.Now().UnixNano())
+
+	return nil
+}
+
+//Sends AUTH with the configured credentials, if there are any
+//If the server rejects them, the connection is closed and an error is returned
+//Both a +OK and a RESP3 map (as HELLO replies with) are accepted, and a map is consumed in full so that the stream
+//stays aligned.  Any error reply, ex: -WRONGPASS or -NOAUTH, is a failure
+func (c *Connection) authenticate() (err error) {
+	if c.authPassword == "" {
+		return nil
+	}
+
+	if c.Writer == nil || c.Reader == nil {
+		c.logger.Errorf("authenticate: Authenticating on invalid connection")
+		return errors.New("Authenticating on an invalid connection")
+	}
+
+	args := [][]byte{protocol.AUTH_COMMAND}
+	if c.authUser != "" {
+		args = append(args, []byte(c.authUser))
+	}
+	args = append(args, []byte(c.authPassword))
+
+	// Each token is a bulk string of its own, so that a password holding spaces or any other byte (ex: \r) arrives
+	// intact.  Written inline, it would be split into several arguments, or cut short
+	err = protocol.WriteMultibulk(args, c.Writer, true)
+	if err != nil {
+		c.logger.Errorf("authenticate: Error received from protocol.WriteMultibulk: %s", err)
+		c.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return err
+	}
+
+	if err = c.readAuthReply(); err != nil {
+		c.logger.Errorf("authenticate: Error while attempting to authenticate. Err:%q", err)
+		metrics.Increment("auth_error")
+		c.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return fmt.Errorf("%w: %w", ERR_INVALID_AUTH_RESPONSE, err)
+	}
+
+	return nil
+}
+
+//Reads the reply to an AUTH (or a HELLO with AUTH), returning an error unless it is a success
+func (c *Connection) readAuthReply() error {
+	first, err := c.Reader.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if first[0] == '%' {
+		return protocol.IgnoreServerResponse(c.Reader)
+	}
+
+	line, err := protocol.ReadStatusLine(c.Reader)
+	if err != nil {
+		return err
+	} else if !protocol.IsStatusLine(line, protocol.OK_RESPONSE) {
+		return unexpectedReply(line)
+	}
+
+	return nil
+}
+
+//Describes a reply that isn't the +OK expected, ex: "WRONGPASS invalid username-password pair" for an error reply
+//Arguments that the server echoes back are left out, since they may be credentials
+func unexpectedReply(line []byte) error {
+	if code, message := protocol.ParseError(line); code != "" {
+		// As in: -ERR unknown command 'AUTH', with args beginning with: 'password'
+		if echoed := strings.Index(message, ", with args beginning with"); echoed >= 0 {
+			message = message[:echoed]
+		}
+		return errors.New(strings.TrimSpace(code + " " + message))
+	}
+
+	return fmt.Errorf("unexpected reply %q", line)
+}
+
+//Sends CLIENT SETNAME with the configured client name, if there is one
+//A server that refuses it (ex: one that doesn't support CLIENT) is logged and otherwise ignored.  If the reply can't
+//be read, the connection is closed and an error is returned
+func (c *Connection) setClientName() error {
+	if c.clientName == "" {
+		return nil
+	}
+
+	if c.Writer == nil || c.Reader == nil {
+		c.logger.Errorf("setClientName: Naming invalid connection")
+		return errors.New("Naming an invalid connection")
+	}
+
+	args := [][]byte{protocol.CLIENT_COMMAND, protocol.SETNAME_SUBCOMMAND, []byte(c.clientName)}
+	if err := protocol.WriteMultibulk(args, c.Writer, true); err != nil {
+		c.logger.Errorf("setClientName: Error received from protocol.WriteMultibulk: %s", err)
+		c.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return err
+	}
+
+	line, isPrefix, err := c.Reader.ReadLine()
+	if err != nil || isPrefix {
+		if err == nil {
+			err = errors.New("Client name response too long")
+		}
+		c.logger.Errorf("setClientName: Error while attempting to set the client name. Err:%q", err)
+		c.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return err
+	}
+
+	if !bytes.Equal(line, protocol.OK_RESPONSE) {
+		c.logger.Warnf("setClientName: Could not name the connection to %s %q. Response:%q", c.endpoint, c.clientName, line)
+		metrics.Increment("client_name_error")
+	}
 
 	return nil
 }
 
+//Records a failed connect, and pushes back the next retry exponentially, with jitter
+func (c *Connection) backoff() {
+	c.consecutiveFailures++
+	if c.backoffBase <= 0 {
+		return
+	}
+
+	delay := c.backoffBase
+	for i := uint(1); i < c.consecutiveFailures && delay < c.backoffCap; i++ {
+		delay *= 2
+	}
+	if delay > c.backoffCap {
+		delay = c.backoffCap
+	}
+
+	// Wait somewhere between half and all of the delay, so that a pool's connections don't retry in lockstep
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	c.nextRetryAt = time.Now().Add(delay)
+}
+
+//Applies our keepalive and no-delay options to a dialed tcp connection
+func (c *Connection) configureTCP(tcpConnection *net.TCPConn) {
+	if c.keepAlivePeriod > 0 {
+		if err := tcpConnection.SetKeepAlive(true); err != nil {
+			c.logger.Warnf("Could not enable keepalive on %s: %s", c.endpoint, err)
+		} else if err := tcpConnection.SetKeepAlivePeriod(c.keepAlivePeriod); err != nil {
+			c.logger.Warnf("Could not set the keepalive period on %s: %s", c.endpoint, err)
+		}
+	}
+
+	if err := tcpConnection.SetNoDelay(c.noDelay); err != nil {
+		c.logger.Warnf("Could not set no-delay on %s: %s", c.endpoint, err)
+	}
+}
+
+//Dials our endpoint, wrapping the connection in TLS if requested
+//The connect timeout covers both the dial and the TLS handshake
+func (c *Connection) dial(ctx context.Context) (net.Conn, error) {
+	protocol := c.protocol
+	tlsConfig := c.tlsConfig
+	if strings.HasSuffix(protocol, TLS_PROTOCOL_SUFFIX) {
+		protocol = strings.TrimSuffix(protocol, TLS_PROTOCOL_SUFFIX)
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	}
+
+	if c.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.connectTimeout)
+		defer cancel()
+	}
+
+	addresses, err := c.resolve(ctx, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keepalives are configured below, rather than with the dialer's defaults
+	dialer := &net.Dialer{KeepAlive: -1}
+	var rawConnection net.Conn
+	for _, address := range addresses {
+		// Every address shares what's left of the connect timeout
+		rawConnection, err = dialer.DialContext(ctx, protocol, address)
+		if err == nil {
+			break
+		}
+		c.logger.Warnf("dial: Could not connect to %s (%s): %s", address, c.endpoint, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	address := rawConnection.RemoteAddr().String()
+	if address != c.resolvedAddr {
+		if c.resolvedAddr != "" {
+			c.logger.Infof("%s moved from %s to %s", c.endpoint, c.resolvedAddr, address)
+			metrics.Increment("endpoint_moved")
+		}
+		c.resolvedAddr = address
+	}
+
+	if tcpConnection, ok := rawConnection.(*net.TCPConn); ok {
+		c.configureTCP(tcpConnection)
+	}
+
+	if tlsConfig == nil {
+		return rawConnection, nil
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	if c.clientCertificate != nil {
+		tlsConfig.GetClientCertificate = c.clientCertificate.GetClientCertificate
+	}
+	request := &clientCertificateRequest{config: tlsConfig.Clone()}
+	tlsConfig.GetClientCertificate = request.GetClientCertificate
+
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.endpoint); err == nil {
+			tlsConfig.ServerName = host
+		} else {
+			tlsConfig.ServerName = c.endpoint
+		}
+	}
+
+	tlsConnection := tls.Client(rawConnection, tlsConfig)
+	if err := tlsConnection.HandshakeContext(ctx); err != nil {
+		rawConnection.Close()
+		return nil, clientCertificateError(err, request.requested)
+	}
+
+	if request.requested {
+		return mutualTLSConn{tlsConnection}, nil
+	}
+	return tlsConnection, nil
+}
+
+//Returns the addresses to dial for our endpoint, in the order to try them
+//A tcp endpoint's host is looked up on every call, so that a dial follows the host to a new IP.  Anything else
+//(unix sockets, literal IPs) is dialed as is
+func (c *Connection) resolve(ctx context.Context, protocol string) ([]string, error) {
+	if !strings.HasPrefix(protocol, "tcp") {
+		return []string{c.endpoint}, nil
+	}
+
+	host, port, err := net.SplitHostPort(c.endpoint)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{c.endpoint}, nil
+	}
+
+	startResolve := time.Now()
+	ips, err := c.resolver.LookupIPAddr(ctx, host)
+	metrics.Timing("resolve", time.Now().Sub(startResolve))
+	if err != nil {
+		c.logger.Errorf("resolve: Could not resolve %s: %s", host, err)
+		metrics.Increment("resolve_error")
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	c.logger.Debugf("resolve: %s resolved to %v", host, addresses)
+
+	return addresses, nil
+}
+
 //Selects the given database, for the connection
 //If an error is returned, or if an invalid response is returned from the select, then this will return an error
 //If not, the connections internal database will be updated accordingly
+//Selecting the database that was already selected on this connection is a no-op.  A fresh connection always gets a
+//real select, since nothing has confirmed its database yet
+//The database is remembered as the desired one, to be selected again on reconnect, unless the server refuses it
 func (this *Connection) SelectDatabase(DatabaseId int) (err error) {
+	previousDesired := this.desiredDatabaseId
+	this.desiredDatabaseId = DatabaseId
+
 	if this.connection == nil {
-		Error("SelectDatabase: Selecting on invalid connection")
+		this.logger.Errorf("SelectDatabase: Selecting on invalid connection")
 		return errors.New("Selecting database on an invalid connection")
 	}
 
-	err = protocol.WriteLine([]byte(fmt.Sprintf("select %d", DatabaseId)), this.Writer, true)
+	if this.databaseSelected && this.DatabaseId == DatabaseId {
+		return nil
+	}
+
+	if this.inMulti {
+		this.logger.Errorf("SelectDatabase: Refusing to select inside a transaction")
+		return ERR_IN_TRANSACTION
+	}
+
+	startSelect := time.Now()
+	defer func() {
+		metrics.Timing("select", time.Now().Sub(startSelect))
+	}()
+
+	// Written as a multibulk, as AUTH, CLIENT SETNAME and HELLO are, so that arguments are framed whatever they hold
+	// MULTI, PING and QUIT have no arguments, so they're written inline
+	err = protocol.WriteMultibulk([][]byte{protocol.SELECT_COMMAND, []byte(strconv.Itoa(DatabaseId))}, this.Writer, true)
 	if err != nil {
-		Error("SelectDatabase: Error received from protocol.FlushLine: %s", err)
+		this.logger.Errorf("SelectDatabase: Error received from protocol.WriteMultibulk: %s", err)
+		return err
+	}
+
+	line, err := protocol.ReadStatusLine(this.Reader)
+	if err == nil && !protocol.IsStatusLine(line, protocol.OK_RESPONSE) {
+		err = unexpectedReply(line)
+		// Reselecting a database the server refuses would fail every reconnect
+		this.desiredDatabaseId = previousDesired
+	}
+	if err != nil {
+		this.logger.Errorf("SelectDatabase: Error while attempting to select database. Err:%q Response:%q", err, line)
+		this.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return fmt.Errorf("%w: %w", ERR_INVALID_SELECT_RESPONSE, err)
+	}
+
+	this.DatabaseId = DatabaseId
+	this.databaseSelected = true
+	atomic.StoreInt64(&this.counters.databaseId, int64(DatabaseId))
+	return
+}
+
+//Returns the database last asked for with SelectDatabase, which the connection is on whenever it's connected
+//DatabaseId is the database confirmed on the current underlying connection, and is 0 while disconnected
+func (c *Connection) DesiredDatabaseId() int {
+	return c.desiredDatabaseId
+}
+
+//Returns the RESP protocol version that this connection has negotiated with the redis server
+func (c *Connection) ProtocolVersion() int {
+	return c.protocolVersion
+}
+
+//Records that the server has accepted a HELLO for the given RESP protocol version, that was sent over the connection
+//as one of a client's commands rather than with Hello
+func (c *Connection) SetProtocolVersion(version int) {
+	c.protocolVersion = version
+}
+
+//Negotiates the given RESP protocol version with the redis server, via HELLO
+//The server's reply is consumed.  If an error or an error reply is received, the connection is disconnected
+func (this *Connection) Hello(version int) (err error) {
+	if this.connection == nil {
+		this.logger.Errorf("Hello: Negotiating protocol on invalid connection")
+		return errors.New("Negotiating protocol on an invalid connection")
+	}
+
+	if this.inMulti {
+		this.logger.Errorf("Hello: Refusing to negotiate protocol inside a transaction")
+		return ERR_IN_TRANSACTION
+	}
+
+	err = protocol.WriteMultibulk([][]byte{protocol.HELLO_COMMAND, []byte(strconv.Itoa(version))}, this.Writer, true)
+	if err != nil {
+		this.logger.Errorf("Hello: Error received from protocol.WriteMultibulk: %s", err)
+		return err
+	}
+
+	if first, err := this.Reader.Peek(1); err == nil && first[0] == '-' {
+		line, _, _ := this.Reader.ReadLine()
+		this.logger.Errorf("Hello: Server refused protocol %d. Response:%q", version, line)
+		this.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return errors.New("Invalid hello response")
+	}
+
+	if err = protocol.IgnoreServerResponse(this.Reader); err != nil {
+		this.logger.Errorf("Hello: Error while attempting to negotiate protocol %d. Err:%q", version, err)
+		this.Disconnect(DISCONNECT_HANDSHAKE_FAIL)
+		return err
+	}
+
+	this.protocolVersion = version
+	return
+}
+
+//Opens a transaction on the connection, via MULTI, and consumes the server's reply
+//If an error or an invalid response is received, the connection is disconnected
+func (this *Connection) Multi() (err error) {
+	if this.connection == nil {
+		this.logger.Errorf("Multi: Opening a transaction on invalid connection")
+		return errors.New("Opening a transaction on an invalid connection")
+	}
+
+	err = protocol.WriteLine(protocol.MULTI_COMMAND, this.Writer, true)
+	if err != nil {
+		this.logger.Errorf("Multi: Error received from protocol.FlushLine: %s", err)
 		return err
 	}
 
@@ -123,18 +857,154 @@ func (this *Connection) SelectDatabase(DatabaseId int) (err error) {
 			err = errors.New("unknown ReadLine error")
 		}
 
-		Error("SelectDatabase: Error while attempting to select database. Err:%q Response:%q isPrefix:%t", err, line, isPrefix)
-		this.Disconnect()
-		return errors.New("Invalid select response")
+		this.logger.Errorf("Multi: Error while attempting to open a transaction. Err:%q Response:%q isPrefix:%t", err, line, isPrefix)
+		this.Disconnect(DisconnectReasonOf(err))
+		return errors.New("Invalid multi response")
 	}
 
-	this.DatabaseId = DatabaseId
+	this.inMulti = true
 	return
 }
 
+//Realigns the connection with the start of the server's next reply, after a reply was abandoned part way through,
+//by discarding the given number of bytes that are known to be left of it (ex: the rest of a bulk payload, and its
+//\r\n).  This saves a reconnect when the reply's framing is known, where Disconnect would drop a usable socket
+//Nothing past those bytes is read.  If they can't be discarded (ex: the server goes quiet), or whatever is already
+//buffered after them doesn't start a reply, the connection is disconnected and ERR_RESYNC_FAILED is returned
+func (c *Connection) Resync(expectedRemaining int64) (err error) {
+	if c.Reader == nil || c.connection == nil {
+		return fmt.Errorf("%w: not connected", ERR_RESYNC_FAILED)
+	}
+
+	defer func() {
+		if err != nil {
+			c.logger.Errorf("Resync: Disconnecting from %s. Err:%s", c.endpoint, err)
+			metrics.Increment("resync_error")
+			c.Disconnect(DISCONNECT_PROTOCOL_ERROR)
+		}
+	}()
+
+	if expectedRemaining < 0 {
+		return fmt.Errorf("%w: can't discard %d bytes", ERR_RESYNC_FAILED, expectedRemaining)
+	}
+	if err = protocol.DiscardBytes(c.Reader, expectedRemaining); err != nil {
+		return fmt.Errorf("%w: %w", ERR_RESYNC_FAILED, err)
+	}
+
+	// Only what's already buffered is checked, since waiting for more would block on an idle server
+	if c.Reader.Buffered() > 0 {
+		next, _ := c.Reader.Peek(1)
+		if protocol.ReplyKindOf(next[0]) == protocol.REPLY_UNKNOWN {
+			return fmt.Errorf("%w: %q doesn't start a reply", ERR_RESYNC_FAILED, next)
+		}
+	}
+
+	metrics.Increment("resynced")
+	return nil
+}
+
+//Brings the tracked state in line with a server that has just run RESET: database 0 is selected and RESP2 is
+//negotiated.  RESET also deauthenticates the connection, so the configured credentials (if any) are sent again
+//If that AUTH fails, the connection is disconnected and an error is returned
+func (this *Connection) HandleReset() error {
+	this.DatabaseId = 0
+	this.desiredDatabaseId = 0
+	atomic.StoreInt64(&this.counters.databaseId, 0)
+	this.databaseSelected = true
+	this.protocolVersion = protocol.RESP2
+	this.inMulti = false
+	this.watching = false
+
+	return this.authenticate()
+}
+
+//Tracks whether a transaction is open on this connection, from a command that has been sent on it
+//MULTI opens one, EXEC and DISCARD end it (and unwatch every key), and WATCH holds one open until then, or until
+//UNWATCH.  RESET ends both, and is handled by HandleReset
+func (c *Connection) TrackTransaction(command []byte) {
+	if bytes.Equal(command, protocol.MULTI_COMMAND) {
+		c.inMulti = true
+	} else if bytes.Equal(command, protocol.EXEC_COMMAND) || bytes.Equal(command, protocol.DISCARD_COMMAND) {
+		c.inMulti = false
+		c.watching = false
+	} else if bytes.Equal(command, protocol.WATCH_COMMAND) {
+		c.watching = true
+	} else if bytes.Equal(command, protocol.UNWATCH_COMMAND) && !c.inMulti {
+		// Inside a MULTI, the UNWATCH is only queued
+		c.watching = false
+	}
+}
+
+//Returns whether a MULTI has been sent on this connection, and not yet ended by EXEC, DISCARD or RESET
+func (c *Connection) InMulti() bool {
+	return c.inMulti
+}
+
+//Returns whether a MULTI or WATCH is open on this connection.  Until it ends, the connection belongs to the client that
+//opened it, and mustn't be used for anyone else's commands
+func (c *Connection) InTransaction() bool {
+	return c.inMulti || c.watching
+}
+
+//Returned by Pipeline when a command's reply can't be read, identifying which command it was
+type PipelineError struct {
+	//The index of the command whose reply failed
+	Index int
+	Err   error
+}
+
+func (this *PipelineError) Error() string {
+	return fmt.Sprintf("Pipelined command %d failed: %s", this.Index, this.Err)
+}
+
+func (this *PipelineError) Unwrap() error {
+	return this.Err
+}
+
+//Writes every command, flushes once, and then reads one reply per command, in order
+//Each command must be a complete, encoded redis command.  Error replies from redis are returned as replies, not
+//errors.  If a reply can't be read, the replies read so far are returned with a *PipelineError, and the connection is
+//disconnected, since the rest of the stream can no longer be matched up with its commands
+func (c *Connection) Pipeline(commands [][]byte) (replies []protocol.Reply, err error) {
+	if c.connection == nil {
+		c.logger.Errorf("Pipeline: Pipelining on invalid connection")
+		return nil, errors.New("Pipelining on an invalid connection")
+	}
+
+	for i, command := range commands {
+		if _, err = c.Writer.Write(command); err != nil {
+			c.logger.Errorf("Pipeline: Error writing command %d: %s", i, err)
+			c.Disconnect(DisconnectReasonOf(err))
+			return nil, &PipelineError{i, err}
+		}
+	}
+
+	if err = c.Writer.Flush(); err != nil {
+		c.logger.Errorf("Pipeline: Error flushing commands: %s", err)
+		c.Disconnect(DisconnectReasonOf(err))
+		return nil, &PipelineError{0, err}
+	}
+
+	replies = make([]protocol.Reply, 0, len(commands))
+	for i := range commands {
+		reply, err := protocol.ParseReply(c.Reader)
+		if err != nil {
+			c.logger.Errorf("Pipeline: Error reading the reply to command %d: %s", i, err)
+			c.Disconnect(DisconnectReasonOf(err))
+			return replies, &PipelineError{i, err}
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
 //Checks if the current connection is up or not
 //If we do not get a response, or if we do not get a PONG reply, or if there is any error, returns false
 func (myConnection *Connection) CheckConnection() bool {
+	myConnection.socketLock.Lock()
+	defer myConnection.socketLock.Unlock()
+
 	if myConnection.connection == nil {
 		return false
 	}
@@ -147,39 +1017,183 @@ func (myConnection *Connection) CheckConnection() bool {
 	startWrite := time.Now()
 	err := protocol.WriteLine(protocol.SHORT_PING_COMMAND, myConnection.Writer, true)
 	if err != nil {
-		Error("CheckConnection: Could not write PING Err:%s Timing:%s", err, time.Now().Sub(startWrite))
-		myConnection.Disconnect()
+		myConnection.logger.Errorf("CheckConnection: Could not write PING Err:%s Timing:%s", err, time.Now().Sub(startWrite))
+		myConnection.disconnect(DISCONNECT_HEALTH_CHECK_FAIL)
 		return false
 	}
 
+	return myConnection.readPong(myConnection.probeTimeout) == nil
+}
+
+//Times a PING round trip to the server, waiting up to the probe timeout for the PONG, and records it as the
+//"rtt.<endpoint>" timing.  Like CheckConnection, this disconnects and returns an error if the PING can't be written,
+//or if anything but a PONG arrives in time
+func (c *Connection) MeasureRTT() (rtt time.Duration, err error) {
+	c.socketLock.Lock()
+	defer c.socketLock.Unlock()
+
+	if c.connection == nil {
+		c.logger.Errorf("MeasureRTT: Pinging on invalid connection")
+		return 0, errors.New("Measuring RTT on an invalid connection")
+	}
+
+	start := time.Now()
+	if err = protocol.WriteLine(protocol.SHORT_PING_COMMAND, c.Writer, true); err != nil {
+		c.logger.Errorf("MeasureRTT: Could not write PING Err:%s", err)
+		c.disconnect(DISCONNECT_HEALTH_CHECK_FAIL)
+		return 0, err
+	}
+
+	if err = c.readPong(c.probeTimeout); err != nil {
+		return 0, err
+	}
+
+	rtt = time.Now().Sub(start)
+	metrics.Timing("rtt."+strings.NewReplacer(".", "-", ":", "-").Replace(c.endpoint), rtt)
+	return rtt, nil
+}
+
+//Reads the response to a PING, waiting up to the given timeout.  Disconnects if anything but a PONG arrives in time
+//The socketLock must be held
+func (c *Connection) readPong(timeout time.Duration) error {
+	if c.Reader == nil {
+		return errors.New("Reading a PONG on an invalid connection")
+	}
+
+	// A health probe shouldn't wait as long as a bulk read might, so it gets its own deadline
+	if c.readWriter != nil {
+		readTimeout := c.readWriter.ReadTimeout
+		c.readWriter.ReadTimeout = timeout
+		defer func(readWriter *protocol.TimedNetReadWriter) {
+			readWriter.ReadTimeout = readTimeout
+		}(c.readWriter)
+	}
+
 	startRead := time.Now()
-	line, isPrefix, err := myConnection.Reader.ReadLine()
+	line, isPrefix, err := c.Reader.ReadLine()
 
-	if err == nil && !isPrefix && bytes.Equal(line, protocol.PONG_RESPONSE) {
-		return true
+	if err == nil && !isPrefix && protocol.IsStatusLine(line, protocol.PONG_RESPONSE) {
+		return nil
 	} else {
 		if err != nil {
-			Error("CheckConnection: Could not read PING. Error: %s Timing:%s", err, time.Now().Sub(startRead))
+			c.logger.Errorf("CheckConnection: Could not read PING. Error: %s Timing:%s", err, time.Now().Sub(startRead))
 		} else if isPrefix {
-			Error("CheckConnection: ReadLine returned prefix: %q", line)
+			c.logger.Errorf("CheckConnection: ReadLine returned prefix: %q", line)
+			err = ERR_UNEXPECTED_PONG
 		} else {
-			Error("CheckConnection: Expected PONG response. Got: %q", line)
+			c.logger.Errorf("CheckConnection: Expected PONG response. Got: %q", line)
+			err = ERR_UNEXPECTED_PONG
 		}
-		myConnection.Disconnect()
-		return false
+		c.disconnect(DISCONNECT_HEALTH_CHECK_FAIL)
+		return err
+	}
+}
+
+//Raises the timeout of the next read from the server to the given timeout, for a reply that the server may
+//legitimately take longer than the read timeout to send (ex: BLPOP or WAIT).  Later reads get the read timeout again
+//The returned function reverts the next read to the read timeout, in case it hasn't happened yet (ex: the reply was
+//already buffered, or reading was abandoned), and must be called once the reply has been read, or has failed to be
+//A timeout no longer than the read timeout leaves it alone
+func (c *Connection) ExtendNextReadTimeout(timeout time.Duration) (revert func()) {
+	readWriter := c.readWriter
+	if readWriter == nil || readWriter.ReadTimeout <= 0 || timeout <= readWriter.ReadTimeout {
+		return func() {}
+	}
+
+	readWriter.SetNextReadDeadline(timeout)
+	return func() {
+		readWriter.SetNextReadDeadline(0)
 	}
 }
 
+//Checks the health of many connections at once.  Every PING is written before any PONG is waited on, and the PONGs
+//are collected concurrently, so that the whole sweep is bounded by the one timeout rather than by the sum of the
+//round trips.  Connections that don't PONG in time are disconnected, and reported as false
+func CheckConnections(connections []*Connection, timeout time.Duration) []bool {
+	results := make([]bool, len(connections))
+	deadline := time.Now().Add(timeout)
+
+	for i, c := range connections {
+		if c == nil {
+			continue
+		}
+
+		c.socketLock.Lock()
+		if c.connection == nil {
+			c.socketLock.Unlock()
+			continue
+		}
+		if err := protocol.WriteLine(protocol.SHORT_PING_COMMAND, c.Writer, true); err != nil {
+			c.logger.Errorf("CheckConnections: Could not write PING Err:%s", err)
+			c.disconnect(DISCONNECT_HEALTH_CHECK_FAIL)
+		} else {
+			// Marks the PING as sent, the PONG is checked below
+			results[i] = true
+		}
+		c.socketLock.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range connections {
+		if !results[i] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, c *Connection) {
+			defer wg.Done()
+			remaining := deadline.Sub(time.Now())
+			// A zero timeout would mean no deadline at all, so an expired sweep still gets the smallest one
+			if remaining <= 0 {
+				remaining = time.Nanosecond
+			}
+			c.socketLock.Lock()
+			defer c.socketLock.Unlock()
+			results[i] = c.readPong(remaining) == nil
+		}(i, c)
+	}
+	wg.Wait()
+
+	return results
+}
+
+//Returns whether a write to the server has failed since the connection was established.  The server may have read
+//part of a command, and would take whatever is sent next as the rest of it, so the connection can't be used again
+//IsConnected is false for a poisoned connection, so that ReconnectIfNecessary replaces it with a fresh one
+func (c *Connection) Poisoned() bool {
+	return atomic.LoadInt32(&c.poisoned) == 1
+}
+
+//Checks whether the underlying socket is still open, and hasn't been poisoned by a failed write
+//Probes by peeking through our Reader, so that anything the server has sent stays buffered rather than being lost
 func (c *Connection) IsConnected() bool {
-	if c.connection == nil {
+	c.socketLock.Lock()
+	defer c.socketLock.Unlock()
+
+	if c.connection == nil || c.Reader == nil {
 		return false
 	}
 
+	if c.Poisoned() {
+		c.logger.Infof("A write to the connection failed, will reconnect the connection")
+		metrics.Increment("poisoned")
+		return false
+	}
+
+	// Anything already buffered means the socket was readable, and is left alone for the next reader
+	if c.Reader.Buffered() > 0 {
+		return true
+	}
+
 	// Adds a hundredth a milli...
-	c.connection.SetReadDeadline(time.Now().Add(time.Microsecond * 10))
-	var b [4]byte
-	n, err := c.connection.Read(b[:])
+	if c.readWriter != nil {
+		defer func(readTimeout time.Duration) {
+			c.readWriter.ReadTimeout = readTimeout
+		}(c.readWriter.ReadTimeout)
+		c.readWriter.ReadTimeout = time.Microsecond * 10
+	}
 
+	_, err := c.Reader.Peek(1)
 	if err != nil {
 		if err, ok := err.(net.Error); ok {
 			if err.Timeout() {
@@ -187,13 +1201,9 @@ func (c *Connection) IsConnected() bool {
 			}
 		}
 
-		Info("There was an error when checking the connection (%s), will reconnect the connection", err)
+		c.logger.Infof("There was an error when checking the connection (%s), will reconnect the connection", err)
 		return false
 	}
 
-	if n != 0 {
-		Warn("Got %d bytes back when we expected 0.", n)
-	}
-
 	return true
 }
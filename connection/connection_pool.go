@@ -26,10 +26,11 @@
 package connection
 
 import (
+	"context"
 	. "github.com/salesforce/rmux/log"
 	"time"
 	"sync/atomic"
-	"github.com/salesforce/rmux/graphite"
+	"github.com/salesforce/rmux/metrics"
 	"strings"
 	"sync"
 )
@@ -45,7 +46,7 @@ const (
 
 //A pool of connections to a single outbound redis server
 type ConnectionPool struct {
-	//The protocol to use for our connections (unix/tcp/udp)
+	//The protocol to use for our connections (unix/tcp/udp, or tcp+tls for TLS)
 	Protocol string
 	//The endpoint to connect to
 	Endpoint string
@@ -65,15 +66,47 @@ type ConnectionPool struct {
 	connectedLock sync.RWMutex
 	// Whether or not the connction pool is up or down
 	isConnected bool
+	// If set, connections find their endpoint through sentinel
+	sentinel *SentinelResolver
+	// Read replicas of this pool's server, that read-only commands may be sent to
+	replicas []*ConnectionPool
+	// Round-robins read-only commands between the replicas
+	nextReplica uint32
+	// Every connection this pool has created, including the diagnostic connection, and the credentials they use
+	connections []*Connection
+	authUser string
+	authPassword string
+	clientName string
+	traceHook TraceHook
+	clientCertificate *ClientCertificate
+	connectLimiter *ConnectLimiter
+	tripThreshold int
+	tripCoolDown time.Duration
+	connectionsLock sync.Mutex
+	// Set by Drain, after which no connection is handed out
+	draining int32
 }
 
 //Initialize a new connection pool, for the given protocol/endpoint, with a given pool capacity
 //ex: "unix", "/tmp/myAwesomeSocket", 5
 func NewConnectionPool(Protocol, Endpoint string, poolCapacity int, connectTimeout time.Duration,
 		readTimeout time.Duration, writeTimeout time.Duration) (newConnectionPool *ConnectionPool) {
+	return createConnectionPool(Protocol, Endpoint, nil, poolCapacity, connectTimeout, readTimeout, writeTimeout)
+}
+
+//Initialize a new connection pool to the master that the given sentinels monitor, with a given pool capacity
+//Each connection looks up the master whenever it reconnects, so the pool follows failovers
+func NewSentinelConnectionPool(resolver *SentinelResolver, poolCapacity int, connectTimeout time.Duration,
+		readTimeout time.Duration, writeTimeout time.Duration) (newConnectionPool *ConnectionPool) {
+	return createConnectionPool("tcp", "sentinel:"+resolver.MasterName, resolver, poolCapacity, connectTimeout, readTimeout, writeTimeout)
+}
+
+func createConnectionPool(Protocol, Endpoint string, sentinel *SentinelResolver, poolCapacity int, connectTimeout time.Duration,
+		readTimeout time.Duration, writeTimeout time.Duration) (newConnectionPool *ConnectionPool) {
 	newConnectionPool = &ConnectionPool{}
 	newConnectionPool.Protocol = Protocol
 	newConnectionPool.Endpoint = Endpoint
+	newConnectionPool.sentinel = sentinel
 	newConnectionPool.connectionPool = make(chan *Connection, poolCapacity)
 	newConnectionPool.ConnectTimeout = connectTimeout
 	newConnectionPool.ReadTimeout = readTimeout
@@ -91,41 +124,145 @@ func NewConnectionPool(Protocol, Endpoint string, poolCapacity int, connectTimeo
 }
 
 //Gets a connection from the connection pool
+//A tripped connection (see Connection.Tripped) is put back, and the next one tried.  ERR_TRIPPED is only returned once
+//as many connections as the pool holds have been tried, and each was tripped
 func (cp *ConnectionPool) GetConnection() (connection *Connection, err error) {
-	select {
-	case connection = <-cp.connectionPool:
+	if atomic.LoadInt32(&cp.draining) == 1 {
+		return nil, ERR_DRAINING
+	}
+
+	for tries := 1; ; tries++ {
+		connection = <-cp.connectionPool
+		connection.acquire()
 		atomic.AddInt32(&cp.Count, 1)
 
-		if err := connection.ReconnectIfNecessary(); err != nil {
-			// Recycle the holder, return an error
-			cp.RecycleRemoteConnection(connection)
-			Error("Received a nil connection in pool.GetConnection: %s", err)
-			graphite.Increment("reconnect_error");
-			return nil, err
+		if !connection.Tripped() {
+			break
+		}
+
+		// Put back behind the others, so that the next one is tried
+		cp.RecycleRemoteConnection(connection)
+		if tries >= cap(cp.connectionPool) {
+			metrics.Increment("tripped_refused")
+			return nil, ERR_TRIPPED
 		}
+	}
 
-		return connection, nil
-	// TODO: Maybe a while/timeout/graphiteping loop?
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		// Recycle the holder, return an error
+		cp.RecycleRemoteConnection(connection)
+		Error("Received a nil connection in pool.GetConnection: %s", err)
+		metrics.Increment("reconnect_error");
+		return nil, err
 	}
+
+	return connection, nil
 }
 
 // Creates a new Connection basead on the pool's configuration
 func (cp *ConnectionPool) CreateConnection() *Connection {
-	return NewConnection(
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	connection := NewConnection(
 		cp.Protocol,
 		cp.Endpoint,
-		cp.ConnectTimeout,
-		cp.ReadTimeout,
-		cp.WriteTimeout,
+		WithConnectTimeout(cp.ConnectTimeout),
+		WithReadTimeout(cp.ReadTimeout),
+		WithWriteTimeout(cp.WriteTimeout),
+		WithSentinel(cp.sentinel),
+		WithAuth(cp.authUser, cp.authPassword),
+		WithClientName(cp.clientName),
+		WithTraceHook(cp.traceHook),
+		WithClientCertificate(cp.clientCertificate),
+		WithConnectLimiter(cp.connectLimiter),
+		WithCircuitBreaker(cp.tripThreshold, cp.tripCoolDown),
 	)
+	cp.connections = append(cp.connections, connection)
+	return connection
+}
+
+//Sets the name that the pool's connections give themselves with CLIENT SETNAME, from their next connect on
+//Should be set before the pool is used, since connections that are already up keep their old name
+func (cp *ConnectionPool) SetClientName(name string) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.clientName = name
+	for _, connection := range cp.connections {
+		connection.clientName = name
+	}
+}
+
+//Calls the given hook around every command proxied over the pool's connections.  Should be set before the pool is used
+func (cp *ConnectionPool) SetTraceHook(hook TraceHook) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.traceHook = hook
+	for _, connection := range cp.connections {
+		connection.traceHook = hook
+	}
+}
+
+//Presents the given client certificate from each of the pool's connections' next connect on, for a "tcp+tls" server
+//that requires mutual TLS.  Reloading the certificate rotates it without the pool being touched
+func (cp *ConnectionPool) SetClientCertificate(certificate *ClientCertificate) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.clientCertificate = certificate
+	for _, connection := range cp.connections {
+		connection.clientCertificate = certificate
+	}
+}
+
+//Makes each of the pool's connections wait for a turn from the given limiter before connecting, so that the pool (and
+//any other sharing the limiter) doesn't reconnect all at once.  Should be set before the pool is used
+func (cp *ConnectionPool) SetConnectLimiter(limiter *ConnectLimiter) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.connectLimiter = limiter
+	for _, connection := range cp.connections {
+		connection.connectLimiter = limiter
+	}
+}
+
+//Trips each of the pool's connections for the given cool-down once threshold replies in a row have failed, during
+//which the pool doesn't hand it out, and tries its other connections instead.  See Connection.RecordReply.  Should be set before the pool is used
+func (cp *ConnectionPool) SetCircuitBreaker(threshold int, coolDown time.Duration) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.tripThreshold = threshold
+	cp.tripCoolDown = coolDown
+	for _, connection := range cp.connections {
+		connection.tripThreshold = threshold
+		connection.tripCoolDown = coolDown
+	}
+}
+
+//Replaces the credentials that the pool's connections AUTH with, without tearing them down
+//Each connection swaps them in the next time it is handed out (see Connection.UpdateCredentials)
+func (cp *ConnectionPool) UpdateCredentials(user, password string) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	cp.authUser = user
+	cp.authPassword = password
+	for _, connection := range cp.connections {
+		connection.UpdateCredentials(user, password)
+	}
 }
 
 func (cp *ConnectionPool) getDiagnosticConnection() (connection *Connection, err error) {
 	cp.diagnosticConnectionLock.Lock()
+	cp.diagnosticConnection.acquire()
 
 	if err := cp.diagnosticConnection.ReconnectIfNecessary(); err != nil {
 		Error("The diangnostic connection is down for %s:%s : %s", cp.Protocol, cp.Endpoint, err)
-		cp.diagnosticConnectionLock.Unlock()
+		cp.releaseDiagnosticConnection()
 		return nil, err
 	}
 
@@ -133,16 +270,60 @@ func (cp *ConnectionPool) getDiagnosticConnection() (connection *Connection, err
 }
 
 func (cp *ConnectionPool) releaseDiagnosticConnection() {
+	cp.diagnosticConnection.release()
 	cp.diagnosticConnectionLock.Unlock()
 }
 
 //Recycles a connection back into our connection pool
 //If the pool is full, throws it away
 func (myConnectionPool *ConnectionPool) RecycleRemoteConnection(remoteConnection *Connection) {
+	remoteConnection.release()
 	myConnectionPool.connectionPool <- remoteConnection
 	atomic.AddInt32(&myConnectionPool.Count, -1)
 }
 
+//Stops handing out connections, then drains every one of the pool's connections (see Connection.Drain), so that the
+//commands already sent over them have their replies copied in full before they're disconnected
+//Returns once they're all drained, or with the context's error if it ends first.  The pool stays drained either way
+func (cp *ConnectionPool) Drain(ctx context.Context) (err error) {
+	atomic.StoreInt32(&cp.draining, 1)
+
+	cp.connectionsLock.Lock()
+	connections := append([]*Connection(nil), cp.connections...)
+	cp.connectionsLock.Unlock()
+
+	// Every connection is marked as draining, even once the context has ended
+	for _, connection := range connections {
+		if drainErr := connection.Drain(ctx); err == nil {
+			err = drainErr
+		}
+	}
+	return err
+}
+
+//Disconnects the pooled connections that have been idle for longer than maxIdle, to bound the number of connections
+//held open on the server during quiet periods.  They reconnect the next time they're handed out
+//Only connections that are waiting in the pool are looked at, so none are in use.  Returns how many were disconnected
+func (cp *ConnectionPool) ReapIdleConnections(maxIdle time.Duration) (reaped int) {
+	for i := len(cp.connectionPool); i > 0; i-- {
+		select {
+		case connection := <-cp.connectionPool:
+			// A connection being drained is briefly held by Drain
+			connection.acquire()
+			if connection.connection != nil && connection.IsIdleLongerThan(maxIdle) {
+				connection.GracefulDisconnect(DISCONNECT_IDLE_REAP)
+				metrics.Increment("idle_reaped")
+				reaped++
+			}
+			connection.release()
+			cp.connectionPool <- connection
+		default:
+			return
+		}
+	}
+	return
+}
+
 func (cp *ConnectionPool) SetIsConnected(isConnected bool) {
 	cp.connectedLock.Lock()
 	defer cp.connectedLock.Unlock()
@@ -176,8 +357,9 @@ func (cp *ConnectionPool) CheckConnectionState() (isUp bool) {
 		return
 	}
 
-	if !connection.CheckConnection() {
-		connection.Disconnect()
+	// Timing the check as well gives a continuous measure of the backend's latency
+	if _, err := connection.MeasureRTT(); err != nil {
+		connection.Disconnect(DISCONNECT_HEALTH_CHECK_FAIL)
 		isUp = false
 		return
 	}
@@ -185,9 +367,64 @@ func (cp *ConnectionPool) CheckConnectionState() (isUp bool) {
 	return
 }
 
+//Adds a read replica of this pool's server.  Read-only commands may be sent to it, while it's up
+//Replicas must all be added before the pool is used
+func (cp *ConnectionPool) AddReplica(replica *ConnectionPool) {
+	cp.replicas = append(cp.replicas, replica)
+}
+
+//Returns this pool's read replicas
+func (cp *ConnectionPool) Replicas() []*ConnectionPool {
+	return cp.replicas
+}
+
+//Returns the pool to send a read-only command to: the next replica that is up, round-robin, or this pool if there
+//are no replicas up
+func (cp *ConnectionPool) ReadPool() *ConnectionPool {
+	numReplicas := len(cp.replicas)
+	if numReplicas == 0 {
+		return cp
+	}
+
+	start := atomic.AddUint32(&cp.nextReplica, 1)
+	for i := 0; i < numReplicas; i++ {
+		replica := cp.replicas[(int(start)+i)%numReplicas]
+		if replica.IsConnected() {
+			return replica
+		}
+	}
+
+	return cp
+}
+
 func (cp *ConnectionPool) ReportGraphite() {
-	endpoint := strings.Replace(cp.Endpoint, ".", "-", -1)
-	endpoint = strings.Replace(cp.Endpoint, ":", "-", -1)
+	metrics.Gauge("pools." + cp.metricEndpoint(), int(cp.Count))
+}
 
-	graphite.Gauge("pools." + endpoint, int(cp.Count))
+//Returns the bytes read from and written to the server by every connection the pool has created, including the
+//diagnostic connection, since they were created.  Connections' ResetTraffic doesn't affect it
+func (cp *ConnectionPool) Traffic() (bytesRead, bytesWritten uint64) {
+	cp.connectionsLock.Lock()
+	defer cp.connectionsLock.Unlock()
+
+	for _, connection := range cp.connections {
+		bytesRead += atomic.LoadUint64(&connection.counters.bytesRead)
+		bytesWritten += atomic.LoadUint64(&connection.counters.bytesWritten)
+	}
+	return
+}
+
+//Reports the pool's Traffic as gauges, ex: pools.localhost-6379.bytes_read.  They only ever grow, so rates come from
+//their derivative
+func (cp *ConnectionPool) ReportTraffic() {
+	bytesRead, bytesWritten := cp.Traffic()
+	endpoint := cp.metricEndpoint()
+	metrics.Gauge("pools."+endpoint+".bytes_read", int(bytesRead))
+	metrics.Gauge("pools."+endpoint+".bytes_written", int(bytesWritten))
+}
+
+//Returns the pool's endpoint, with the dots and colons that would split a graphite path replaced
+func (cp *ConnectionPool) metricEndpoint() string {
+	endpoint := strings.Replace(cp.Endpoint, ".", "-", -1)
+	return strings.Replace(endpoint, ":", "-", -1)
 }
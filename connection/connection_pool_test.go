@@ -26,6 +26,8 @@
 package connection
 
 import (
+	"bufio"
+	"context"
 	"net"
 	"testing"
 	"time"
@@ -162,3 +164,207 @@ func TestCheckConnectionState(test *testing.T) {
 
 	wg.Wait()
 }
+
+func TestReapIdleConnections(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	timeout := 50 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout)
+
+	idle, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	busy, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	connectionPool.RecycleRemoteConnection(idle)
+
+	if reaped := connectionPool.ReapIdleConnections(time.Hour); reaped != 0 {
+		test.Fatalf("Nothing has been idle for an hour, but %d connections were reaped", reaped)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !idle.IsIdleLongerThan(5 * time.Millisecond) {
+		test.Fatal("The recycled connection should be idle")
+	}
+
+	// The connection that's in use is left alone, even though it is just as idle
+	if reaped := connectionPool.ReapIdleConnections(5 * time.Millisecond); reaped != 1 {
+		test.Fatalf("Expected the one pooled connection to be reaped, reaped %d", reaped)
+	}
+	if idle.connection != nil {
+		test.Fatal("The idle connection should have been disconnected")
+	}
+	if busy.connection == nil {
+		test.Fatal("The connection in use should not have been disconnected")
+	}
+	connectionPool.RecycleRemoteConnection(busy)
+}
+
+func TestDrain(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	// Answers every line with +OK, so that QUIT is acknowledged as well
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				reader := bufio.NewReader(fd)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					fd.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout)
+
+	busy, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	if err := protocol.WriteLine([]byte("set a 1"), busy.Writer, true); err != nil {
+		test.Fatalf("Failed to send a command: %s", err)
+	}
+
+	// While the command's reply hasn't been read, the pool can't finish draining
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := connectionPool.Drain(ctx); err != context.DeadlineExceeded {
+		test.Fatalf("Expected the drain to time out on the connection in use, got %v", err)
+	}
+	if _, err := connectionPool.GetConnection(); err != ERR_DRAINING {
+		test.Fatalf("Expected a draining pool not to hand out connections, got %v", err)
+	}
+	if !busy.IsConnected() {
+		test.Fatal("Expected the connection in use to be left connected")
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- connectionPool.Drain(context.Background())
+	}()
+
+	select {
+	case err := <-drained:
+		test.Fatalf("Expected the drain to wait for the connection in use, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The reply is read in full before the connection is given back, and only then closed
+	if line, err := protocol.ReadStatusLine(busy.Reader); err != nil || string(line) != "+OK" {
+		test.Fatalf("Expected the reply to the command, got %q, %v", line, err)
+	}
+	connectionPool.RecycleRemoteConnection(busy)
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			test.Fatalf("Expected the drain to finish, got %v", err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("Timed out waiting for the drain")
+	}
+	if busy.connection != nil {
+		test.Fatal("Expected the drained connection to be disconnected")
+	}
+	if err := busy.ReconnectIfNecessary(); err != ERR_DRAINING {
+		test.Fatalf("Expected a drained connection to refuse to reconnect, got %v", err)
+	}
+}
+
+func TestConcurrentForwardAndHealthCheck(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock := _listenSocket(test, testSocket)
+	defer listenSock.Close()
+
+	// Answers PING with +PONG and anything else with +OK
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				scanner := protocol.NewRespScanner(fd)
+				for scanner.Scan() {
+					if bytes.HasPrefix(scanner.Bytes(), []byte("PING")) {
+						fd.Write([]byte("+PONG\r\n"))
+					} else {
+						fd.Write([]byte("+OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout)
+
+	done := make(chan struct{})
+	var checks sync.WaitGroup
+	checks.Add(1)
+	go func() {
+		defer checks.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			connectionPool.CheckConnectionState()
+			connectionPool.ReapIdleConnections(0)
+		}
+	}()
+
+	var forwarders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			for j := 0; j < 100; j++ {
+				connection, err := connectionPool.GetConnection()
+				if err == ERR_RECONNECT_BACKOFF {
+					continue
+				} else if err != nil {
+					test.Errorf("Failed to get a connection: %s", err)
+					return
+				}
+
+				err = protocol.WriteMultibulk([][]byte{[]byte("SET"), []byte("a"), []byte("1")}, connection.Writer, true)
+				if err == nil {
+					_, _, err = connection.Reader.ReadLine()
+				}
+				if err != nil {
+					test.Errorf("Failed to forward a command: %s", err)
+				}
+				connectionPool.RecycleRemoteConnection(connection)
+			}
+		}()
+	}
+
+	forwarders.Wait()
+	close(done)
+	checks.Wait()
+}
@@ -28,13 +28,27 @@ package connection
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/salesforce/rmux/metrics"
+	"github.com/salesforce/rmux/protocol"
 	"github.com/salesforce/rmux/writer"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
+//The options for a connection whose connect, read and write timeouts are all the given one
+func withTimeouts(timeout time.Duration) []Option {
+	return []Option{WithConnectTimeout(timeout), WithReadTimeout(timeout), WithWriteTimeout(timeout)}
+}
+
 func verifySelectDatabaseSuccess(test *testing.T, database int) {
 	testSocket := "/tmp/rmuxConnectionTest"
 	listenSock, err := net.Listen("unix", testSocket)
@@ -42,7 +56,7 @@ func verifySelectDatabaseSuccess(test *testing.T, database int) {
 		test.Fatal("Failed to listen on test socket ", testSocket)
 	}
 	defer listenSock.Close()
-	testConnection := NewConnection("unix", testSocket, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
 	testConnection.ReconnectIfNecessary()
 
 	//read buffer does't matter
@@ -58,7 +72,7 @@ func verifySelectDatabaseSuccess(test *testing.T, database int) {
 		test.Fatalf("Error when selecting database: %s", err)
 	}
 
-	expectedWrite := []byte(fmt.Sprintf("select %d\r\n", database))
+	expectedWrite := []byte(fmt.Sprintf("*2\r\n$6\r\nselect\r\n$%d\r\n%d\r\n", len(strconv.Itoa(database)), database))
 	if !bytes.Equal(expectedWrite, w.Bytes()) {
 		test.Fatalf("Select statement was not written to output buffer got:%q expected:%q", w.Bytes(), expectedWrite)
 	}
@@ -77,7 +91,7 @@ func verifySelectDatabaseError(test *testing.T, database int) {
 	defer func() {
 		listenSock.Close()
 	}()
-	testConnection := NewConnection("unix", testSocket, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
 	testConnection.ReconnectIfNecessary()
 	//read buffer does't matter
 	readBuf := bufio.NewReader(bytes.NewBufferString("+NOPE\r\n"))
@@ -88,7 +102,7 @@ func verifySelectDatabaseError(test *testing.T, database int) {
 	testConnection.Writer = writer.NewFlexibleWriter(w)
 	err = testConnection.SelectDatabase(database)
 
-	expectedWrite := []byte(fmt.Sprintf("select %d\r\n", database))
+	expectedWrite := []byte(fmt.Sprintf("*2\r\n$6\r\nselect\r\n$%d\r\n%d\r\n", len(strconv.Itoa(database)), database))
 	if !bytes.Equal(expectedWrite, w.Bytes()) {
 		test.Fatal("Select statement was not written to output buffer", w.Bytes(), expectedWrite)
 	}
@@ -106,7 +120,7 @@ func verifySelectDatabaseTimeout(test *testing.T, database int) {
 	}
 	defer listenSock.Close()
 
-	testConnection := NewConnection("unix", testSocket, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
 	if err := testConnection.ReconnectIfNecessary(); err != nil {
 		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
 	}
@@ -117,7 +131,7 @@ func verifySelectDatabaseTimeout(test *testing.T, database int) {
 	testConnection.Writer = writer.NewFlexibleWriter(w)
 	err = testConnection.SelectDatabase(database)
 
-	expectedWrite := []byte(fmt.Sprintf("select %d\r\n", database))
+	expectedWrite := []byte(fmt.Sprintf("*2\r\n$6\r\nselect\r\n$%d\r\n%d\r\n", len(strconv.Itoa(database)), database))
 	if !bytes.Equal(expectedWrite, w.Bytes()) {
 		test.Fatalf("Select statement was not written to output buffer Got(%q) Expected(%q)", w.Bytes(), expectedWrite)
 	}
@@ -127,6 +141,449 @@ func verifySelectDatabaseTimeout(test *testing.T, database int) {
 	}
 }
 
+func TestSelectDatabaseElided(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
+	testConnection.ReconnectIfNecessary()
+
+	w := new(bytes.Buffer)
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	testConnection.Writer = writer.NewFlexibleWriter(w)
+
+	if err := testConnection.SelectDatabase(3); err != nil {
+		test.Fatalf("Error when selecting database: %s", err)
+	}
+
+	// The second select has no response to read, so it would fail if it went to the server
+	w.Reset()
+	if err := testConnection.SelectDatabase(3); err != nil {
+		test.Fatalf("Selecting the current database should be a no-op, got: %s", err)
+	}
+
+	if w.Len() != 0 {
+		test.Fatalf("Selecting the current database should not write anything, got: %q", w.Bytes())
+	}
+
+	// After a reconnect, nothing has confirmed the database, so the select has to go to the server
+	// (The test server doesn't answer, so the reconnect isn't left to select database 3 again itself)
+	testConnection.Disconnect(DISCONNECT_RECONNECT)
+	testConnection.desiredDatabaseId = 0
+	testConnection.ReconnectIfNecessary()
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	testConnection.Writer = writer.NewFlexibleWriter(w)
+
+	if err := testConnection.SelectDatabase(0); err != nil {
+		test.Fatalf("Error when selecting database: %s", err)
+	}
+
+	if !bytes.Equal(w.Bytes(), []byte("*2\r\n$6\r\nselect\r\n$1\r\n0\r\n")) {
+		test.Fatalf("Select after a reconnect was not written, got: %q", w.Bytes())
+	}
+}
+
+func TestHandleReset(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
+	testConnection.ReconnectIfNecessary()
+
+	w := new(bytes.Buffer)
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	testConnection.Writer = writer.NewFlexibleWriter(w)
+
+	if err := testConnection.SelectDatabase(3); err != nil {
+		test.Fatalf("Error when selecting database: %s", err)
+	}
+
+	// RESET selected database 0 on the server, so selecting it again is a no-op
+	w.Reset()
+	if err := testConnection.HandleReset(); err != nil {
+		test.Fatalf("Error when handling a reset: %s", err)
+	}
+	if testConnection.DatabaseId != 0 {
+		test.Fatalf("Expected database 0 after a reset, got %d", testConnection.DatabaseId)
+	}
+	if err := testConnection.SelectDatabase(0); err != nil || w.Len() != 0 {
+		test.Fatalf("Selecting database 0 after a reset should be a no-op, got %v, %q", err, w.Bytes())
+	}
+
+	// With credentials, the reset connection is authenticated again
+	testConnection.authPassword = "secret"
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	if err := testConnection.HandleReset(); err != nil {
+		test.Fatalf("Error when handling a reset: %s", err)
+	}
+	if !bytes.Equal(w.Bytes(), []byte("*2\r\n$4\r\nauth\r\n$6\r\nsecret\r\n")) {
+		test.Fatalf("Expected AUTH to be sent again after a reset, got %q", w.Bytes())
+	}
+}
+
+func TestReselectOnReconnect(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	received := make(chan string, 10)
+	var refused sync.Map
+	refused.Store("select 99", true)
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				reader := bufio.NewReader(fd)
+				for {
+					line, err := readMultibulkLine(reader)
+					if err != nil {
+						return
+					}
+					received <- line
+					if _, ok := refused.Load(line); ok {
+						fd.Write([]byte("-ERR DB index is out of range\r\n"))
+					} else {
+						fd.Write([]byte("+OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := testConnection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error connecting: %s", err)
+	}
+	defer testConnection.Disconnect(DISCONNECT_RECONNECT)
+	if err := testConnection.SelectDatabase(5); err != nil {
+		test.Fatalf("Error selecting the database: %s", err)
+	}
+	<-received
+
+	// A blip loses the confirmed database, but not the desired one
+	testConnection.Disconnect(DISCONNECT_RECONNECT)
+	if testConnection.DatabaseId != 0 || testConnection.DesiredDatabaseId() != 5 {
+		test.Fatalf("Expected database 0 while disconnected, with 5 desired, got %d and %d", testConnection.DatabaseId, testConnection.DesiredDatabaseId())
+	}
+
+	if err := testConnection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error reconnecting: %s", err)
+	}
+	if command := <-received; command != "select 5" {
+		test.Fatalf("Expected the reconnect to select database 5 again, got %q", command)
+	}
+	if testConnection.DatabaseId != 5 {
+		test.Fatalf("Expected database 5 after reconnecting, got %d", testConnection.DatabaseId)
+	}
+
+	// A database the server refuses isn't selected again on reconnect
+	if err := testConnection.SelectDatabase(99); err == nil {
+		test.Fatal("Expected selecting database 99 to fail")
+	}
+	<-received
+	if testConnection.DesiredDatabaseId() != 5 {
+		test.Fatalf("Expected database 5 to stay desired after a refused select, got %d", testConnection.DesiredDatabaseId())
+	}
+	if err := testConnection.ReconnectIfNecessary(); err != nil || testConnection.DatabaseId != 5 {
+		test.Fatalf("Expected to reconnect to database 5, got %v and %d", err, testConnection.DatabaseId)
+	}
+	<-received
+
+	// After a RESET, the server is on database 0, and so is every later connection
+	testConnection.HandleReset()
+	testConnection.Disconnect(DISCONNECT_RECONNECT)
+	if err := testConnection.ReconnectIfNecessary(); err != nil || testConnection.DatabaseId != 0 {
+		test.Fatalf("Expected to reconnect to database 0 after a reset, got %v and %d", err, testConnection.DatabaseId)
+	}
+	select {
+	case command := <-received:
+		test.Fatalf("Expected nothing to be selected after a reset, got %q", command)
+	default:
+	}
+
+	// A database the server starts refusing (ex: after a failover) fails one reconnect, not every later one
+	if err := testConnection.SelectDatabase(7); err != nil {
+		test.Fatalf("Error selecting database 7: %s", err)
+	}
+	<-received
+	refused.Store("select 7", true)
+	testConnection.Disconnect(DISCONNECT_RECONNECT)
+	if err := testConnection.ReconnectIfNecessary(); err == nil {
+		test.Fatal("Expected the reconnect to fail when the server refuses database 7")
+	}
+	<-received
+	if testConnection.DesiredDatabaseId() != 0 {
+		test.Fatalf("Expected the refused database to be forgotten, got %d desired", testConnection.DesiredDatabaseId())
+	}
+	// Skip the backoff after the failed reconnect
+	testConnection.nextRetryAt = time.Time{}
+	if err := testConnection.ReconnectIfNecessary(); err != nil || testConnection.DatabaseId != 0 {
+		test.Fatalf("Expected to reconnect to database 0, got %v and %d", err, testConnection.DatabaseId)
+	}
+	select {
+	case command := <-received:
+		test.Fatalf("Expected nothing to be selected after the refusal, got %q", command)
+	default:
+	}
+}
+
+//Writes through to its writer until limit bytes have been written, then fails, as a socket that breaks mid-command
+type failingWriter struct {
+	io.ReadWriter
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ReadWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, syscall.EPIPE
+	}
+	w.limit -= len(p)
+	return w.ReadWriter.Write(p)
+}
+
+func TestPoisonedOnFailedWrite(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- fd
+		}
+	}()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := testConnection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error connecting: %s", err)
+	}
+	defer testConnection.Disconnect(DISCONNECT_RECONNECT)
+	first := <-accepted
+	defer first.Close()
+
+	// Only the start of the multibulk gets through
+	testConnection.Writer = writer.NewFlexibleWriter(&countingReadWriter{&failingWriter{testConnection.readWriter, 8}, testConnection.counters, &testConnection.poisoned})
+	command := [][]byte{[]byte("set"), []byte("key"), []byte("value")}
+	if err := protocol.WriteMultibulk(command, testConnection.Writer, true); err == nil {
+		test.Fatal("Expected the write to fail")
+	}
+	if !testConnection.Poisoned() || testConnection.IsConnected() {
+		test.Fatal("Expected a failed write to poison the connection")
+	}
+
+	// The socket is still open, but isn't reused
+	if err := testConnection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error reconnecting: %s", err)
+	}
+	select {
+	case second := <-accepted:
+		defer second.Close()
+	case <-time.After(time.Second):
+		test.Fatal("Expected a poisoned connection to be replaced by a fresh one")
+	}
+	if testConnection.Poisoned() || !testConnection.IsConnected() {
+		test.Fatal("Expected the fresh connection to be usable")
+	}
+}
+
+func TestResync(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- fd
+		}
+	}()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := testConnection.Resync(0); !errors.Is(err, ERR_RESYNC_FAILED) {
+		test.Errorf("Expected a disconnected connection not to resync, got %v", err)
+	}
+	if err := testConnection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error connecting: %s", err)
+	}
+	defer testConnection.Disconnect(DISCONNECT_RECONNECT)
+	fd := <-accepted
+	defer fd.Close()
+
+	fd.Write([]byte("$10\r\nhelloworld\r\n+OK\r\n"))
+
+	// The reply is abandoned after the start of its payload
+	line, _, err := testConnection.Reader.ReadLine()
+	if err != nil || string(line) != "$10" {
+		test.Fatalf("Expected the bulk header, got %q, %v", line, err)
+	}
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(testConnection.Reader, payload); err != nil {
+		test.Fatalf("Error reading the start of the payload: %s", err)
+	}
+
+	if err := testConnection.Resync(7); err != nil {
+		test.Fatalf("Expected the connection to resync, got %s", err)
+	}
+	if line, _, err := testConnection.Reader.ReadLine(); err != nil || string(line) != "+OK" {
+		test.Fatalf("Expected the next reply after resyncing, got %q, %v", line, err)
+	}
+	if !testConnection.IsConnected() {
+		test.Fatal("Expected the connection to still be up after resyncing")
+	}
+
+	// Discarding too little leaves it part way through the payload, which doesn't start a reply
+	fd.Write([]byte("$10\r\nhelloworld\r\n+OK\r\n"))
+	testConnection.Reader.ReadLine()
+	if err := testConnection.Resync(5); !errors.Is(err, ERR_RESYNC_FAILED) {
+		test.Errorf("Expected a misaligned resync to fail, got %v", err)
+	}
+	if testConnection.IsConnected() {
+		test.Error("Expected a failed resync to disconnect")
+	}
+}
+
+func TestHandshakeErrorsReported(test *testing.T) {
+	testConnection := NewConnection("unix", "/tmp/rmuxConnectionTest", withTimeouts(10*time.Millisecond)...)
+	testConnection.authPassword = "secret"
+
+	testData := []struct {
+		reply    string
+		expected string
+	}{
+		{"-WRONGPASS invalid username-password pair or user is disabled.\r\n", "invalid authentication response: WRONGPASS invalid username-password pair or user is disabled."},
+		// Without a trailing newline, as one hardened server sends it before closing
+		{"-ERR invalid password", "invalid authentication response: ERR invalid password"},
+		// The password echoed back isn't repeated
+		{"-ERR unknown command 'AUTH', with args beginning with: 'secret' \r\n", "invalid authentication response: ERR unknown command 'AUTH'"},
+		{"+NOPE\r\n", `invalid authentication response: unexpected reply "+NOPE"`},
+		// Longer than the reader's buffer
+		{"-ERR " + strings.Repeat("x", 5000) + "\r\n", "invalid authentication response: ERR " + strings.Repeat("x", 5000)},
+	}
+
+	for _, d := range testData {
+		testConnection.Reader = bufio.NewReader(bytes.NewBufferString(d.reply))
+		testConnection.Writer = writer.NewFlexibleWriter(new(bytes.Buffer))
+
+		err := testConnection.authenticate()
+		if !errors.Is(err, ERR_INVALID_AUTH_RESPONSE) || err.Error() != d.expected {
+			test.Errorf("Expected %q for %q, got %v", d.expected, d.reply, err)
+		}
+	}
+
+	testConnection.authPassword = ""
+	testConnection.connection, _ = net.Pipe()
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("-ERR DB index is out of range\r\n"))
+	testConnection.Writer = writer.NewFlexibleWriter(new(bytes.Buffer))
+
+	err := testConnection.SelectDatabase(99)
+	if expected := "invalid select response: ERR DB index is out of range"; !errors.Is(err, ERR_INVALID_SELECT_RESPONSE) || err.Error() != expected {
+		test.Errorf("Expected %q, got %v", expected, err)
+	}
+}
+
+func TestTrackTransaction(test *testing.T) {
+	testCases := []struct {
+		commands      []string
+		inMulti       bool
+		inTransaction bool
+	}{
+		{[]string{"get"}, false, false},
+		{[]string{"multi"}, true, true},
+		{[]string{"multi", "set"}, true, true},
+		{[]string{"multi", "exec"}, false, false},
+		{[]string{"multi", "discard"}, false, false},
+		{[]string{"watch"}, false, true},
+		{[]string{"watch", "unwatch"}, false, false},
+		{[]string{"watch", "multi", "unwatch"}, true, true},
+		{[]string{"watch", "multi", "exec"}, false, false},
+	}
+
+	for _, testCase := range testCases {
+		testConnection := NewConnection("unix", "/tmp/rmuxConnectionTest", withTimeouts(10*time.Millisecond)...)
+		for _, command := range testCase.commands {
+			testConnection.TrackTransaction([]byte(command))
+		}
+
+		if testConnection.InMulti() != testCase.inMulti || testConnection.InTransaction() != testCase.inTransaction {
+			test.Errorf("Expected InMulti %t and InTransaction %t after %v, got %t and %t", testCase.inMulti,
+				testCase.inTransaction, testCase.commands, testConnection.InMulti(), testConnection.InTransaction())
+		}
+	}
+}
+
+func TestSelectDatabaseInTransaction(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
+	testConnection.ReconnectIfNecessary()
+
+	w := new(bytes.Buffer)
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	testConnection.Writer = writer.NewFlexibleWriter(w)
+
+	if err := testConnection.SelectDatabase(1); err != nil {
+		test.Fatalf("Error when selecting database: %s", err)
+	}
+
+	// Nothing may be injected into an open MULTI, though re-selecting the current database is still a no-op
+	w.Reset()
+	testConnection.TrackTransaction(protocol.MULTI_COMMAND)
+	if err := testConnection.SelectDatabase(1); err != nil {
+		test.Fatalf("Re-selecting the current database in a transaction should be a no-op, got %s", err)
+	}
+	if err := testConnection.SelectDatabase(2); err != ERR_IN_TRANSACTION {
+		test.Fatalf("Expected selecting inside a transaction to be refused, got %v", err)
+	}
+	if err := testConnection.Hello(protocol.RESP3); err != ERR_IN_TRANSACTION {
+		test.Fatalf("Expected HELLO inside a transaction to be refused, got %v", err)
+	}
+	if w.Len() != 0 {
+		test.Fatalf("Expected nothing to be written inside a transaction, got %q", w.Bytes())
+	}
+
+	// The transaction ends with the underlying connection
+	testConnection.Disconnect(DISCONNECT_RECONNECT)
+	if testConnection.InTransaction() {
+		test.Fatal("Expected the transaction to end with the connection")
+	}
+}
+
 func TestSelectDatabase(test *testing.T) {
 	verifySelectDatabaseSuccess(test, 0)
 	verifySelectDatabaseSuccess(test, 1)
@@ -149,13 +606,13 @@ func TestNewUnixConnection(test *testing.T) {
 	}
 	defer listenSock.Close()
 
-	connection := NewConnection("unix", testSocket, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	connection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
 	connection.ReconnectIfNecessary()
 	if connection == nil || connection.connection == nil {
 		test.Fatal("Connection initialization returned nil, binding to unix endpoint failed")
 	}
 
-	connection = NewConnection("unix", "/tmp/thisdoesnotexist", 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	connection = NewConnection("unix", "/tmp/thisdoesnotexist", withTimeouts(10*time.Millisecond)...)
 	connection.ReconnectIfNecessary()
 	if connection != nil && connection.connection != nil {
 		test.Fatal("Connection initialization success, binding to fake unix endpoint succeeded????")
@@ -170,14 +627,14 @@ func TestNewTcpConnection(test *testing.T) {
 	}
 	defer listenSock.Close()
 
-	connection := NewConnection("tcp", testEndpoint, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	connection := NewConnection("tcp", testEndpoint, withTimeouts(10*time.Millisecond)...)
 	connection.ReconnectIfNecessary()
 	if connection == nil || connection.connection == nil {
 		test.Fatal("Connection initialization returned nil, binding to tcp endpoint failed")
 	}
 
 	//reserved sock should have nothing on it
-	connection = NewConnection("tcp", "localhost:49151", 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	connection = NewConnection("tcp", "localhost:49151", withTimeouts(10*time.Millisecond)...)
 	connection.ReconnectIfNecessary()
 	if connection != nil && connection.connection != nil {
 		test.Fatal("Connection initialization success, binding to fake tcp endpoint succeeded????")
@@ -194,7 +651,7 @@ func TestCheckConnection(test *testing.T) {
 		listenSock.Close()
 	}()
 
-	connection := NewConnection("unix", testSocket, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
 	connection.ReconnectIfNecessary()
 	if connection == nil {
 		test.Fatal("Connection initialization returned nil, binding to unix endpoint failed")
@@ -205,8 +662,8 @@ func TestCheckConnection(test *testing.T) {
 		test.Fatal("Failed to accept connection")
 	}
 
-	// Buffering responses, one valid, one not
-	if _, err := fd.Write([]byte("+PONG\r\nPONG")); err != nil {
+	// Buffering responses, two valid (one with trailing whitespace), one not
+	if _, err := fd.Write([]byte("+PONG\r\n+PONG \r\nPONG")); err != nil {
 		test.Fatalf("Failed to write to buffer: %s", err)
 	}
 
@@ -214,6 +671,10 @@ func TestCheckConnection(test *testing.T) {
 		test.Fatal("Valid connection's check connection failed")
 	}
 
+	if !connection.CheckConnection() {
+		test.Fatal("Check connection failed on a PONG with trailing whitespace")
+	}
+
 	if connection.CheckConnection() {
 		test.Fatal("Invalid connection's check connection succeeded")
 	}
@@ -222,3 +683,901 @@ func TestCheckConnection(test *testing.T) {
 		test.Fatal("Timing-out connection's check connection succeeded")
 	}
 }
+
+func TestCheckConnectionProbeTimeout(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	// A bulk-tuned read timeout shouldn't hold up a health probe against a server that never answers
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(5*time.Second),
+		WithWriteTimeout(100*time.Millisecond),
+		WithProbeTimeout(20*time.Millisecond),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	fd, err := listenSock.Accept()
+	if err != nil {
+		test.Fatal("Failed to accept connection")
+	}
+	defer fd.Close()
+
+	readWriter := connection.readWriter
+	start := time.Now()
+	if connection.CheckConnection() {
+		test.Fatal("A server that never answers should fail the check")
+	}
+
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		test.Fatalf("The check should have given up after the probe timeout, but took %s", elapsed)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("A failed check should disconnect")
+	}
+
+	if readWriter.ReadTimeout != 5*time.Second {
+		test.Fatalf("The read timeout should be restored after the probe, got %s", readWriter.ReadTimeout)
+	}
+}
+
+func TestDisconnectDuringCheckConnection(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	// Answers every PING, on every connection, until the listener closes
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				buffer := make([]byte, 64)
+				for {
+					if _, err := fd.Read(buffer); err != nil {
+						return
+					}
+					fd.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	for i := 0; i < 50; i++ {
+		if err := connection.ReconnectIfNecessary(); err != nil {
+			test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			connection.CheckConnection()
+		}()
+		// Its owner reconnecting, as a disconnect may have happened already
+		go func() {
+			defer wg.Done()
+			connection.ReconnectIfNecessary()
+		}()
+		go func() {
+			defer wg.Done()
+			connection.IsConnected()
+		}()
+		go func() {
+			defer wg.Done()
+			connection.Disconnect(DISCONNECT_RECONNECT)
+			connection.Disconnect(DISCONNECT_RECONNECT)
+		}()
+		wg.Wait()
+
+		connection.Disconnect(DISCONNECT_RECONNECT)
+		if connection.connection != nil || connection.Reader != nil || connection.Writer != nil {
+			test.Fatal("Disconnect should leave the connection closed")
+		}
+	}
+}
+
+func TestExtendNextReadTimeout(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(20*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	fd, err := listenSock.Accept()
+	if err != nil {
+		test.Fatal("Failed to accept connection")
+	}
+	defer fd.Close()
+
+	// A reply slower than the read timeout arrives in time, once the next read is given longer
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fd.Write([]byte("+OK\r\n"))
+	}()
+	revert := connection.ExtendNextReadTimeout(time.Second)
+	if line, _, err := connection.Reader.ReadLine(); err != nil || string(line) != "+OK" {
+		test.Fatalf("Expected the extended read to succeed, got %q and %v", line, err)
+	}
+	revert()
+
+	// Only that read was extended
+	start := time.Now()
+	if _, err := connection.Reader.Peek(1); err == nil {
+		test.Fatal("Expected the following read to time out")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		test.Fatalf("Expected the following read to get the read timeout, but it took %s", elapsed)
+	}
+}
+
+func TestExtendNextReadTimeoutReverted(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(20*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	fd, err := listenSock.Accept()
+	if err != nil {
+		test.Fatal("Failed to accept connection")
+	}
+	defer fd.Close()
+
+	// An extension that no read used, ex: because the reply was already buffered, doesn't outlive its revert
+	connection.ExtendNextReadTimeout(time.Second)()
+
+	start := time.Now()
+	if _, err := connection.Reader.Peek(1); err == nil {
+		test.Fatal("Expected the read to time out")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		test.Fatalf("Expected the read to get the read timeout, but it took %s", elapsed)
+	}
+}
+
+func TestMeasureRTT(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	registry := metrics.NewPrometheusRegistry(nil)
+	metrics.SetSink(registry)
+	defer metrics.SetSink(nil)
+
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(5*time.Second),
+		WithWriteTimeout(100*time.Millisecond),
+		WithProbeTimeout(200*time.Millisecond),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	fd, err := listenSock.Accept()
+	if err != nil {
+		test.Fatal("Failed to accept connection")
+	}
+	defer fd.Close()
+
+	replies := []string{"+PONG\r\n", "-ERR not a pong\r\n"}
+	go func() {
+		buf := make([]byte, len("PING\r\n"))
+		for _, reply := range replies {
+			if _, err := io.ReadFull(fd, buf); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			fd.Write([]byte(reply))
+		}
+	}()
+
+	rtt, err := connection.MeasureRTT()
+	if err != nil || rtt < 10*time.Millisecond || rtt > time.Second {
+		test.Fatalf("Expected a round trip of at least 10ms, got %s, %v", rtt, err)
+	}
+	if !strings.Contains(string(registry.Expose()), "rmux_rtt__tmp_rmuxConnectionTest_seconds_count 1") {
+		test.Errorf("Expected the round trip to be recorded, got:\n%s", registry.Expose())
+	}
+
+	if _, err := connection.MeasureRTT(); err != ERR_UNEXPECTED_PONG {
+		test.Fatalf("Expected anything but a PONG to fail, got %v", err)
+	}
+	if connection.connection != nil {
+		test.Fatal("A failed measurement should disconnect")
+	}
+	if !strings.Contains(string(registry.Expose()), "rmux_disconnect_health_check_fail_total 1") {
+		test.Errorf("Expected the disconnect to be counted as a failed health check, got:\n%s", registry.Expose())
+	}
+	if _, err := connection.MeasureRTT(); err == nil {
+		test.Fatal("Measuring on a disconnected connection should fail")
+	}
+}
+
+func TestHello(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	testConnection := NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
+	testConnection.ReconnectIfNecessary()
+	if testConnection.ProtocolVersion() != protocol.RESP2 {
+		test.Fatalf("New connections should speak RESP2, got %d", testConnection.ProtocolVersion())
+	}
+
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("%2\r\n$6\r\nserver\r\n$5\r\nredis\r\n$5\r\nproto\r\n:3\r\n"))
+	w := new(bytes.Buffer)
+	testConnection.Writer = writer.NewFlexibleWriter(w)
+
+	if err := testConnection.Hello(protocol.RESP3); err != nil {
+		test.Fatalf("Error when negotiating RESP3: %s", err)
+	}
+
+	if !bytes.Equal([]byte("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n"), w.Bytes()) {
+		test.Fatalf("Hello statement was not written to output buffer got:%q", w.Bytes())
+	}
+
+	if testConnection.ProtocolVersion() != protocol.RESP3 {
+		test.Fatalf("Connection should have negotiated RESP3, got %d", testConnection.ProtocolVersion())
+	}
+
+	testConnection.Reader = bufio.NewReader(bytes.NewBufferString("-NOPROTO unsupported protocol version\r\n"))
+	if err := testConnection.Hello(protocol.RESP3); err == nil {
+		test.Fatal("Hello did not fail, even though an error reply was given")
+	}
+
+	if testConnection.ProtocolVersion() != protocol.RESP2 {
+		test.Fatalf("A refused hello should leave the connection disconnected on RESP2, got %d", testConnection.ProtocolVersion())
+	}
+}
+
+func TestIsConnectedKeepsPendingData(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	fd, err := listenSock.Accept()
+	if err != nil {
+		test.Fatal("Failed to accept connection")
+	}
+
+	if !connection.IsConnected() {
+		test.Fatal("An idle connection should be connected")
+	}
+
+	// A pub/sub message that arrives while nobody is reading
+	message := ">3\r\n$7\r\nmessage\r\n$7\r\nchannel\r\n$5\r\nhello\r\n"
+	if _, err := fd.Write([]byte(message)); err != nil {
+		test.Fatalf("Failed to write to buffer: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if !connection.IsConnected() {
+		test.Fatal("A connection with pending data should be connected")
+	}
+
+	received := make([]byte, len(message))
+	if _, err := io.ReadFull(connection.Reader, received); err != nil || string(received) != message {
+		test.Fatalf("Pending data was lost by the liveness probe. Got %q, %v", received, err)
+	}
+
+	fd.Close()
+	time.Sleep(10 * time.Millisecond)
+	if connection.IsConnected() {
+		test.Fatal("A closed connection should not be connected")
+	}
+}
+
+func TestReconnectWithContextCancelled(test *testing.T) {
+	// A server that accepts, but never answers a TLS handshake, so that connecting blocks
+	listenSock, err := net.Listen("tcp", "localhost:8889")
+	if err != nil {
+		test.Fatalf("Error listening on tcp sock: %s", err)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			if _, err := listenSock.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	connection := NewConnection("tcp+tls", "localhost:8889", WithConnectTimeout(5*time.Second), WithReadTimeout(10*time.Millisecond), WithWriteTimeout(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	if err := connection.ReconnectWithContext(ctx); err != context.Canceled {
+		test.Fatalf("Expected a cancelled dial to return context.Canceled, got %v", err)
+	}
+
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		test.Fatalf("Cancelling should abort the dial promptly, but it took %s", elapsed)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("A cancelled dial should leave the connection unset")
+	}
+}
+
+func TestReconnectBackoff(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(10*time.Millisecond),
+		WithReadTimeout(10*time.Millisecond),
+		WithWriteTimeout(10*time.Millisecond),
+		WithReconnectBackoff(20*time.Millisecond, 50*time.Millisecond),
+	)
+
+	// Nothing is listening yet
+	start := time.Now()
+	if err := connection.ReconnectIfNecessary(); err == nil || err == ERR_RECONNECT_BACKOFF {
+		test.Fatalf("Expected the first connect to fail dialing, got %v", err)
+	}
+
+	if wait := connection.NextRetryAt().Sub(start); wait < 10*time.Millisecond || wait > 30*time.Millisecond {
+		test.Fatalf("Expected the first backoff to be between 10ms and 20ms, got %s", wait)
+	}
+
+	if err := connection.ReconnectIfNecessary(); err != ERR_RECONNECT_BACKOFF {
+		test.Fatalf("Expected a reconnect during the backoff to be refused, got %v", err)
+	}
+
+	// Fail enough times to hit the cap
+	for i := 0; i < 4; i++ {
+		time.Sleep(connection.NextRetryAt().Sub(time.Now()))
+		connection.ReconnectIfNecessary()
+	}
+
+	if wait := connection.NextRetryAt().Sub(time.Now()); wait > 50*time.Millisecond {
+		test.Fatalf("Expected the backoff to be capped at 50ms, got %s", wait)
+	}
+
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	time.Sleep(connection.NextRetryAt().Sub(time.Now()))
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Expected a reconnect after the backoff to succeed, got %s", err)
+	}
+
+	if !connection.NextRetryAt().IsZero() {
+		test.Fatal("A successful connect should reset the backoff")
+	}
+}
+
+func getSocketOption(test *testing.T, connection net.Conn, level, option int) int {
+	rawConnection, err := connection.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		test.Fatalf("Could not get the raw connection: %s", err)
+	}
+
+	var value int
+	rawConnection.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	if err != nil {
+		test.Fatalf("Could not read socket option %d: %s", option, err)
+	}
+
+	return value
+}
+
+func TestTCPOptions(test *testing.T) {
+	testEndpoint := "localhost:8886"
+	listenSock, err := net.Listen("tcp", testEndpoint)
+	if err != nil {
+		test.Fatalf("Error listening on tcp sock %s. Error: %s", testEndpoint, err)
+	}
+	defer listenSock.Close()
+
+	connection := NewConnection("tcp", testEndpoint, withTimeouts(10*time.Millisecond)...)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Failed to connect: %s", err)
+	}
+
+	if getSocketOption(test, connection.connection, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		test.Error("Keepalive should be enabled by default")
+	}
+
+	if getSocketOption(test, connection.connection, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		test.Error("No-delay should be enabled by default")
+	}
+
+	connection = NewConnection("tcp", testEndpoint,
+		WithConnectTimeout(10*time.Millisecond),
+		WithReadTimeout(10*time.Millisecond),
+		WithWriteTimeout(10*time.Millisecond),
+		WithTCPOptions(0, false),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Failed to connect: %s", err)
+	}
+
+	if getSocketOption(test, connection.connection, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		test.Error("Keepalive should have been disabled")
+	}
+
+	if getSocketOption(test, connection.connection, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		test.Error("No-delay should have been disabled")
+	}
+
+	// Unix sockets skip the tcp options
+	testSocket := "/tmp/rmuxConnectionTest"
+	unixSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer unixSock.Close()
+
+	connection = NewConnection("unix", testSocket, withTimeouts(10*time.Millisecond)...)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Failed to connect over a unix socket: %s", err)
+	}
+}
+
+func TestGracefulDisconnect(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		fd, err := listenSock.Accept()
+		if err != nil {
+			return
+		}
+		line, _, _ := bufio.NewReader(fd).ReadLine()
+		received <- string(line)
+		fd.Write([]byte("+OK\r\n"))
+	}()
+
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	connection.GracefulDisconnect(DISCONNECT_DRAIN)
+	if line := <-received; line != "quit" {
+		test.Errorf("Expected the server to receive quit, got %q", line)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("The connection should be closed after a graceful disconnect")
+	}
+
+	// A server that never acknowledges should still be closed promptly
+	go listenSock.Accept()
+	connection = NewConnection("unix", testSocket, WithConnectTimeout(100*time.Millisecond), WithReadTimeout(5*time.Second), WithWriteTimeout(5*time.Second))
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	start := time.Now()
+	connection.GracefulDisconnect(DISCONNECT_DRAIN)
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		test.Errorf("An unacknowledged QUIT should fall back to a hard close, but it took %s", elapsed)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("The connection should be closed after an unacknowledged graceful disconnect")
+	}
+
+	// Disconnected connections are left alone
+	connection.GracefulDisconnect(DISCONNECT_DRAIN)
+}
+
+func verifyAuth(test *testing.T, user, password, response string, expectedCommand string, expectSuccess bool) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		fd, err := listenSock.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		buf := make([]byte, len(expectedCommand))
+		n, _ := io.ReadFull(fd, buf)
+		received <- string(buf[:n])
+		fd.Write([]byte(response))
+	}()
+
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(100*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+		WithAuth(user, password),
+	)
+	err = connection.ReconnectIfNecessary()
+
+	if command := <-received; command != expectedCommand {
+		test.Errorf("Expected AUTH to be sent as %q, got %q", expectedCommand, command)
+	}
+
+	if expectSuccess {
+		if err != nil {
+			test.Fatalf("Expected authentication to succeed, got %s", err)
+		}
+		if connection.connection == nil {
+			test.Fatal("An authenticated connection should stay open")
+		}
+		if connection.Reader.Buffered() != 0 {
+			test.Fatal("The whole auth response should have been consumed")
+		}
+	} else {
+		if err == nil {
+			test.Fatal("Expected authentication to fail")
+		}
+		if connection.connection != nil {
+			test.Fatal("A connection that failed authentication should be closed")
+		}
+	}
+}
+
+func TestWithAuth(test *testing.T) {
+	verifyAuth(test, "", "s3cret", "+OK\r\n", "*2\r\n$4\r\nauth\r\n$6\r\ns3cret\r\n", true)
+	verifyAuth(test, "rmux", "pass word", "+OK\r\n", "*3\r\n$4\r\nauth\r\n$4\r\nrmux\r\n$9\r\npass word\r\n", true)
+	// ACL passwords may hold any bytes, which an inline AUTH would split or cut short
+	verifyAuth(test, "rmux", "a b\rc\r\nd\x00", "+OK\r\n", "*3\r\n$4\r\nauth\r\n$4\r\nrmux\r\n$9\r\na b\rc\r\nd\x00\r\n", true)
+	verifyAuth(test, "", "wrong", "-WRONGPASS invalid password\r\n", "*2\r\n$4\r\nauth\r\n$5\r\nwrong\r\n", false)
+	verifyAuth(test, "", "wrong", "-NOAUTH HELLO must be called with the client already authenticated\r\n", "*2\r\n$4\r\nauth\r\n$5\r\nwrong\r\n", false)
+	// A RESP3 server may reply with a HELLO-style map, which has to be consumed in full
+	verifyAuth(test, "", "s3cret", "%2\r\n$6\r\nserver\r\n$5\r\nredis\r\n$5\r\nproto\r\n:3\r\n", "*2\r\n$4\r\nauth\r\n$6\r\ns3cret\r\n", true)
+}
+
+func TestUpdateCredentials(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	oldAuth := "*2\r\n$4\r\nauth\r\n$3\r\nold\r\n"
+	newAuth := "*3\r\n$4\r\nauth\r\n$4\r\nrmux\r\n$3\r\nnew\r\n"
+	received := make(chan string, 2)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		fd, err := listenSock.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		for _, expected := range []string{oldAuth, newAuth} {
+			buf := make([]byte, len(expected))
+			n, _ := io.ReadFull(fd, buf)
+			received <- string(buf[:n])
+			fd.Write([]byte("+OK\r\n"))
+		}
+		<-done
+	}()
+
+	connection := NewConnection("unix", testSocket,
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(100*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+		WithAuth("", "old"),
+	)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Expected authentication to succeed, got %s", err)
+	}
+	if auth := <-received; auth != oldAuth {
+		test.Fatalf("Expected AUTH to be sent as %q, got %q", oldAuth, auth)
+	}
+
+	// The live connection is re-authenticated, rather than reconnected: the server only accepts the one connection
+	connection.UpdateCredentials("rmux", "new")
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Expected authentication with the new credentials to succeed, got %s", err)
+	}
+	if auth := <-received; auth != newAuth {
+		test.Fatalf("Expected AUTH to be sent as %q, got %q", newAuth, auth)
+	}
+	if !connection.IsConnected() {
+		test.Fatal("The connection should stay open after re-authenticating")
+	}
+}
+
+func TestWithClientName(test *testing.T) {
+	setName := "*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$6\r\nrmux-0\r\n"
+
+	// An older server that refuses CLIENT still gets connected to
+	for _, response := range []string{"+OK\r\n", "-ERR unknown command 'CLIENT'\r\n"} {
+		testSocket := "/tmp/rmuxConnectionTest"
+		listenSock, err := net.Listen("unix", testSocket)
+		if err != nil {
+			test.Fatal("Failed to listen on test socket ", testSocket)
+		}
+
+		received := make(chan string, 1)
+		done := make(chan bool)
+		go func() {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			defer fd.Close()
+
+			buf := make([]byte, len(setName))
+			n, _ := io.ReadFull(fd, buf)
+			received <- string(buf[:n])
+			fd.Write([]byte(response))
+			<-done
+		}()
+
+		connection := NewConnection("unix", testSocket,
+			WithConnectTimeout(100*time.Millisecond),
+			WithReadTimeout(100*time.Millisecond),
+			WithWriteTimeout(100*time.Millisecond),
+			WithClientName("rmux-0"),
+		)
+		err = connection.ReconnectIfNecessary()
+
+		if command := <-received; command != setName {
+			test.Errorf("Expected CLIENT SETNAME to be sent as %q, got %q", setName, command)
+		}
+		if err != nil || !connection.IsConnected() {
+			test.Errorf("Expected to stay connected after %q, got %v", response, err)
+		}
+
+		close(done)
+		connection.Disconnect(DISCONNECT_RECONNECT)
+		listenSock.Close()
+	}
+}
+
+type capturingLogger struct {
+	errors []string
+	infos  []string
+}
+
+func (l *capturingLogger) Debugf(format string, a ...interface{}) {}
+func (l *capturingLogger) Infof(format string, a ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, a...))
+}
+func (l *capturingLogger) Warnf(format string, a ...interface{})  {}
+func (l *capturingLogger) Errorf(format string, a ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, a...))
+}
+
+func TestWithLogger(test *testing.T) {
+	logger := &capturingLogger{}
+	connection := NewConnection("unix", "/tmp/rmuxConnectionTest", WithLogger(logger))
+
+	if err := connection.SelectDatabase(1); err == nil {
+		test.Fatal("Selecting on a disconnected connection should fail")
+	}
+
+	if len(logger.errors) != 1 || !strings.HasPrefix(logger.errors[0], "SelectDatabase:") {
+		test.Fatalf("Expected the select error to go to the injected logger, got %q", logger.errors)
+	}
+}
+
+func TestCheckConnections(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	// The first two servers are slow to PONG, the third never does
+	go func() {
+		for i := 0; i < 3; i++ {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func(fd net.Conn, answer bool) {
+				bufio.NewReader(fd).ReadLine()
+				if answer {
+					time.Sleep(50 * time.Millisecond)
+					fd.Write([]byte("+PONG\r\n"))
+				}
+			}(fd, i < 2)
+		}
+	}()
+
+	connections := make([]*Connection, 4)
+	for i := 0; i < 3; i++ {
+		connections[i] = NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+		if err := connections[i].ReconnectIfNecessary(); err != nil {
+			test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+		}
+	}
+	// Never connected
+	connections[3] = NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+
+	start := time.Now()
+	results := CheckConnections(connections, 150*time.Millisecond)
+	elapsed := time.Now().Sub(start)
+
+	expected := []bool{true, true, false, false}
+	for i := range expected {
+		if results[i] != expected[i] {
+			test.Errorf("Expected connection %d's check to be %t, got %t", i, expected[i], results[i])
+		}
+	}
+
+	// Checked one after another, this would take at least 250ms
+	if elapsed > 240*time.Millisecond {
+		test.Errorf("The sweep should be bounded by its timeout, but took %s", elapsed)
+	}
+
+	if connections[2].connection != nil {
+		test.Error("A connection that didn't PONG in time should be disconnected")
+	}
+}
+
+func TestPipeline(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	commands := [][]byte{
+		[]byte("*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"),
+		[]byte("*2\r\n$4\r\nincr\r\n$1\r\nb\r\n"),
+		[]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"),
+	}
+	expectedWrite := string(bytes.Join(commands, nil))
+
+	received := make(chan string, 1)
+	go func() {
+		fd, err := listenSock.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		buf := make([]byte, len(expectedWrite))
+		n, _ := io.ReadFull(fd, buf)
+		received <- string(buf[:n])
+		// The last reply is cut off, as if the server went away mid-stream
+		fd.Write([]byte("+OK\r\n-ERR value is not an integer\r\n$1\r\n"))
+	}()
+
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect to testSocket %s: %s", testSocket, err)
+	}
+
+	replies, err := connection.Pipeline(commands)
+	if written := <-received; written != expectedWrite {
+		test.Fatalf("Expected every command to be written, got %q", written)
+	}
+
+	if len(replies) != 2 || replies[0].Kind != protocol.REPLY_SIMPLE_STRING || replies[1].Kind != protocol.REPLY_ERROR {
+		test.Fatalf("Expected an OK and an error reply before the failure, got %+v", replies)
+	}
+
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Index != 2 {
+		test.Fatalf("Expected the failure to be attributed to command 2, got %v", err)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("A failed pipeline should disconnect")
+	}
+}
+
+func TestResolvedAddr(test *testing.T) {
+	// Only listen on IPv4, so that if localhost also resolves to ::1, that address has to be skipped
+	listenSock, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Error listening on tcp sock. Error: %s", err)
+	}
+	defer listenSock.Close()
+
+	_, port, _ := net.SplitHostPort(listenSock.Addr().String())
+	connection := NewConnection("tcp", net.JoinHostPort("localhost", port), WithConnectTimeout(time.Second))
+	if connection.ResolvedAddr() != "" {
+		test.Fatalf("Expected no resolved address before dialing, got %s", connection.ResolvedAddr())
+	}
+
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error connecting to localhost:%s. Error: %s", port, err)
+	}
+	defer connection.Disconnect(DISCONNECT_RECONNECT)
+
+	if connection.ResolvedAddr() != listenSock.Addr().String() {
+		test.Fatalf("Expected to have dialed %s, dialed %s", listenSock.Addr(), connection.ResolvedAddr())
+	}
+}
+
+//Reads a multibulk command, and returns its arguments joined by spaces, like the inline form of the command
+func readMultibulkLine(reader *bufio.Reader) (string, error) {
+	header, _, err := reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	count, err := protocol.ParseInt(header[1:])
+	if err != nil {
+		return "", err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		// Skips the bulk header, whose length the test's arguments don't need
+		if _, _, err := reader.ReadLine(); err != nil {
+			return "", err
+		}
+		arg, _, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		args[i] = string(arg)
+	}
+	return strings.Join(args, " "), nil
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generates a self-signed certificate for localhost, for use in tests
+func generateTestCertificate(test *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		test.Fatalf("Failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		test.Fatalf("Failed to create certificate: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		test.Fatalf("Failed to parse certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestWithTLS(test *testing.T) {
+	certificate, roots := generateTestCertificate(test)
+
+	serverNames := make(chan string, 2)
+	listenSock, err := tls.Listen("tcp", "localhost:8887", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		test.Fatalf("Error listening on tls sock: %s", err)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 16)
+				fd.Read(buf)
+				fd.Write([]byte("+PONG\r\n"))
+			}()
+		}
+	}()
+
+	connection := NewConnection("tcp", "localhost:8887", WithTLS(&tls.Config{RootCAs: roots}), WithConnectTimeout(500*time.Millisecond),
+		WithReadTimeout(500*time.Millisecond), WithWriteTimeout(500*time.Millisecond))
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Failed to connect over TLS: %s", err)
+	}
+
+	if serverName := <-serverNames; serverName != "localhost" {
+		test.Errorf("SNI should default to the endpoint host, got %q", serverName)
+	}
+
+	if !connection.CheckConnection() {
+		test.Fatal("Failed to PING over TLS")
+	}
+
+	// SNI can be overridden, at which point verification against our localhost certificate fails
+	connection = NewConnection("tcp", "localhost:8887", WithTLS(&tls.Config{RootCAs: roots, ServerName: "redis.example.com"}),
+		WithConnectTimeout(500*time.Millisecond), WithReadTimeout(500*time.Millisecond), WithWriteTimeout(500*time.Millisecond))
+	if err := connection.ReconnectIfNecessary(); err == nil {
+		test.Fatal("Connection should have failed verification for an overridden server name")
+	}
+
+	if serverName := <-serverNames; serverName != "redis.example.com" {
+		test.Errorf("SNI should have been overridden, got %q", serverName)
+	}
+
+	if connection.connection != nil {
+		test.Fatal("A failed handshake should leave the connection unset")
+	}
+}
+
+func TestTLSHandshakeTimeout(test *testing.T) {
+	// A plaintext server that never answers the handshake
+	listenSock, err := net.Listen("tcp", "localhost:8888")
+	if err != nil {
+		test.Fatalf("Error listening on tcp sock: %s", err)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			if _, err := listenSock.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	connection := NewConnection("tcp+tls", "localhost:8888", withTimeouts(50*time.Millisecond)...)
+
+	start := time.Now()
+	if err := connection.ReconnectIfNecessary(); err == nil {
+		test.Fatal("Connection should have failed its handshake")
+	}
+
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		test.Errorf("The connect timeout should cover the handshake, but it took %s", elapsed)
+	}
+}
+
+// Writes the certificate and its key to PEM files, as LoadClientCertificate reads them
+func writeTestCertificate(test *testing.T, certificate tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		test.Fatalf("Failed to marshal key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		test.Fatalf("Failed to write certificate: %s", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		test.Fatalf("Failed to write key: %s", err)
+	}
+}
+
+func TestClientCertificate(test *testing.T) {
+	certificate, roots := generateTestCertificate(test)
+
+	// The server only trusts client certificates signed by its own
+	listenSock, err := tls.Listen("tcp", "localhost:8886", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	if err != nil {
+		test.Fatalf("Error listening on tls sock: %s", err)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				buf := make([]byte, 64)
+				if _, err := fd.Read(buf); err == nil {
+					fd.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	dir := test.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(test, certificate, certFile, keyFile)
+	clientCertificate, err := LoadClientCertificate(certFile, keyFile)
+	if err != nil {
+		test.Fatalf("Failed to load the client certificate: %s", err)
+	}
+
+	// AUTH makes the connect read from the server, which is where a TLS 1.3 server's refusal shows up
+	connect := func(tlsConfig *tls.Config, certificate *ClientCertificate) error {
+		connection := NewConnection("tcp+tls", "localhost:8886",
+			WithConnectTimeout(500*time.Millisecond),
+			WithReadTimeout(500*time.Millisecond),
+			WithWriteTimeout(500*time.Millisecond),
+			WithTLS(tlsConfig),
+			WithClientCertificate(certificate),
+			WithAuth("", "secret"),
+		)
+		defer connection.Disconnect(DISCONNECT_RECONNECT)
+		return connection.ReconnectIfNecessary()
+	}
+
+	if err := connect(&tls.Config{RootCAs: roots}, clientCertificate); err != nil {
+		test.Fatalf("Failed to connect with a client certificate: %s", err)
+	}
+
+	for _, maxVersion := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		err := connect(&tls.Config{RootCAs: roots, MaxVersion: maxVersion}, nil)
+		if !errors.Is(err, ERR_CLIENT_CERTIFICATE_REJECTED) {
+			test.Errorf("Expected the missing client certificate to be rejected under %x, got %v", maxVersion, err)
+		}
+	}
+
+	// A reloaded certificate is presented from the next connect, and this one isn't trusted
+	untrusted, _ := generateTestCertificate(test)
+	writeTestCertificate(test, untrusted, certFile, keyFile)
+	if err := clientCertificate.Reload(); err != nil {
+		test.Fatalf("Failed to reload the client certificate: %s", err)
+	}
+	if err := connect(&tls.Config{RootCAs: roots}, clientCertificate); !errors.Is(err, ERR_CLIENT_CERTIFICATE_REJECTED) {
+		test.Errorf("Expected the reloaded certificate to be rejected, got %v", err)
+	}
+
+	// A failed reload keeps the current certificate
+	os.Remove(keyFile)
+	if err := clientCertificate.Reload(); err == nil {
+		test.Fatal("Expected a reload without a key to fail")
+	}
+	if current, _ := clientCertificate.GetClientCertificate(nil); !bytes.Equal(current.Certificate[0], untrusted.Certificate[0]) {
+		test.Error("Expected a failed reload to keep the current certificate")
+	}
+}
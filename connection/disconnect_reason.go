@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"errors"
+	"github.com/salesforce/rmux/protocol"
+	"io"
+	"net"
+)
+
+//Why a connection was disconnected, as logged and counted by Disconnect
+type DisconnectReason int
+
+const (
+	//A health probe (ex: CheckConnection, MeasureRTT) got no PONG, or the wrong reply, in time
+	DISCONNECT_HEALTH_CHECK_FAIL DisconnectReason = iota
+	//The server sent something that can't be framed or doesn't answer what was sent, so the stream can't be trusted
+	DISCONNECT_PROTOCOL_ERROR
+	//A read from or write to the server failed, ex: the server closed the connection
+	DISCONNECT_IO_ERROR
+	//A read from or write to the server timed out
+	DISCONNECT_TIMEOUT
+	//The server refused or garbled the connection's setup: AUTH, CLIENT SETNAME, SELECT or HELLO
+	DISCONNECT_HANDSHAKE_FAIL
+	//Dropped so that it can be reconnected from scratch
+	DISCONNECT_RECONNECT
+	//The server is no longer the master, so the connection is dropped to reconnect to the new one
+	DISCONNECT_FAILOVER
+	//The client went away, or couldn't be written to, part way through a reply or with a transaction open
+	DISCONNECT_CLIENT
+	//The connection's pool is draining
+	DISCONNECT_DRAIN
+	//The connection sat in its pool for longer than the idle limit
+	DISCONNECT_IDLE_REAP
+	//A client's transaction sent CLIENT subcommands on it, which may have named it or set its flags.  It's reconnected
+	//from scratch, so that they don't carry over to whichever client uses it next
+	DISCONNECT_CLIENT_STATE
+)
+
+//The names of the reasons, as logged, and counted as "disconnect.<name>"
+var disconnectReasonNames = []string{
+	DISCONNECT_HEALTH_CHECK_FAIL: "health_check_fail",
+	DISCONNECT_PROTOCOL_ERROR:    "protocol_error",
+	DISCONNECT_IO_ERROR:          "io_error",
+	DISCONNECT_TIMEOUT:           "timeout",
+	DISCONNECT_HANDSHAKE_FAIL:    "handshake_fail",
+	DISCONNECT_RECONNECT:         "reconnect",
+	DISCONNECT_FAILOVER:          "failover",
+	DISCONNECT_CLIENT:            "client",
+	DISCONNECT_DRAIN:             "drain",
+	DISCONNECT_IDLE_REAP:         "idle_reap",
+	DISCONNECT_CLIENT_STATE:      "client_state",
+}
+
+func (reason DisconnectReason) String() string {
+	if reason < 0 || int(reason) >= len(disconnectReasonNames) {
+		return "unknown"
+	}
+	return disconnectReasonNames[reason]
+}
+
+//Returns the reason to disconnect for, after the given error from talking to the server
+//Failures to write to the client are DISCONNECT_CLIENT, timeouts are DISCONNECT_TIMEOUT, and other network failures
+//are DISCONNECT_IO_ERROR.  Anything else means the stream couldn't be made sense of, so is DISCONNECT_PROTOCOL_ERROR
+func DisconnectReasonOf(err error) DisconnectReason {
+	var clientWriteError *protocol.ClientWriteError
+	if errors.As(err, &clientWriteError) {
+		return DISCONNECT_CLIENT
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		if netError.Timeout() {
+			return DISCONNECT_TIMEOUT
+		}
+		return DISCONNECT_IO_ERROR
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return DISCONNECT_IO_ERROR
+	}
+	return DISCONNECT_PROTOCOL_ERROR
+}
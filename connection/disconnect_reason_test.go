@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"github.com/salesforce/rmux/protocol"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDisconnectReasonOf(test *testing.T) {
+	testData := []struct {
+		err      error
+		expected DisconnectReason
+	}{
+		{&protocol.ClientWriteError{Err: os.ErrDeadlineExceeded}, DISCONNECT_CLIENT},
+		{&protocol.BackendReadError{Err: os.ErrDeadlineExceeded}, DISCONNECT_TIMEOUT},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, DISCONNECT_IO_ERROR},
+		{&protocol.BackendReadError{Err: io.EOF}, DISCONNECT_IO_ERROR},
+		{fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), DISCONNECT_IO_ERROR},
+		{&PipelineError{0, net.ErrClosed}, DISCONNECT_IO_ERROR},
+		{&protocol.BackendReadError{Err: errors.New("Unexpected reply")}, DISCONNECT_PROTOCOL_ERROR},
+	}
+
+	for _, d := range testData {
+		if reason := DisconnectReasonOf(d.err); reason != d.expected {
+			test.Errorf("Expected %s for %v, got %s", d.expected, d.err, reason)
+		}
+	}
+}
+
+func TestDisconnectLogsReason(test *testing.T) {
+	logger := &capturingLogger{}
+	connection := NewConnection("unix", "/tmp/rmuxConnectionTest", WithLogger(logger))
+	connection.connection, _ = net.Pipe()
+
+	connection.Disconnect(DISCONNECT_IDLE_REAP)
+	connection.Disconnect(DISCONNECT_DRAIN)
+
+	// Only the disconnect that closed anything is logged
+	if len(logger.infos) != 1 || !strings.HasSuffix(logger.infos[0], "Reason:idle_reap") {
+		test.Fatalf("Expected one disconnect logged with its reason, got %q", logger.infos)
+	}
+
+	if reason := DisconnectReason(-1).String(); reason != "unknown" {
+		test.Errorf("Expected an out of range reason to be unknown, got %q", reason)
+	}
+}
@@ -26,6 +26,7 @@
 package connection
 
 import (
+	"bytes"
 	"errors"
 //	. "github.com/salesforce/rmux/log"
 	"github.com/salesforce/rmux/protocol"
@@ -44,6 +45,8 @@ type HashRing struct {
 	DefaultConnectionPool *ConnectionPool
 	// Whether to failover to next pool when the desired one is down
 	Failover bool
+	// If set, cluster -MOVED/-ASK redirects are followed to these nodes, rather than returned to the client
+	ClusterNodes *ClusterNodes
 }
 
 func NewHashRing(connectionPools []*ConnectionPool, failover bool) (newHashRing *HashRing, err error) {
@@ -107,17 +110,26 @@ func (myHashRing *HashRing) setBitMask(prime int) {
 
 //Gets the connectionKey, for a to-be-multiplexed command
 //Uses the bernstein hash, which is one of the fastest key-distribution algorithms out there
+//Commands are routed by their first argument, except for scripts, which are routed by the keys they declare,
+//introspection subcommands (ex: OBJECT ENCODING), which are routed by the key after the subcommand, and WATCH, which
+//is routed by every key it watches.  Those must all hash to the same pool, or ERR_KEYS_SPAN_BACKENDS is
+//returned
 func (myHashRing *HashRing) GetConnectionPool(command protocol.Command) (connectionPool *ConnectionPool, err error) {
 	var hash uint32 = 0
-	if command.GetArgCount() > 0 {
-		//The bernstein hash is one of the faster key-distribution algorithms out there, for small character keys
-		//An alternate (but slower) algorithm would be to use go's built-in hash/fnv, if this proves insufficient
-		for _, char := range command.GetFirstArg() {
-			hash = hash<<5 + hash + uint32(char)
+	if protocol.IsEvalFunction(command.GetCommand()) {
+		if hash, err = myHashRing.getEvalHash(command); err != nil {
+			return nil, err
 		}
+	} else if bytes.Equal(command.GetCommand(), protocol.WATCH_COMMAND) {
+		if hash, err = myHashRing.getKeysHash(protocol.GetWatchKeys(command)); err != nil {
+			return nil, err
+		}
+	} else if key, ok := protocol.GetIntrospectionKey(command); ok {
+		hash = myHashRing.hashKey(key)
+	} else if command.GetArgCount() > 0 {
+		hash = myHashRing.hashKey(command.GetFirstArg())
 	}
 
-	hash = myHashRing.BitMask & hash
 	targetHash := hash
 	connectionPool = myHashRing.ConnectionPools[hash]
 
@@ -142,3 +154,40 @@ func (myHashRing *HashRing) GetConnectionPool(command protocol.Command) (connect
 		return connectionPool, nil
 	}
 }
+
+//Returns the hash of the keys that the given script declares, once they've been checked to all hash to the same pool
+//A script without keys may run anywhere, so it gets the hash of an empty key
+func (myHashRing *HashRing) getEvalHash(command protocol.Command) (hash uint32, err error) {
+	keys, err := protocol.GetEvalKeys(command)
+	if err != nil {
+		return 0, err
+	}
+
+	return myHashRing.getKeysHash(keys)
+}
+
+//Returns the hash of the first of the given keys, once they've been checked to all hash to the same pool
+func (myHashRing *HashRing) getKeysHash(keys [][]byte) (hash uint32, err error) {
+	for i, key := range keys {
+		keyHash := myHashRing.hashKey(key)
+		if i == 0 {
+			hash = keyHash
+		} else if myHashRing.ConnectionPools[keyHash] != myHashRing.ConnectionPools[hash] {
+			return 0, protocol.ERR_KEYS_SPAN_BACKENDS
+		}
+	}
+
+	return hash, nil
+}
+
+//Returns the position on the ring of the given key
+func (myHashRing *HashRing) hashKey(key []byte) uint32 {
+	//The bernstein hash is one of the faster key-distribution algorithms out there, for small character keys
+	//An alternate (but slower) algorithm would be to use go's built-in hash/fnv, if this proves insufficient
+	var hash uint32 = 0
+	for _, char := range key {
+		hash = hash<<5 + hash + uint32(char)
+	}
+
+	return myHashRing.BitMask & hash
+}
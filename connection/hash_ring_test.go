@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"github.com/salesforce/rmux/protocol"
+	"testing"
+	"time"
+)
+
+func TestGetConnectionPoolForEval(test *testing.T) {
+	pools := make([]*ConnectionPool, 3)
+	for i := range pools {
+		pools[i] = NewConnectionPool("unix", "/tmp/rmuxHashRingTest", 0, time.Millisecond, time.Millisecond, time.Millisecond)
+		pools[i].SetIsConnected(true)
+	}
+	hashRing, err := NewHashRing(pools, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	parse := func(request string) protocol.Command {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", request, err)
+		}
+		return command
+	}
+
+	// Find two keys that live in different pools
+	keyA, keyB := "a", ""
+	for _, key := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		if hashRing.ConnectionPools[hashRing.hashKey([]byte(key))] != hashRing.ConnectionPools[hashRing.hashKey([]byte(keyA))] {
+			keyB = key
+			break
+		}
+	}
+	if keyB == "" {
+		test.Fatal("Expected some keys to hash to different pools")
+	}
+
+	// A script goes where its key does, not where its script body would
+	expected, _ := hashRing.GetConnectionPool(parse("*2\r\n$3\r\nget\r\n$1\r\n" + keyA + "\r\n"))
+	pool, err := hashRing.GetConnectionPool(parse("*4\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n1\r\n$1\r\n" + keyA + "\r\n"))
+	if err != nil || pool != expected {
+		test.Errorf("Expected the script to be routed by its key, got %v", err)
+	}
+
+	// Repeating a key keeps it on one backend
+	if _, err := hashRing.GetConnectionPool(parse("*5\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n2\r\n$1\r\n" + keyA + "\r\n$1\r\n" + keyA + "\r\n")); err != nil {
+		test.Errorf("Expected keys on the same backend to be routed, got %v", err)
+	}
+
+	if _, err := hashRing.GetConnectionPool(parse("*5\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n2\r\n$1\r\n" + keyA + "\r\n$1\r\n" + keyB + "\r\n")); err != protocol.ERR_KEYS_SPAN_BACKENDS {
+		test.Errorf("Expected keys on different backends to be refused, got %v", err)
+	}
+
+	// Arguments after the keys aren't routed on
+	if _, err := hashRing.GetConnectionPool(parse("*5\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n1\r\n$1\r\n" + keyA + "\r\n$1\r\n" + keyB + "\r\n")); err != nil {
+		test.Errorf("Expected a script's other arguments to be ignored, got %v", err)
+	}
+
+	// So does a function
+	pool, err = hashRing.GetConnectionPool(parse("*4\r\n$5\r\nfcall\r\n$6\r\nmyfunc\r\n$1\r\n1\r\n$1\r\n" + keyA + "\r\n"))
+	if err != nil || pool != expected {
+		test.Errorf("Expected the function to be routed by its key, got %v", err)
+	}
+
+	if _, err := hashRing.GetConnectionPool(parse("*3\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n5\r\n")); err != protocol.ERR_BAD_ARGUMENTS {
+		test.Errorf("Expected a bad numkeys to be refused, got %v", err)
+	}
+}
+
+func TestGetConnectionPoolForWatch(test *testing.T) {
+	pools := make([]*ConnectionPool, 3)
+	for i := range pools {
+		pools[i] = NewConnectionPool("unix", "/tmp/rmuxHashRingTest", 0, time.Millisecond, time.Millisecond, time.Millisecond)
+		pools[i].SetIsConnected(true)
+	}
+	hashRing, err := NewHashRing(pools, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	parse := func(request string) protocol.Command {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", request, err)
+		}
+		return command
+	}
+
+	keyA, keyB := "a", ""
+	for _, key := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		if hashRing.ConnectionPools[hashRing.hashKey([]byte(key))] != hashRing.ConnectionPools[hashRing.hashKey([]byte(keyA))] {
+			keyB = key
+			break
+		}
+	}
+	if keyB == "" {
+		test.Fatal("Expected some keys to hash to different pools")
+	}
+
+	expected, _ := hashRing.GetConnectionPool(parse("*2\r\n$3\r\nget\r\n$1\r\n" + keyA + "\r\n"))
+	pool, err := hashRing.GetConnectionPool(parse("*3\r\n$5\r\nwatch\r\n$1\r\n" + keyA + "\r\n$1\r\n" + keyA + "\r\n"))
+	if err != nil || pool != expected {
+		test.Errorf("Expected the watch to be routed by its keys, got %v", err)
+	}
+
+	// Every watched key is checked, not only the first
+	if _, err := hashRing.GetConnectionPool(parse("*3\r\n$5\r\nwatch\r\n$1\r\n" + keyA + "\r\n$1\r\n" + keyB + "\r\n")); err != protocol.ERR_KEYS_SPAN_BACKENDS {
+		test.Errorf("Expected keys on different backends to be refused, got %v", err)
+	}
+}
+
+func TestGetConnectionPoolForIntrospection(test *testing.T) {
+	pools := make([]*ConnectionPool, 3)
+	for i := range pools {
+		pools[i] = NewConnectionPool("unix", "/tmp/rmuxHashRingTest", 0, time.Millisecond, time.Millisecond, time.Millisecond)
+		pools[i].SetIsConnected(true)
+	}
+	hashRing, err := NewHashRing(pools, false)
+	if err != nil {
+		test.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	parse := func(request string) protocol.Command {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", request, err)
+		}
+		return command
+	}
+
+	// Find a key that doesn't live in the subcommand's pool
+	key := ""
+	for _, candidate := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if hashRing.ConnectionPools[hashRing.hashKey([]byte(candidate))] != hashRing.ConnectionPools[hashRing.hashKey([]byte("encoding"))] {
+			key = candidate
+			break
+		}
+	}
+	if key == "" {
+		test.Fatal("Expected some keys to hash to a different pool than the subcommand")
+	}
+
+	expected, _ := hashRing.GetConnectionPool(parse("*2\r\n$3\r\nget\r\n$1\r\n" + key + "\r\n"))
+	pool, err := hashRing.GetConnectionPool(parse("*3\r\n$6\r\nobject\r\n$8\r\nencoding\r\n$1\r\n" + key + "\r\n"))
+	if err != nil || pool != expected {
+		test.Errorf("Expected the introspection to be routed by its key, got %v", err)
+	}
+}
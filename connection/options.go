@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"crypto/tls"
+	. "github.com/salesforce/rmux/log"
+	"net"
+	"time"
+)
+
+//Configures a Connection as it is constructed, see NewConnection
+type Option func(*Connection)
+
+//Sets how long a dial (including any TLS handshake) may take
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.connectTimeout = timeout
+	}
+}
+
+//Sets the deadline applied to each read from the redis server
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.readTimeout = timeout
+	}
+}
+
+//Sets the deadline applied to each write to the redis server
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.writeTimeout = timeout
+	}
+}
+
+//Wraps the connection in TLS, using the given configuration
+//The server name defaults to the endpoint's host, unless it is set on the tlsConfig
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(c *Connection) {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		c.tlsConfig = tlsConfig
+	}
+}
+
+//Presents the given client certificate to TLS servers that require mutual TLS, on top of the TLS configuration
+//Reloading the certificate takes effect from the next connect
+func WithClientCertificate(certificate *ClientCertificate) Option {
+	return func(c *Connection) {
+		c.clientCertificate = certificate
+	}
+}
+
+//Sends AUTH with the given credentials on every new connection
+//An empty user sends the single-argument AUTH understood by servers without ACLs
+func WithAuth(user, password string) Option {
+	return func(c *Connection) {
+		c.authUser = user
+		c.authPassword = password
+	}
+}
+
+//Sets the TCP options applied to newly dialed connections.  A keepAlivePeriod of 0 disables keepalives
+//These are ignored for unix sockets
+func WithTCPOptions(keepAlivePeriod time.Duration, noDelay bool) Option {
+	return func(c *Connection) {
+		c.keepAlivePeriod = keepAlivePeriod
+		c.noDelay = noDelay
+	}
+}
+
+//Sets the backoff between failed connects.  The delay starts at base, and doubles (with jitter) up to cap
+//A base of 0 disables the backoff
+func WithReconnectBackoff(base, cap time.Duration) Option {
+	return func(c *Connection) {
+		c.backoffBase = base
+		c.backoffCap = cap
+	}
+}
+
+//Sends this connection's logs to the given logger, rather than the global rmux/log
+func WithLogger(logger Logger) Option {
+	return func(c *Connection) {
+		if logger == nil {
+			logger = GlobalLogger
+		}
+		c.logger = logger
+	}
+}
+
+//Sets how long CheckConnection waits for a PONG, regardless of the read timeout.  Defaults to DEFAULT_PROBE_TIMEOUT
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.probeTimeout = timeout
+	}
+}
+
+//Resolves the endpoint through the given sentinels before every dial, so that reconnects follow a failover
+//The endpoint passed to the constructor is only used for logging until the first resolve
+func WithSentinel(resolver *SentinelResolver) Option {
+	return func(c *Connection) {
+		c.sentinel = resolver
+	}
+}
+
+//Names every new connection with CLIENT SETNAME, so that it can be told apart in the server's CLIENT LIST
+//The name can't contain spaces
+func WithClientName(name string) Option {
+	return func(c *Connection) {
+		c.clientName = name
+	}
+}
+
+//Looks up the endpoint's host with the given resolver before every tcp dial.  Defaults to net.DefaultResolver
+func WithResolver(resolver *net.Resolver) Option {
+	return func(c *Connection) {
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		c.resolver = resolver
+	}
+}
+
+//Calls the given hook around every command proxied over the connection, ex: to record tracing spans
+//A nil hook (the default) traces nothing, and costs nothing
+func WithTraceHook(hook TraceHook) Option {
+	return func(c *Connection) {
+		c.traceHook = hook
+	}
+}
+
+//Waits for a turn from the given limiter before each connect, so that only so many connections connect to the same
+//endpoint at once.  Limiters are usually shared between every pool
+func WithConnectLimiter(limiter *ConnectLimiter) Option {
+	return func(c *Connection) {
+		c.connectLimiter = limiter
+	}
+}
+
+//Trips the connection for the given cool-down once threshold replies in a row have failed: they couldn't be read, or
+//said the server can't serve commands for now, see RecordReply.  Pools don't hand out tripped connections.  A threshold of 0 (the default) never trips
+func WithCircuitBreaker(threshold int, coolDown time.Duration) Option {
+	return func(c *Connection) {
+		c.tripThreshold = threshold
+		c.tripCoolDown = coolDown
+	}
+}
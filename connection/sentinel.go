@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/salesforce/rmux/log"
+	"github.com/salesforce/rmux/protocol"
+	. "github.com/salesforce/rmux/writer"
+	"net"
+	"time"
+)
+
+var (
+	SENTINEL_COMMAND        = []byte("sentinel")
+	GET_MASTER_ADDR_COMMAND = []byte("get-master-addr-by-name")
+)
+
+//Returned when no sentinel could tell us where the master is
+var ERR_NO_MASTER = errors.New("No sentinel knows the master's address")
+
+//Resolves the current address of a sentinel-monitored master, via SENTINEL get-master-addr-by-name
+type SentinelResolver struct {
+	//The sentinels to ask, in order, ex: "10.0.0.1:26379"
+	Sentinels []string
+	//The name that the sentinels monitor the master under
+	MasterName string
+	//How long each sentinel gets to connect and answer
+	Timeout time.Duration
+}
+
+func NewSentinelResolver(sentinels []string, masterName string, timeout time.Duration) *SentinelResolver {
+	return &SentinelResolver{sentinels, masterName, timeout}
+}
+
+//Asks each sentinel in turn for the master's address, and returns the first answer, as a host:port endpoint
+func (this *SentinelResolver) Resolve(ctx context.Context) (endpoint string, err error) {
+	for _, sentinel := range this.Sentinels {
+		endpoint, err = this.askSentinel(ctx, sentinel)
+		if err == nil {
+			return endpoint, nil
+		}
+		Warn("Could not resolve master %s from sentinel %s: %s", this.MasterName, sentinel, err)
+
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+
+	return "", ERR_NO_MASTER
+}
+
+func (this *SentinelResolver) askSentinel(ctx context.Context, sentinel string) (endpoint string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, this.Timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	args := [][]byte{SENTINEL_COMMAND, GET_MASTER_ADDR_COMMAND, []byte(this.MasterName)}
+	if err = protocol.WriteMultibulk(args, NewFlexibleWriter(conn), true); err != nil {
+		return "", err
+	}
+
+	reply, err := protocol.ParseReply(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+
+	// A null reply means this sentinel doesn't monitor a master by that name
+	if reply.Kind != protocol.REPLY_ARRAY || len(reply.Elements) != 2 ||
+		reply.Elements[0].Kind != protocol.REPLY_BULK_STRING || reply.Elements[1].Kind != protocol.REPLY_BULK_STRING {
+		return "", fmt.Errorf("Unexpected reply for master %s", this.MasterName)
+	}
+
+	return net.JoinHostPort(string(reply.Elements[0].Value), string(reply.Elements[1].Value)), nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Answers every get-master-addr-by-name on the listener with the address the master channel currently holds
+func serveSentinel(test *testing.T, listener net.Listener, master chan string) {
+	request := "*3\r\n$8\r\nsentinel\r\n$23\r\nget-master-addr-by-name\r\n$8\r\nmymaster\r\n"
+	go func() {
+		for {
+			fd, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			buf := make([]byte, len(request))
+			if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != request {
+				test.Errorf("Unexpected sentinel request %q", buf)
+			}
+
+			host, port, _ := net.SplitHostPort(<-master)
+			fmt.Fprintf(fd, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+			fd.Close()
+		}
+	}()
+}
+
+func TestSentinelResolver(test *testing.T) {
+	sentinel, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer sentinel.Close()
+
+	firstMaster, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer firstMaster.Close()
+
+	secondMaster, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer secondMaster.Close()
+
+	master := make(chan string, 2)
+	master <- firstMaster.Addr().String()
+	master <- secondMaster.Addr().String()
+	serveSentinel(test, sentinel, master)
+
+	// A sentinel that's down is skipped
+	deadSentinel, _ := net.Listen("tcp", "localhost:0")
+	deadSentinel.Close()
+
+	resolver := NewSentinelResolver([]string{deadSentinel.Addr().String(), sentinel.Addr().String()}, "mymaster", 100*time.Millisecond)
+	connection := NewConnection("tcp", "sentinel:mymaster",
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(100*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+		WithSentinel(resolver),
+	)
+
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not connect through sentinel: %s", err)
+	}
+
+	if connection.endpoint != firstMaster.Addr().String() {
+		test.Fatalf("Expected to connect to the first master %s, got %s", firstMaster.Addr(), connection.endpoint)
+	}
+
+	// After a failover, the next reconnect asks sentinel again
+	connection.Disconnect(DISCONNECT_RECONNECT)
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Could not reconnect through sentinel: %s", err)
+	}
+
+	if connection.endpoint != secondMaster.Addr().String() {
+		test.Fatalf("Expected to reconnect to the new master %s, got %s", secondMaster.Addr(), connection.endpoint)
+	}
+
+	resolver.Sentinels = []string{deadSentinel.Addr().String()}
+	if _, err := resolver.Resolve(context.Background()); err != ERR_NO_MASTER {
+		test.Fatalf("Expected ERR_NO_MASTER when no sentinel answers, got %v", err)
+	}
+}
+
+//Stats is called from other goroutines, ex: the INFO and stats endpoints, while the connection's owner reconnects to
+//whichever master sentinel reports.  Run with -race
+func TestStatsDuringSentinelReconnect(test *testing.T) {
+	sentinel, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		test.Fatalf("Failed to listen: %s", err)
+	}
+	defer sentinel.Close()
+
+	masters := make([]net.Listener, 2)
+	for i := range masters {
+		if masters[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			test.Fatalf("Failed to listen: %s", err)
+		}
+		defer masters[i].Close()
+	}
+
+	// The race detector only sees the goroutines overlap if they can run in parallel
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	const reconnects = 10
+	master := make(chan string, reconnects)
+	for i := 0; i < reconnects; i++ {
+		master <- masters[i%2].Addr().String()
+	}
+	serveSentinel(test, sentinel, master)
+
+	resolver := NewSentinelResolver([]string{sentinel.Addr().String()}, "mymaster", 100*time.Millisecond)
+	connection := NewConnection("tcp", "sentinel:mymaster",
+		WithConnectTimeout(100*time.Millisecond),
+		WithReadTimeout(100*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+		WithSentinel(resolver),
+	)
+	defer connection.Disconnect(DISCONNECT_RECONNECT)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				connection.Stats()
+			}
+		}
+	}()
+
+	for i := 0; i < reconnects; i++ {
+		connection.Disconnect(DISCONNECT_RECONNECT)
+		if err := connection.ReconnectIfNecessary(); err != nil {
+			test.Fatalf("Could not reconnect through sentinel: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if endpoint := connection.Stats().Endpoint; endpoint != masters[(reconnects-1)%2].Addr().String() {
+		test.Fatalf("Expected stats for the last master %s, got %s", masters[(reconnects-1)%2].Addr(), endpoint)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	. "github.com/salesforce/rmux/writer"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//A snapshot of a connection's state and traffic, as returned by Connection.Stats
+type ConnectionStats struct {
+	Endpoint string
+	//The database that the connection has selected
+	DatabaseId int
+	//Whether the connection is established.  A connection that the server has dropped counts as connected until
+	//it is next used
+	Connected bool
+	//When bytes were last read from or written to the server.  Zero if they never have been
+	LastIO time.Time
+	//How many times the connection has been re-established, after its first connect
+	Reconnects uint64
+	//Bytes read from and written to the server, across every reconnect, since the last ResetTraffic
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+//The counters behind Stats.  They're only accessed atomically, so that Stats can be called while the connection is
+//in use.  The 64-bit fields come first, to keep them aligned for atomic access on 32-bit platforms
+type connectionCounters struct {
+	bytesRead    uint64
+	bytesWritten uint64
+	//What bytesRead and bytesWritten were at the last ResetTraffic.  Stats reports the traffic since then
+	bytesReadBase    uint64
+	bytesWrittenBase uint64
+	reconnects   uint64
+	lastIO       int64
+	//When a command was last written, or the connection was established
+	lastUsed   int64
+	databaseId int64
+	connected  int32
+	//The endpoint's current address, a string.  It changes when sentinel reports a new master
+	endpoint atomic.Value
+}
+
+//Counts the bytes that pass through a reader/writer, and records when they last did
+//A failed write sets poisoned, since part of a command may have reached the server (see Connection.Poisoned)
+type countingReadWriter struct {
+	readWriter io.ReadWriter
+	counters   *connectionCounters
+	poisoned   *int32
+}
+
+func (this *countingReadWriter) Read(p []byte) (n int, err error) {
+	n, err = this.readWriter.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&this.counters.bytesRead, uint64(n))
+		atomic.StoreInt64(&this.counters.lastIO, time.Now().UnixNano())
+	}
+	return
+}
+
+func (this *countingReadWriter) Write(p []byte) (n int, err error) {
+	n, err = this.readWriter.Write(p)
+	if err != nil {
+		atomic.StoreInt32(this.poisoned, 1)
+	}
+	if n > 0 {
+		now := time.Now().UnixNano()
+		atomic.AddUint64(&this.counters.bytesWritten, uint64(n))
+		atomic.StoreInt64(&this.counters.lastIO, now)
+		atomic.StoreInt64(&this.counters.lastUsed, now)
+	}
+	return
+}
+
+func (this *countingReadWriter) CanWriteVectored() bool {
+	return CanWriteVectored(this.readWriter)
+}
+
+func (this *countingReadWriter) WriteVectored(buffers *net.Buffers) (n int64, err error) {
+	n, err = WriteVectored(this.readWriter, buffers)
+	if err != nil {
+		atomic.StoreInt32(this.poisoned, 1)
+	}
+	if n > 0 {
+		now := time.Now().UnixNano()
+		atomic.AddUint64(&this.counters.bytesWritten, uint64(n))
+		atomic.StoreInt64(&this.counters.lastIO, now)
+		atomic.StoreInt64(&this.counters.lastUsed, now)
+	}
+	return
+}
+
+//Returns a snapshot of the connection's state and traffic.  Safe to call from any goroutine, even while the
+//connection is in use
+func (c *Connection) Stats() ConnectionStats {
+	stats := ConnectionStats{
+		Endpoint:     c.counters.endpoint.Load().(string),
+		DatabaseId:   int(atomic.LoadInt64(&c.counters.databaseId)),
+		Connected:    atomic.LoadInt32(&c.counters.connected) == 1,
+		Reconnects:   atomic.LoadUint64(&c.counters.reconnects),
+	}
+
+	// The bases are loaded first, since they can only ever be reset up to a count that has already been reached
+	readBase, writtenBase := atomic.LoadUint64(&c.counters.bytesReadBase), atomic.LoadUint64(&c.counters.bytesWrittenBase)
+	stats.BytesRead = atomic.LoadUint64(&c.counters.bytesRead) - readBase
+	stats.BytesWritten = atomic.LoadUint64(&c.counters.bytesWritten) - writtenBase
+
+	if lastIO := atomic.LoadInt64(&c.counters.lastIO); lastIO != 0 {
+		stats.LastIO = time.Unix(0, lastIO)
+	}
+
+	return stats
+}
+
+//Returns the bytes read from and written to the server since the last reset, and starts Stats counting them from zero
+//again.  Traffic reported by the connection's pool isn't affected.  Safe to call from any goroutine
+func (c *Connection) ResetTraffic() (bytesRead, bytesWritten uint64) {
+	read, written := atomic.LoadUint64(&c.counters.bytesRead), atomic.LoadUint64(&c.counters.bytesWritten)
+	bytesRead = read - atomic.SwapUint64(&c.counters.bytesReadBase, read)
+	bytesWritten = written - atomic.SwapUint64(&c.counters.bytesWrittenBase, written)
+	return
+}
+
+//Returns when a command was last written to the connection, or when it was established if nothing has been written
+//since.  Zero if it has never connected.  Safe to call from any goroutine
+func (c *Connection) LastUsed() time.Time {
+	if lastUsed := atomic.LoadInt64(&c.counters.lastUsed); lastUsed != 0 {
+		return time.Unix(0, lastUsed)
+	}
+	return time.Time{}
+}
+
+//Returns whether the connection has gone unused for longer than the given duration.  A connection that has never
+//connected isn't idle, since there's nothing to reap.  Safe to call from any goroutine
+func (c *Connection) IsIdleLongerThan(d time.Duration) bool {
+	lastUsed := c.LastUsed()
+	return !lastUsed.IsZero() && time.Now().Sub(lastUsed) > d
+}
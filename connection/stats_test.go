@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				buf := make([]byte, len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n"))
+				if _, err := io.ReadFull(fd, buf); err == nil {
+					fd.Write([]byte("+OK\r\n"))
+				}
+				io.Copy(ioutil.Discard, fd)
+			}()
+		}
+	}()
+
+	connection := NewConnection("unix", testSocket, withTimeouts(100*time.Millisecond)...)
+	if stats := connection.Stats(); stats.Connected || !stats.LastIO.IsZero() {
+		test.Fatalf("Expected a new connection to be disconnected, with no I/O, got %+v", stats)
+	}
+
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error connecting: %s", err)
+	}
+	if err := connection.SelectDatabase(2); err != nil {
+		test.Fatalf("Error selecting the database: %s", err)
+	}
+
+	stats := connection.Stats()
+	if !stats.Connected || stats.DatabaseId != 2 || stats.Reconnects != 0 || stats.Endpoint != testSocket {
+		test.Fatalf("Unexpected stats after selecting: %+v", stats)
+	}
+	if stats.BytesWritten != uint64(len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n")) || stats.BytesRead != uint64(len("+OK\r\n")) {
+		test.Fatalf("Expected the select to be counted, got %+v", stats)
+	}
+	if stats.LastIO.IsZero() {
+		test.Fatal("Expected the select to set the last I/O time")
+	}
+
+	connection.Disconnect(DISCONNECT_RECONNECT)
+	if stats := connection.Stats(); stats.Connected || stats.DatabaseId != 0 {
+		test.Fatalf("Expected a disconnected connection on database 0, got %+v", stats)
+	}
+
+	if err := connection.ReconnectIfNecessary(); err != nil {
+		test.Fatalf("Error reconnecting: %s", err)
+	}
+	defer connection.Disconnect(DISCONNECT_RECONNECT)
+	// The reconnect selects database 2 again
+	if stats := connection.Stats(); !stats.Connected || stats.Reconnects != 1 || stats.DatabaseId != 2 || stats.BytesWritten != uint64(2*len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n")) {
+		test.Fatalf("Expected the reconnect to be counted, and the traffic kept, got %+v", stats)
+	}
+
+	if read, written := connection.ResetTraffic(); read != uint64(2*len("+OK\r\n")) || written != uint64(2*len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n")) {
+		test.Fatalf("Expected the traffic so far from the reset, got %d read and %d written", read, written)
+	}
+	if stats := connection.Stats(); stats.BytesRead != 0 || stats.BytesWritten != 0 {
+		test.Fatalf("Expected the traffic to be counted from zero after a reset, got %+v", stats)
+	}
+	if read, written := connection.ResetTraffic(); read != 0 || written != 0 {
+		test.Fatalf("Expected no traffic since the last reset, got %d read and %d written", read, written)
+	}
+}
+
+func TestPoolTraffic(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatal("Failed to listen on test socket ", testSocket)
+	}
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				buf := make([]byte, len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n"))
+				for {
+					if _, err := io.ReadFull(fd, buf); err != nil {
+						return
+					}
+					fd.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	pool := NewConnectionPool("unix", testSocket, 2, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		connection, err := pool.GetConnection()
+		if err != nil {
+			test.Fatalf("Error getting a connection: %s", err)
+		}
+		defer connection.Disconnect(DISCONNECT_RECONNECT)
+
+		if err := connection.ReconnectIfNecessary(); err != nil {
+			test.Fatalf("Error connecting: %s", err)
+		}
+		if err := connection.SelectDatabase(2); err != nil {
+			test.Fatalf("Error selecting the database: %s", err)
+		}
+
+		// Resetting a connection's traffic doesn't take it out of the pool's
+		connection.ResetTraffic()
+	}
+
+	if read, written := pool.Traffic(); read != 2*uint64(len("+OK\r\n")) || written != 2*uint64(len("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n")) {
+		test.Fatalf("Expected both connections' traffic, got %d read and %d written", read, written)
+	}
+}
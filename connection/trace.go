@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"context"
+	"github.com/salesforce/rmux/protocol"
+	"sync/atomic"
+	"time"
+)
+
+//Called around every command that is proxied over a connection, ex: to record a tracing span for it
+//OnCommandStart is called before the command is written, and OnCommandEnd once its reply has been copied to the
+//client, or the round trip failed.  Pipelined commands share a round trip, so they're started and ended together
+//Both are called on the client's goroutine, in the middle of its request, so they should be quick
+type TraceHook interface {
+	OnCommandStart(span *TraceSpan)
+	OnCommandEnd(span *TraceSpan, err error)
+}
+
+//A command being proxied over a connection, as passed to a TraceHook
+type TraceSpan struct {
+	//Starts out as context.Background().  OnCommandStart may replace it, ex: with a context carrying its own span,
+	//to pick back up in OnCommandEnd
+	Context context.Context
+	//The lowercased command, as returned by protocol.GetCommand.  Only valid until OnCommandEnd returns
+	Command []byte
+	//The address that the connection is dialed to, or its configured endpoint if it hasn't been resolved
+	Endpoint string
+	//The database the command runs against
+	DatabaseId int
+	Start time.Time
+	//The size of the command, and of its reply.  BytesRead is only known by OnCommandEnd
+	BytesWritten int
+	BytesRead int
+}
+
+//Returns the hook that this connection's commands are traced with, or nil if they aren't
+func (c *Connection) TraceHook() TraceHook {
+	return c.traceHook
+}
+
+//Calls the connection's TraceHook's OnCommandStart for each of the given commands, which are about to be written
+//Returns their spans, to be passed to EndTrace, or nil if the connection has no TraceHook
+func (c *Connection) StartTrace(commands []protocol.Command) (spans []*TraceSpan) {
+	if c.traceHook == nil {
+		return nil
+	}
+
+	endpoint := c.resolvedAddr
+	if endpoint == "" {
+		endpoint = c.endpoint
+	}
+
+	now := time.Now()
+	spans = make([]*TraceSpan, len(commands))
+	for i, command := range commands {
+		spans[i] = &TraceSpan{
+			Context:      context.Background(),
+			Command:      command.GetCommand(),
+			Endpoint:     endpoint,
+			DatabaseId:   c.DatabaseId,
+			Start:        now,
+			BytesWritten: len(command.GetBuffer()),
+		}
+		c.traceHook.OnCommandStart(spans[i])
+	}
+	return spans
+}
+
+//Calls the connection's TraceHook's OnCommandEnd for each of the spans returned by StartTrace
+func (c *Connection) EndTrace(spans []*TraceSpan, err error) {
+	for _, span := range spans {
+		c.traceHook.OnCommandEnd(span, err)
+	}
+}
+
+//Returns how many bytes have been read from the server and consumed from Reader, across every reconnect
+//The difference across reading a reply is its size
+func (c *Connection) BytesConsumed() uint64 {
+	consumed := atomic.LoadUint64(&c.counters.bytesRead)
+	if c.Reader != nil {
+		consumed -= uint64(c.Reader.Buffered())
+	}
+	return consumed
+}
@@ -27,16 +27,32 @@ package graphite
 
 import (
 	"os"
+	"io"
 	"net"
 	"fmt"
 	"strings"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-var udpConn *net.UDPConn = nil
+const (
+	//Default time between sends of the aggregated metrics
+	DEFAULT_FLUSH_INTERVAL = time.Second
+	//Default number of metrics recorded since the last send, that triggers a send before the interval is up
+	DEFAULT_BATCH_SIZE = 1000
+	//How many recorded metrics can wait to be aggregated.  Beyond that, metrics are dropped (and counted) rather than
+	//slowing down the caller
+	QUEUE_SIZE = 16384
+	//The largest statsd packet sent.  Metrics are packed into packets of up to this size, one per line
+	MAX_PACKET_SIZE = 1432
+)
+
+var current *sender
 var prefix string
 var timingsEnabled bool = false
+var flushInterval time.Duration = DEFAULT_FLUSH_INTERVAL
+var batchSize int = DEFAULT_BATCH_SIZE
 
 func SetEndpoint(endpoint string) error {
 	addr, err := net.ResolveUDPAddr("udp", endpoint)
@@ -56,8 +72,8 @@ func SetEndpoint(endpoint string) error {
 		return err
 	}
 
-	udpConn = conn
 	prefix = fmt.Sprintf("rmux.%s.", hostname)
+	current = newSender(conn, flushInterval, batchSize)
 	return nil
 }
 
@@ -65,29 +81,185 @@ func EnableTimings() {
 	timingsEnabled = true
 }
 
+//Sets how often the aggregated metrics are sent.  Must be called before SetEndpoint
+func SetFlushInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_FLUSH_INTERVAL
+	}
+	flushInterval = interval
+}
+
+//Sets how many metrics may be recorded before they're sent, ahead of the flush interval.  Must be called before
+//SetEndpoint
+func SetBatchSize(size int) {
+	if size <= 0 {
+		size = DEFAULT_BATCH_SIZE
+	}
+	batchSize = size
+}
+
 func Increment(metric string) {
-	if Enabled() {
-		sd := prefix + metric + ":1|c"
-		udpConn.Write([]byte(sd))
+	if s := current; s != nil {
+		s.record(event{metric: metric, kind: 'c'})
 	}
 }
 
 func Gauge(metric string, value int) {
-	if Enabled() {
-		sd := prefix + metric + ":" + strconv.Itoa(value) + "|g"
-		udpConn.Write([]byte(sd))
+	if s := current; s != nil {
+		s.record(event{metric: metric, kind: 'g', value: value})
 	}
 }
 
 func Timing(metric string, value time.Duration) {
-	if Enabled() && timingsEnabled {
-		sd := fmt.Sprintf("%s%s:%.4f|ms", prefix, metric, float64(value)/float64(time.Millisecond))
-		udpConn.Write([]byte(sd))
+	SampledTiming(metric, value, 1)
+}
+
+//Sends a timing that was sampled 1 in every sampleRate, with its sample rate, so that statsd scales it back up
+func SampledTiming(metric string, value time.Duration, sampleRate int) {
+	if s := current; s != nil && timingsEnabled {
+		s.record(event{metric: metric, kind: 't', timing: value, value: sampleRate})
 	}
 }
 
 func Enabled() bool {
-	return udpConn != nil
+	return current != nil
+}
+
+//Sends everything recorded so far, without waiting for the flush interval.  Blocks until it has been sent
+func Flush() {
+	if s := current; s != nil {
+		s.flush()
+	}
+}
+
+//A metric, as recorded by Increment, Gauge or Timing
+type event struct {
+	metric string
+	//'c' for counters, 'g' for gauges, 't' for timings
+	kind   byte
+	//A gauge's value, or a timing's sample rate
+	value  int
+	timing time.Duration
 }
 
-// Todo: Maybe this should aggregate increments
+//Aggregates recorded metrics in the background, and sends them to graphite in batches
+//Increments of the same counter are summed, and only the last value of each gauge is kept.  Every timing is sent
+type sender struct {
+	writer  io.Writer
+	events  chan event
+	flushes chan chan struct{}
+	// The number of metrics dropped because the queue was full, since the last send
+	dropped uint64
+
+	// Owned by the background goroutine
+	counters  map[string]int
+	gauges    map[string]int
+	timings   []string
+	batched   int
+	batchSize int
+}
+
+func newSender(writer io.Writer, interval time.Duration, batchSize int) *sender {
+	s := &sender{
+		writer:    writer,
+		events:    make(chan event, QUEUE_SIZE),
+		flushes:   make(chan chan struct{}),
+		counters:  make(map[string]int),
+		gauges:    make(map[string]int),
+		batchSize: batchSize,
+	}
+	go s.run(interval)
+	return s
+}
+
+//Queues the metric for the background goroutine, or drops it if the queue is full, so the caller never blocks
+func (s *sender) record(e event) {
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+//Asks the background goroutine to send everything queued so far, and waits for it to have done so
+func (s *sender) flush() {
+	done := make(chan struct{})
+	s.flushes <- done
+	<-done
+}
+
+func (s *sender) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-s.events:
+			s.aggregate(e)
+			if s.batched >= s.batchSize {
+				s.send()
+			}
+		case <-ticker.C:
+			s.send()
+		case done := <-s.flushes:
+			for len(s.events) > 0 {
+				s.aggregate(<-s.events)
+			}
+			s.send()
+			close(done)
+		}
+	}
+}
+
+func (s *sender) aggregate(e event) {
+	s.batched++
+	switch e.kind {
+	case 'c':
+		s.counters[e.metric]++
+	case 'g':
+		s.gauges[e.metric] = e.value
+	case 't':
+		line := fmt.Sprintf("%s%s:%.4f|ms", prefix, e.metric, float64(e.timing)/float64(time.Millisecond))
+		if e.value > 1 {
+			line += "|@" + strconv.FormatFloat(1/float64(e.value), 'g', 6, 64)
+		}
+		s.timings = append(s.timings, line)
+	}
+}
+
+//Sends the aggregated metrics, packed into as few packets as they fit in, and starts a new batch
+func (s *sender) send() {
+	if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+		s.counters["metrics_dropped"] += int(dropped)
+	}
+
+	packet := make([]byte, 0, MAX_PACKET_SIZE)
+	writeLine := func(line string) {
+		if len(packet) > 0 && len(packet)+1+len(line) > MAX_PACKET_SIZE {
+			s.writer.Write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	for metric, count := range s.counters {
+		writeLine(prefix + metric + ":" + strconv.Itoa(count) + "|c")
+		delete(s.counters, metric)
+	}
+	for metric, value := range s.gauges {
+		writeLine(prefix + metric + ":" + strconv.Itoa(value) + "|g")
+		delete(s.gauges, metric)
+	}
+	for _, line := range s.timings {
+		writeLine(line)
+	}
+	if len(packet) > 0 {
+		s.writer.Write(packet)
+	}
+
+	s.timings = s.timings[:0]
+	s.batched = 0
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package graphite
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Collects the packets that a sender writes
+type packetRecorder struct {
+	lock    sync.Mutex
+	packets []string
+}
+
+func (r *packetRecorder) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.packets = append(r.packets, string(b))
+	return len(b), nil
+}
+
+func (r *packetRecorder) lines() (lines []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, packet := range r.packets {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	return
+}
+
+func TestSenderAggregates(test *testing.T) {
+	recorder := &packetRecorder{}
+	s := newSender(recorder, time.Hour, 1000000)
+
+	for i := 0; i < 10000; i++ {
+		s.record(event{metric: "disconnect", kind: 'c'})
+	}
+	s.record(event{metric: "pools.a", kind: 'g', value: 1})
+	s.record(event{metric: "pools.a", kind: 'g', value: 3})
+	s.record(event{metric: "select", kind: 't', timing: 1500 * time.Microsecond})
+	s.flush()
+
+	lines := recorder.lines()
+	expected := map[string]bool{"disconnect:10000|c": true, "pools.a:3|g": true, "select:1.5000|ms": true}
+	if len(lines) != len(expected) {
+		test.Fatalf("Expected %d aggregated metrics, got %q", len(expected), lines)
+	}
+	for _, line := range lines {
+		if !expected[line] {
+			test.Errorf("Unexpected metric %q", line)
+		}
+	}
+
+	// Nothing is sent again until more is recorded
+	s.flush()
+	if len(recorder.lines()) != len(expected) {
+		test.Errorf("Expected an empty batch not to be sent, got %q", recorder.lines())
+	}
+}
+
+func TestSenderSampledTiming(test *testing.T) {
+	recorder := &packetRecorder{}
+	s := newSender(recorder, time.Hour, 1000000)
+
+	s.record(event{metric: "command", kind: 't', timing: time.Millisecond, value: 10})
+	s.record(event{metric: "connect", kind: 't', timing: time.Millisecond, value: 1})
+	s.flush()
+
+	expected := map[string]bool{"command:1.0000|ms|@0.1": true, "connect:1.0000|ms": true}
+	lines := recorder.lines()
+	if len(lines) != len(expected) {
+		test.Fatalf("Expected %d timings, got %q", len(expected), lines)
+	}
+	for _, line := range lines {
+		if !expected[line] {
+			test.Errorf("Unexpected metric %q", line)
+		}
+	}
+}
+
+func TestSenderBatchSize(test *testing.T) {
+	recorder := &packetRecorder{}
+	s := newSender(recorder, time.Hour, 10)
+
+	for i := 0; i < 10; i++ {
+		s.record(event{metric: "command", kind: 'c'})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.lines()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if lines := recorder.lines(); len(lines) != 1 || lines[0] != "command:10|c" {
+		test.Errorf("Expected a full batch to be sent before the interval, got %q", lines)
+	}
+}
+
+func TestSenderFlushInterval(test *testing.T) {
+	recorder := &packetRecorder{}
+	s := newSender(recorder, 10*time.Millisecond, 1000000)
+	s.record(event{metric: "command", kind: 'c'})
+
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.lines()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if lines := recorder.lines(); len(lines) != 1 || lines[0] != "command:1|c" {
+		test.Errorf("Expected the batch to be sent once the interval was up, got %q", lines)
+	}
+}
+
+func TestSenderPacketSize(test *testing.T) {
+	recorder := &packetRecorder{}
+	s := newSender(recorder, time.Hour, 1000000)
+
+	metric := string(bytes.Repeat([]byte("m"), 100))
+	for i := 0; i < 100; i++ {
+		s.record(event{metric: metric, kind: 't', timing: time.Millisecond})
+	}
+	s.flush()
+
+	if len(recorder.packets) < 2 {
+		test.Errorf("Expected the timings to be split across packets, got %d", len(recorder.packets))
+	}
+	for _, packet := range recorder.packets {
+		if len(packet) > MAX_PACKET_SIZE {
+			test.Errorf("Expected packets of at most %d bytes, got %d", MAX_PACKET_SIZE, len(packet))
+		}
+	}
+	if lines := recorder.lines(); len(lines) != 100 {
+		test.Errorf("Expected every timing to be sent, got %d", len(lines))
+	}
+}
+
+func TestSenderDropsWhenFull(test *testing.T) {
+	// A sender whose background goroutine isn't running yet, so nothing is taken off the queue
+	s := &sender{events: make(chan event, 2), counters: make(map[string]int), gauges: make(map[string]int)}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			s.record(event{metric: "command", kind: 'c'})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		test.Fatal("Expected recording to a full queue not to block")
+	}
+
+	recorder := &packetRecorder{}
+	s.writer = recorder
+	s.flushes = make(chan chan struct{})
+	s.batchSize = 1000000
+	go s.run(time.Hour)
+	s.flush()
+
+	expected := map[string]bool{"command:2|c": true, "metrics_dropped:3|c": true}
+	lines := recorder.lines()
+	if len(lines) != len(expected) {
+		test.Fatalf("Expected the dropped metrics to be counted, got %q", lines)
+	}
+	for _, line := range lines {
+		if !expected[line] {
+			test.Errorf("Unexpected metric %q", line)
+		}
+	}
+}
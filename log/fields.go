@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//A key=value pair attached to a log line
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+//Shorthand for constructing a Field
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+//A log message with fields attached, formatted lazily, so that a disabled level costs no formatting
+type FieldsMessage struct {
+	Message string
+	Fields  []Field
+}
+
+//Formats as key=value pairs, ex: msg="Copy failed" conn_id=3 remote=10.0.0.1:5555 err="EOF"
+//Values containing spaces, quotes, equals signs or control characters are quoted, so every line splits cleanly
+func (m FieldsMessage) String() string {
+	var b bytes.Buffer
+	b.WriteString("msg=")
+	b.WriteString(formatValue(m.Message))
+	for _, f := range m.Fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(formatValue(f.Value))
+	}
+	return b.String()
+}
+
+//Logs the message and its fields to the given logger, at debug level
+func Debugw(logger Logger, message string, fields ...Field) {
+	logger.Debugf("%s", FieldsMessage{message, fields})
+}
+
+func formatValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.IndexFunc(s, needsQuoting) >= 0 {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func needsQuoting(r rune) bool {
+	return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+}
@@ -110,3 +110,32 @@ func Warn(format string, a ...interface{}) {
 		fmt.Println(out)
 	}
 }
+
+//A sink for rmux's logs, so that they can be routed into another logging pipeline, or captured in tests
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Infof(format string, a ...interface{})
+	Warnf(format string, a ...interface{})
+	Errorf(format string, a ...interface{})
+}
+
+//Routes to the package-global Debug/Info/Warn/Error, and so honors SetLogLevel and UseSyslog
+var GlobalLogger Logger = globalLogger{}
+
+type globalLogger struct{}
+
+func (globalLogger) Debugf(format string, a ...interface{}) {
+	Debug(format, a...)
+}
+
+func (globalLogger) Infof(format string, a ...interface{}) {
+	Info(format, a...)
+}
+
+func (globalLogger) Warnf(format string, a ...interface{}) {
+	Warn(format, a...)
+}
+
+func (globalLogger) Errorf(format string, a ...interface{}) {
+	Error(format, a...)
+}
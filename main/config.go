@@ -27,7 +27,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"strings"
 )
 
 type PoolConfig struct {
@@ -46,6 +48,54 @@ type PoolConfig struct {
 	RemoteWriteTimeout   int64      `json:"remoteWriteTimeout"`
 	RemoteConnectTimeout int64      `json:"remoteConnectTimeout"`
 	Failover             bool       `json:"failover"`
+	ClusterRedirects     bool       `json:"clusterRedirects"`
+	Sentinels            []string   `json:"sentinels"`
+	SentinelMaster       string     `json:"sentinelMaster"`
+	//Read replicas (tcp) of the tcp connections, keyed by the connection they replicate
+	Replicas             map[string][]string `json:"replicas"`
+	//The named command policy to start from: "default", "monitoring" (also allows OBJECT ENCODING, MEMORY USAGE and
+	//the like) or "locked-down" (only commands that never write).  Empty means "default"
+	CommandProfile       string     `json:"commandProfile"`
+	//Commands to allow or refuse, on top of the defaults.  ex: "dbsize", for a read-only monitoring deployment
+	AllowCommands        []string   `json:"allowCommands"`
+	DenyCommands         []string   `json:"denyCommands"`
+	//Subcommands to allow, of commands that are refused as a whole, keyed by command.  ex: "config": ["get"]
+	AllowSubcommands     map[string][]string `json:"allowSubcommands"`
+	//If set, only these commands are accepted, and everything else is refused with "-ERR command not allowed"
+	CommandAllowlist     []string   `json:"commandAllowlist"`
+	//How many times to retry a read-only command while its server replies -LOADING, and the wait (in
+	//milliseconds) before each retry
+	LoadingRetries       int        `json:"loadingRetries"`
+	LoadingRetryDelay    int64      `json:"loadingRetryDelay"`
+	//A file holding the credentials to AUTH to the backends with, as "password" or "user password"
+	//It is read again on SIGHUP, so that the credentials can be rotated without a restart
+	AuthFile             string     `json:"authFile"`
+	//A file listing the addresses of the clients to trace (see RedisMultiplexer.TraceClients), separated by whitespace
+	//It is read again on SIGHUP, so that a client can be traced without a restart
+	TraceClientsFile     string     `json:"traceClientsFile"`
+	//Names backend connections with CLIENT SETNAME, ex: the proxy's instance id.  Pool indexes are appended
+	ClientName           string     `json:"clientName"`
+	//How many backend connections may connect to the same server at once.  0 doesn't limit them
+	MaxConcurrentConnects int       `json:"maxConcurrentConnects"`
+	//Stop using a backend connection for tripCoolDown milliseconds once this many replies in a row were error replies
+	//or failures.  0 never stops using them
+	TripThreshold        int        `json:"tripThreshold"`
+	TripCoolDown         int64      `json:"tripCoolDown"`
+	//Disconnect pooled backend connections after this many milliseconds unused.  0 keeps them open
+	MaxIdle              int64      `json:"maxIdle"`
+	//Disconnect clients whose open MULTI or WATCH leaves its backend connection unused for this many milliseconds.
+	//Defaults to 30000
+	MaxPinIdle           int64      `json:"maxPinIdle"`
+	//Report the bytes read from and written to each backend every this many milliseconds.  0 doesn't report them
+	TrafficReportInterval int64     `json:"trafficReportInterval"`
+	//Allow SCAN while multiplexing, running it across every backend in turn
+	ScanFanOut           bool       `json:"scanFanOut"`
+	//Answer commands with a multibulk of their command and arguments, as parsed, rather than proxying them.  No
+	//connections are needed, ex: for testing clients' framing against the proxy's parser
+	Echo                 bool       `json:"echo"`
+	//Refuse commands that aren't multibulks, ex: inline commands as typed over telnet ("PING"), and disconnect the
+	//clients that send them
+	RequireMultibulkCommands bool   `json:"requireMultibulkCommands"`
 }
 
 func ReadConfigFromFile(configFile string) ([]PoolConfig, error) {
@@ -62,6 +112,34 @@ func ReadConfigFromFile(configFile string) ([]PoolConfig, error) {
 	return configs, nil
 }
 
+//Reads the credentials from an auth file: a single line, holding either "password" or "user password"
+func ReadCredentialsFromFile(authFile string) (user, password string, err error) {
+	fileContents, err := ioutil.ReadFile(authFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(string(fileContents))
+	switch len(fields) {
+	case 1:
+		return "", fields[0], nil
+	case 2:
+		return fields[0], fields[1], nil
+	default:
+		return "", "", errors.New("The auth file must hold either a password, or a user and a password")
+	}
+}
+
+//Reads the addresses of the clients to trace from a trace clients file.  An empty file traces no clients
+func ReadTraceClientsFromFile(traceClientsFile string) ([]string, error) {
+	fileContents, err := ioutil.ReadFile(traceClientsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(fileContents)), nil
+}
+
 func ParseConfigJson(configJson []byte) ([]PoolConfig, error) {
 	var configs []PoolConfig
 
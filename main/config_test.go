@@ -26,6 +26,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 )
@@ -162,3 +164,64 @@ func TestParseConfigJson_Json3_Error(test *testing.T) {
 		test.Fatalf("Should have errored attempting to parse json3")
 	}
 }
+
+func TestReadCredentialsFromFile(test *testing.T) {
+	testData := []struct {
+		contents string
+		user     string
+		password string
+		isError  bool
+	}{
+		{"s3cret\n", "", "s3cret", false},
+		{"rmux s3cret\n", "rmux", "s3cret", false},
+		{"", "", "", true},
+		{"too many fields\n", "", "", true},
+	}
+
+	for _, d := range testData {
+		authFile, err := ioutil.TempFile("", "rmux-auth")
+		if err != nil {
+			test.Fatalf("Error creating auth file: %s", err)
+		}
+		authFile.WriteString(d.contents)
+		authFile.Close()
+
+		user, password, err := ReadCredentialsFromFile(authFile.Name())
+		os.Remove(authFile.Name())
+
+		if (err != nil) != d.isError || user != d.user || password != d.password {
+			test.Errorf("Reading %q returned %q, %q, %v", d.contents, user, password, err)
+		}
+	}
+}
+
+func TestReadTraceClientsFromFile(test *testing.T) {
+	testData := []struct {
+		contents  string
+		addresses []string
+	}{
+		{"10.0.0.1\n", []string{"10.0.0.1"}},
+		{"10.0.0.1 10.0.0.2:5555\n10.0.0.3\n", []string{"10.0.0.1", "10.0.0.2:5555", "10.0.0.3"}},
+		{"", []string{}},
+	}
+
+	for _, d := range testData {
+		traceClientsFile, err := ioutil.TempFile("", "rmux-trace")
+		if err != nil {
+			test.Fatalf("Error creating trace clients file: %s", err)
+		}
+		traceClientsFile.WriteString(d.contents)
+		traceClientsFile.Close()
+
+		addresses, err := ReadTraceClientsFromFile(traceClientsFile.Name())
+		os.Remove(traceClientsFile.Name())
+
+		if err != nil || !reflect.DeepEqual(addresses, d.addresses) {
+			test.Errorf("Reading %q returned %q, %v", d.contents, addresses, err)
+		}
+	}
+
+	if _, err := ReadTraceClientsFromFile("/nonexistent/rmux-trace"); err == nil {
+		test.Error("Expected an error reading a missing trace clients file")
+	}
+}
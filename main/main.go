@@ -33,13 +33,18 @@ import (
 	. "github.com/salesforce/rmux/log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"github.com/salesforce/rmux/connection"
 	"github.com/salesforce/rmux/graphite"
+	"github.com/salesforce/rmux/metrics"
+	"github.com/salesforce/rmux/protocol"
+	"net/http"
 	"time"
 )
 
@@ -64,7 +69,39 @@ var configFile = flag.String("config", "", "Configuration file (JSON)")
 var doDebug = flag.Bool("debug", false, "Debug mode")
 var graphiteServer = flag.String("graphite", "", "Graphite statsd endpoint")
 var doTiming = flag.Bool("timing", false, "Send command timings to graphite")
+var timingSampleRate = flag.Int("timingSampleRate", 1, "Record 1 in this many per-command timings, scaled up to stand in for the rest.  1 records them all")
+var graphiteFlushInterval = flag.Int64("graphiteFlushInterval", 0, "Milliseconds between sends of the aggregated graphite metrics.  Defaults to 1000")
+var graphiteBatchSize = flag.Int("graphiteBatchSize", graphite.DEFAULT_BATCH_SIZE, "How many graphite metrics may be recorded before they're sent, ahead of the flush interval")
+var prometheusListen = flag.String("prometheus", "", "Address to serve prometheus metrics on, at /metrics.  ex: localhost:9121")
 var failover = flag.Bool("failover", false, "Failover to another connection pool if target pool is down in mux mode")
+var clusterRedirects = flag.Bool("clusterRedirects", false, "Follow redis cluster MOVED/ASK redirects, rather than returning them to the client")
+var sentinels = flag.String("sentinels", "", "Sentinels (ex: localhost:26379) to look up the sentinelMaster's address from")
+var sentinelMaster = flag.String("sentinelMaster", "", "The name of the master to multiplex over, as monitored by the sentinels")
+var replicas = flag.String("replicas", "", "Read replicas to send read-only commands to, as connection=replica pairs.  ex: \"localhost:6380=localhost:6390\"")
+var commandProfile = flag.String("commandProfile", protocol.POLICY_PROFILE_DEFAULT, "The command policy to start from: \"default\", \"monitoring\" (also allows OBJECT ENCODING, MEMORY USAGE and the like) or \"locked-down\" (only commands that never write)")
+var allowCommands = flag.String("allowCommands", "", "Commands to allow, that are refused by default as unsafe.  Commands that are only refused while multiplexing (ex: mget) stay refused.  ex: \"dbsize\"")
+var denyCommands = flag.String("denyCommands", "", "Commands to refuse, that are allowed by default")
+var allowSubcommands = flag.String("allowSubcommands", "", "Subcommands to allow, of commands that are refused as a whole, as command=subcommand pairs.  ex: \"config=get cluster=slots\"")
+var commandAllowlist = flag.String("commandAllowlist", "", "If set, the only commands to accept (ping and quit are always accepted).  ex: \"get set del\"")
+var loadingRetries = flag.Int("loadingRetries", 0, "How many times to retry a read-only command while its server replies -LOADING.  0 disables retrying")
+var loadingRetryDelay = flag.Int64("loadingRetryDelay", 0, "Wait in milliseconds before each -LOADING retry.  Defaults to 100")
+var authFile = flag.String("authFile", "", "File holding the credentials to AUTH to redis with, as \"password\" or \"user password\".  Read again on SIGHUP")
+var traceClientsFile = flag.String("traceClientsFile", "", "File listing the addresses of clients to write debug logs for, ex: \"10.0.0.1 10.0.0.2:5555\".  Read again on SIGHUP")
+var clientName = flag.String("clientName", "", "Name to give backend connections with CLIENT SETNAME, ex: this proxy's instance id.  Pool indexes are appended")
+var maxConcurrentConnects = flag.Int("maxConcurrentConnects", 0, "How many backend connections may connect to the same server at once, so that a recovering server isn't overwhelmed.  0 doesn't limit them")
+var tripThreshold = flag.Int("tripThreshold", 0, "Stop using a backend connection for tripCoolDown once this many replies in a row failed, or were errors like -LOADING that say the server can't serve commands.  0 never stops using them")
+var tripCoolDown = flag.Int64("tripCoolDown", 1000, "Milliseconds that a tripped backend connection isn't used for")
+var trafficReportInterval = flag.Int64("trafficReportInterval", 0, "Report the bytes read from and written to each backend every this many milliseconds.  0 doesn't report them")
+var maxIdle = flag.Int64("maxIdle", 0, "Disconnect pooled backend connections after this many milliseconds unused.  0 keeps them open")
+var maxPinIdle = flag.Int64("maxPinIdle", 0, "Disconnect clients whose open MULTI or WATCH leaves its backend connection unused for this many milliseconds, releasing the connection.  Defaults to 30000")
+var maxBulkLength = flag.Int64("maxBulkLength", protocol.DEFAULT_MAX_BULK_LENGTH, "The longest bulk string, in bytes, accepted from clients and servers.  Longer ones disconnect the client")
+var maxMultibulkLength = flag.Int("maxMultibulkLength", protocol.DEFAULT_MAX_MULTIBULK_LENGTH, "The most elements accepted in a multibulk command from clients.  More disconnect the client")
+var maxBlockingTimeout = flag.Int64("maxBlockingTimeout", int64(protocol.DEFAULT_MAX_BLOCKING_TIMEOUT/time.Millisecond), "The longest in milliseconds that the reply to a blocking command (ex: BLPOP) is waited for, including ones that block forever")
+var longRunningCommands = flag.String("longRunningCommands", "", "Commands whose replies may take longer than the remote read timeout, as command=milliseconds pairs to wait for them.  ex: \"debug=10000\", for DEBUG SLEEP")
+var lenientNewlines = flag.Bool("lenientNewlines", false, "Accept a bare \\n in place of the \\r\\n after a bulk payload in commands and replies, which is passed on as \\r\\n")
+var scanFanOut = flag.Bool("scanFanOut", false, "Allow SCAN while multiplexing, running it across every backend in turn.  Its cursor says which backend an iteration is up to")
+var echo = flag.Bool("echo", false, "Run as a protocol echo server, without any backend: commands are answered with a multibulk of their command and arguments, as parsed")
+var requireMultibulkCommands = flag.Bool("requireMultibulkCommands", false, "Only accept multibulk commands, and disconnect clients that send inline commands, as typed over telnet (ex: \"PING\")")
 var useSyslog = flag.Bool("useSyslog", true, "If true, outputs to syslog as well as stdout")
 
 func main() {
@@ -88,8 +125,16 @@ func main() {
 	}
 	UseSyslog(*useSyslog)
 
+	protocol.SetMaxBulkLength(*maxBulkLength)
+	protocol.SetMaxMultibulkLength(*maxMultibulkLength)
+	protocol.SetMaxBlockingTimeout(time.Duration(*maxBlockingTimeout) * time.Millisecond)
+	terminateIfError(setLongRunningCommands(*longRunningCommands), "Error parsing long running commands: %s\r\n")
+	protocol.SetLenientNewlines(*lenientNewlines)
+
 	if *graphiteServer != "" {
 		Info("Enabling graphite stats")
+		graphite.SetFlushInterval(time.Duration(*graphiteFlushInterval) * time.Millisecond)
+		graphite.SetBatchSize(*graphiteBatchSize)
 		err := graphite.SetEndpoint(*graphiteServer)
 		if err != nil {
 			Error("Error when setting graphite endpoint: %s", err)
@@ -100,6 +145,21 @@ func main() {
 		Info("Enabling graphite timings")
 		graphite.EnableTimings()
 	}
+	metrics.SetTimingSampleRate(*timingSampleRate)
+
+	if *prometheusListen != "" {
+		Info("Serving prometheus metrics on %s", *prometheusListen)
+		registry := metrics.NewPrometheusRegistry(nil)
+		metrics.SetSink(metrics.Multi(metrics.GraphiteSink{}, registry))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		go func() {
+			if err := http.ListenAndServe(*prometheusListen, mux); err != nil {
+				Error("Error serving prometheus metrics: %s", err)
+			}
+		}()
+	}
 
 	if *configFile != "" {
 		configs, err = ReadConfigFromFile(*configFile)
@@ -113,6 +173,7 @@ func main() {
 
 	Info("Starting %d rmux instances", len(rmuxInstances))
 
+	go reloadOnHangup(configs, rmuxInstances)
 	start(rmuxInstances)
 }
 
@@ -131,16 +192,81 @@ func configureFromArgs() ([]PoolConfig, error) {
 		arrUnixConnections = []string{}
 	}
 
+	var arrSentinels []string
+	if *sentinels != "" {
+		arrSentinels = strings.Split(*sentinels, " ")
+	}
+
+	arrReplicas := map[string][]string{}
+	if *replicas != "" {
+		for _, pair := range strings.Split(*replicas, " ") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("Replicas must be given as connection=replica, got: %s", pair)
+			}
+			arrReplicas[parts[0]] = append(arrReplicas[parts[0]], parts[1])
+		}
+	}
+
+	var arrAllowCommands []string
+	if *allowCommands != "" {
+		arrAllowCommands = strings.Split(*allowCommands, " ")
+	}
+
+	var arrDenyCommands []string
+	if *denyCommands != "" {
+		arrDenyCommands = strings.Split(*denyCommands, " ")
+	}
+
+	arrAllowSubcommands := map[string][]string{}
+	if *allowSubcommands != "" {
+		for _, pair := range strings.Split(*allowSubcommands, " ") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("Subcommands must be given as command=subcommand, got: %s", pair)
+			}
+			arrAllowSubcommands[parts[0]] = append(arrAllowSubcommands[parts[0]], parts[1])
+		}
+	}
+
+	var arrCommandAllowlist []string
+	if *commandAllowlist != "" {
+		arrCommandAllowlist = strings.Split(*commandAllowlist, " ")
+	}
+
 	config := []PoolConfig{{
-		Host:         *host,
-		Port:         *port,
-		Socket:       *socket,
-		MaxProcesses: *maxProcesses,
-		PoolSize:     *poolSize,
-		Failover:     *failover,
+		Host:             *host,
+		Port:             *port,
+		Socket:           *socket,
+		MaxProcesses:     *maxProcesses,
+		PoolSize:         *poolSize,
+		Failover:         *failover,
+		ClusterRedirects: *clusterRedirects,
+		SentinelMaster:   *sentinelMaster,
 
 		TcpConnections:  arrTcpConnections,
 		UnixConnections: arrUnixConnections,
+		Sentinels:       arrSentinels,
+		Replicas:        arrReplicas,
+		CommandProfile:  *commandProfile,
+		AllowCommands:   arrAllowCommands,
+		DenyCommands:    arrDenyCommands,
+		AllowSubcommands: arrAllowSubcommands,
+		CommandAllowlist: arrCommandAllowlist,
+		LoadingRetries:    *loadingRetries,
+		LoadingRetryDelay: *loadingRetryDelay,
+		AuthFile:          *authFile,
+		TraceClientsFile:  *traceClientsFile,
+		ClientName:        *clientName,
+		MaxConcurrentConnects: *maxConcurrentConnects,
+		TripThreshold:     *tripThreshold,
+		TripCoolDown:      *tripCoolDown,
+		MaxIdle:           *maxIdle,
+		MaxPinIdle:        *maxPinIdle,
+		TrafficReportInterval: *trafficReportInterval,
+		ScanFanOut:        *scanFanOut,
+		Echo:              *echo,
+		RequireMultibulkCommands: *requireMultibulkCommands,
 
 		LocalTimeout:      *localTimeout,
 		LocalReadTimeout:  *localReadTimeout,
@@ -200,6 +326,73 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 		}
 
 		rmuxInstance.Failover = config.Failover
+		rmuxInstance.Echo = config.Echo
+		rmuxInstance.ScanFanOut = config.ScanFanOut
+		rmuxInstance.RequireMultibulkCommands = config.RequireMultibulkCommands
+		if config.Echo {
+			Info("Echoing commands back, rather than proxying them")
+		}
+		rmuxInstance.FollowClusterRedirects = config.ClusterRedirects
+
+		if config.CommandProfile != "" {
+			Info("Using the %s command policy", config.CommandProfile)
+			if rmuxInstance.CommandPolicy, err = protocol.NewCommandPolicyProfile(config.CommandProfile); err != nil {
+				err = fmt.Errorf("%w: %q", err, config.CommandProfile)
+				return
+			}
+		}
+
+		if len(config.AllowCommands) > 0 {
+			Info("Allowing commands: %v", config.AllowCommands)
+			rmuxInstance.CommandPolicy.Allow(config.AllowCommands...)
+		}
+
+		for command, subcommands := range config.AllowSubcommands {
+			Info("Allowing %s subcommands: %v", command, subcommands)
+			rmuxInstance.CommandPolicy.AllowSubcommands(command, subcommands...)
+		}
+
+		rmuxInstance.LoadingRetries = config.LoadingRetries
+		rmuxInstance.ClientName = config.ClientName
+
+		if config.MaxConcurrentConnects > 0 {
+			rmuxInstance.ConnectLimiter = connection.NewConnectLimiter(config.MaxConcurrentConnects)
+			Info("Connecting at most %d backend connections to each server at once", config.MaxConcurrentConnects)
+		}
+
+		if config.TripThreshold > 0 {
+			rmuxInstance.TripThreshold = config.TripThreshold
+			rmuxInstance.TripCoolDown = time.Duration(config.TripCoolDown) * time.Millisecond
+			Info("Tripping backend connections for %s after %d failures in a row", rmuxInstance.TripCoolDown, config.TripThreshold)
+		}
+
+		if config.MaxIdle != 0 {
+			rmuxInstance.MaxIdle = time.Duration(config.MaxIdle) * time.Millisecond
+			Info("Disconnecting backend connections after they're idle for: %s", rmuxInstance.MaxIdle)
+		}
+		if config.MaxPinIdle != 0 {
+			rmuxInstance.MaxPinIdle = time.Duration(config.MaxPinIdle) * time.Millisecond
+			Info("Disconnecting clients whose transactions are idle for: %s", rmuxInstance.MaxPinIdle)
+		}
+		if config.TrafficReportInterval != 0 {
+			rmuxInstance.TrafficReportInterval = time.Duration(config.TrafficReportInterval) * time.Millisecond
+			Info("Reporting backend traffic every: %s", rmuxInstance.TrafficReportInterval)
+		}
+		if config.LoadingRetryDelay != 0 {
+			rmuxInstance.LoadingRetryDelay = time.Duration(config.LoadingRetryDelay) * time.Millisecond
+			Info("Setting the -LOADING retry delay to: %s", rmuxInstance.LoadingRetryDelay)
+		}
+
+		if len(config.CommandAllowlist) > 0 {
+			Info("Only accepting commands: %v", config.CommandAllowlist)
+			rmuxInstance.CommandPolicy.SetAllowlist(true)
+			rmuxInstance.CommandPolicy.Allow(config.CommandAllowlist...)
+		}
+
+		if len(config.DenyCommands) > 0 {
+			Info("Refusing commands: %v", config.DenyCommands)
+			rmuxInstance.CommandPolicy.Deny(config.DenyCommands...)
+		}
 
 		if config.LocalTimeout != 0 {
 			timeout := time.Duration(config.LocalTimeout) * time.Millisecond
@@ -260,10 +453,46 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 			}
 		}
 
-		if rmuxInstance.PrimaryConnectionPool == nil {
+		if config.SentinelMaster != "" {
+			if len(config.Sentinels) == 0 {
+				err = errors.New("A sentinel master needs at least one sentinel to look it up from")
+				return
+			}
+			Info("Adding sentinel (destination) connection: %s via %v", config.SentinelMaster, config.Sentinels)
+			rmuxInstance.AddSentinelConnection(config.Sentinels, config.SentinelMaster)
+		}
+
+		for master, masterReplicas := range config.Replicas {
+			for _, replica := range masterReplicas {
+				Info("Adding tcp (replica) connection: %s of %s", replica, master)
+				if err = rmuxInstance.AddReplica(master, "tcp", replica); err != nil {
+					return
+				}
+			}
+		}
+
+		if rmuxInstance.PrimaryConnectionPool == nil && !config.Echo {
 			err = errors.New("You must have at least one connection defined")
 			return
 		}
+
+		if config.AuthFile != "" {
+			var user, password string
+			if user, password, err = ReadCredentialsFromFile(config.AuthFile); err != nil {
+				return
+			}
+			Info("Authenticating to redis with the credentials from %s", config.AuthFile)
+			rmuxInstance.UpdateCredentials(user, password)
+		}
+
+		if config.TraceClientsFile != "" {
+			var addresses []string
+			if addresses, err = ReadTraceClientsFromFile(config.TraceClientsFile); err != nil {
+				return
+			}
+			Info("Tracing the clients from %s: %v", config.TraceClientsFile, addresses)
+			rmuxInstance.TraceClients(addresses...)
+		}
 	}
 
 	return rmuxInstances, nil
@@ -295,6 +524,42 @@ func start(rmuxInstances []*rmux.RedisMultiplexer) {
 	waitGroup.Wait()
 }
 
+// Reads every instance's files again whenever a SIGHUP is received, see reloadFiles
+func reloadOnHangup(configs []PoolConfig, rmuxInstances []*rmux.RedisMultiplexer) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		reloadFiles(configs, rmuxInstances)
+	}
+}
+
+// Reads every instance's auth and trace clients files again, so that the credentials can be rotated, and clients
+// traced, without restarting.  A file that can't be read leaves that instance's setting alone
+func reloadFiles(configs []PoolConfig, rmuxInstances []*rmux.RedisMultiplexer) {
+	for i, config := range configs {
+		if config.AuthFile != "" {
+			user, password, err := ReadCredentialsFromFile(config.AuthFile)
+			if err != nil {
+				Error("Error reading the credentials from %s: %s", config.AuthFile, err)
+			} else {
+				Info("Updating the credentials from %s", config.AuthFile)
+				rmuxInstances[i].UpdateCredentials(user, password)
+			}
+		}
+
+		if config.TraceClientsFile != "" {
+			addresses, err := ReadTraceClientsFromFile(config.TraceClientsFile)
+			if err != nil {
+				Error("Error reading the clients to trace from %s: %s", config.TraceClientsFile, err)
+			} else {
+				Info("Tracing the clients from %s: %v", config.TraceClientsFile, addresses)
+				rmuxInstances[i].TraceClients(addresses...)
+			}
+		}
+	}
+}
+
 // Terminates the program if the passed in error does not evaluate to nil.
 // err will be the first value of formatted string
 func terminateIfError(err error, format string, a ...interface{}) {
@@ -305,3 +570,26 @@ func terminateIfError(err error, format string, a ...interface{}) {
 		os.Exit(1)
 	}
 }
+
+//Marks the commands in the given command=milliseconds pairs as long running, see protocol.SetLongRunningCommand
+func setLongRunningCommands(pairs string) error {
+	if pairs == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(pairs, " ") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Long running commands must be given as command=milliseconds, got: %s", pair)
+		}
+		milliseconds, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || milliseconds <= 0 {
+			return fmt.Errorf("Long running commands must be given as command=milliseconds, got: %s", pair)
+		}
+
+		timeout := time.Duration(milliseconds) * time.Millisecond
+		Info("Waiting up to %s for replies to %s", timeout, parts[0])
+		protocol.SetLongRunningCommand(parts[0], timeout)
+	}
+	return nil
+}
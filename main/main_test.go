@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTraceClientsFileReloadedOnHangup(test *testing.T) {
+	traceClientsFile, err := ioutil.TempFile("", "rmux-trace")
+	if err != nil {
+		test.Fatalf("Error creating trace clients file: %s", err)
+	}
+	defer os.Remove(traceClientsFile.Name())
+	traceClientsFile.WriteString("10.0.0.1\n")
+	traceClientsFile.Close()
+
+	configs := []PoolConfig{{
+		Socket:           "/tmp/rmux-trace-test.sock",
+		PoolSize:         1,
+		TcpConnections:   []string{"localhost:8001"},
+		TraceClientsFile: traceClientsFile.Name(),
+	}}
+	rmuxInstances, err := createInstances(configs)
+	if err != nil {
+		test.Fatalf("Error creating rmux instances: %s", err)
+	}
+	defer rmuxInstances[0].Listener.Close()
+
+	if traced := rmuxInstances[0].TracedClients(); !reflect.DeepEqual(traced, []string{"10.0.0.1"}) {
+		test.Fatalf("Expected the clients in the file to be traced from the start, got %q", traced)
+	}
+
+	// Keeps a SIGHUP from terminating the test, whether or not reloadOnHangup has asked for them yet
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGHUP)
+	defer signal.Stop(ignored)
+	go reloadOnHangup(configs, rmuxInstances)
+
+	ioutil.WriteFile(traceClientsFile.Name(), []byte("10.0.0.2:5555 10.0.0.3\n"), 0600)
+	expected := []string{"10.0.0.2:5555", "10.0.0.3"}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+		if traced := rmuxInstances[0].TracedClients(); reflect.DeepEqual(traced, expected) {
+			break
+		} else if time.Now().After(deadline) {
+			test.Fatalf("Expected %q to be traced after a SIGHUP, got %q", expected, traced)
+		}
+	}
+
+	// A file that can't be read leaves the traced clients alone
+	os.Remove(traceClientsFile.Name())
+	reloadFiles(configs, rmuxInstances)
+	if traced := rmuxInstances[0].TracedClients(); !reflect.DeepEqual(traced, expected) {
+		test.Fatalf("Expected %q to still be traced, got %q", expected, traced)
+	}
+}
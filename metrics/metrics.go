@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//A common front for rmux's metrics, so that they can be sent to graphite, exposed for prometheus, or both
+package metrics
+
+import (
+	"github.com/salesforce/rmux/graphite"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//A destination for metrics.  Metric names are dot-separated, ex: "pools.localhost:6379"
+type Sink interface {
+	Increment(metric string)
+	Gauge(metric string, value int)
+	Timing(metric string, value time.Duration)
+}
+
+//Implemented by sinks that can record a sampled timing as standing in for the others that weren't recorded
+//Sinks that don't implement it are given sampled timings as plain timings
+type SamplingSink interface {
+	//Records a timing that was sampled 1 in every sampleRate
+	SampledTiming(metric string, value time.Duration, sampleRate int)
+}
+
+var sink Sink = GraphiteSink{}
+
+//1 in how many SampledTiming calls are recorded, and how many calls have been made for each metric, as a *uint64
+var timingSampleRate uint64 = 1
+var sampledTimingCalls sync.Map
+
+//Sends all metrics to the given sink, rather than graphite.  Use Multi to keep graphite as well
+func SetSink(s Sink) {
+	if s == nil {
+		s = GraphiteSink{}
+	}
+	sink = s
+}
+
+func Increment(metric string) {
+	sink.Increment(metric)
+}
+
+func Gauge(metric string, value int) {
+	sink.Gauge(metric, value)
+}
+
+func Timing(metric string, value time.Duration) {
+	sink.Timing(metric, value)
+}
+
+//Records 1 in every N of the timings given to SampledTiming, to cut the overhead of per-command timings.  The recorded
+//ones are scaled up, so that rates and counts stay meaningful.  Values below 2 record every timing
+func SetTimingSampleRate(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreUint64(&timingSampleRate, uint64(n))
+}
+
+//Like Timing, but only records 1 in every N calls, as set by SetTimingSampleRate.  Each metric is sampled with its own
+//counter, so that metrics recorded together, ex: for every command, are each sampled 1 in N.  High-frequency timings
+//should use this, and rare ones Timing
+func SampledTiming(metric string, value time.Duration) {
+	sampleRate := atomic.LoadUint64(&timingSampleRate)
+	if sampleRate == 1 {
+		sink.Timing(metric, value)
+		return
+	}
+
+	calls, ok := sampledTimingCalls.Load(metric)
+	if !ok {
+		calls, _ = sampledTimingCalls.LoadOrStore(metric, new(uint64))
+	}
+	if atomic.AddUint64(calls.(*uint64), 1)%sampleRate != 0 {
+		return
+	}
+
+	if s, ok := sink.(SamplingSink); ok {
+		s.SampledTiming(metric, value, int(sampleRate))
+	} else {
+		sink.Timing(metric, value)
+	}
+}
+
+//Sends metrics to the graphite statsd endpoint, see graphite.SetEndpoint
+type GraphiteSink struct{}
+
+func (GraphiteSink) Increment(metric string) {
+	graphite.Increment(metric)
+}
+
+func (GraphiteSink) Gauge(metric string, value int) {
+	graphite.Gauge(metric, value)
+}
+
+func (GraphiteSink) Timing(metric string, value time.Duration) {
+	graphite.Timing(metric, value)
+}
+
+func (GraphiteSink) SampledTiming(metric string, value time.Duration, sampleRate int) {
+	graphite.SampledTiming(metric, value, sampleRate)
+}
+
+//Returns a sink that sends every metric to each of the given sinks
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+func (this multiSink) Increment(metric string) {
+	for _, s := range this {
+		s.Increment(metric)
+	}
+}
+
+func (this multiSink) Gauge(metric string, value int) {
+	for _, s := range this {
+		s.Gauge(metric, value)
+	}
+}
+
+func (this multiSink) Timing(metric string, value time.Duration) {
+	for _, s := range this {
+		s.Timing(metric, value)
+	}
+}
+
+func (this multiSink) SampledTiming(metric string, value time.Duration, sampleRate int) {
+	for _, s := range this {
+		if sampling, ok := s.(SamplingSink); ok {
+			sampling.SampledTiming(metric, value, sampleRate)
+		} else {
+			s.Timing(metric, value)
+		}
+	}
+}
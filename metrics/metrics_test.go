@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+//Records how many timings it was given, and what sample rates and metrics they came with
+type countingSink struct {
+	timings     int
+	sampleRates []int
+	sampled     map[string]int
+}
+
+func (this *countingSink) Increment(metric string)                  {}
+func (this *countingSink) Gauge(metric string, value int)           {}
+func (this *countingSink) Timing(metric string, value time.Duration) { this.timings++ }
+func (this *countingSink) SampledTiming(metric string, value time.Duration, sampleRate int) {
+	this.sampleRates = append(this.sampleRates, sampleRate)
+	if this.sampled == nil {
+		this.sampled = make(map[string]int)
+	}
+	this.sampled[metric]++
+}
+
+func TestSampledTiming(test *testing.T) {
+	counting := &countingSink{}
+	SetSink(counting)
+	defer SetSink(nil)
+	defer SetTimingSampleRate(1)
+
+	// Without sampling, every timing is recorded as is
+	for i := 0; i < 10; i++ {
+		SampledTiming("command", time.Millisecond)
+	}
+	if counting.timings != 10 || len(counting.sampleRates) != 0 {
+		test.Fatalf("Expected every timing to be recorded unsampled, got %d and %v", counting.timings, counting.sampleRates)
+	}
+
+	SetTimingSampleRate(4)
+	for i := 0; i < 100; i++ {
+		SampledTiming("command", time.Millisecond)
+	}
+	if len(counting.sampleRates) != 25 {
+		test.Fatalf("Expected 1 in 4 timings to be recorded, got %d", len(counting.sampleRates))
+	}
+	for _, sampleRate := range counting.sampleRates {
+		if sampleRate != 4 {
+			test.Fatalf("Expected the sampled timings to carry their sample rate, got %d", sampleRate)
+		}
+	}
+
+	// Plain timings aren't sampled
+	Timing("connect", time.Millisecond)
+	if counting.timings != 11 {
+		test.Errorf("Expected Timing not to be sampled, got %d timings", counting.timings)
+	}
+}
+
+func TestSampledTimingPerMetric(test *testing.T) {
+	counting := &countingSink{}
+	SetSink(counting)
+	defer SetSink(nil)
+	defer SetTimingSampleRate(1)
+
+	// Every command records three timings, which a shared counter would sample as the same one each time
+	SetTimingSampleRate(3)
+	for i := 0; i < 30; i++ {
+		SampledTiming("flush", time.Millisecond)
+		SampledTiming("copy", time.Millisecond)
+		SampledTiming("per_command", time.Millisecond)
+	}
+	for _, metric := range []string{"flush", "copy", "per_command"} {
+		if counting.sampled[metric] != 10 {
+			test.Errorf("Expected 1 in 3 %s timings to be recorded, got %d of 30", metric, counting.sampled[metric])
+		}
+	}
+}
+
+func TestSampledTimingScalesHistograms(test *testing.T) {
+	registry := NewPrometheusRegistry([]float64{0.001, 0.01})
+	SetSink(Multi(registry))
+	defer SetSink(nil)
+	defer SetTimingSampleRate(1)
+
+	SetTimingSampleRate(10)
+	for i := 0; i < 100; i++ {
+		SampledTiming("command", 5*time.Millisecond)
+	}
+
+	h := registry.histograms["rmux_command_seconds"]
+	if h == nil || h.count != 100 || h.counts[0] != 0 || h.counts[1] != 100 {
+		test.Fatalf("Expected the sampled timings to be scaled back up to 100 observations, got %+v", h)
+	}
+	if h.sumNanos != int64(500*time.Millisecond) {
+		test.Errorf("Expected the sum to be scaled too, got %s", time.Duration(h.sumNanos))
+	}
+}
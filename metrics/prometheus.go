@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Histogram bucket upper bounds, in seconds.  Redis round trips are usually sub-millisecond, so the buckets start small
+var DEFAULT_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+//Collects metrics in memory, and exposes them in the prometheus text format via Handler
+//Increments become counters named rmux_<metric>_total, gauges become rmux_<metric>, and timings become histograms
+//named rmux_<metric>_seconds.  Characters that prometheus doesn't allow in names are replaced with underscores
+//Recording a metric that has been seen before is lock-free: each metric's entry is looked up by the name it's recorded
+//under, and updated atomically.  The lock is only taken to add an entry, and to expose them
+type PrometheusRegistry struct {
+	buckets []float64
+	//Each metric's entry, keyed by the name it's recorded under, ex: "pools.localhost:6379"
+	counterMetrics   sync.Map
+	gaugeMetrics     sync.Map
+	histogramMetrics sync.Map
+	//Guards the entries keyed by their prometheus name, which metrics whose names sanitize to the same one share
+	lock       sync.Mutex
+	counters   map[string]*counter
+	gauges     map[string]*gauge
+	histograms map[string]*histogram
+}
+
+type counter struct {
+	value uint64
+}
+
+type gauge struct {
+	value int64
+}
+
+//Its fields are only accessed atomically.  The sum is kept in nanoseconds, so that it can be added to atomically.  The
+//64-bit fields come first, to keep them aligned for atomic access on 32-bit platforms
+type histogram struct {
+	count    uint64
+	sumNanos int64
+	counts   []uint64
+}
+
+//Initializes an empty registry, whose histograms use the given bucket bounds (in seconds), or DEFAULT_BUCKETS if nil
+func NewPrometheusRegistry(buckets []float64) *PrometheusRegistry {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusRegistry{
+		buckets:    buckets,
+		counters:   make(map[string]*counter),
+		gauges:     make(map[string]*gauge),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (this *PrometheusRegistry) Increment(metric string) {
+	c, ok := this.counterMetrics.Load(metric)
+	if !ok {
+		name := "rmux_" + sanitizeName(metric) + "_total"
+		this.lock.Lock()
+		if c, ok = this.counters[name]; !ok {
+			c = &counter{}
+			this.counters[name] = c.(*counter)
+		}
+		this.counterMetrics.Store(metric, c)
+		this.lock.Unlock()
+	}
+	atomic.AddUint64(&c.(*counter).value, 1)
+}
+
+func (this *PrometheusRegistry) Gauge(metric string, value int) {
+	g, ok := this.gaugeMetrics.Load(metric)
+	if !ok {
+		name := "rmux_" + sanitizeName(metric)
+		this.lock.Lock()
+		if g, ok = this.gauges[name]; !ok {
+			g = &gauge{}
+			this.gauges[name] = g.(*gauge)
+		}
+		this.gaugeMetrics.Store(metric, g)
+		this.lock.Unlock()
+	}
+	atomic.StoreInt64(&g.(*gauge).value, int64(value))
+}
+
+func (this *PrometheusRegistry) Timing(metric string, value time.Duration) {
+	this.SampledTiming(metric, value, 1)
+}
+
+//Records the timing as sampleRate observations of the same value, since it stands in for the ones that weren't sampled
+func (this *PrometheusRegistry) SampledTiming(metric string, value time.Duration, sampleRate int) {
+	entry, ok := this.histogramMetrics.Load(metric)
+	if !ok {
+		name := "rmux_" + sanitizeName(metric) + "_seconds"
+		this.lock.Lock()
+		if entry, ok = this.histograms[name]; !ok {
+			entry = &histogram{counts: make([]uint64, len(this.buckets))}
+			this.histograms[name] = entry.(*histogram)
+		}
+		this.histogramMetrics.Store(metric, entry)
+		this.lock.Unlock()
+	}
+	h := entry.(*histogram)
+	weight := uint64(sampleRate)
+
+	// Buckets are cumulative, so the observation counts towards every bucket at or above it
+	for i := sort.SearchFloat64s(this.buckets, value.Seconds()); i < len(this.buckets); i++ {
+		atomic.AddUint64(&h.counts[i], weight)
+	}
+	atomic.AddUint64(&h.count, weight)
+	atomic.AddInt64(&h.sumNanos, int64(value)*int64(sampleRate))
+}
+
+//Returns an http.Handler that serves the registry's metrics, for mounting at /metrics
+func (this *PrometheusRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(this.Expose())
+	})
+}
+
+//Returns the registry's metrics in the prometheus text format, sorted by name
+//Metrics being recorded meanwhile may be part way through, ex: a histogram's count may include an observation that
+//its buckets don't yet
+func (this *PrometheusRegistry) Expose() []byte {
+	var b bytes.Buffer
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, name := range sortedKeys(this.counters) {
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s %d\n", name, name, atomic.LoadUint64(&this.counters[name].value))
+	}
+
+	for _, name := range sortedKeys(this.gauges) {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %d\n", name, name, atomic.LoadInt64(&this.gauges[name].value))
+	}
+
+	for _, name := range sortedKeys(this.histograms) {
+		h := this.histograms[name]
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for i, bound := range this.buckets {
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), atomic.LoadUint64(&h.counts[i]))
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+		fmt.Fprintf(&b, "%s_sum %s\n", name, strconv.FormatFloat(time.Duration(atomic.LoadInt64(&h.sumNanos)).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count %d\n", name, count)
+	}
+
+	return b.Bytes()
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch typed := m.(type) {
+	case map[string]*counter:
+		for k := range typed {
+			keys = append(keys, k)
+		}
+	case map[string]*gauge:
+		for k := range typed {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range typed {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Replaces anything outside of [a-zA-Z0-9_] with an underscore
+func sanitizeName(metric string) string {
+	b := []byte(metric)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
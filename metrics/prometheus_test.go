@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRegistry(test *testing.T) {
+	registry := NewPrometheusRegistry([]float64{0.001, 0.01})
+	registry.Increment("connect")
+	registry.Increment("connect")
+	registry.Gauge("pools.localhost:6379", 4)
+	registry.Timing("select", 500*time.Microsecond)
+	registry.Timing("select", 5*time.Millisecond)
+	registry.Timing("select", time.Second)
+
+	server := httptest.NewServer(registry.Handler())
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		test.Fatalf("Could not fetch metrics: %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	expected := `# TYPE rmux_connect_total counter
+rmux_connect_total 2
+# TYPE rmux_pools_localhost_6379 gauge
+rmux_pools_localhost_6379 4
+# TYPE rmux_select_seconds histogram
+rmux_select_seconds_bucket{le="0.001"} 1
+rmux_select_seconds_bucket{le="0.01"} 2
+rmux_select_seconds_bucket{le="+Inf"} 3
+rmux_select_seconds_sum 1.0055
+rmux_select_seconds_count 3
+`
+	if string(body) != expected {
+		test.Fatalf("Unexpected exposition.\nExpected:\n%s\nGot:\n%s", expected, body)
+	}
+}
+
+func TestMulti(test *testing.T) {
+	first := NewPrometheusRegistry(nil)
+	second := NewPrometheusRegistry(nil)
+	SetSink(Multi(first, second))
+	defer SetSink(nil)
+
+	Increment("disconnect")
+	for _, registry := range []*PrometheusRegistry{first, second} {
+		if c := registry.counters["rmux_disconnect_total"]; c == nil || c.value != 1 {
+			test.Errorf("Expected every sink to receive the increment, got %v", c)
+		}
+	}
+}
+
+func TestPrometheusRegistryConcurrent(test *testing.T) {
+	registry := NewPrometheusRegistry([]float64{0.001})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				registry.Increment("command")
+				registry.Timing("command.get", time.Millisecond)
+				registry.Expose()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c := registry.counters["rmux_command_total"]; c == nil || c.value != 4000 {
+		test.Fatalf("Expected 4000 increments, got %v", c)
+	}
+	if h := registry.histograms["rmux_command_get_seconds"]; h == nil || h.count != 4000 || h.counts[0] != 4000 {
+		test.Fatalf("Expected 4000 observations, got %+v", h)
+	}
+
+	// Metrics that are already registered are recorded without allocating
+	if allocs := testing.AllocsPerRun(100, func() { registry.Increment("command") }); allocs != 0 {
+		test.Errorf("Incrementing a registered counter should not allocate, got %v allocations", allocs)
+	}
+
+	// Names that sanitize to the same prometheus name are the same metric
+	registry.Increment("pools.a")
+	registry.Increment("pools_a")
+	if c := registry.counters["rmux_pools_a_total"]; c == nil || c.value != 2 || len(registry.counters) != 2 {
+		test.Errorf("Expected both increments to count towards rmux_pools_a_total, got %v of %d counters", c, len(registry.counters))
+	}
+}
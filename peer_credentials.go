@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"errors"
+	"net"
+)
+
+//Returned by GetPeerCredentials on platforms that can't say who is on the other end of a UNIX socket
+var ERR_PEER_CREDENTIALS_UNSUPPORTED = errors.New("Peer credentials are not supported on this platform")
+
+//The process on the other end of a UNIX socket, as the kernel saw it when the connection was made
+type PeerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+//Decides whether a client connected over a UNIX socket may use the proxy.  A non-nil error refuses it, and is sent
+//to the client before its connection is closed
+type PeerAuthorizer func(credentials PeerCredentials) error
+
+//Returns the credentials of the process on the other end of a UNIX socket, ex: to authorize it by its uid
+//The second return is false for any other kind of connection, which has no peer credentials
+func GetPeerCredentials(conn net.Conn) (credentials PeerCredentials, isUnix bool, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, false, nil
+	}
+
+	credentials, err = getPeerCredentials(unixConn)
+	return credentials, true, err
+}
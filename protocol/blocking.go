@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//Added to a blocking command's own timeout, so that the server has time to send its reply once the timeout is up
+	BLOCKING_TIMEOUT_MARGIN = 100 * time.Millisecond
+	//Default longest that the reply to a blocking command is waited for
+	DEFAULT_MAX_BLOCKING_TIMEOUT = 5 * time.Minute
+)
+
+//Commands that may block on the server until their timeout is up.  XREAD and XREADGROUP only block with a BLOCK option
+var BLOCKING_FUNCTIONS = map[string]bool{
+	"blmove":     true,
+	"blmpop":     true,
+	"blpop":      true,
+	"brpop":      true,
+	"brpoplpush": true,
+	"bzmpop":     true,
+	"bzpopmax":   true,
+	"bzpopmin":   true,
+	"xread":      true,
+	"xreadgroup": true,
+}
+
+var (
+	BLOCK_OPTION   = []byte("block")
+	STREAMS_OPTION = []byte("streams")
+
+	maxBlockingTimeout int64 = int64(DEFAULT_MAX_BLOCKING_TIMEOUT)
+
+	//The commands marked with SetLongRunningCommand, as a map[string]time.Duration keyed by lowercased command.  Each
+	//change stores a new map, so that looking one up never has to lock
+	longRunningCommands atomic.Value
+	longRunningLock     sync.Mutex
+)
+
+//Sets the longest that the reply to a blocking command is waited for.  A command that blocks forever (with a timeout
+//of 0) is waited for this long, after which its connection is given up on
+func SetMaxBlockingTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&maxBlockingTimeout, int64(timeout))
+}
+
+//Returns the longest that the reply to a blocking command is waited for
+func MaxBlockingTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&maxBlockingTimeout))
+}
+
+//Marks the given command as one that the server may take longer than a read timeout to reply to, and so whose reply
+//is waited for as long as the given timeout instead, ex: "debug", so that DEBUG SLEEP can be proxied without its
+//connection being given up on.  This takes precedence over the command's usual reply timeout, if it has one
+//A timeout of 0 unmarks the command
+func SetLongRunningCommand(command string, timeout time.Duration) {
+	longRunningLock.Lock()
+	defer longRunningLock.Unlock()
+
+	current := loadLongRunningCommands()
+	next := make(map[string]time.Duration, len(current)+1)
+	for name, existing := range current {
+		next[name] = existing
+	}
+
+	command = strings.ToLower(command)
+	if timeout > 0 {
+		next[command] = timeout
+	} else {
+		delete(next, command)
+	}
+	longRunningCommands.Store(next)
+}
+
+func loadLongRunningCommands() map[string]time.Duration {
+	current, _ := longRunningCommands.Load().(map[string]time.Duration)
+	return current
+}
+
+//Returns how long to wait for the reply to the given command, if it was marked with SetLongRunningCommand
+func LongRunningReplyTimeout(command Command) (time.Duration, bool) {
+	timeout, ok := loadLongRunningCommands()[string(command.GetCommand())]
+	return timeout, ok
+}
+
+//Returns how long to wait for the reply to the given command, if it blocks on the server: its timeout argument plus
+//BLOCKING_TIMEOUT_MARGIN, capped at MaxBlockingTimeout.  A timeout of 0 blocks forever, so it gets the cap
+//The timeout is in seconds (which may be fractional) and is the last argument, except for BLMPOP and BZMPOP, where it's
+//the first, and XREAD and XREADGROUP, where it's the milliseconds after BLOCK
+//Returns false if the command doesn't block.  A timeout that can't be parsed is refused by the server straight away,
+//so it gets just the margin
+func BlockingReplyTimeout(command Command) (time.Duration, bool) {
+	name := command.GetCommand()
+	if !BLOCKING_FUNCTIONS[string(name)] {
+		return 0, false
+	}
+
+	args := commandArgs(command)
+	var timeout float64
+	var err error
+	switch {
+	case name[0] == 'x':
+		position := blockOptionPosition(name, args)
+		if position < 0 {
+			return 0, false
+		}
+		if position+1 >= len(args) {
+			return BLOCKING_TIMEOUT_MARGIN, true
+		}
+		var milliseconds int
+		milliseconds, err = ParseInt(args[position+1])
+		timeout = float64(milliseconds) / 1000
+	case string(name) == "blmpop" || string(name) == "bzmpop":
+		if len(args) < 1 {
+			return BLOCKING_TIMEOUT_MARGIN, true
+		}
+		timeout, err = strconv.ParseFloat(string(args[0]), 64)
+	default:
+		if len(args) < 2 {
+			return BLOCKING_TIMEOUT_MARGIN, true
+		}
+		timeout, err = strconv.ParseFloat(string(args[len(args)-1]), 64)
+	}
+
+	if err != nil || timeout < 0 {
+		return BLOCKING_TIMEOUT_MARGIN, true
+	}
+
+	maxTimeout := MaxBlockingTimeout()
+	if timeout == 0 || timeout >= maxTimeout.Seconds() {
+		return maxTimeout, true
+	}
+
+	blockingTimeout := time.Duration(timeout*float64(time.Second)) + BLOCKING_TIMEOUT_MARGIN
+	if blockingTimeout > maxTimeout {
+		blockingTimeout = maxTimeout
+	}
+	return blockingTimeout, true
+}
+
+//Returns the position of the BLOCK option among an XREAD or XREADGROUP's arguments, or -1 if it has none
+//Options all come before STREAMS, after which the arguments are stream names and ids.  XREADGROUP's options follow
+//GROUP and its group and consumer names, which could be anything
+func blockOptionPosition(name []byte, args [][]byte) int {
+	start := 0
+	if string(name) == "xreadgroup" {
+		start = 3
+	}
+
+	for i := start; i < len(args); i++ {
+		if bytes.EqualFold(args[i], STREAMS_OPTION) {
+			break
+		}
+		if bytes.EqualFold(args[i], BLOCK_OPTION) {
+			return i
+		}
+	}
+	return -1
+}
+
+//Returns how long to wait for the reply to the given command, if the server may legitimately take longer than a
+//read timeout to send it: a command marked as long running, a WAIT, or a blocking command.  See
+//LongRunningReplyTimeout, WaitReplyTimeout and BlockingReplyTimeout
+func ReplyTimeout(command Command) (time.Duration, bool) {
+	if timeout, ok := LongRunningReplyTimeout(command); ok {
+		return timeout, true
+	}
+	if timeout, ok := WaitReplyTimeout(command); ok {
+		return timeout, true
+	}
+	return BlockingReplyTimeout(command)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockingReplyTimeout(test *testing.T) {
+	testData := []struct {
+		command  string
+		ok       bool
+		expected time.Duration
+	}{
+		{"*3\r\n$5\r\nblpop\r\n$1\r\na\r\n$1\r\n5\r\n", true, 5*time.Second + BLOCKING_TIMEOUT_MARGIN},
+		{"*4\r\n$5\r\nBRPOP\r\n$1\r\na\r\n$1\r\nb\r\n$3\r\n0.5\r\n", true, 500*time.Millisecond + BLOCKING_TIMEOUT_MARGIN},
+		{"*4\r\n$10\r\nbrpoplpush\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\n0\r\n", true, DEFAULT_MAX_BLOCKING_TIMEOUT},
+		{"*3\r\n$8\r\nbzpopmin\r\n$1\r\na\r\n$6\r\n999999\r\n", true, DEFAULT_MAX_BLOCKING_TIMEOUT},
+		{"*3\r\n$5\r\nblpop\r\n$1\r\na\r\n$3\r\nabc\r\n", true, BLOCKING_TIMEOUT_MARGIN},
+		{"*2\r\n$5\r\nblpop\r\n$1\r\na\r\n", true, BLOCKING_TIMEOUT_MARGIN},
+		{"blpop a 2\r\n", true, 2*time.Second + BLOCKING_TIMEOUT_MARGIN},
+		{"blmove a b left right 3\r\n", true, 3*time.Second + BLOCKING_TIMEOUT_MARGIN},
+		//blmpop and bzmpop take their timeout first
+		{"blmpop 1 1 a left\r\n", true, time.Second + BLOCKING_TIMEOUT_MARGIN},
+		{"bzmpop 0 1 a min\r\n", true, DEFAULT_MAX_BLOCKING_TIMEOUT},
+		//xread only blocks with a block option, given in milliseconds
+		{"xread count 1 block 1500 streams a 0\r\n", true, 1500*time.Millisecond + BLOCKING_TIMEOUT_MARGIN},
+		{"xread BLOCK 0 STREAMS a $\r\n", true, DEFAULT_MAX_BLOCKING_TIMEOUT},
+		{"xread count 1 streams block 0\r\n", false, 0},
+		{"xread block\r\n", true, BLOCKING_TIMEOUT_MARGIN},
+		{"xreadgroup group block consumer streams a >\r\n", false, 0},
+		{"xreadgroup group g c block 250 streams a >\r\n", true, 250*time.Millisecond + BLOCKING_TIMEOUT_MARGIN},
+		{"*2\r\n$4\r\nlpop\r\n$1\r\na\r\n", false, 0},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		timeout, ok := BlockingReplyTimeout(command)
+		if ok != d.ok || timeout != d.expected {
+			test.Errorf("BlockingReplyTimeout(%q) returned %s, %t. Expected %s, %t", d.command, timeout, ok, d.expected, d.ok)
+		}
+	}
+}
+
+func TestMaxBlockingTimeout(test *testing.T) {
+	defer SetMaxBlockingTimeout(DEFAULT_MAX_BLOCKING_TIMEOUT)
+	SetMaxBlockingTimeout(time.Second)
+
+	command, err := ParseCommand([]byte("blpop a 0\r\n"))
+	if err != nil {
+		test.Fatalf("Error parsing: %s", err)
+	}
+	if timeout, ok := BlockingReplyTimeout(command); !ok || timeout != time.Second {
+		test.Errorf("Expected blocking forever to be capped at the max blocking timeout, got %s", timeout)
+	}
+
+	command, err = ParseCommand([]byte("blpop a 5\r\n"))
+	if err != nil {
+		test.Fatalf("Error parsing: %s", err)
+	}
+	if timeout, ok := BlockingReplyTimeout(command); !ok || timeout != time.Second {
+		test.Errorf("Expected a longer timeout to be capped at the max blocking timeout, got %s", timeout)
+	}
+}
+
+func TestLongRunningReplyTimeout(test *testing.T) {
+	defer SetLongRunningCommand("debug", 0)
+	defer SetLongRunningCommand("blpop", 0)
+
+	debugSleep, err := ParseCommand([]byte("DEBUG SLEEP 5\r\n"))
+	if err != nil {
+		test.Fatalf("Error parsing: %s", err)
+	}
+	if _, ok := ReplyTimeout(debugSleep); ok {
+		test.Error("Expected DEBUG not to have a reply timeout until it's marked as long running")
+	}
+
+	SetLongRunningCommand("DEBUG", 6*time.Second)
+	if timeout, ok := ReplyTimeout(debugSleep); !ok || timeout != 6*time.Second {
+		test.Errorf("Expected the long running timeout, got %s, %t", timeout, ok)
+	}
+
+	// Marking a blocking command overrides the timeout it would get from its arguments
+	blpop, err := ParseCommand([]byte("blpop a 1\r\n"))
+	if err != nil {
+		test.Fatalf("Error parsing: %s", err)
+	}
+	SetLongRunningCommand("blpop", time.Minute)
+	if timeout, ok := ReplyTimeout(blpop); !ok || timeout != time.Minute {
+		test.Errorf("Expected the long running timeout to take precedence, got %s, %t", timeout, ok)
+	}
+
+	SetLongRunningCommand("debug", 0)
+	if _, ok := LongRunningReplyTimeout(debugSleep); ok {
+		test.Error("Expected a timeout of 0 to unmark the command")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { ReplyTimeout(debugSleep) }); allocs != 0 {
+		test.Errorf("Expected looking up a reply timeout not to allocate, got %v allocations", allocs)
+	}
+}
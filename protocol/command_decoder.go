@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+)
+
+//The states a CommandDecoder moves through.  It ends in either DECODE_DONE or DECODE_FAILED
+type DecoderState int
+
+const (
+	//Waiting on the *N header of the multibulk
+	DECODE_HEADER DecoderState = iota
+	//Waiting on the $N header of the next element
+	DECODE_BULK_HEADER
+	//Waiting on the payload of the current element, and its trailing \r\n
+	DECODE_BULK_PAYLOAD
+	//Every element has been decoded
+	DECODE_DONE
+	//The command couldn't be decoded.  The same error is returned from then on
+	DECODE_FAILED
+)
+
+//Where a decoded element lies in the command's contents.  A null bulk has a negative Start
+type ElementSpan struct {
+	Start int
+	End   int
+}
+
+//Returns the element from the contents it was decoded from, or nil for a null bulk
+func (this ElementSpan) Of(contents []byte) []byte {
+	if this.Start < 0 {
+		return nil
+	}
+	return contents[this.Start:this.End]
+}
+
+//Decodes a multibulk command an element at a time, as it arrives
+//Every call is given all of the command buffered so far, from its first byte, and carries on from where the last one
+//stopped.  Only offsets are kept between calls, so the contents may move (ex: in a bufio.Reader's buffer) as they grow.
+//Nothing past the end of the contents is ever looked at: an incomplete command returns ERROR_NEED_MORE_DATA, and
+//a malformed one a RecoverableError.  The zero value is ready to use
+type CommandDecoder struct {
+	state DecoderState
+	err   error
+	// Of the next byte to decode
+	offset int
+	// The elements the header announced, and how many of them have been decoded
+	count   int
+	decoded int
+	// The payload of the element being decoded
+	payloadStart  int
+	payloadLength int
+	// Whether a payload was trailed by a bare \n, which LenientNewlines accepts in place of \r\n.  If so, the command
+	// isn't well formed as it is, see canonicalCommand
+	bareNewline bool
+}
+
+func (this *CommandDecoder) State() DecoderState {
+	return this.state
+}
+
+//Returns the number of elements in the command, or 0 until its header has been decoded
+func (this *CommandDecoder) Count() int {
+	return this.count
+}
+
+//Returns the number of elements decoded so far
+func (this *CommandDecoder) Decoded() int {
+	return this.decoded
+}
+
+//Returns how much of the contents has been decoded.  Once DECODE_DONE, that's the length of the whole command
+func (this *CommandDecoder) Offset() int {
+	return this.offset
+}
+
+//Decodes the next element of the command, and returns where it lies in the contents
+//Returns io.EOF once every element has been decoded, or ERROR_NEED_MORE_DATA if the contents end before the next one
+//does, in which case it can be called again once more has been buffered.  Any other error is final
+func (this *CommandDecoder) Next(contents []byte) (span ElementSpan, err error) {
+	for {
+		switch this.state {
+		case DECODE_HEADER:
+			line, next, err := this.headerLine(contents, '*', ERROR_MULTIBULK_FORMAT_REQUIRED)
+			if err != nil {
+				return span, err
+			}
+
+			count, err := ParseInt(line)
+			if err != nil {
+				return span, this.fail(err)
+			} else if count < 1 {
+				return span, this.fail(ERROR_COMMAND_PARSE)
+			} else if err = checkMultibulkLength(count); err != nil {
+				return span, this.fail(err)
+			}
+
+			this.count, this.offset, this.state = count, next, DECODE_BULK_HEADER
+		case DECODE_BULK_HEADER:
+			line, next, err := this.headerLine(contents, '$', ERROR_COMMAND_PARSE)
+			if err != nil {
+				return span, err
+			}
+
+			// Parsed as an int64, so that a length past a 32-bit int is refused as too long rather than as malformed
+			length, err := ParseInt64(line)
+			if err != nil {
+				return span, this.fail(err)
+			} else if length < 0 {
+				this.offset = next
+				return this.element(ElementSpan{-1, -1}), nil
+			} else if err = checkBulkLength(length); err != nil {
+				return span, this.fail(err)
+			} else if length > int64(MAX_INT) {
+				return span, this.fail(ERROR_BULK_TOO_LONG)
+			}
+
+			this.payloadStart, this.payloadLength, this.offset, this.state = next, int(length), next, DECODE_BULK_PAYLOAD
+		case DECODE_BULK_PAYLOAD:
+			// Compared without adding to the length, which a huge bulk limit would let overflow
+			available := len(contents) - this.payloadStart
+			if available <= this.payloadLength {
+				return span, ERROR_NEED_MORE_DATA
+			}
+
+			end := this.payloadStart + this.payloadLength
+			// Checked before waiting on the rest of a \r\n, since a bare \n may be the last byte the client sends
+			if contents[end] == '\n' && LenientNewlines() {
+				this.offset, this.bareNewline = end+1, true
+				return this.element(ElementSpan{this.payloadStart, end}), nil
+			}
+
+			if available-1 <= this.payloadLength {
+				return span, ERROR_NEED_MORE_DATA
+			}
+			if contents[end] != '\r' || contents[end+1] != '\n' {
+				return span, this.fail(ERROR_BAD_BULK_FORMAT)
+			}
+
+			this.offset = end + 2
+			return this.element(ElementSpan{this.payloadStart, end}), nil
+		case DECODE_DONE:
+			return span, io.EOF
+		default:
+			return span, this.err
+		}
+	}
+}
+
+//Decodes elements onto the spans until the command has been decoded, or there are max spans if max is positive
+func (this *CommandDecoder) appendSpans(contents []byte, spans []ElementSpan, max int) ([]ElementSpan, error) {
+	for max <= 0 || len(spans) < max {
+		span, err := this.Next(contents)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return spans, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+//Returns the header line with the given prefix at the offset, without either, and the offset just past the line
+func (this *CommandDecoder) headerLine(contents []byte, prefix byte, prefixErr error) (line []byte, next int, err error) {
+	if len(contents) <= this.offset {
+		return nil, 0, ERROR_NEED_MORE_DATA
+	} else if contents[this.offset] != prefix {
+		return nil, 0, this.fail(prefixErr)
+	}
+
+	newlinePos := bytes.Index(contents[this.offset:], REDIS_NEWLINE)
+	if newlinePos < 0 {
+		return nil, 0, ERROR_NEED_MORE_DATA
+	}
+
+	return contents[this.offset+1 : this.offset+newlinePos], this.offset + newlinePos + 2, nil
+}
+
+//Returns the multibulk command re-encoded with a \r\n after each of its payloads, for one that was decoded with bare
+//\n trailers, so that what's passed on is well formed
+func canonicalCommand(command []byte) []byte {
+	var decoder CommandDecoder
+	spans, err := decoder.appendSpans(command, nil, 0)
+	if err != nil {
+		return command
+	}
+
+	canonical := appendMultibulkHeader(make([]byte, 0, len(command)+len(spans)), '*', len(spans))
+	for _, span := range spans {
+		if span.Start < 0 {
+			canonical = appendMultibulkHeader(canonical, '$', -1)
+			continue
+		}
+		canonical = appendMultibulkHeader(canonical, '$', span.End-span.Start)
+		canonical = append(append(canonical, span.Of(command)...), REDIS_NEWLINE...)
+	}
+	return canonical
+}
+
+func (this *CommandDecoder) element(span ElementSpan) ElementSpan {
+	this.decoded++
+	if this.decoded == this.count {
+		this.state = DECODE_DONE
+	} else {
+		this.state = DECODE_BULK_HEADER
+	}
+	return span
+}
+
+func (this *CommandDecoder) fail(err error) error {
+	this.state, this.err = DECODE_FAILED, err
+	return err
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCommandDecoder(test *testing.T) {
+	input := []byte("*3\r\n$3\r\nSET\r\n$-1\r\n$5\r\nva\r\nl\r\n")
+	expected := [][]byte{[]byte("SET"), nil, []byte("va\r\nl")}
+
+	// Fed a byte at a time, every element comes out once, as soon as it's complete
+	var decoder CommandDecoder
+	var decoded [][]byte
+	for i := 0; i <= len(input); i++ {
+		for {
+			span, err := decoder.Next(input[:i])
+			if err == ERROR_NEED_MORE_DATA || err == io.EOF {
+				break
+			} else if err != nil {
+				test.Fatalf("Decoding %q failed: %s", input[:i], err)
+			}
+			decoded = append(decoded, span.Of(input[:i]))
+		}
+	}
+
+	if len(decoded) != len(expected) {
+		test.Fatalf("Expected %q, got %q", expected, decoded)
+	}
+	for i := range expected {
+		if !bytes.Equal(expected[i], decoded[i]) || (expected[i] == nil) != (decoded[i] == nil) {
+			test.Errorf("Expected element %d to be %q, got %q", i, expected[i], decoded[i])
+		}
+	}
+
+	if decoder.State() != DECODE_DONE || decoder.Count() != 3 || decoder.Decoded() != 3 || decoder.Offset() != len(input) {
+		test.Errorf("Unexpected decoder after the command: %+v", decoder)
+	}
+
+	testData := []struct {
+		input    string
+		expected error
+	}{
+		{"PING\r\n", ERROR_MULTIBULK_FORMAT_REQUIRED},
+		{"$3\r\nget\r\n", ERROR_MULTIBULK_FORMAT_REQUIRED},
+		{"*0\r\n", ERROR_COMMAND_PARSE},
+		{"*-1\r\n", ERROR_COMMAND_PARSE},
+		{"*\r\n", ERROR_INVALID_INT},
+		{"*1\r\n:1\r\n", ERROR_COMMAND_PARSE},
+		{"*1\r\n$\r\n", ERROR_INVALID_INT},
+		{"*1\r\n$3\r\ngetxx", ERROR_BAD_BULK_FORMAT},
+		{"*1\r\n$99999999999999999999\r\n", ERROR_INVALID_INT},
+		{"*1\r\n$9223372036854775807\r\n", ERROR_BULK_TOO_LONG},
+		{"*1\r\n$3\r\nge", ERROR_NEED_MORE_DATA},
+		{"*1", ERROR_NEED_MORE_DATA},
+	}
+
+	for _, d := range testData {
+		var decoder CommandDecoder
+		_, err := decoder.appendSpans([]byte(d.input), nil, 0)
+		if err != d.expected {
+			test.Errorf("Expected %v decoding %q, got %v", d.expected, d.input, err)
+		}
+
+		// Failures are final, however much more arrives
+		if _, again := decoder.Next([]byte(d.input + "*1\r\n$4\r\nping\r\n")); err != ERROR_NEED_MORE_DATA && again != err {
+			test.Errorf("Expected %v to be returned again for %q, got %v", err, d.input, again)
+		}
+	}
+}
+
+//Checks that GetCommand never panics, and decodes a command the same way however it arrives
+//Run with: go test -fuzz=FuzzGetCommand ./protocol
+func FuzzGetCommand(f *testing.F) {
+	seeds := []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+		"*3\r\n$3\r\nset\r\n$-1\r\n$0\r\n\r\n",
+		"*1\r\n$4\r\nping",
+		"*2\r\n$3\r\nget\r\n$",
+		"*1\r\n$-",
+		"*-\r\n",
+		"*1\r\n$3\r\ngetxx",
+		"*1\r\n$9223372036854775807\r\n",
+		"*1\r\n$2147483647\r\n",
+		"PING\r\n",
+		" GET  key\n",
+		"\r\n",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed), false)
+		f.Add([]byte(seed), true)
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte, allowInline bool) {
+		command, firstArg, err := GetCommand(bufio.NewReader(bytes.NewReader(input)), allowInline, nil)
+
+		splitCommand, splitFirstArg, splitErr := GetCommand(bufio.NewReader(iotest.OneByteReader(bytes.NewReader(input))), allowInline, nil)
+		if splitErr != err || !bytes.Equal(splitCommand, command) || !bytes.Equal(splitFirstArg, firstArg) {
+			t.Fatalf("GetCommand(%q) returned %q %q %v whole, but %q %q %v split", input, command, firstArg, err,
+				splitCommand, splitFirstArg, splitErr)
+		}
+
+		if !allowInline {
+			// GetCommand stops after the first argument, so it can only succeed more often
+			if _, _, argsErr := GetCommandAndArgs(bufio.NewReader(strings.NewReader(string(input))), nil); argsErr == nil && err != nil {
+				t.Fatalf("GetCommandAndArgs(%q) decoded a command that GetCommand failed on with %v", input, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+//The name that commands outside of METRIC_COMMANDS are recorded under
+const OTHER_METRIC_COMMAND = "other"
+
+//Commands that get their own latency metric.  Anything else is bucketed under OTHER_METRIC_COMMAND, so that clients
+//sending arbitrary verbs can't grow the number of metrics without bound
+var METRIC_COMMANDS = []string{
+	"append", "bitcount", "decr", "decrby", "del", "dump", "echo", "eval", "evalsha", "exists", "expire",
+	"expireat", "fcall", "fcall_ro", "get", "getbit", "getrange", "getset", "hdel", "hexists", "hget", "hgetall", "hincrby",
+	"hincrbyfloat", "hkeys", "hlen", "hmget", "hmset", "hscan", "hset", "hsetnx", "hvals", "incr", "incrby",
+	"incrbyfloat", "info", "lindex", "linsert", "llen", "lpop", "lpush", "lpushx", "lrange", "lrem", "lset",
+	"ltrim", "mget", "mset", "persist", "pexpire", "pexpireat", "ping", "psetex", "pttl", "publish", "rpop",
+	"rpoplpush", "rpush", "rpushx", "sadd", "scard", "select", "set", "setbit", "setex", "setnx", "setrange",
+	"sismember", "smembers", "sort", "spop", "srandmember", "srem", "sscan", "strlen", "ttl", "type", "zadd",
+	"zcard", "zcount", "zincrby", "zlexcount", "zrange", "zrangebylex", "zrangebyscore", "zrank", "zrem",
+	"zremrangebylex", "zremrangebyrank", "zremrangebyscore", "zrevrange", "zrevrangebylex", "zrevrangebyscore",
+	"zrevrank", "zscan", "zscore",
+}
+
+//Maps each of METRIC_COMMANDS to itself, so that looking up a name doesn't allocate
+var metricCommandNames = make(map[string]string, len(METRIC_COMMANDS))
+
+//Maps each of METRIC_COMMANDS to its timing metric, ex: "command.get", so that it isn't built for every command
+var commandTimingMetrics = make(map[string]string, len(METRIC_COMMANDS))
+
+//The timing metric of commands outside of METRIC_COMMANDS
+const OTHER_COMMAND_TIMING_METRIC = "command." + OTHER_METRIC_COMMAND
+
+func init() {
+	for _, command := range METRIC_COMMANDS {
+		metricCommandNames[command] = command
+		commandTimingMetrics[command] = "command." + command
+	}
+}
+
+//Returns the name that the given lowercased command's latency is recorded under
+func CommandMetricName(command []byte) string {
+	if name, ok := metricCommandNames[string(command)]; ok {
+		return name
+	}
+	return OTHER_METRIC_COMMAND
+}
+
+//Returns the metric that the given lowercased command's latency is recorded under, ex: "command.get"
+func CommandTimingMetric(command []byte) string {
+	if metric, ok := commandTimingMetrics[string(command)]; ok {
+		return metric
+	}
+	return OTHER_COMMAND_TIMING_METRIC
+}
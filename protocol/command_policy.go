@@ -0,0 +1,330 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//How a policy treats one command.  A command can be both single-db and allowed or denied
+type commandRule uint8
+
+const (
+	//Allowed, even though IsSupportedFunction would refuse it as unsafe.  Its multiplexing and multi-key checks still
+	//apply
+	RULE_ALLOWED commandRule = 1 << iota
+	//Refused, even though IsSupportedFunction would allow it
+	RULE_DENIED
+	//Only allowed while not multiplexing
+	RULE_SINGLE_DB
+	//Only allowed as one of its INTROSPECTION_SUBCOMMANDS (ex: OBJECT ENCODING), which CheckCommand looks for
+	RULE_INTROSPECTION_ONLY
+	//Only allowed as one of the subcommands given to AllowSubcommands (ex: CONFIG GET), which CheckCommand looks for
+	RULE_SUBCOMMANDS_ONLY
+	//Allowed while multiplexing too, even though IsSupportedFunction only allows it while not multiplexing
+	RULE_MULTI_DB
+)
+
+//The names of the policies that NewCommandPolicyProfile knows
+const (
+	//Exactly what IsSupportedFunction allows
+	POLICY_PROFILE_DEFAULT = "default"
+	//The default, plus the key introspection subcommands of INTROSPECTION_SUBCOMMANDS (ex: OBJECT ENCODING, MEMORY
+	//USAGE).  The rest of OBJECT and MEMORY stay refused
+	POLICY_PROFILE_MONITORING = "monitoring"
+	//Only the commands that never write (see READONLY_FUNCTIONS), in allowlist mode
+	POLICY_PROFILE_LOCKED_DOWN = "locked-down"
+)
+
+//Error for a profile name that NewCommandPolicyProfile doesn't know
+var ERR_UNKNOWN_POLICY_PROFILE = &RecoverableError{"unknown command policy profile"}
+
+//An immutable snapshot of a policy's rules.  Changes build a new snapshot, so that Check never has to lock
+type commandRules struct {
+	//Whether only the allowed commands are accepted
+	allowlist bool
+	//The rules of every command the policy has been told about, keyed by lowercased command
+	rules map[string]commandRule
+	//The subcommands allowed by AllowSubcommands, keyed by lowercased command and then lowercased subcommand
+	subcommands map[string]map[string]bool
+}
+
+//Decides which commands a client may send through the proxy
+//By default, a policy follows IsSupportedFunction.  Commands that it refuses as unsafe can be allowed on top of that
+//(ex: "dbsize", for a read-only monitoring deployment), and commands can be denied.  Allowing a command doesn't lift
+//IsSupportedFunction's multiplexing and multi-key checks: those are changed with SetSingleDb.  A policy is safe to
+//change while clients are using it
+//In allowlist mode, only the allowed commands (and ALWAYS_ALLOWED_COMMANDS) are accepted, still subject to the
+//multiplexing and multi-key checks
+type CommandPolicy struct {
+	//Serializes changes.  Checks read the current snapshot without it
+	lock sync.Mutex
+	//The current *commandRules
+	current atomic.Value
+}
+
+//Commands that the proxy answers itself, which are accepted even in allowlist mode
+var ALWAYS_ALLOWED_COMMANDS = map[string]bool{
+	"ping": true,
+	"quit": true,
+}
+
+//Initializes a new command policy, that allows exactly what IsSupportedFunction allows
+//The zero value is ready to use as well
+func NewCommandPolicy() *CommandPolicy {
+	return &CommandPolicy{}
+}
+
+//Initializes a new command policy from the given named profile: one of the POLICY_PROFILE_* names
+//The returned policy can be changed further, ex: to allow or deny more commands
+func NewCommandPolicyProfile(name string) (*CommandPolicy, error) {
+	policy := NewCommandPolicy()
+	switch name {
+	case POLICY_PROFILE_DEFAULT, "":
+	case POLICY_PROFILE_MONITORING:
+		for command := range INTROSPECTION_SUBCOMMANDS {
+			policy.AllowIntrospection(command)
+		}
+	case POLICY_PROFILE_LOCKED_DOWN:
+		policy.SetAllowlist(true)
+		for command := range READONLY_FUNCTIONS {
+			policy.Allow(command)
+		}
+	default:
+		return nil, ERR_UNKNOWN_POLICY_PROFILE
+	}
+	return policy, nil
+}
+
+//The rules of a policy that hasn't been changed since it was declared
+var noCommandRules = &commandRules{rules: map[string]commandRule{}, subcommands: map[string]map[string]bool{}}
+
+func (this *CommandPolicy) load() *commandRules {
+	if current, ok := this.current.Load().(*commandRules); ok {
+		return current
+	}
+	return noCommandRules
+}
+
+//Copies the current rules, lets change edit the copy, and publishes it
+func (this *CommandPolicy) update(change func(next *commandRules)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	current := this.load()
+	next := &commandRules{
+		allowlist:   current.allowlist,
+		rules:       make(map[string]commandRule, len(current.rules)),
+		subcommands: make(map[string]map[string]bool, len(current.subcommands)),
+	}
+	for command, rule := range current.rules {
+		next.rules[command] = rule
+	}
+	// The sets are replaced, rather than changed, so sharing them with the current snapshot is safe
+	for command, subcommands := range current.subcommands {
+		next.subcommands[command] = subcommands
+	}
+	change(next)
+	this.current.Store(next)
+}
+
+//Sets and clears bits of the given commands' rules, dropping the ones left empty
+func (this *commandRules) setRule(command string, set, clear commandRule) {
+	command = strings.ToLower(command)
+	rule := (this.rules[command] &^ clear) | set
+	if rule == 0 {
+		delete(this.rules, command)
+	} else {
+		this.rules[command] = rule
+	}
+	if rule&RULE_SUBCOMMANDS_ONLY == 0 {
+		delete(this.subcommands, command)
+	}
+}
+
+//Allows the given commands, overriding any earlier Deny, AllowIntrospection or AllowSubcommands
+//Only IsSupportedFunction's refusal of unsafe commands (the ones it refuses even while not multiplexing) is overridden,
+//so ex: allowing mget doesn't allow it while multiplexing
+func (this *CommandPolicy) Allow(commands ...string) {
+	this.update(func(next *commandRules) {
+		for _, command := range commands {
+			next.setRule(command, RULE_ALLOWED, RULE_DENIED|RULE_INTROSPECTION_ONLY|RULE_SUBCOMMANDS_ONLY)
+		}
+	})
+}
+
+//Allows only the INTROSPECTION_SUBCOMMANDS of the given commands (ex: OBJECT ENCODING, but not OBJECT as a whole),
+//overriding any earlier Allow or Deny.  Only CheckCommand sees the subcommand, so Check refuses these commands
+func (this *CommandPolicy) AllowIntrospection(commands ...string) {
+	this.update(func(next *commandRules) {
+		for _, command := range commands {
+			next.setRule(command, RULE_ALLOWED|RULE_INTROSPECTION_ONLY, RULE_DENIED)
+		}
+	})
+}
+
+//Allows the given command only as one of the given subcommands (ex: "config", "get"), where the rest of the command
+//stays refused.  Adds to the subcommands already allowed, overriding any earlier Allow or Deny, and can be combined
+//with AllowIntrospection.  Only CheckCommand sees the subcommand, so Check refuses the command
+func (this *CommandPolicy) AllowSubcommands(command string, subcommands ...string) {
+	this.update(func(next *commandRules) {
+		next.setRule(command, RULE_ALLOWED|RULE_SUBCOMMANDS_ONLY, RULE_DENIED)
+
+		command = strings.ToLower(command)
+		allowed := make(map[string]bool, len(next.subcommands[command])+len(subcommands))
+		for subcommand := range next.subcommands[command] {
+			allowed[subcommand] = true
+		}
+		for _, subcommand := range subcommands {
+			allowed[strings.ToLower(subcommand)] = true
+		}
+		next.subcommands[command] = allowed
+	})
+}
+
+//Refuses the given commands, overriding any earlier Allow, AllowIntrospection or AllowSubcommands
+func (this *CommandPolicy) Deny(commands ...string) {
+	this.update(func(next *commandRules) {
+		for _, command := range commands {
+			next.setRule(command, RULE_DENIED, RULE_ALLOWED|RULE_INTROSPECTION_ONLY|RULE_SUBCOMMANDS_ONLY)
+		}
+	})
+}
+
+//Turns allowlist mode on or off.  While it is on, only commands passed to Allow are accepted
+func (this *CommandPolicy) SetAllowlist(enabled bool) {
+	this.update(func(next *commandRules) {
+		next.allowlist = enabled
+	})
+}
+
+//Sets whether the given command is only allowed while not multiplexing
+//Marking a command single-db applies to allowed commands too.  Clearing it also lifts IsSupportedFunction's own
+//single-db rule (ex: for sdiff or keys), so that the command is checked as if not multiplexing
+func (this *CommandPolicy) SetSingleDb(command string, singleDb bool) {
+	this.update(func(next *commandRules) {
+		if singleDb {
+			next.setRule(command, RULE_SINGLE_DB, RULE_MULTI_DB)
+		} else {
+			next.setRule(command, RULE_MULTI_DB, RULE_SINGLE_DB)
+		}
+	})
+}
+
+//Returns whether the given lowercased command may be sent through the proxy
+//A nil policy behaves like NewCommandPolicy()
+func (this *CommandPolicy) IsSupported(command []byte, isMultiplexing, isMultipleArgument bool) bool {
+	return this.Check(command, isMultiplexing, isMultipleArgument) == nil
+}
+
+//Returns nil if the given lowercased command may be sent through the proxy.  Otherwise, returns the error to reply
+//with: ERR_COMMAND_NOT_ALLOWED if allowlist mode refuses it, or ERR_COMMAND_UNSUPPORTED
+//A nil policy behaves like NewCommandPolicy().  Checking doesn't lock or allocate
+func (this *CommandPolicy) Check(command []byte, isMultiplexing, isMultipleArgument bool) error {
+	return this.check(command, nil, isMultiplexing, isMultipleArgument)
+}
+
+//Like Check, but given the whole command, so that commands allowed by AllowIntrospection are accepted as their
+//INTROSPECTION_SUBCOMMANDS, commands allowed by AllowSubcommands as their subcommands, and SAFE_SUBCOMMANDS unless
+//their command is denied (or, in allowlist mode, isn't allowed).  Only those commands have their arguments looked at
+func (this *CommandPolicy) CheckCommand(command Command, isMultiplexing bool) error {
+	return this.check(command.GetCommand(), command, isMultiplexing, command.GetArgCount() > 2)
+}
+
+//Checks the given lowercased command name.  The whole command is only given by CheckCommand, and is only looked at
+//for the rules that depend on its subcommand
+func (this *CommandPolicy) check(name []byte, command Command, isMultiplexing, isMultipleArgument bool) error {
+	if this == nil {
+		if !IsSupportedFunction(name, isMultiplexing, isMultipleArgument) && !isSafeSubcommand(command) {
+			return ERR_COMMAND_UNSUPPORTED
+		}
+		return nil
+	}
+
+	current := this.load()
+	//The compiler doesn't copy name for a lookup keyed by string(name)
+	rule := current.rules[string(name)]
+
+	refused := ERR_COMMAND_UNSUPPORTED
+	if current.allowlist {
+		refused = ERR_COMMAND_NOT_ALLOWED
+	}
+
+	if rule&RULE_DENIED != 0 {
+		return refused
+	}
+
+	if rule&(RULE_INTROSPECTION_ONLY|RULE_SUBCOMMANDS_ONLY) != 0 && !current.allowsSubcommand(rule, name, command) {
+		return refused
+	}
+
+	if isMultiplexing && rule&RULE_SINGLE_DB != 0 {
+		return ERR_COMMAND_UNSUPPORTED
+	}
+	if rule&RULE_MULTI_DB != 0 {
+		isMultiplexing = false
+	}
+
+	if rule&RULE_ALLOWED != 0 {
+		// Commands that IsSupportedFunction only refuses while multiplexing, or with several keys, are still refused then
+		if IsSupportedFunction(name, false, false) && !IsSupportedFunction(name, isMultiplexing, isMultipleArgument) {
+			return ERR_COMMAND_UNSUPPORTED
+		}
+		return nil
+	}
+
+	if current.allowlist {
+		if ALWAYS_ALLOWED_COMMANDS[string(name)] {
+			return nil
+		}
+		return ERR_COMMAND_NOT_ALLOWED
+	}
+
+	if !IsSupportedFunction(name, isMultiplexing, isMultipleArgument) && !isSafeSubcommand(command) {
+		return ERR_COMMAND_UNSUPPORTED
+	}
+	return nil
+}
+
+//Returns whether the given command is one of the subcommands that its rule restricts it to.  A command given without
+//its arguments (by Check) never is
+func (this *commandRules) allowsSubcommand(rule commandRule, name []byte, command Command) bool {
+	if command == nil {
+		return false
+	}
+	if rule&RULE_INTROSPECTION_ONLY != 0 && IsIntrospectionCommand(command) {
+		return true
+	}
+	return rule&RULE_SUBCOMMANDS_ONLY != 0 && command.GetArgCount() > 0 &&
+		hasSubcommand(this.subcommands[string(name)], command.GetFirstArg())
+}
+
+//Returns whether the given command, if there is one, is one of SAFE_SUBCOMMANDS
+func isSafeSubcommand(command Command) bool {
+	return command != nil && IsSafeSubcommand(command)
+}
@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestCommandPolicy(test *testing.T) {
+	var nilPolicy *CommandPolicy
+	policy := NewCommandPolicy()
+
+	for _, command := range []string{"get", "dbsize", "mget", "config"} {
+		for _, isMultiplexing := range []bool{true, false} {
+			expected := IsSupportedFunction([]byte(command), isMultiplexing, false)
+			if policy.IsSupported([]byte(command), isMultiplexing, false) != expected {
+				test.Errorf("Expected the default policy to match IsSupportedFunction for %s", command)
+			}
+			if nilPolicy.IsSupported([]byte(command), isMultiplexing, false) != expected {
+				test.Errorf("Expected a nil policy to match IsSupportedFunction for %s", command)
+			}
+		}
+	}
+
+	policy.Allow("DBSIZE")
+	if !policy.IsSupported([]byte("dbsize"), true, false) {
+		test.Error("Expected dbsize to be allowed")
+	}
+
+	policy.SetSingleDb("dbsize", true)
+	if policy.IsSupported([]byte("dbsize"), true, false) {
+		test.Error("Expected single-db dbsize to be refused while multiplexing")
+	}
+	if !policy.IsSupported([]byte("dbsize"), false, false) {
+		test.Error("Expected single-db dbsize to be allowed while not multiplexing")
+	}
+
+	policy.Deny("dbsize", "get")
+	if policy.IsSupported([]byte("dbsize"), false, false) || policy.IsSupported([]byte("get"), false, false) {
+		test.Error("Expected denied commands to be refused")
+	}
+
+	policy.Allow("get")
+	if !policy.IsSupported([]byte("get"), true, false) {
+		test.Error("Expected allowing get to override denying it")
+	}
+}
+
+func TestCommandPolicyMultiplexingChecks(test *testing.T) {
+	policy := NewCommandPolicy()
+
+	// Allowing a command only overrides the unsafe list, not the multiplexing and multi-key checks
+	policy.Allow("mget", "del", "sdiff")
+	testData := []struct {
+		command            string
+		isMultiplexing     bool
+		isMultipleArgument bool
+		expected           error
+	}{
+		{"mget", true, false, ERR_COMMAND_UNSUPPORTED},
+		{"mget", false, false, nil},
+		{"del", true, true, ERR_COMMAND_UNSUPPORTED},
+		{"del", true, false, nil},
+		{"sdiff", true, false, ERR_COMMAND_UNSUPPORTED},
+	}
+	for _, d := range testData {
+		if err := policy.Check([]byte(d.command), d.isMultiplexing, d.isMultipleArgument); err != d.expected {
+			test.Errorf("Expected %v for allowed %s (multiplexing:%t multiple:%t), got %v", d.expected, d.command, d.isMultiplexing, d.isMultipleArgument, err)
+		}
+	}
+
+	// The same goes for allowlist mode
+	policy.SetAllowlist(true)
+	if err := policy.Check([]byte("mget"), true, false); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected mget to be refused while multiplexing in allowlist mode, got %v", err)
+	}
+	policy.SetAllowlist(false)
+
+	// Clearing single-db lifts IsSupportedFunction's own single-db rule, whether or not the command is allowed
+	policy.SetSingleDb("sdiff", false)
+	policy.SetSingleDb("keys", false)
+	for _, command := range []string{"sdiff", "keys"} {
+		if err := policy.Check([]byte(command), true, false); err != nil {
+			test.Errorf("Expected %s to be allowed while multiplexing once it isn't single-db, got %v", command, err)
+		}
+	}
+	policy.SetSingleDb("keys", true)
+	if err := policy.Check([]byte("keys"), true, false); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected keys to be single-db again, got %v", err)
+	}
+}
+
+func TestCommandPolicyAllowlist(test *testing.T) {
+	policy := NewCommandPolicy()
+	policy.SetAllowlist(true)
+	policy.Allow("get", "dbsize")
+
+	testData := []struct {
+		command  string
+		expected error
+	}{
+		{"get", nil},
+		{"dbsize", nil},
+		{"ping", nil},
+		{"quit", nil},
+		{"set", ERR_COMMAND_NOT_ALLOWED},
+		{"config", ERR_COMMAND_NOT_ALLOWED},
+	}
+
+	for _, d := range testData {
+		if err := policy.Check([]byte(d.command), true, false); err != d.expected {
+			test.Errorf("Expected %v for %s, got %v", d.expected, d.command, err)
+		}
+	}
+
+	policy.Deny("get")
+	if err := policy.Check([]byte("get"), true, false); err != ERR_COMMAND_NOT_ALLOWED {
+		test.Errorf("Expected a denied command to be not allowed, got %v", err)
+	}
+
+	policy.SetAllowlist(false)
+	if err := policy.Check([]byte("set"), true, false); err != nil {
+		test.Errorf("Expected set to be supported outside of allowlist mode, got %v", err)
+	}
+}
+
+func TestCommandPolicyProfiles(test *testing.T) {
+	testData := []struct {
+		profile  string
+		command  string
+		expected error
+	}{
+		{POLICY_PROFILE_DEFAULT, "get a", nil},
+		{POLICY_PROFILE_DEFAULT, "object encoding a", ERR_COMMAND_UNSUPPORTED},
+		{"", "memory usage a", ERR_COMMAND_UNSUPPORTED},
+		{POLICY_PROFILE_MONITORING, "get a", nil},
+		{POLICY_PROFILE_MONITORING, "OBJECT ENCODING a", nil},
+		{POLICY_PROFILE_MONITORING, "*3\r\n$6\r\nobject\r\n$4\r\nfreq\r\n$1\r\na", nil},
+		{POLICY_PROFILE_MONITORING, "object idletime a", nil},
+		{POLICY_PROFILE_MONITORING, "memory usage a samples 5", nil},
+		{POLICY_PROFILE_MONITORING, "object help", ERR_COMMAND_UNSUPPORTED},
+		{POLICY_PROFILE_MONITORING, "object encoding", ERR_COMMAND_UNSUPPORTED},
+		{POLICY_PROFILE_MONITORING, "memory purge", ERR_COMMAND_UNSUPPORTED},
+		{POLICY_PROFILE_MONITORING, "config get maxmemory", ERR_COMMAND_UNSUPPORTED},
+		{POLICY_PROFILE_LOCKED_DOWN, "get a", nil},
+		{POLICY_PROFILE_LOCKED_DOWN, "ping", nil},
+		{POLICY_PROFILE_LOCKED_DOWN, "set a b", ERR_COMMAND_NOT_ALLOWED},
+		{POLICY_PROFILE_LOCKED_DOWN, "object encoding a", ERR_COMMAND_NOT_ALLOWED},
+	}
+
+	for _, d := range testData {
+		policy, err := NewCommandPolicyProfile(d.profile)
+		if err != nil {
+			test.Fatalf("Error creating the %q profile: %s", d.profile, err)
+		}
+		command, err := ParseCommand([]byte(d.command + "\r\n"))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+		if err := policy.CheckCommand(command, true); err != d.expected {
+			test.Errorf("Expected %v for %q with the %q profile, got %v", d.expected, d.command, d.profile, err)
+		}
+	}
+
+	policy, _ := NewCommandPolicyProfile(POLICY_PROFILE_MONITORING)
+	if err := policy.Check([]byte("object"), true, true); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected Check to refuse object without its subcommand, got %v", err)
+	}
+	policy.Allow("object")
+	if err := policy.Check([]byte("object"), true, true); err != nil {
+		test.Errorf("Expected allowing object to override allowing its introspection, got %v", err)
+	}
+
+	if _, err := NewCommandPolicyProfile("permissive"); err != ERR_UNKNOWN_POLICY_PROFILE {
+		test.Errorf("Expected an unknown profile to be refused, got %v", err)
+	}
+}
+
+func TestCommandPolicySafeSubcommands(test *testing.T) {
+	denied := NewCommandPolicy()
+	denied.Deny("client")
+	allowlist := NewCommandPolicy()
+	allowlist.SetAllowlist(true)
+
+	testData := []struct {
+		policy   *CommandPolicy
+		command  string
+		expected error
+	}{
+		{nil, "client setinfo lib-name redis-py", nil},
+		{nil, "client kill 127.0.0.1:6379", ERR_COMMAND_UNSUPPORTED},
+		{NewCommandPolicy(), "CLIENT NO-EVICT on", nil},
+		{NewCommandPolicy(), "client no-touch on", nil},
+		{NewCommandPolicy(), "client setname app", nil},
+		{NewCommandPolicy(), "client getname", nil},
+		{NewCommandPolicy(), "client pause 1000", ERR_COMMAND_UNSUPPORTED},
+		{NewCommandPolicy(), "client unpause", ERR_COMMAND_UNSUPPORTED},
+		{NewCommandPolicy(), "client", ERR_COMMAND_UNSUPPORTED},
+		{denied, "client setinfo lib-name redis-py", ERR_COMMAND_UNSUPPORTED},
+		{allowlist, "client setinfo lib-name redis-py", ERR_COMMAND_NOT_ALLOWED},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command + "\r\n"))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+		if err := d.policy.CheckCommand(command, true); err != d.expected {
+			test.Errorf("Expected %v for %q, got %v", d.expected, d.command, err)
+		}
+	}
+
+	// Without the subcommand, Check refuses the whole command
+	if err := NewCommandPolicy().Check([]byte("client"), true, false); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected Check to refuse client without its subcommand, got %v", err)
+	}
+}
+
+func TestCommandPolicySubcommands(test *testing.T) {
+	policy := NewCommandPolicy()
+	policy.AllowSubcommands("config", "get")
+	policy.AllowSubcommands("CLUSTER", "Slots")
+	policy.AllowSubcommands("cluster", "info", "count-failure-reports")
+
+	testData := []struct {
+		command  string
+		expected error
+	}{
+		{"config get maxmemory", nil},
+		{"CONFIG GET maxmemory", nil},
+		{"*3\r\n$6\r\nconfig\r\n$3\r\nget\r\n$9\r\nmaxmemory", nil},
+		{"config set maxmemory 0", ERR_COMMAND_UNSUPPORTED},
+		{"config", ERR_COMMAND_UNSUPPORTED},
+		{"cluster slots", nil},
+		{"cluster info", nil},
+		{"cluster count-failure-reports node", nil},
+		{"cluster reset hard", ERR_COMMAND_UNSUPPORTED},
+		{"client kill 127.0.0.1:6379", ERR_COMMAND_UNSUPPORTED},
+		{"get a", nil},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command + "\r\n"))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+		if err := policy.CheckCommand(command, true); err != d.expected {
+			test.Errorf("Expected %v for %q, got %v", d.expected, d.command, err)
+		}
+	}
+
+	// Without the subcommand, Check refuses the whole command
+	if err := policy.Check([]byte("config"), true, false); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected Check to refuse config without its subcommand, got %v", err)
+	}
+
+	configGet, _ := ParseCommand([]byte("config get maxmemory\r\n"))
+	configSet, _ := ParseCommand([]byte("config set maxmemory 0\r\n"))
+	policy.Deny("config")
+	if err := policy.CheckCommand(configGet, true); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected denying config to override its allowed subcommands, got %v", err)
+	}
+	policy.AllowSubcommands("config", "set")
+	if err := policy.CheckCommand(configGet, true); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected config get to be forgotten once config was denied, got %v", err)
+	}
+	if err := policy.CheckCommand(configSet, true); err != nil {
+		test.Errorf("Expected config set to be allowed again, got %v", err)
+	}
+	policy.Allow("config")
+	if err := policy.CheckCommand(configGet, true); err != nil {
+		test.Errorf("Expected allowing config to override its allowed subcommands, got %v", err)
+	}
+
+	// Subcommands combine with introspection
+	monitoring, _ := NewCommandPolicyProfile(POLICY_PROFILE_MONITORING)
+	monitoring.AllowSubcommands("object", "help")
+	for _, command := range []string{"object help", "object encoding a"} {
+		parsed, _ := ParseCommand([]byte(command + "\r\n"))
+		if err := monitoring.CheckCommand(parsed, true); err != nil {
+			test.Errorf("Expected %q to be allowed, got %v", command, err)
+		}
+	}
+	parsed, _ := ParseCommand([]byte("object freqx a\r\n"))
+	if err := monitoring.CheckCommand(parsed, true); err != ERR_COMMAND_UNSUPPORTED {
+		test.Errorf("Expected object freqx to be refused, got %v", err)
+	}
+}
+
+func TestCommandPolicyCheckDoesNotAllocate(test *testing.T) {
+	policy := NewCommandPolicy()
+	policy.Allow("dbsize")
+	policy.Deny("keys")
+	policy.SetSingleDb("get", true)
+
+	for _, command := range []string{"get", "dbsize", "keys", "sismember", "notacommand"} {
+		slice := []byte(command)
+		allocs := testing.AllocsPerRun(100, func() {
+			policy.Check(slice, true, false)
+			IsReadOnlyFunction(slice)
+			CommandMetricName(slice)
+		})
+		if allocs != 0 {
+			test.Errorf("Expected classifying %s not to allocate, got %v allocations", command, allocs)
+		}
+	}
+}
+
+func BenchmarkCommandPolicyCheck(b *testing.B) {
+	policy := NewCommandPolicy()
+	policy.Allow("dbsize")
+	slice := []byte("sismember")
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		policy.Check(slice, true, true)
+	}
+}
+
+func BenchmarkCommandPolicyCheckParallel(b *testing.B) {
+	policy := NewCommandPolicy()
+	policy.Allow("dbsize")
+	b.ReportAllocs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		slice := []byte("sismember")
+		for pb.Next() {
+			policy.Check(slice, true, true)
+		}
+	})
+}
+
+//Commands shorter than the letters IsSupportedFunction looks at are checked like any other, rather than crashing the
+//client.  Whether they're refused is up to IsSupportedFunction, and redis refuses the ones that don't exist anyway
+func TestCheckCommand_ShortCommands(test *testing.T) {
+	policy := NewCommandPolicy()
+	for _, name := range []string{"d", "de", "su", "zi", "pu", "sc", "pub", "zit"} {
+		command, err := ParseCommand([]byte(name + " a b\r\n"))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", name, err)
+		}
+
+		for _, isMultiplexing := range []bool{true, false} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						test.Errorf("Checking %q panicked: %v", name, r)
+					}
+				}()
+				policy.CheckCommand(command, isMultiplexing)
+			}()
+		}
+	}
+}
+
+//Subscribing isn't supported, to one channel or several, so neither is unsubscribing, with or without channels
+func TestCheckCommand_PubSub(test *testing.T) {
+	policy := NewCommandPolicy()
+	for _, d := range []string{"subscribe a", "subscribe a b c", "psubscribe a* b*", "ssubscribe a b", "unsubscribe", "unsubscribe a", "punsubscribe", "punsubscribe a*", "sunsubscribe a"} {
+		command, err := ParseCommand([]byte(d + "\r\n"))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d, err)
+		}
+		for _, isMultiplexing := range []bool{true, false} {
+			if err := policy.CheckCommand(command, isMultiplexing); err != ERR_COMMAND_UNSUPPORTED {
+				test.Errorf("Expected %q to be refused when multiplexing is %t, got %v", d, isMultiplexing, err)
+			}
+		}
+	}
+}
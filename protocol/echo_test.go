@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"github.com/salesforce/rmux/writer"
+	"testing"
+)
+
+func TestWriteEcho(test *testing.T) {
+	testData := []struct {
+		command  string
+		expected string
+	}{
+		{"*3\r\n$3\r\nSET\r\n$3\r\nKey\r\n$5\r\na\r\nb!\r\n", "*3\r\n$3\r\nset\r\n$3\r\nKey\r\n$5\r\na\r\nb!\r\n"},
+		{"*1\r\n$4\r\nping\r\n", "*1\r\n$4\r\nping\r\n"},
+		{"*2\r\n$3\r\nget\r\n$0\r\n\r\n", "*2\r\n$3\r\nget\r\n$0\r\n\r\n"},
+		{"GET  foo bar\r\n", "*3\r\n$3\r\nget\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		w := new(bytes.Buffer)
+		flexibleWriter := writer.NewFlexibleWriter(w)
+		if err := WriteEcho(command, flexibleWriter); err != nil {
+			test.Fatalf("WriteEcho(%q) returned %s", d.command, err)
+		}
+		flexibleWriter.Flush()
+
+		if w.String() != d.expected {
+			test.Errorf("WriteEcho(%q) wrote %q, expected %q", d.command, w.String(), d.expected)
+		}
+	}
+}
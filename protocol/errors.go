@@ -25,6 +25,50 @@
 
 package protocol
 
+import (
+	"bytes"
+)
+
+//Error codes that a redis server may reply with, as returned by ParseError
+const (
+	ERROR_CODE_ERR        = "ERR"
+	ERROR_CODE_MOVED      = "MOVED"
+	ERROR_CODE_ASK        = "ASK"
+	ERROR_CODE_NOAUTH     = "NOAUTH"
+	ERROR_CODE_READONLY   = "READONLY"
+	ERROR_CODE_LOADING    = "LOADING"
+	ERROR_CODE_MASTERDOWN = "MASTERDOWN"
+	ERROR_CODE_BUSY       = "BUSY"
+)
+
+//Splits an error reply into its code (the first token after the '-') and its message, ex:
+//"-LOADING Redis is loading the dataset in memory\r\n" -> "LOADING", "Redis is loading the dataset in memory"
+//The message is empty for a bare code, like "-ERR".  Both are empty if the line isn't an error reply
+func ParseError(line []byte) (code string, message string) {
+	if len(line) == 0 || line[0] != '-' {
+		return "", ""
+	}
+
+	line = bytes.TrimRight(line[1:], "\r\n")
+	end := bytes.IndexAny(line, " \t")
+	if end < 0 {
+		return string(line), ""
+	}
+
+	return string(line[:end]), string(bytes.TrimLeft(line[end:], " \t"))
+}
+
+//Returns whether the error reply says that the server can't serve commands for now, rather than that the command itself
+//failed: -LOADING while it loads its dataset, -BUSY while a script runs, or -READONLY and -MASTERDOWN once it's no
+//longer a usable master.  Errors like -WRONGTYPE or -ERR are down to the client's command, and say nothing of the server
+func IsServerStateError(line []byte) bool {
+	switch code, _ := ParseError(line); code {
+	case ERROR_CODE_LOADING, ERROR_CODE_BUSY, ERROR_CODE_READONLY, ERROR_CODE_MASTERDOWN:
+		return true
+	}
+	return false
+}
+
 type RecoverableError struct {
 	errMsg string
 }
@@ -32,3 +76,39 @@ type RecoverableError struct {
 func (e *RecoverableError) Error() string {
 	return e.errMsg
 }
+
+//Returned by CopyServerResponse when a reply couldn't be written to the client, ex: a slow client that didn't read it
+//before the write deadline.  The server's reply may have been left part way read
+type ClientWriteError struct {
+	Err error
+}
+
+func (e *ClientWriteError) Error() string {
+	return "Error writing reply to client: " + e.Err.Error()
+}
+
+func (e *ClientWriteError) Unwrap() error {
+	return e.Err
+}
+
+//Returned by CopyServerResponse when a reply couldn't be read from the server, ex: a server that didn't send it before
+//the read deadline, went away, or sent something that can't be framed.  The client may have been sent part of it
+type BackendReadError struct {
+	Err error
+}
+
+func (e *BackendReadError) Error() string {
+	return "Error reading reply from server: " + e.Err.Error()
+}
+
+func (e *BackendReadError) Unwrap() error {
+	return e.Err
+}
+
+//Attributes an error from copying a reply to the server, unless it came from writing to the client
+func backendReadError(err error) error {
+	if _, ok := err.(*ClientWriteError); ok {
+		return err
+	}
+	return &BackendReadError{err}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestParseError(test *testing.T) {
+	testData := []struct {
+		line    string
+		code    string
+		message string
+	}{
+		{"-LOADING Redis is loading the dataset in memory\r\n", ERROR_CODE_LOADING, "Redis is loading the dataset in memory"},
+		{"-MOVED 3999 127.0.0.1:6381\r\n", ERROR_CODE_MOVED, "3999 127.0.0.1:6381"},
+		{"-NOAUTH Authentication required.", ERROR_CODE_NOAUTH, "Authentication required."},
+		{"-ERR\r\n", ERROR_CODE_ERR, ""},
+		{"-ERR", ERROR_CODE_ERR, ""},
+		{"-READONLY  \t You can't write against a read only replica.\r\n", ERROR_CODE_READONLY, "You can't write against a read only replica."},
+		{"+OK\r\n", "", ""},
+		{"", "", ""},
+	}
+
+	for _, d := range testData {
+		code, message := ParseError([]byte(d.line))
+		if code != d.code || message != d.message {
+			test.Errorf("ParseError(%q) returned %q, %q. Expected %q, %q", d.line, code, message, d.code, d.message)
+		}
+	}
+}
+
+func TestIsServerStateError(test *testing.T) {
+	for _, line := range []string{"-LOADING Redis is loading the dataset in memory", "-BUSY Redis is busy running a script.\r\n",
+		"-READONLY You can't write against a read only replica.", "-MASTERDOWN Link with MASTER is down"} {
+		if !IsServerStateError([]byte(line)) {
+			test.Errorf("Expected %q to be a server state error", line)
+		}
+	}
+
+	for _, line := range []string{"-WRONGTYPE Operation against a key holding the wrong kind of value", "-ERR no such key",
+		"-NOSCRIPT No matching script.", "-BUSYKEY Target key name already exists.", "+LOADING", ""} {
+		if IsServerStateError([]byte(line)) {
+			test.Errorf("Expected %q not to be a server state error", line)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+)
+
+var (
+	EVAL_COMMAND     = []byte("eval")
+	EVALSHA_COMMAND  = []byte("evalsha")
+	FCALL_COMMAND    = []byte("fcall")
+	FCALL_RO_COMMAND = []byte("fcall_ro")
+
+	//Error for a script whose keys wouldn't all be routed to the same backend
+	ERR_KEYS_SPAN_BACKENDS = &RecoverableError{"Keys in request don't hash to the same backend"}
+)
+
+//Returns whether the given lowercased command runs a lua script or a function (ex: FCALL), and so declares its keys
+//with numkeys
+func IsEvalFunction(command []byte) bool {
+	return bytes.Equal(command, EVAL_COMMAND) || bytes.Equal(command, EVALSHA_COMMAND) ||
+		bytes.Equal(command, FCALL_COMMAND) || bytes.Equal(command, FCALL_RO_COMMAND)
+}
+
+//Returns the keys that an EVAL, EVALSHA, FCALL or FCALL_RO declares, given its arguments: the script (or its sha, or
+//the function's name), numkeys, then
+//numkeys keys, then the script's other arguments.  The returned keys share the arguments' memory
+//ERR_BAD_ARGUMENTS is returned if numkeys is missing, isn't a number, or is more than the number of arguments
+func EvalKeys(args [][]byte) (keys [][]byte, err error) {
+	if len(args) < 2 {
+		return nil, ERR_BAD_ARGUMENTS
+	}
+
+	numKeys, err := ParseInt(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return nil, ERR_BAD_ARGUMENTS
+	}
+
+	return args[2 : 2+numKeys], nil
+}
+
+//Returns the keys that the given EVAL, EVALSHA, FCALL or FCALL_RO command declares.  See EvalKeys
+func GetEvalKeys(command Command) ([][]byte, error) {
+	return EvalKeys(commandArgs(command))
+}
+
+//Returns every argument of the given command, after the command itself, whether it's multibulk or inline
+//The arguments share the command's buffer
+func commandArgs(command Command) (args [][]byte) {
+	if buffer := command.GetBuffer(); len(buffer) > 0 && buffer[0] == '*' {
+		_, args, _ = parseCommandAndArgs(buffer)
+	} else {
+		// Inline: the command, then its space-delimited arguments
+		fields := bytes.Fields(buffer)
+		if len(fields) > 0 {
+			args = fields[1:]
+		}
+	}
+	return
+}
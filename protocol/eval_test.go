@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestGetEvalKeys(test *testing.T) {
+	testData := []struct {
+		command  string
+		expected []string
+		err      error
+	}{
+		{"*5\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n1\r\n$1\r\na\r\n$1\r\nb\r\n", []string{"a"}, nil},
+		{"*5\r\n$7\r\nevalsha\r\n$3\r\nabc\r\n$1\r\n2\r\n$1\r\na\r\n$1\r\nb\r\n", []string{"a", "b"}, nil},
+		{"*3\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n0\r\n", []string{}, nil},
+		{"eval return 1 a b\r\n", []string{"a"}, nil},
+		{"*5\r\n$5\r\nfcall\r\n$6\r\nmyfunc\r\n$1\r\n1\r\n$1\r\na\r\n$1\r\nb\r\n", []string{"a"}, nil},
+		{"fcall_ro myfunc 2 a b c\r\n", []string{"a", "b"}, nil},
+		{"fcall myfunc\r\n", nil, ERR_BAD_ARGUMENTS},
+		{"*3\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\n1\r\n", nil, ERR_BAD_ARGUMENTS},
+		{"*4\r\n$4\r\neval\r\n$6\r\nreturn\r\n$2\r\n-1\r\n$1\r\na\r\n", nil, ERR_BAD_ARGUMENTS},
+		{"*4\r\n$4\r\neval\r\n$6\r\nreturn\r\n$1\r\nx\r\n$1\r\na\r\n", nil, ERR_BAD_ARGUMENTS},
+		{"*2\r\n$4\r\neval\r\n$6\r\nreturn\r\n", nil, ERR_BAD_ARGUMENTS},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		keys, err := GetEvalKeys(command)
+		if err != d.err || len(keys) != len(d.expected) {
+			test.Errorf("GetEvalKeys(%q) returned %q, %v. Expected %q, %v", d.command, keys, err, d.expected, d.err)
+			continue
+		}
+		for i, key := range keys {
+			if string(key) != d.expected[i] {
+				test.Errorf("GetEvalKeys(%q) returned %q. Expected %q", d.command, keys, d.expected)
+			}
+		}
+	}
+}
+
+func TestIsEvalFunction(test *testing.T) {
+	for command, expected := range map[string]bool{"eval": true, "evalsha": true, "fcall": true, "fcall_ro": true, "function": false, "echo": false, "evalsha_ro": false} {
+		if IsEvalFunction([]byte(command)) != expected {
+			test.Errorf("Expected IsEvalFunction(%q) to be %t", command, expected)
+		}
+	}
+}
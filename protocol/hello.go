@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+)
+
+var AUTH_OPTION = []byte("auth")
+
+//The arguments that a HELLO was sent with, as parsed by ParseHello
+type Hello struct {
+	//The protocol version asked for, or 0 if none was
+	Version int
+	//Whether SETNAME was given, and the name that it gives the client (nil to remove its name)
+	SetsName bool
+	Name     []byte
+}
+
+//Parses a HELLO command: HELLO [protover [AUTH username password] [SETNAME clientname]]
+//AUTH is accepted, and its credentials dropped, since the proxy authenticates its backend connections itself.  The
+//name given with SETNAME is returned, to be kept for the client like CLIENT SETNAME's, rather than given to a backend
+//connection that other clients share.  ERR_BAD_ARGUMENTS is returned for a version other than RESP2 or RESP3, or an
+//unknown or incomplete option
+func ParseHello(command Command) (hello Hello, err error) {
+	args := commandArgs(command)
+	if len(args) == 0 {
+		return hello, nil
+	}
+
+	if hello.Version, err = ParseInt(args[0]); err != nil || (hello.Version != RESP2 && hello.Version != RESP3) {
+		return Hello{}, ERR_BAD_ARGUMENTS
+	}
+
+	for i := 1; i < len(args); {
+		if bytes.EqualFold(args[i], AUTH_OPTION) && i+2 < len(args) {
+			i += 3
+		} else if bytes.EqualFold(args[i], SETNAME_SUBCOMMAND) && i+1 < len(args) {
+			if hello.Name, err = parseClientName(args[i+1]); err != nil {
+				return Hello{}, err
+			}
+			hello.SetsName = true
+			i += 2
+		} else {
+			return Hello{}, ERR_BAD_ARGUMENTS
+		}
+	}
+
+	return hello, nil
+}
+
+//Returns a HELLO for the given version, without any options, as a multibulk
+func EncodeHello(version int) []byte {
+	versionArg := strconv.AppendInt(nil, int64(version), 10)
+	hello := appendMultibulkHeader(nil, '*', 2)
+	hello = appendMultibulkHeader(hello, '$', len(HELLO_COMMAND))
+	hello = append(append(hello, HELLO_COMMAND...), REDIS_NEWLINE...)
+	hello = appendMultibulkHeader(hello, '$', len(versionArg))
+	return append(append(hello, versionArg...), REDIS_NEWLINE...)
+}
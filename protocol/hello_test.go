@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestParseHello(test *testing.T) {
+	testData := []struct {
+		input    string
+		expected Hello
+	}{
+		{"*1\r\n$5\r\nhello\r\n", Hello{}},
+		{"*2\r\n$5\r\nhello\r\n$1\r\n3\r\n", Hello{Version: RESP3}},
+		// As redis-py and lettuce send it
+		{"*5\r\n$5\r\nhello\r\n$1\r\n3\r\n$4\r\nAUTH\r\n$4\r\nuser\r\n$8\r\npassword\r\n", Hello{Version: RESP3}},
+		{"*4\r\n$5\r\nhello\r\n$1\r\n2\r\n$7\r\nSETNAME\r\n$3\r\napp\r\n", Hello{Version: RESP2, SetsName: true, Name: []byte("app")}},
+		{"*7\r\n$5\r\nhello\r\n$1\r\n3\r\n$4\r\nauth\r\n$1\r\nu\r\n$1\r\np\r\n$7\r\nsetname\r\n$0\r\n\r\n", Hello{Version: RESP3, SetsName: true}},
+		{"hello 3 setname app\r\n", Hello{Version: RESP3, SetsName: true, Name: []byte("app")}},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.input))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", d.input, err)
+		}
+
+		hello, err := ParseHello(command)
+		if err != nil || hello.Version != d.expected.Version || hello.SetsName != d.expected.SetsName ||
+			string(hello.Name) != string(d.expected.Name) || (hello.Name == nil) != (d.expected.Name == nil) {
+			test.Errorf("ParseHello(%q) returned %+v, %v. Expected %+v", d.input, hello, err, d.expected)
+		}
+	}
+
+	for _, input := range []string{"hello 4\r\n", "hello three\r\n", "hello 3 auth user\r\n", "hello 3 setname\r\n",
+		"hello 3 setname a\x01b\r\n", "hello 3 other\r\n"} {
+		command, err := ParseCommand([]byte(input))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", input, err)
+		}
+		if _, err := ParseHello(command); err == nil {
+			test.Errorf("ParseHello should have refused %q", input)
+		}
+	}
+}
+
+func TestEncodeHello(test *testing.T) {
+	if hello := string(EncodeHello(RESP3)); hello != "*2\r\n$5\r\nhello\r\n$1\r\n3\r\n" {
+		test.Errorf("Unexpected HELLO %q", hello)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+//Introspection subcommands that read one key, given right after the subcommand (ex: OBJECT ENCODING key), keyed by
+//lowercased command and then lowercased subcommand.  They don't write, so a policy can allow them without allowing
+//the rest of their command (ex: OBJECT and MEMORY are unsafe as a whole)
+var INTROSPECTION_SUBCOMMANDS = map[string]map[string]bool{
+	"object": {"encoding": true, "freq": true, "idletime": true, "refcount": true},
+	"memory": {"usage": true},
+}
+
+//Returns the key that the given command introspects, and whether it's one of INTROSPECTION_SUBCOMMANDS at all
+//Other commands cost a single lookup.  The key shares the command's buffer
+func GetIntrospectionKey(command Command) (key []byte, ok bool) {
+	subcommands, ok := INTROSPECTION_SUBCOMMANDS[string(command.GetCommand())]
+	if !ok {
+		return nil, false
+	}
+
+	args := commandArgs(command)
+	if len(args) < 2 || !hasSubcommand(subcommands, args[0]) {
+		return nil, false
+	}
+	return args[1], true
+}
+
+//Returns whether the given command is one of INTROSPECTION_SUBCOMMANDS, with its key
+func IsIntrospectionCommand(command Command) bool {
+	_, ok := GetIntrospectionKey(command)
+	return ok
+}
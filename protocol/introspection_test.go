@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestGetIntrospectionKey(test *testing.T) {
+	testData := []struct {
+		command  string
+		key      string
+		expected bool
+	}{
+		{"object encoding a\r\n", "a", true},
+		{"OBJECT RefCount b\r\n", "b", true},
+		{"*3\r\n$6\r\nmemory\r\n$5\r\nUSAGE\r\n$1\r\nc\r\n", "c", true},
+		{"memory usage d samples 0\r\n", "d", true},
+		{"object encoding\r\n", "", false},
+		{"object help\r\n", "", false},
+		{"object encodingextra a\r\n", "", false},
+		{"memory doctor\r\n", "", false},
+		{"get encoding\r\n", "", false},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		key, ok := GetIntrospectionKey(command)
+		if ok != d.expected || string(key) != d.key {
+			test.Errorf("GetIntrospectionKey(%q) returned %q, %t. Expected %q, %t", d.command, key, ok, d.key, d.expected)
+		}
+	}
+}
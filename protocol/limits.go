@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"sync/atomic"
+)
+
+const (
+	//Default longest bulk string accepted, as with redis's proto-max-bulk-len
+	DEFAULT_MAX_BULK_LENGTH = 512 * 1024 * 1024
+	//Default most elements accepted in a client's multibulk command
+	DEFAULT_MAX_MULTIBULK_LENGTH = 1024 * 1024
+)
+
+var (
+	//Returned when a bulk header advertises more than MaxBulkLength bytes.  The stream can't be followed past it
+	ERROR_BULK_TOO_LONG = &RecoverableError{"Protocol error: invalid bulk length"}
+	//Returned when a client's multibulk header advertises more than MaxMultibulkLength elements
+	ERROR_MULTIBULK_TOO_LONG = &RecoverableError{"Protocol error: invalid multibulk length"}
+
+	maxBulkLength      int64 = DEFAULT_MAX_BULK_LENGTH
+	maxMultibulkLength int64 = DEFAULT_MAX_MULTIBULK_LENGTH
+	lenientNewlines    int32
+)
+
+//Sets the longest bulk string that is read, copied or ignored, from clients and servers alike
+//Longer headers are refused before anything is buffered for them, so that a bad length can't exhaust memory
+func SetMaxBulkLength(length int64) {
+	atomic.StoreInt64(&maxBulkLength, length)
+}
+
+//Returns the longest bulk string that is accepted
+func MaxBulkLength() int64 {
+	return atomic.LoadInt64(&maxBulkLength)
+}
+
+//Sets the most elements accepted in a client's multibulk command
+//Servers' replies aren't held to it, since they may rightly be longer, ex: to KEYS * or LRANGE key 0 -1.  They're
+//copied and ignored an element at a time, and ParseReply allocates no more than this many elements ahead of reading them
+func SetMaxMultibulkLength(count int) {
+	atomic.StoreInt64(&maxMultibulkLength, int64(count))
+}
+
+//Returns the most elements accepted in a client's multibulk command
+func MaxMultibulkLength() int {
+	return int(atomic.LoadInt64(&maxMultibulkLength))
+}
+
+//Sets whether a bare \n is accepted in place of the \r\n that trails a bulk payload, in clients' multibulk commands,
+//and when copying or ignoring replies.  Off by default.  What's passed on is always trailed by \r\n
+func SetLenientNewlines(lenient bool) {
+	var value int32
+	if lenient {
+		value = 1
+	}
+	atomic.StoreInt32(&lenientNewlines, value)
+}
+
+//Returns whether a bare \n is accepted as a bulk payload's trailer
+func LenientNewlines() bool {
+	return atomic.LoadInt32(&lenientNewlines) == 1
+}
+
+//Returns whether the error is one that a protocol limit was exceeded with, after which the stream can't be followed
+func IsProtocolLimitError(err error) bool {
+	return err == ERROR_BULK_TOO_LONG || err == ERROR_MULTIBULK_TOO_LONG
+}
+
+func checkBulkLength(length int64) error {
+	if length > MaxBulkLength() {
+		return ERROR_BULK_TOO_LONG
+	}
+	return nil
+}
+
+func checkMultibulkLength(count int) error {
+	if int64(count) > atomic.LoadInt64(&maxMultibulkLength) {
+		return ERROR_MULTIBULK_TOO_LONG
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"github.com/salesforce/rmux/writer"
+	"testing"
+)
+
+func TestBulkLengthLimit(t *testing.T) {
+	SetMaxBulkLength(16)
+	defer SetMaxBulkLength(DEFAULT_MAX_BULK_LENGTH)
+
+	w := new(bytes.Buffer)
+	if err := CopyServerResponses(getReader("$17\r\n"), writer.NewFlexibleWriter(w), 1, nil); !errors.Is(err, ERROR_BULK_TOO_LONG) {
+		t.Errorf("Expected copying an oversized bulk to fail with ERROR_BULK_TOO_LONG, got %v", err)
+	}
+	if w.Len() != 0 {
+		t.Errorf("Expected nothing to be copied for an oversized bulk, got %q", w.Bytes())
+	}
+	if err := CopyServerResponses(getReader("$16\r\n0123456789abcdef\r\n"), writer.NewFlexibleWriter(w), 1, nil); err != nil {
+		t.Errorf("Expected a bulk at the limit to be copied, got %v", err)
+	}
+
+	if err := IgnoreServerResponse(getReader("*1\r\n$999999999999\r\n")); err != ERROR_BULK_TOO_LONG {
+		t.Errorf("Expected ignoring an oversized bulk to fail with ERROR_BULK_TOO_LONG, got %v", err)
+	}
+	if _, err := ParseReply(getReader("$17\r\n")); err != ERROR_BULK_TOO_LONG {
+		t.Errorf("Expected parsing an oversized bulk to fail with ERROR_BULK_TOO_LONG, got %v", err)
+	}
+
+	// Commands from clients are refused before their payload is waited for
+	if _, _, err := ScanBulkString([]byte("$17\r\n"), false); err != ERROR_BULK_TOO_LONG {
+		t.Errorf("Expected scanning an oversized bulk to fail with ERROR_BULK_TOO_LONG, got %v", err)
+	}
+	if _, _, err := GetCommand(getReader("*1\r\n$17\r\n"), false, nil); err != ERROR_BULK_TOO_LONG {
+		t.Errorf("Expected GetCommand to refuse an oversized bulk, got %v", err)
+	}
+}
+
+func TestMultibulkLengthLimit(t *testing.T) {
+	SetMaxMultibulkLength(2)
+	defer SetMaxMultibulkLength(DEFAULT_MAX_MULTIBULK_LENGTH)
+
+	// Only clients' commands are held to the limit
+	if _, _, err := ScanArray([]byte("*3\r\n"), false); err != ERROR_MULTIBULK_TOO_LONG {
+		t.Errorf("Expected scanning an oversized array to fail with ERROR_MULTIBULK_TOO_LONG, got %v", err)
+	}
+	if _, _, err := GetCommand(getReader("*3\r\n"), false, nil); err != ERROR_MULTIBULK_TOO_LONG {
+		t.Errorf("Expected GetCommand to refuse an oversized multibulk, got %v", err)
+	}
+
+	// Servers' replies may be longer, ex: to KEYS * or LRANGE key 0 -1
+	for _, reply := range []string{"*3\r\n:1\r\n:2\r\n:3\r\n", "%3\r\n:1\r\n:1\r\n:2\r\n:2\r\n:3\r\n:3\r\n", "~3\r\n:1\r\n:2\r\n:3\r\n"} {
+		w := new(bytes.Buffer)
+		if err := CopyServerResponses(getReader(reply), writer.NewFlexibleWriter(w), 1, nil); err != nil || w.String() != reply {
+			t.Errorf("Expected %q to be copied whole, got %q, %v", reply, w.Bytes(), err)
+		}
+		if err := IgnoreServerResponse(getReader(reply)); err != nil {
+			t.Errorf("Expected %q to be ignored, got %v", reply, err)
+		}
+	}
+
+	reply, err := ParseReply(getReader("*3\r\n:1\r\n:2\r\n:3\r\n"))
+	if err != nil || len(reply.Elements) != 3 || reply.Elements[2].Integer != 3 {
+		t.Errorf("Expected an array longer than the limit to be parsed, got %+v, %v", reply, err)
+	}
+
+	// A count that is never followed by its elements fails on the missing elements, without allocating them all
+	if _, err := ParseReply(getReader("*2147483647\r\n:1\r\n")); err != io.EOF {
+		t.Errorf("Expected parsing a truncated array to fail at the end of the stream, got %v", err)
+	}
+}
+
+func TestIsProtocolLimitError(t *testing.T) {
+	if !IsProtocolLimitError(ERROR_BULK_TOO_LONG) || !IsProtocolLimitError(ERROR_MULTIBULK_TOO_LONG) {
+		t.Error("Expected the limit errors to be recognized")
+	}
+	if IsProtocolLimitError(ERROR_BAD_BULK_FORMAT) {
+		t.Error("Expected other protocol errors not to be taken for limit errors")
+	}
+}
@@ -26,7 +26,9 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
+	"github.com/salesforce/rmux/log"
 )
 
 var NIL_STRING []byte = nil
@@ -90,6 +92,10 @@ func ParseMultibulkCommand(b []byte) (*MultibulkCommand, error) {
 		cBuf = cBuf[newlinePos+2+count+2:]
 	}
 
+	if len(c.Command) == 0 {
+		return nil, ERR_EMPTY_COMMAND
+	}
+
 	for i := 0; i < len(c.Command); i++ {
 		if char := c.Command[i]; char >= 'A' && char <= 'Z' {
 			c.Command[i] = c.Command[i] + 0x20
@@ -115,3 +121,176 @@ func (this *MultibulkCommand) GetFirstArg() []byte {
 func (this *MultibulkCommand) GetArgCount() int {
 	return this.ArgCount
 }
+
+//Peeks the multibulk command on the source, and returns its lowercased command and first argument
+//Blocks until enough of the command has been read to decode both, so commands split across reads are handled.
+//If allowInline is set, space-delimited inline commands (as typed over telnet) are accepted as well.
+//Nothing is consumed from the source, and the returned slices are only valid until the next read.
+//At most the source's buffer is peeked, however large the command's values are.  Anything other than a multibulk
+//returns ERROR_MULTIBULK_FORMAT_REQUIRED, unless allowInline is set, and an empty command ERR_EMPTY_COMMAND.
+//Parse failures are debug logged against logCtx, which may be nil
+func GetCommand(source *bufio.Reader, allowInline bool, logCtx *LogContext) (command, firstArg []byte, err error) {
+	var decoder CommandDecoder
+	var decoded [2]ElementSpan
+	spans := decoded[:0]
+	for {
+		buffered, _ := source.Peek(source.Buffered())
+
+		if allowInline && len(buffered) > 0 && buffered[0] != '*' {
+			command, firstArg, err = parseInlineCommand(buffered)
+		} else if spans, err = decoder.appendSpans(buffered, spans, 2); err == nil {
+			command = spans[0].Of(buffered)
+			if len(spans) > 1 {
+				firstArg = spans[1].Of(buffered)
+			}
+			if len(command) == 0 {
+				command, firstArg, err = nil, nil, ERR_EMPTY_COMMAND
+			}
+			command = lowercased(command)
+		}
+		if err != ERROR_NEED_MORE_DATA {
+			if err != nil {
+				logCtx.Debug("GetCommand: Could not parse command", log.F("err", err), log.F("buffered", len(buffered)), log.F("prefix", redactedPrefix(buffered)))
+			}
+			return
+		}
+
+		if err = waitForMoreData(source, len(buffered)); err != nil {
+			logCtx.Debug("GetCommand: Could not read command", log.F("err", err))
+			return nil, nil, err
+		}
+	}
+}
+
+//Peeks the multibulk command on the source, and returns its lowercased command and every argument
+//Arguments are left untouched, since keys are case-sensitive.  Blocks until the whole command has been read.
+//Nothing is consumed from the source, and the returned slices are only valid until the next read.
+//If the full command cannot fit in the source's buffer, ERROR_NEED_MORE_DATA is returned, and if its command is
+//empty, ERR_EMPTY_COMMAND.
+//Parse failures are debug logged against logCtx, which may be nil
+func GetCommandAndArgs(source *bufio.Reader, logCtx *LogContext) (command []byte, args [][]byte, err error) {
+	var decoder CommandDecoder
+	var spans []ElementSpan
+	for {
+		buffered, _ := source.Peek(source.Buffered())
+
+		if spans, err = decoder.appendSpans(buffered, spans, 0); err == nil {
+			if command, args = commandAndArgs(buffered, spans); len(command) == 0 {
+				command, args, err = nil, nil, ERR_EMPTY_COMMAND
+			}
+		}
+		if err != ERROR_NEED_MORE_DATA {
+			if err != nil {
+				logCtx.Debug("GetCommandAndArgs: Could not parse command", log.F("err", err), log.F("buffered", len(buffered)), log.F("prefix", redactedPrefix(buffered)))
+			}
+			return
+		}
+
+		if err = waitForMoreData(source, len(buffered)); err != nil {
+			logCtx.Debug("GetCommandAndArgs: Could not read command", log.F("err", err))
+			return nil, nil, err
+		}
+	}
+}
+
+//The most of a client's input that's logged when it can't be parsed
+const LOGGED_PREFIX_LENGTH = 16
+
+//Returns the start of a client's input that is safe to log, ex: "*3" or an inline command's name
+//It stops at the first space or newline, so that arguments, ex: AUTH and HELLO passwords, are never logged
+func redactedPrefix(b []byte) []byte {
+	if end := bytes.IndexAny(b, " \r\n"); end >= 0 {
+		b = b[:end]
+	}
+	if len(b) > LOGGED_PREFIX_LENGTH {
+		b = b[:LOGGED_PREFIX_LENGTH]
+	}
+	return b
+}
+
+//Blocks until the source has more than the given number of bytes buffered
+func waitForMoreData(source *bufio.Reader, buffered int) error {
+	if _, err := source.Peek(buffered + 1); err != nil {
+		if err == bufio.ErrBufferFull {
+			return ERROR_NEED_MORE_DATA
+		}
+		return err
+	}
+
+	return nil
+}
+
+//Parses an inline command line into its command and first argument.  Quoted arguments are not supported
+func parseInlineCommand(b []byte) (command, firstArg []byte, err error) {
+	newlinePos := bytes.IndexByte(b, '\n')
+	if newlinePos < 0 {
+		return nil, nil, ERROR_NEED_MORE_DATA
+	}
+
+	line := b[:newlinePos]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	for len(line) > 0 && firstArg == nil {
+		var token []byte
+		if spacePos := bytes.IndexByte(line, ' '); spacePos < 0 {
+			token, line = line, nil
+		} else {
+			token, line = line[:spacePos], line[spacePos+1:]
+		}
+
+		if len(token) == 0 {
+			continue
+		} else if command == nil {
+			command = token
+		} else {
+			firstArg = token
+		}
+	}
+
+	if command == nil {
+		return nil, nil, ERROR_COMMAND_PARSE
+	}
+
+	return lowercased(command), firstArg, nil
+}
+
+func parseCommandAndArgs(b []byte) (command []byte, args [][]byte, err error) {
+	var decoder CommandDecoder
+	spans, err := decoder.appendSpans(b, nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	command, args = commandAndArgs(b, spans)
+	return command, args, nil
+}
+
+//Returns the decoded elements of a command from its contents, with the command lowercased
+func commandAndArgs(contents []byte, spans []ElementSpan) (command []byte, args [][]byte) {
+	command = spans[0].Of(contents)
+	args = make([][]byte, 0, len(spans)-1)
+	for _, span := range spans[1:] {
+		args = append(args, span.Of(contents))
+	}
+
+	return lowercased(command), args
+}
+
+//Returns the given bytes lowercased.  They're left untouched, since they may be a reader's buffer, so a copy is returned
+//if anything needs lowercasing, and otherwise the bytes themselves
+func lowercased(b []byte) []byte {
+	for i := 0; i < len(b); i++ {
+		if char := b[i]; char >= 'A' && char <= 'Z' {
+			lower := append([]byte(nil), b...)
+			for ; i < len(lower); i++ {
+				if char := lower[i]; char >= 'A' && char <= 'Z' {
+					lower[i] = char + 0x20
+				}
+			}
+			return lower
+		}
+	}
+	return b
+}
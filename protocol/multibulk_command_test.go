@@ -26,7 +26,14 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/salesforce/rmux/writer"
 )
 
 var multibulkTestData = map[string]commandTestData{
@@ -98,3 +105,164 @@ func TestMultibulkCommand(test *testing.T) {
 		tester.checkCommandOutput(expected, command, err, input)
 	}
 }
+
+func TestEmptyCommand(test *testing.T) {
+	for _, input := range []string{"*1\r\n$0\r\n\r\n", "*2\r\n$0\r\n\r\n$3\r\nkey\r\n", "*1\r\n$-1\r\n"} {
+		if _, err := ParseMultibulkCommand([]byte(input)); err != ERR_EMPTY_COMMAND {
+			test.Errorf("Expected ERR_EMPTY_COMMAND from ParseMultibulkCommand(%q), got %v", input, err)
+		}
+
+		if command, firstArg, err := GetCommand(getReader(input), false, nil); err != ERR_EMPTY_COMMAND || command != nil || firstArg != nil {
+			test.Errorf("Expected ERR_EMPTY_COMMAND from GetCommand(%q), got %q %q %v", input, command, firstArg, err)
+		}
+
+		if command, args, err := GetCommandAndArgs(getReader(input), nil); err != ERR_EMPTY_COMMAND || command != nil || args != nil {
+			test.Errorf("Expected ERR_EMPTY_COMMAND from GetCommandAndArgs(%q), got %q %q %v", input, command, args, err)
+		}
+	}
+
+	// Clients are told as redis tells them
+	buf := new(bytes.Buffer)
+	WriteError([]byte(ERR_EMPTY_COMMAND.Error()), writer.NewFlexibleWriter(buf), true)
+	if buf.String() != "-ERR unknown command ''\r\n" {
+		test.Errorf("Unexpected error reply %q", buf.String())
+	}
+}
+
+func TestGetCommandAndArgs(test *testing.T) {
+	source := getReader("*4\r\n$4\r\nMSET\r\n$4\r\nKey1\r\n$-1\r\n$6\r\nVal\r\nA\r\n")
+	// Fill the buffer, so that the command can be peeked
+	source.Peek(1)
+
+	command, args, err := GetCommandAndArgs(source, nil)
+	if err != nil {
+		test.Fatalf("GetCommandAndArgs errored: %s", err)
+	}
+
+	if string(command) != "mset" {
+		test.Errorf("Expected the command to be lowercased to mset, got %q", command)
+	}
+
+	expected := [][]byte{[]byte("Key1"), nil, []byte("Val\r\nA")}
+	if len(args) != len(expected) {
+		test.Fatalf("Expected %d args, got %q", len(expected), args)
+	}
+
+	for i := range expected {
+		if !bytes.Equal(expected[i], args[i]) || (expected[i] == nil) != (args[i] == nil) {
+			test.Errorf("Expected arg %d to be %q, got %q", i, expected[i], args[i])
+		}
+	}
+
+	if source.Buffered() == 0 {
+		test.Errorf("GetCommandAndArgs should not consume the command")
+	}
+	if buffered, _ := source.Peek(source.Buffered()); !bytes.HasPrefix(buffered, []byte("*4\r\n$4\r\nMSET\r\n")) {
+		test.Errorf("GetCommandAndArgs should leave the buffered command as it was sent, got %q", buffered)
+	}
+
+	partials := []string{"", "*2", "*2\r\n", "*2\r\n$3\r\nget", "*2\r\n$3\r\nget\r\n$3\r\nke"}
+	for _, partial := range partials {
+		source := bufio.NewReader(strings.NewReader(partial))
+
+		if _, _, err := GetCommandAndArgs(source, nil); err != io.EOF {
+			test.Errorf("Expected io.EOF for truncated %q, got %v", partial, err)
+		}
+	}
+
+	// Commands that can't fit in the reader's buffer can't be peeked
+	source = bufio.NewReaderSize(strings.NewReader("*2\r\n$3\r\nget\r\n$20\r\n01234567890123456789\r\n"), 16)
+	if _, _, err := GetCommandAndArgs(source, nil); err != ERROR_NEED_MORE_DATA {
+		test.Errorf("Expected ERROR_NEED_MORE_DATA for an oversized command, got %v", err)
+	}
+
+	for _, bad := range []string{"+PING\r\n", "*0\r\n", "*1\r\n:1\r\n", "*1\r\n$3\r\ngetxx"} {
+		source := getReader(bad)
+		source.Peek(1)
+
+		if _, _, err := GetCommandAndArgs(source, nil); err == nil || err == ERROR_NEED_MORE_DATA {
+			test.Errorf("Expected a parse error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestGetCommandSplitReads(test *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n"
+
+	// Every read only returns a single byte, as if the command arrived across many packets
+	source := bufio.NewReader(iotest.OneByteReader(strings.NewReader(input)))
+	command, firstArg, err := GetCommand(source, false, nil)
+	if err != nil {
+		test.Fatalf("GetCommand errored on a split command: %s", err)
+	}
+
+	if string(command) != "set" || string(firstArg) != "key" {
+		test.Errorf("GetCommand returned command:%q firstArg:%q", command, firstArg)
+	}
+	if buffered, _ := source.Peek(source.Buffered()); !bytes.HasPrefix(buffered, []byte("*3\r\n$3\r\nSET\r\n")) {
+		test.Errorf("GetCommand should leave the buffered command as it was sent, got %q", buffered)
+	}
+
+	source = bufio.NewReader(iotest.OneByteReader(strings.NewReader(input)))
+	command, args, err := GetCommandAndArgs(source, nil)
+	if err != nil {
+		test.Fatalf("GetCommandAndArgs errored on a split command: %s", err)
+	}
+
+	if string(command) != "set" || len(args) != 2 || string(args[1]) != "0123456789" {
+		test.Errorf("GetCommandAndArgs returned command:%q args:%q", command, args)
+	}
+
+	// A value larger than the reader's buffer shouldn't prevent reading the command and key
+	source = bufio.NewReaderSize(strings.NewReader("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$40\r\n0123456789012345678901234567890123456789\r\n"), 32)
+	if command, firstArg, err = GetCommand(source, false, nil); err != nil || string(firstArg) != "key" {
+		test.Errorf("GetCommand failed on a command with a large value. command:%q firstArg:%q err:%v", command, firstArg, err)
+	}
+}
+
+func TestGetCommandAllocations(test *testing.T) {
+	source := getReader("*2\r\n$3\r\nget\r\n$3\r\nkey\r\n")
+	source.Peek(1)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		GetCommand(source, false, nil)
+	})
+
+	if allocs != 0 {
+		test.Errorf("GetCommand should not allocate on fully buffered commands, allocated %f times", allocs)
+	}
+}
+
+func TestGetCommandInline(test *testing.T) {
+	testData := []struct {
+		input    string
+		command  string
+		firstArg string
+	}{
+		{"PING\r\n", "ping", ""},
+		{"ping\n", "ping", ""},
+		{"GET  mykey\r\n", "get", "mykey"},
+		{" SET Key value\r\n", "set", "Key"},
+	}
+
+	for _, d := range testData {
+		command, firstArg, err := GetCommand(getReader(d.input), true, nil)
+		if err != nil {
+			test.Errorf("GetCommand errored on inline %q: %s", d.input, err)
+			continue
+		}
+
+		if string(command) != d.command || string(firstArg) != d.firstArg {
+			test.Errorf("GetCommand(%q) returned command:%q firstArg:%q", d.input, command, firstArg)
+		}
+	}
+
+	if _, _, err := GetCommand(getReader("   \r\n"), true, nil); err != ERROR_COMMAND_PARSE {
+		test.Errorf("Expected an empty inline command to fail to parse, got %v", err)
+	}
+
+	// Inline commands must be opted into
+	if _, _, err := GetCommand(getReader("PING\r\n"), false, nil); err != ERROR_MULTIBULK_FORMAT_REQUIRED {
+		test.Errorf("Expected inline commands to be refused by default, got %v", err)
+	}
+}
@@ -27,13 +27,31 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/salesforce/rmux/log"
 	. "github.com/salesforce/rmux/writer"
 	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	//This is set to match bufio's default buffer size, so taht we can safely read&ignore large chunks of data when necessary
 	BUFFER_SIZE = 4096
+
+	//The length of a null bulk string ($-1), or the count of a null array (*-1)
+	NULL_LENGTH = -1
+	//The largest int, which ParseInt refuses to go past
+	MAX_INT = int(^uint(0) >> 1)
+
+	//RESP protocol versions that can be negotiated via HELLO.  Every new redis connection starts out speaking RESP2
+	RESP2 = 2
+	RESP3 = 3
 )
 
 var (
@@ -43,13 +61,29 @@ var (
 	//Used when we expect a redis bulk-format payload, and do not receive one
 	ERROR_BAD_BULK_FORMAT = &RecoverableError{"Bad bulk format supplied"}
 	ERROR_COMMAND_PARSE   = &RecoverableError{"Command parse error"}
+	//Used when a command has not been fully buffered yet, and more data needs to be read before it can be parsed
+	ERROR_NEED_MORE_DATA = &RecoverableError{"Command is incomplete"}
+	//Used when a client sends something other than a multibulk command, where inline commands aren't accepted
+	//Phrased for the client it's sent to, which is likely a legacy one that doesn't know why it was refused
+	ERROR_MULTIBULK_FORMAT_REQUIRED = &RecoverableError{"unknown command, multibulk format required"}
+	//Used when a multibulk's command is empty (or a null bulk).  Phrased as redis phrases it, since clients are sent it
+	ERR_EMPTY_COMMAND = &RecoverableError{"unknown command ''"}
 
 	//Error for unsupported (deemed unsafe for multiplexing) commands
 	ERR_COMMAND_UNSUPPORTED = &RecoverableError{"This command is not supported"}
 
+	//Error for commands that aren't on the allowlist, when a CommandPolicy is in allowlist mode
+	ERR_COMMAND_NOT_ALLOWED = &RecoverableError{"command not allowed"}
+
 	//Error for when we receive bad arguments (for multiplexing) accompanying a command
 	ERR_BAD_ARGUMENTS = &RecoverableError{"Bad arguments for command"}
 
+	//Error for a SELECT or HELLO inside MULTI.  The proxy handles them itself, so they can't be queued in the transaction
+	ERR_NOT_IN_MULTI = &RecoverableError{"This command is not supported inside MULTI"}
+
+	//Error for a MULTI inside MULTI, when the proxy is answering for a transaction it hasn't sent yet
+	ERR_NESTED_MULTI = &RecoverableError{"MULTI calls can not be nested"}
+
 	//Commands declared once for convenience
 	DEL_COMMAND         = []byte("del")
 	SUBSCRIBE_COMMAND   = []byte("subscribe")
@@ -59,10 +93,27 @@ var (
 	SHORT_PING_COMMAND  = []byte("PING")
 	SELECT_COMMAND      = []byte("select")
 	QUIT_COMMAND        = []byte("quit")
+	HELLO_COMMAND       = []byte("hello")
+	AUTH_COMMAND        = []byte("auth")
+	MULTI_COMMAND       = []byte("multi")
+	EXEC_COMMAND        = []byte("exec")
+	DISCARD_COMMAND     = []byte("discard")
+	WATCH_COMMAND       = []byte("watch")
+	UNWATCH_COMMAND     = []byte("unwatch")
+	RESET_COMMAND       = []byte("reset")
+	CLIENT_COMMAND      = []byte("client")
+	SCAN_COMMAND        = []byte("scan")
+	SETNAME_SUBCOMMAND  = []byte("setname")
 
 	//Responses declared once for convenience
 	OK_RESPONSE   = []byte("+OK")
 	PONG_RESPONSE = []byte("+PONG")
+	//What an EXEC replies when nothing was queued in the transaction
+	EMPTY_ARRAY_RESPONSE = []byte("*0")
+
+	//Errors from a server that is no longer (or not yet) a usable master, ex: after a sentinel failover
+	READONLY_PREFIX   = []byte("-READONLY ")
+	MASTERDOWN_PREFIX = []byte("-MASTERDOWN ")
 	ERR_RESPONSE  = []byte("$-1")
 
 	//Redis expects \r\n newlines.  Using this means we can stop remembering that
@@ -70,6 +121,9 @@ var (
 
 	//These functions should not be executed through a proxy.
 	//If you know what you're doing, you are welcome to execute them directly on your server
+	//The (un)subscribe commands are here because a subscribed connection stays in pub/sub mode, so it can't go back into
+	//a pool, and the proxy has no connections of its own to give subscribers.  With no SUBSCRIBE, there's no
+	//subscription to track or end, so UNSUBSCRIBE and PUNSUBSCRIBE are refused rather than handled
 	UNSAFE_FUNCTIONS = map[string]bool{
 		"auth":         true,
 		"bgrewriteaof": true,
@@ -77,14 +131,11 @@ var (
 		"client":       true,
 		"config":       true,
 		"dbsize":       true,
-		"discard":      true,
 		"debug":        true,
-		"exec":         true,
 		"lastsave":     true,
 		"move":         true,
 		"monitor":      true,
 		"migrate":      true,
-		"multi":        true,
 		"object":       true,
 		"punsubscribe": true,
 		"psubscribe":   true,
@@ -94,23 +145,23 @@ var (
 		"shutdown":     true,
 		"slaveof":      true,
 		"slowlog":      true,
+		"ssubscribe":   true,
 		"subscribe":    true,
+		"sunsubscribe": true,
 		"sync":         true,
 		"time":         true,
 		"unsubscribe":  true,
-		"unwatch":      true,
-		"watch":        true,
 	}
 
 	//These functions will only work if multiplexing is disabled.
-	//It would be rather worthless to watch on one server, multi on another, and increment on a third
+	//It would be rather worthless to diff a set on one server against a set on another, and store the result on a third
 	SINGLE_DB_FUNCTIONS = map[string]bool{
 		"bitop":       true,
 		"brpoplpush":  true,
-		"eval":        true,
 		"keys":        true,
 		"flushall":    true,
 		"flushdb":     true,
+		"function":    true,
 		"mget":        true,
 		"mset":        true,
 		"msetnx":      true,
@@ -125,27 +176,61 @@ var (
 		"smove":       true,
 		"sunion":      true,
 		"sunionstore": true,
+		"wait":        true,
 		"zinterstore": true,
 		"zunionstore": true,
 	}
 )
 
+//Commands that never write, and so may be sent to a read replica
+//This is deliberately conservative: anything not listed here is treated as a write, and goes to the master
+var READONLY_FUNCTIONS = map[string]bool{
+	"bitcount": true, "dump": true, "exists": true, "fcall_ro": true, "get": true, "getbit": true, "getrange": true, "hexists": true,
+	"hget": true, "hgetall": true, "hkeys": true, "hlen": true, "hmget": true, "hscan": true, "hstrlen": true,
+	"hvals": true, "lindex": true, "llen": true, "lrange": true, "mget": true, "pttl": true, "scard": true,
+	"sismember": true, "smembers": true, "srandmember": true, "sscan": true, "strlen": true, "ttl": true,
+	"type": true, "zcard": true, "zcount": true, "zlexcount": true, "zrange": true, "zrangebylex": true,
+	"zrangebyscore": true, "zrank": true, "zrevrange": true, "zrevrangebylex": true, "zrevrangebyscore": true,
+	"zrevrank": true, "zscan": true, "zscore": true,
+}
+
+//Returns whether the given lowercased command never writes
+func IsReadOnlyFunction(command []byte) bool {
+	return READONLY_FUNCTIONS[string(command)]
+}
+
 func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool) bool {
 	commandLength := len(command)
+	//No command is shorter than get, which leaves the checks below at least three characters to look at.  Clients can
+	//send any name, so the ones that look at a fourth check that it's there
+	if commandLength < 3 {
+		return false
+	}
 
 	if command[0] == 'd' {
 		//*del is only supported if we're not multiplexing, or there's only one argument
 		if command[2] == 'l' && isMultipleArgument {
 			return false
 		}
-		//supported: decr, decrby, del, dump
-		//unsupported: debug, dbsize, discard
+		//supported: decr, decrby, del, discard, dump
+		//unsupported: debug, dbsize
+		if command[1] == 'i' {
+			return true
+		}
 		return (command[1] == 'e' || command[1] == 'u') && command[2] != 'b'
 	} else if command[0] == 'g' {
 		//supported: get, getbit, getrange, getset
 		return true
 	} else if command[0] == 's' {
-		//supported: select, set, setbit, setex, setnx, setrange, sort, spop, srandmember, srem, strlen
+		//supported: spublish, which is routed by its shard channel like a key
+		//unsupported: ssubscribe, sunsubscribe.  Subscribing would leave a pooled connection in pub/sub mode
+		if command[1] == 's' && command[2] == 'u' {
+			return false
+		}
+		if command[1] == 'u' && command[2] == 'n' && commandLength > 3 && command[3] == 's' {
+			return false
+		}
+		//supported: select, set, setbit, setex, setnx, setrange, sort, spop, spublish, srandmember, srem, strlen
 		if command[1] == 'e' || command[1] == 'o' || command[1] == 'p' || command[1] == 'r' || command[1] == 't' {
 			return true
 		}
@@ -158,7 +243,7 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 		if command[1] == 'h' || command[1] == 'l' || command[1] == 'y' {
 			return false
 		}
-		// not supported: subscribe
+		// not supported: subscribe, to any number of channels.  See UNSAFE_FUNCTIONS
 		if command[1] == 'u' && command[2] == 'b' {
 			return false
 		}
@@ -167,7 +252,7 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 			return true
 		}
 		if command[1] == 'c' {
-			if command[3] == 'n' {
+			if commandLength > 3 && command[3] == 'n' {
 				// supported if not multiplexing: scan
 				return !isMultiplexing
 			}
@@ -202,14 +287,14 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 		}
 
 		//supported if multiplexing is disabled: zinterstore, zunionstore
-		return !(command[1] == 'i' && command[3] == 't' || command[1] == 'u')
+		return !(command[1] == 'i' && commandLength > 3 && command[3] == 't' || command[1] == 'u')
 	} else if command[0] == 'p' {
 		//supported: ping, psetex, pttl
 		if command[1] == 'u' {
-			if command[2] == 'n' || (command[2] == 'b' && command[3] == 's') {
+			if command[2] == 'n' || (command[2] == 'b' && commandLength > 3 && command[3] == 's') {
 				// unsupported: punsubscribe, pubsub
 				return false
-			} else if command[2] == 'b' && command[3] == 'l' {
+			} else if command[2] == 'b' && commandLength > 3 && command[3] == 'l' {
 				// supported: publish
 				return true
 			} else {
@@ -257,11 +342,16 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 		//supported: time, ttl, type
 		return true
 	} else if command[0] == 'u' {
-		//unsupported: unsubscribe, unwatch
-		return false
+		//supported: unwatch
+		//unsupported: unsubscribe
+		return command[2] == 'w'
 	} else if command[0] == 'w' {
-		//unsupported: watch
-		return false
+		//supported if multiplexing is disabled: wait
+		if command[2] == 'i' {
+			return !isMultiplexing
+		}
+		//supported: watch.  When multiplexing, keys routed to different backends are refused when the command is routed
+		return bytes.Equal(command, WATCH_COMMAND)
 	} else if command[0] == 'a' {
 		//supported: append
 		//unsupported: auth
@@ -277,25 +367,32 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 		//supported if not multiplexing: bitop, brpop, blpop, brpoplpush
 		return !isMultiplexing
 	} else if command[0] == 'c' {
-		//unsupported: client, config
-		return false
+		//supported: command, which client libraries send on connect to learn the command table.  Every backend
+		//replies the same, wherever it's routed
+		//unsupported: client, cluster, config
+		return commandLength == 7 && command[1] == 'o' && command[2] == 'm'
+
 	} else if command[0] == 'e' {
-		//unsupported: exec
-		if command[2] == 'e' {
-			return false
-		}
-		//supported: echo, exists, expire, expireat
-		//supported if not multiplexing: eval, evalsha
-		return command[1] != 'v' || !isMultiplexing
+		//supported: echo, exec, exists, expire, expireat
+		//supported: eval, evalsha, which are routed by their declared keys when multiplexing
+		return true
 	} else if command[0] == 'f' {
-		//Support flushall and flushdb in non-multiplexing mode
+		//supported: fcall, fcall_ro, which are routed by their declared keys when multiplexing, like eval
+		if command[1] == 'c' {
+			return true
+		}
+		//Support flushall, flushdb and function in non-multiplexing mode
 		return !isMultiplexing
 	} else if command[0] == 'k' {
 		//supported if not multiplexing: keys
 		return !isMultiplexing
 	} else if command[0] == 'm' {
+		//supported: multi
 		//supported if not multiplexing: mget, mset, msetnx
-		//unsupported: move, monitor, migrate, multi
+		//unsupported: move, monitor, migrate
+		if command[1] == 'u' {
+			return bytes.Equal(command, MULTI_COMMAND)
+		}
 		if isMultiplexing {
 			return false
 		}
@@ -306,17 +403,82 @@ func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool
 	return false
 }
 
+//Where the protocol package's debug logs go.  Defaults to the global rmux/log
+var logger log.Logger = log.GlobalLogger
+
+//Sends the protocol package's debug logs to the given logger, rather than the global rmux/log
+func SetLogger(l log.Logger) {
+	if l == nil {
+		l = log.GlobalLogger
+	}
+	logger = l
+}
+
+//Identifies the client connection that a protocol operation is running on behalf of, so that its debug logs
+//can be correlated.  A nil LogContext is allowed, and logs without the connection's fields
+type LogContext struct {
+	ConnectionId uint64
+	RemoteAddr   string
+	//Whether the connection's debug logs are written whatever the log level, as set with SetTracing
+	tracing int32
+}
+
+//Turns tracing of the connection on or off, so that one connection can be debugged without every other one's debug
+//logs.  Safe to call while the connection is in use
+func (this *LogContext) SetTracing(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&this.tracing, value)
+}
+
+//Returns whether the connection is being traced.  A nil LogContext never is
+func (this *LogContext) Tracing() bool {
+	return this != nil && atomic.LoadInt32(&this.tracing) == 1
+}
+
+//Logs the message at debug level, as key=value pairs, tagged with the connection's id and remote address
+//If the connection is being traced, it's logged at info level instead, so that it's written without debug logging
+//being on for everyone
+func (this *LogContext) Debug(message string, fields ...log.Field) {
+	if this != nil {
+		fields = append([]log.Field{log.F("conn_id", this.ConnectionId), log.F("remote", this.RemoteAddr)}, fields...)
+	}
+	if this.Tracing() {
+		logger.Infof("%s", log.FieldsMessage{Message: message, Fields: fields})
+		return
+	}
+	log.Debugw(logger, message, fields...)
+}
+
 //Parses a string into an int.
 //Differs from atoi in that this only parses positive dec ints--hex, octal, and negatives are not allowed
 //Upon invalid character received, a PANIC_INVALID_INT is caught and err'd
 func ParseInt(response []byte) (value int, err error) {
+	value64, err := ParseInt64(response)
+	if err != nil {
+		return 0, err
+	}
+
+	//A value that doesn't fit would wrap around, and could pass for a small length on 32-bit platforms
+	if value64 > int64(MAX_INT) || value64 < -int64(MAX_INT) {
+		log.Debugw(logger, "ParseInt: Int overflowed", log.F("input", response))
+		return 0, ERROR_INVALID_INT
+	}
+
+	return int(value64), nil
+}
+
+//Parses a string into an int64, identically to ParseInt
+//Used for bulk lengths, which may legitimately exceed a 32-bit int
+func ParseInt64(response []byte) (value int64, err error) {
 	if len(response) == 0 {
-//		Debug("ParseInt: Zero-length int")
+		log.Debugw(logger, "ParseInt: Zero-length int")
 		err = ERROR_INVALID_INT
 		return
 	}
 
-	value = 0
 	isNegative := false
 	//It's worth re-inventing the wheel, if you have a good understanding of your particular wheel's usage
 	for i, b := range response {
@@ -329,12 +491,18 @@ func ParseInt(response []byte) (value int, err error) {
 		b = b - '0'
 		//Since we know we have a positive value, we can now do this single check
 		if b > 9 {
-//			Debug("ParseInt: Invalid int character: %q when parsing %q", b+'0', response)
+			log.Debugw(logger, "ParseInt: Invalid int character", log.F("char", string(b+'0')), log.F("input", response))
+			err = ERROR_INVALID_INT
+			return
+		}
+		//A value that doesn't fit would wrap around, and could pass for a small length
+		if value > (math.MaxInt64-int64(b))/10 {
+			log.Debugw(logger, "ParseInt: Int overflowed", log.F("input", response))
 			err = ERROR_INVALID_INT
 			return
 		}
 		value *= 10
-		value += int(b)
+		value += int64(b)
 	}
 
 	if isNegative {
@@ -375,13 +543,13 @@ func ParseCommand(b []byte) (command Command, err error) {
 func WriteError(line []byte, dest *FlexibleWriter, flush bool) (err error) {
 	_, err = dest.Write([]byte("-ERR "))
 	if err != nil {
-//		Debug("WriteError: Error received from write: %s", err)
+		log.Debugw(logger, "WriteError: Error received from write", log.F("err", err))
 		return err
 	}
 
 	err = WriteLine(line, dest, flush)
 	if err != nil {
-//		Debug("WriteError: Error received from write: %s", err)
+		log.Debugw(logger, "WriteError: Error received from write", log.F("err", err))
 		return err
 	}
 
@@ -398,13 +566,13 @@ func WriteLine(line []byte, destination *FlexibleWriter, flush bool) (err error)
 	// startTime := time.Now()
 	_, err = destination.Write(line)
 	if err != nil {
-//		Debug("writeLine: Error received from write: %s", err)
+		log.Debugw(logger, "writeLine: Error received from write", log.F("err", err))
 		return
 	}
 
 	_, err = destination.Write(REDIS_NEWLINE)
 	if err != nil {
-//		Debug("writeLine: Error received from writing GO_NEWLINE: %s", err)
+		log.Debugw(logger, "writeLine: Error received from writing GO_NEWLINE", log.F("err", err))
 		return
 	}
 
@@ -415,35 +583,598 @@ func WriteLine(line []byte, destination *FlexibleWriter, flush bool) (err error)
 	return
 }
 
+//Writes the given line and flushes it, like WriteLine, but gives up once the context is done
+//The connection's write deadline is set to the earlier of the context's deadline and writeTimeout from now (if
+//writeTimeout is set), and cancelling the context aborts a flush that is blocked on a slow reader.  If the context
+//is done, ctx.Err() is returned.  Part of the line may have been written by then, so the caller should disconnect
+func FlushLineContext(ctx context.Context, line []byte, destination *FlexibleWriter, conn net.Conn, writeTimeout time.Duration) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if writeTimeout > 0 {
+		if timeout := time.Now().Add(writeTimeout); !hasDeadline || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	conn.SetWriteDeadline(deadline)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// A deadline in the past fails the blocked write straight away
+			conn.SetWriteDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err = WriteLine(line, destination, true)
+	close(done)
+	<-stopped
+	conn.SetWriteDeadline(time.Time{})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The write deadline can fire just before the context's own timer does
+		if ctxDeadline, ok := ctx.Deadline(); ok && !time.Now().Before(ctxDeadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+//Writes the given arguments to the buffer as a multibulk command
+//Unlike an inline command, the arguments may contain spaces or newlines
+//When flushing, the arguments are gathered into a single vectored write if the destination supports it, rather than
+//copied into its buffer (see FlexibleWriter.WriteBuffersAndFlush)
+func WriteMultibulk(args [][]byte, destination *FlexibleWriter, flush bool) (err error) {
+	// The headers are all appended to one slice first, so that it isn't reallocated while they're sliced out of it
+	headers := make([]byte, 0, 16*(len(args)+1))
+	ends := make([]int, 0, len(args)+1)
+	headers = appendMultibulkHeader(headers, '*', len(args))
+	ends = append(ends, len(headers))
+	for _, arg := range args {
+		headers = appendMultibulkHeader(headers, '$', len(arg))
+		ends = append(ends, len(headers))
+	}
+
+	buffers := make(net.Buffers, 0, 3*len(args)+1)
+	buffers = append(buffers, headers[:ends[0]])
+	for i, arg := range args {
+		buffers = append(buffers, headers[ends[i]:ends[i+1]], arg, REDIS_NEWLINE)
+	}
+
+	if flush {
+		return destination.WriteBuffersAndFlush(buffers)
+	}
+
+	for _, buffer := range buffers {
+		if _, err = destination.Write(buffer); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//Appends a multibulk or bulk length header, like *3\r\n
+func appendMultibulkHeader(b []byte, prefix byte, length int) []byte {
+	b = append(b, prefix)
+	b = strconv.AppendInt(b, int64(length), 10)
+	return append(b, REDIS_NEWLINE...)
+}
+
 //Copies a server response from the remoteBuffer into your localBuffer
-//If a protocol or buffer error is encountered, it is bubbled up
-func CopyServerResponses(reader *bufio.Reader, localBuffer *FlexibleWriter, numResponses int) (err error) {
+//Replies are streamed through in bounded memory (see CopyServerResponse), however large their values are.  Errors are
+//typed by the side that failed, as with CopyServerResponse
+//If a protocol or buffer error is encountered, it is bubbled up, and debug logged against logCtx, which may be nil
+func CopyServerResponses(reader *bufio.Reader, localBuffer *FlexibleWriter, numResponses int, logCtx *LogContext) (err error) {
 	//start := time.Now()
 	//defer func() {
 	//	graphite.Timing("copy_server_responses", time.Now().Sub(start))
 	//}()
 
-	scanner := NewRespScanner(reader)
+	return CopyObservedServerResponses(reader, localBuffer, numResponses, logCtx, nil)
+}
+
+//Like CopyServerResponses, and passes the kind of each reply copied (not push frames) to observe, if it's set, ex: to
+//count error replies.  A reply that is a single line, ex: an error's "-LOADING ...", is passed along with it, without its
+//newline.  Otherwise the line is nil.  It's only valid until observe returns
+func CopyObservedServerResponses(reader *bufio.Reader, localBuffer *FlexibleWriter, numResponses int, logCtx *LogContext,
+	observe func(kind ReplyKind, line []byte)) (err error) {
+	return readServerResponses(reader, numResponses, logCtx, func() (bool, error) {
+		kind, line, err := copyObservedServerResponse(reader, localBuffer)
+		if err == nil && !kind.IsPush() && observe != nil {
+			observe(kind, line)
+		}
+		return kind.IsPush(), err
+	})
+}
+
+//Scans numResponses replies from the reader, passing each to the handler in order
+//Push frames are passed to the handler as well, but don't count towards numResponses.  The response is only valid
+//until the handler returns.  If the handler returns an error, scanning stops and the error is returned
+//Each reply is read whole before it is passed on, so prefer CopyServerResponses for replies that needn't be inspected
+func ScanServerResponses(reader *bufio.Reader, numResponses int, logCtx *LogContext, handler func(response []byte) error) (err error) {
+	response := new(bytes.Buffer)
+
+	return readServerResponses(reader, numResponses, logCtx, func() (bool, error) {
+		response.Reset()
+		kind, err := copyServerResponse(reader, response)
+		if err != nil {
+			return false, err
+		}
+		return kind.IsPush(), handler(response.Bytes())
+	})
+}
+
+//Calls read until numResponses replies have been read, not counting push frames, or until it errors
+//Push frames already buffered behind the last reply are read as well, since they'd otherwise reach whichever client is
+//handed the connection next.  Nothing else past the last reply is consumed from the reader
+func readServerResponses(reader *bufio.Reader, numResponses int, logCtx *LogContext, read func() (isPush bool, err error)) error {
+	for numRead := 0; numRead < numResponses; {
+		isPush, err := read()
+		if errors.Is(err, io.EOF) {
+			logCtx.Debug("readServerResponses: Server closed before responding", log.F("read", numRead), log.F("expected", numResponses))
+			return err
+		} else if err != nil {
+			logCtx.Debug("readServerResponses: Could not read response", log.F("err", err), log.F("read", numRead), log.F("expected", numResponses))
+			return err
+		}
+
+		// Push frames can arrive interleaved between a command and its reply, and are not a reply themselves
+		if !isPush {
+			numRead++
+		}
+		if logCtx.Tracing() {
+			logCtx.Debug("readServerResponses: Read response", log.F("push", isPush), log.F("read", numRead), log.F("expected", numResponses))
+		}
+	}
+
+	for reader.Buffered() > 0 {
+		if next, _ := reader.Peek(1); next[0] != '>' {
+			break
+		}
+		if _, err := read(); err != nil {
+			logCtx.Debug("readServerResponses: Could not read a trailing push", log.F("err", err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Copies a single reply from the source to the destination, and returns its kind
+//Bulk payloads are streamed through in chunks, and the destination is flushed whenever BUFFER_SIZE bytes are
+//buffered, so that memory use is bounded by the size of the source's buffer rather than by the size of the reply.
+//Errors say which side failed: a *ClientWriteError if the destination can't be written to, in which case the reply is
+//left part way read, and a *BackendReadError otherwise.  Within those, a clean end of stream before the reply starts
+//is io.EOF, while one part way through is io.ErrUnexpectedEOF
+//The reply's kind is returned, ex: REPLY_ERROR, so that the caller can react to it without parsing the reply again.  It
+//is REPLY_UNKNOWN if not even the reply's first line could be read
+func CopyServerResponse(source *bufio.Reader, destination *FlexibleWriter) (kind ReplyKind, err error) {
+	kind, _, err = copyObservedServerResponse(source, destination)
+	return
+}
+
+//Like CopyServerResponse, and also returns the reply's line if it's a single line, see copyServerReply
+func copyObservedServerResponse(source *bufio.Reader, destination *FlexibleWriter) (kind ReplyKind, line []byte, err error) {
+	if kind, line, err = copyServerReply(source, streamingWriter{destination}); err != nil {
+		return kind, nil, backendReadError(err)
+	}
+
+	if err = destination.Flush(); err != nil {
+		err = &ClientWriteError{err}
+	}
+	return
+}
+
+//Writes to a FlexibleWriter, flushing it as soon as BUFFER_SIZE bytes are buffered
+//Errors are returned as a *ClientWriteError, so that they can be told apart from errors reading the source
+type streamingWriter struct {
+	*FlexibleWriter
+}
+
+func (this streamingWriter) Write(b []byte) (n int, err error) {
+	n, err = this.FlexibleWriter.Write(b)
+	if err == nil && this.Buffered() >= BUFFER_SIZE {
+		err = this.Flush()
+	}
+	if err != nil {
+		err = &ClientWriteError{err}
+	}
+	return
+}
+
+//Copies a single reply from the source to the destination, without holding more than a buffer's worth of it
+func copyServerResponse(source *bufio.Reader, destination io.Writer) (kind ReplyKind, err error) {
+	kind, _, err = copyServerReply(source, destination)
+	return
+}
+
+//Like copyServerResponse, and also returns the reply's line, without its newline, if the reply is a single line (ex: a
+//simple string, an error or an integer) that fits in the source's buffer.  It's only valid until the next read from
+//the source
+func copyServerReply(source *bufio.Reader, destination io.Writer) (kind ReplyKind, line []byte, err error) {
+	line, err = source.ReadSlice('\n')
+	if err == bufio.ErrBufferFull && !isAggregateOrBulk(line[0]) {
+		// Only simple strings and errors can be this long
+		return ReplyKindOf(line[0]), nil, copyLongReplyLine(source, destination, line)
+	} else if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = ERROR_BAD_BULK_FORMAT
+		} else if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return REPLY_UNKNOWN, nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return REPLY_UNKNOWN, nil, ERROR_BAD_BULK_FORMAT
+	}
+
+	// The line is only valid until the next read from the source
+	prefix := line[0]
+	kind = ReplyKindOf(prefix)
+	header := line[1 : len(line)-2]
+	if _, err = destination.Write(line); err != nil {
+		return kind, nil, err
+	}
 
-	numRead := 0
+	switch prefix {
+	case '$', '=', '!':
+		// A verbatim string (=15\r\ntxt:Some string\r\n) and a blob error (!21\r\nSYNTAX invalid syntax\r\n) are framed
+		// like a bulk string, and a verbatim string's txt:/mkd: marker is part of the payload
+		length, err := ParseInt64(header)
+		if err != nil {
+			return kind, nil, err
+		} else if length == NULL_LENGTH {
+			// A null bulk string, as GET replies for a missing key, has no payload
+			return REPLY_NULL, nil, nil
+		} else if length < 0 {
+			return kind, nil, ERROR_BAD_BULK_FORMAT
+		} else if err = checkBulkLength(length); err != nil {
+			return kind, nil, err
+		}
+		return kind, nil, copyBulkPayload(source, destination, length)
+	case '|':
+		// An attribute is a map that annotates the reply after it.  That reply is copied along with it, and its kind is
+		// the one returned
+		count, err := ParseInt(header)
+		if err != nil || count < 0 {
+			return kind, nil, ERROR_BAD_BULK_FORMAT
+		}
+		if err = copyServerElements(source, destination, count, 2); err != nil {
+			return kind, nil, err
+		}
+		if kind, err = copyServerResponse(source, destination); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return kind, nil, err
+	case '*', '%', '>', '~':
+		count, err := ParseInt(header)
+		if err != nil {
+			return kind, nil, ERROR_BAD_BULK_FORMAT
+		} else if count == NULL_LENGTH {
+			// A null array, as BLPOP replies on a timeout, has no elements
+			return REPLY_NULL, nil, nil
+		} else if count == 0 {
+			return kind, nil, nil
+		} else if count < 0 {
+			return kind, nil, ERROR_BAD_BULK_FORMAT
+		}
+
+		// A map's entries are each a key and a value
+		width := 1
+		if prefix == '%' {
+			width = 2
+		}
+		return kind, nil, copyServerElements(source, destination, count, width)
+	case ',', '#', '(', '_':
+		if !isValidScalar(prefix, header) {
+			return kind, nil, ERROR_BAD_BULK_FORMAT
+		}
+		return kind, nil, nil
+	}
+
+	// Simple strings, errors and integers, as well as anything unrecognized, are copied as a single line
+	return kind, line[:len(line)-2], nil
+}
+
+//Copies the count entries of an aggregate, each of which is width replies
+//Each element is copied as a reply of its own, framed by its own prefix, so that an error, status or integer element
+//(ex: the -WRONGTYPE of a command that failed inside an EXEC) is passed through as it is.  Only bulk elements are read
+//as bulk strings
+//Counted by entry, so that a map's count can't overflow when doubled on 32-bit builds
+func copyServerElements(source *bufio.Reader, destination io.Writer, count, width int) error {
+	for i := 0; i < count; i++ {
+		for j := 0; j < width; j++ {
+			if _, err := copyServerResponse(source, destination); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	for ; numRead < numResponses && scanner.Scan(); {
-		localBuffer.Write(scanner.Bytes())
-		localBuffer.Flush()
-		numRead++
+//Checks the value of a RESP3 scalar reply: a double like ,3.14 or ,inf, a boolean (#t or #f), a big number like
+//(3492890328409238509324850943850943825024385, or a null (_)
+func isValidScalar(prefix byte, value []byte) bool {
+	switch prefix {
+	case ',':
+		_, err := strconv.ParseFloat(string(value), 64)
+		return err == nil
+	case '#':
+		return len(value) == 1 && (value[0] == 't' || value[0] == 'f')
+	case '(':
+		if len(value) > 0 && value[0] == '-' {
+			value = value[1:]
+		}
+		if len(value) == 0 {
+			return false
+		}
+		for _, b := range value {
+			if b < '0' || b > '9' {
+				return false
+			}
+		}
+		return true
+	case '_':
+		return len(value) == 0
 	}
+	return false
+}
 
-	if numRead < numResponses {
-		return io.EOF
+//Returns whether the reply type has a length or count header, that is followed by more data
+func isAggregateOrBulk(prefix byte) bool {
+	switch prefix {
+	case '$', '=', '!', '*', '%', '>', '~', '|':
+		return true
 	}
+	return false
+}
 
-	if sErr := scanner.Err(); sErr != nil {
-		return sErr
+//Copies a bulk payload and the \r\n that trails it, no more than the source's buffer size at a time
+func copyBulkPayload(source *bufio.Reader, destination io.Writer, length int64) error {
+	// Copied in chunks, so that lengths over 2GiB are handled on 32-bit builds
+	for length > 0 {
+		chunk := length
+		if chunk > int64(source.Size()) {
+			chunk = int64(source.Size())
+		}
+
+		payload, err := source.Peek(int(chunk))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if _, err = destination.Write(payload); err != nil {
+			return err
+		}
+		source.Discard(len(payload))
+		length -= chunk
 	}
 
+	trailer, err := readReplyTrailer(source)
+	if err == nil && !trailer {
+		err = ERROR_BAD_BULK_FORMAT
+	}
 	if err != nil {
 		return err
 	}
 
+	_, err = destination.Write(REDIS_NEWLINE)
+	return err
+}
+
+//Copies a line that doesn't fit in the source's buffer, starting with the part that has already been read
+func copyLongReplyLine(source *bufio.Reader, destination io.Writer, line []byte) (err error) {
+	var previous byte
+	for {
+		if _, err = destination.Write(line); err != nil {
+			return err
+		}
+
+		if len(line) > 0 {
+			previous = line[len(line)-1]
+		}
+
+		line, err = source.ReadSlice('\n')
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	// The \r may have ended the previous part
+	if (len(line) < 2 && previous != '\r') || (len(line) >= 2 && line[len(line)-2] != '\r') {
+		return ERROR_BAD_BULK_FORMAT
+	}
+
+	_, err = destination.Write(line)
+	return err
+}
+
+//Returns whether the response says that the server is not a usable master, so its master should be looked up again
+func IsFailoverError(response []byte) bool {
+	return bytes.HasPrefix(response, READONLY_PREFIX) || bytes.HasPrefix(response, MASTERDOWN_PREFIX)
+}
+
+//Returns whether the response is the given status reply (ex: OK_RESPONSE or PONG_RESPONSE), with or without its
+//trailing newline
+func IsStatusResponse(response, status []byte) bool {
+	return bytes.Equal(bytes.TrimSuffix(response, REDIS_NEWLINE), status)
+}
+
+//Returns whether the status line (ex: as read by ReadStatusLine) is the given status (ex: OK_RESPONSE or
+//PONG_RESPONSE), ignoring any spaces, tabs, carriage returns or newlines that trail it.  Something in front of the
+//server may add those, and they don't change what it replied
+func IsStatusLine(line, status []byte) bool {
+	return bytes.Equal(bytes.TrimRight(line, " \t\r\n"), status)
+}
+
+//Reads a single status or error reply line, ex: +OK or -ERR ..., and returns it without its newline
+//Unlike bufio's ReadLine, a line longer than the source's buffer is assembled in full, up to the longest bulk string
+//accepted, rather than returned in parts.  As with ReadLine, the end of the stream ends a line that has no newline
+//A line that fits is only valid until the next read from the source
+func ReadStatusLine(source *bufio.Reader) ([]byte, error) {
+	line, isPrefix, err := source.ReadLine()
+	if err != nil || !isPrefix {
+		return line, err
+	}
+
+	// Each part is only valid until the next read, so they're copied
+	full := append([]byte(nil), line...)
+	for isPrefix {
+		if line, isPrefix, err = source.ReadLine(); err == io.EOF {
+			// The stream ended just as the buffer filled
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		full = append(full, line...)
+		if err = checkBulkLength(int64(len(full))); err != nil {
+			return nil, err
+		}
+	}
+
+	return full, nil
+}
+
+//Returns the keys that the given WATCH command watches, which are all of its arguments
+//The returned keys share the command's buffer
+func GetWatchKeys(command Command) [][]byte {
+	return commandArgs(command)
+}
+
+//Reads and discards a single reply from the source, leaving anything that follows it buffered
+//Nested aggregates are skipped recursively, and bulk payloads are discarded without being buffered
+func IgnoreServerResponse(source *bufio.Reader) (err error) {
+	line, err := readReplyLine(source)
+	if err != nil {
+		return err
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return nil
+	case ',', '#', '(', '_':
+		if !isValidScalar(line[0], line[1:]) {
+			return ERROR_BAD_BULK_FORMAT
+		}
+		return nil
+	case '$', '=', '!':
+		length, err := ParseInt64(line[1:])
+		if err != nil {
+			return err
+		} else if length == NULL_LENGTH {
+			return nil
+		} else if length < 0 {
+			return ERROR_BAD_BULK_FORMAT
+		} else if err = DiscardBytes(source, length); err != nil {
+			return err
+		}
+
+		trailer, err := readReplyTrailer(source)
+		if err == nil && !trailer {
+			err = ERROR_BAD_BULK_FORMAT
+		}
+		return err
+	case '*', '%', '>', '~', '|':
+		count, err := ParseInt(line[1:])
+		if err != nil || count < NULL_LENGTH || (line[0] == '|' && count < 0) {
+			return ERROR_BAD_BULK_FORMAT
+		}
+
+		// Maps and attributes are made of key and value pairs
+		width := 1
+		if line[0] == '%' || line[0] == '|' {
+			width = 2
+		}
+
+		for i := 0; i < count; i++ {
+			for j := 0; j < width; j++ {
+				if err = IgnoreServerResponse(source); err != nil {
+					return err
+				}
+			}
+		}
+
+		if line[0] == '|' {
+			// The reply that the attribute annotates
+			return IgnoreServerResponse(source)
+		}
+		return nil
+	}
+
+	return ERROR_BAD_BULK_FORMAT
+}
+
+//Discards exactly length bytes from the source, without buffering more than the source already does
+//ERROR_BULK_TOO_LONG is returned for a length longer than the longest bulk string accepted, and
+//io.ErrUnexpectedEOF if the stream ends first
+func DiscardBytes(source *bufio.Reader, length int64) error {
+	if err := checkBulkLength(length); err != nil {
+		return err
+	}
+
+	// Discard in chunks, so that lengths over 2GiB are handled on 32-bit builds
+	for length > 0 {
+		chunk := length
+		if chunk > BUFFER_SIZE {
+			chunk = BUFFER_SIZE
+		}
+
+		if _, err := source.Discard(int(chunk)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		length -= chunk
+	}
 	return nil
 }
+
+//Reads the \r\n that trails a bulk payload, returning whether it was well formed
+//A bare \n is well formed too, if LenientNewlines is set
+func readReplyTrailer(source *bufio.Reader) (bool, error) {
+	trailer, err := source.Peek(2)
+	if err == nil && trailer[0] == '\r' && trailer[1] == '\n' {
+		source.Discard(2)
+		return true, nil
+	}
+
+	// Checked before the error, since a bare \n may be the last byte of the stream
+	if len(trailer) > 0 && trailer[0] == '\n' && LenientNewlines() {
+		source.Discard(1)
+		return true, nil
+	}
+
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, err
+	}
+
+	source.Discard(2)
+	return false, nil
+}
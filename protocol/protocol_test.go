@@ -28,9 +28,20 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/salesforce/rmux/writer"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type ProtocolTester struct {
@@ -65,11 +76,49 @@ func TestParseInt(test *testing.T) {
 	tester.verifyParseIntError([]byte("01b"))
 	tester.verifyParseIntError([]byte("0b1"))
 	tester.verifyParseIntError([]byte("b1"))
+	tester.verifyParseIntError([]byte(""))
+	tester.verifyParseIntError(nil)
+	tester.verifyParseIntError([]byte("99999999999999999999"))
 
 	tester.verifyParseIntResponse([]byte("-1"), -1)
 	tester.verifyParseIntResponse([]byte("12345"), 12345)
 	tester.verifyParseIntResponse([]byte("01"), 1)
 	tester.verifyParseIntResponse([]byte("10"), 10)
+	tester.verifyParseIntResponse([]byte("0"), 0)
+
+	// Values past a 32-bit int are only an int on 64-bit platforms.  Run with GOARCH=386 to check the 32-bit side
+	for _, input := range []string{"3000000000", "-3000000000"} {
+		value, err := ParseInt([]byte(input))
+		if strconv.IntSize == 32 && err == nil {
+			test.Errorf("ParseInt(%q) should overflow a 32-bit int, got %d", input, value)
+		} else if strconv.IntSize == 64 && (err != nil || strconv.Itoa(value) != input) {
+			test.Errorf("ParseInt(%q) returned %d, %v", input, value, err)
+		}
+	}
+}
+
+func TestParseInt64(test *testing.T) {
+	for _, fakeInt := range []string{"", "invalid int", "0b1", "3000000000b", "99999999999999999999", "-99999999999999999999"} {
+		if _, err := ParseInt64([]byte(fakeInt)); err == nil {
+			test.Errorf("ParseInt64 did not error on %q", fakeInt)
+		}
+	}
+
+	testData := []struct {
+		input    string
+		expected int64
+	}{
+		{"-1", -1},
+		{"0", 0},
+		{"3000000000", 3000000000},
+		{"9000000000000", 9000000000000},
+	}
+
+	for _, d := range testData {
+		if value, err := ParseInt64([]byte(d.input)); err != nil || value != d.expected {
+			test.Errorf("ParseInt64(%q) returned %d, %v. Expected %d", d.input, value, err, d.expected)
+		}
+	}
 }
 
 func (test *ProtocolTester) compareString(str1, str2 string) {
@@ -107,6 +156,21 @@ func TestWriteLine(test *testing.T) {
 	}
 }
 
+func TestWriteMultibulk(test *testing.T) {
+	w := new(bytes.Buffer)
+	buf := writer.NewFlexibleWriter(w)
+	WriteMultibulk([][]byte{[]byte("auth"), []byte("two words"), []byte("")}, buf, false)
+	if w.Len() != 0 {
+		test.Fatal("Buffer flushed prematurely")
+	}
+
+	buf.Flush()
+	expected := "*3\r\n$4\r\nauth\r\n$9\r\ntwo words\r\n$0\r\n\r\n"
+	if w.String() != expected {
+		test.Fatalf("Multibulk was not written correctly. got:%q expected:%q", w.String(), expected)
+	}
+}
+
 func TestFlushLine(test *testing.T) {
 	w := new(bytes.Buffer)
 	w.Reset()
@@ -127,6 +191,44 @@ func TestFlushLine(test *testing.T) {
 	}
 }
 
+func TestFlushLineContext(test *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	w := writer.NewFlexibleWriter(local)
+
+	// Nothing reads from the pipe, so every flush blocks until it gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := FlushLineContext(ctx, []byte("+OK"), w, local, time.Minute); err != context.Canceled {
+		test.Errorf("Expected a cancelled flush to return context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := FlushLineContext(ctx, []byte("+OK"), writer.NewFlexibleWriter(local), local, time.Minute); err != context.DeadlineExceeded {
+		test.Errorf("Expected the context's deadline to be used over a longer write timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		test.Errorf("Expected the flush to give up at the context's deadline, took %s", elapsed)
+	}
+
+	err := FlushLineContext(context.Background(), []byte("+OK"), writer.NewFlexibleWriter(local), local, 20*time.Millisecond)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		test.Errorf("Expected a shorter write timeout to be used over the context, got %v", err)
+	}
+
+	// The deadline is cleared afterwards, so the connection is still usable
+	go ioutil.ReadAll(remote)
+	if err := FlushLineContext(context.Background(), []byte("+OK"), writer.NewFlexibleWriter(local), local, 0); err != nil {
+		test.Errorf("Expected a flush to a reader to succeed, got %v", err)
+	}
+}
+
 func (test *ProtocolTester) verifyGoodCopyServerResponse(goodMessage, extraMessage string) {
 	w := new(bytes.Buffer)
 	w.Reset()
@@ -135,7 +237,7 @@ func (test *ProtocolTester) verifyGoodCopyServerResponse(goodMessage, extraMessa
 
 	reader := bufio.NewReader(bytes.NewBufferString(strings.Join([]string{goodMessage, extraMessage}, "")))
 
-	err := CopyServerResponses(reader, writer, 1)
+	err := CopyServerResponses(reader, writer, 1, nil)
 	if err != nil {
 		test.Fatalf("CopyServerResponse fataled on %q", goodMessage)
 	}
@@ -148,6 +250,556 @@ func (test *ProtocolTester) verifyGoodCopyServerResponse(goodMessage, extraMessa
 	}
 }
 
+func (test *ProtocolTester) verifyCopiedServerResponse(message string, expected error) {
+	w := new(bytes.Buffer)
+	writer := writer.NewFlexibleWriter(w)
+	reader := bufio.NewReader(bytes.NewBufferString(message))
+
+	// Anything that goes wrong here is the server's doing
+	err := CopyServerResponses(reader, writer, 1, nil)
+	if readErr, ok := err.(*BackendReadError); expected != nil && (!ok || readErr.Err != expected) {
+		test.Fatalf("CopyServerResponses(%q) should have returned a BackendReadError of %v, got %v", message, expected, err)
+	} else if expected == nil && err != nil {
+		test.Fatalf("CopyServerResponses(%q) should have succeeded, got %v", message, err)
+	}
+
+	if expected == nil && !bytes.Equal(w.Bytes(), []byte(message)) {
+		test.Fatalf("CopyServerResponses did not copy the reply faithfully. Expected %q, got %q", message, w.Bytes())
+	}
+}
+
+func TestCopyServerResponsesMap(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// CONFIG GET maxmemory, under RESP3
+	tester.verifyCopiedServerResponse("%1\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n", nil)
+	// Nested aggregates, as seen in CLIENT INFO style replies
+	tester.verifyCopiedServerResponse("%2\r\n$4\r\nname\r\n$3\r\nfoo\r\n$5\r\nflags\r\n*2\r\n+N\r\n%1\r\n+a\r\n:1\r\n", nil)
+	tester.verifyCopiedServerResponse("%0\r\n", nil)
+
+	// Malformed headers should error rather than wait for more data
+	tester.verifyCopiedServerResponse("%abc\r\n$1\r\na\r\n", ERROR_BAD_BULK_FORMAT)
+	tester.verifyCopiedServerResponse("%\r\n", ERROR_BAD_BULK_FORMAT)
+}
+
+func TestCopyServerResponsesNulls(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// BLPOP/BRPOP reply with a null array on a timeout, which must not swallow the reply after it
+	tester.verifyGoodCopyServerResponse("*-1\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("*0\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("$-1\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("%0\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("*3\r\n*-1\r\n*0\r\n$-1\r\n", "+OK\r\n")
+
+	// Only -1 means null
+	tester.verifyCopiedServerResponse("*-2\r\n", ERROR_BAD_BULK_FORMAT)
+	tester.verifyCopiedServerResponse("$-2\r\n", ERROR_BAD_BULK_FORMAT)
+
+	for _, reply := range []string{"*-1\r\n", "*0\r\n", "$-1\r\n", "*2\r\n*-1\r\n$-1\r\n"} {
+		reader := bufio.NewReader(bytes.NewBufferString(reply + "+PONG\r\n"))
+		if err := IgnoreServerResponse(reader); err != nil {
+			test.Errorf("IgnoreServerResponse errored on %q: %s", reply, err)
+		} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, PONG_RESPONSE) {
+			test.Errorf("Stream was not aligned after ignoring %q. Read %q", reply, line)
+		}
+	}
+
+	for _, reply := range []string{"*-2\r\n", "$-2\r\n"} {
+		if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString(reply))); err != ERROR_BAD_BULK_FORMAT {
+			test.Errorf("IgnoreServerResponse should have refused %q, got %v", reply, err)
+		}
+	}
+}
+
+func TestCopyServerResponsesVerbatim(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// LATENCY DOCTOR and LOLWUT reply with verbatim strings under RESP3
+	tester.verifyGoodCopyServerResponse("=15\r\ntxt:Some string\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("*2\r\n=7\r\nmkd:# a\r\n=4\r\ntxt:\r\n", "+OK\r\n")
+	// The payload may hold newlines, which mustn't be taken for the end of the reply
+	tester.verifyGoodCopyServerResponse("=10\r\ntxt:a\r\nb\r\n\r\n", "+OK\r\n")
+	tester.verifyCopiedServerResponse("=15\r\ntxt:some\r\n", io.ErrUnexpectedEOF)
+
+	reader := bufio.NewReader(bytes.NewBufferString("=15\r\ntxt:Some string\r\n+PONG\r\n"))
+	if err := IgnoreServerResponse(reader); err != nil {
+		test.Errorf("IgnoreServerResponse errored on a verbatim string: %s", err)
+	} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, PONG_RESPONSE) {
+		test.Errorf("Stream was not aligned after ignoring a verbatim string. Read %q", line)
+	}
+}
+
+func TestCopyServerResponsesScalars(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// ZSCORE, SISMEMBER and the like, under RESP3
+	for _, reply := range []string{",3.14\r\n", ",-1e10\r\n", ",inf\r\n", ",-inf\r\n", ",nan\r\n", "#t\r\n", "#f\r\n",
+		"(3492890328409238509324850943850943825024385\r\n", "(-1\r\n", "_\r\n"} {
+		tester.verifyGoodCopyServerResponse(reply, "+OK\r\n")
+		tester.verifyGoodCopyServerResponse("*2\r\n"+reply+reply, "+OK\r\n")
+
+		reader := bufio.NewReader(bytes.NewBufferString(reply + "+PONG\r\n"))
+		if err := IgnoreServerResponse(reader); err != nil {
+			test.Errorf("IgnoreServerResponse errored on %q: %s", reply, err)
+		} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, PONG_RESPONSE) {
+			test.Errorf("Stream was not aligned after ignoring %q. Read %q", reply, line)
+		}
+	}
+
+	for _, reply := range []string{",\r\n", ",abc\r\n", "#x\r\n", "#true\r\n", "(\r\n", "(-\r\n", "(12a\r\n", "_x\r\n"} {
+		tester.verifyCopiedServerResponse(reply, ERROR_BAD_BULK_FORMAT)
+		if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString(reply))); err != ERROR_BAD_BULK_FORMAT {
+			test.Errorf("IgnoreServerResponse should have refused %q, got %v", reply, err)
+		}
+	}
+}
+
+func TestCopyServerResponsesSetsAttributesAndBlobErrors(test *testing.T) {
+	tester := &ProtocolTester{test}
+	replies := []string{
+		// SMEMBERS, under RESP3
+		"~2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"~0\r\n",
+		"*2\r\n~1\r\n:1\r\n~1\r\n%1\r\n+k\r\n+v\r\n",
+		"!21\r\nSYNTAX invalid syntax\r\n",
+		// The payload may hold newlines, which mustn't be taken for the end of the reply
+		"!8\r\nERR a\r\nb\r\n",
+		// An attribute, followed by the reply it annotates
+		"|1\r\n+key-popularity\r\n%2\r\n$1\r\na\r\n,0.1923\r\n$1\r\nb\r\n,0.0012\r\n*2\r\n:2039123\r\n:9543892\r\n",
+		"|0\r\n+OK\r\n",
+		"*2\r\n|1\r\n+ttl\r\n:3600\r\n$1\r\na\r\n:1\r\n",
+	}
+
+	for _, reply := range replies {
+		tester.verifyGoodCopyServerResponse(reply, "+NEXT\r\n")
+
+		reader := bufio.NewReader(bytes.NewBufferString(reply + "+PONG\r\n"))
+		if err := IgnoreServerResponse(reader); err != nil {
+			test.Errorf("IgnoreServerResponse errored on %q: %s", reply, err)
+		} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, PONG_RESPONSE) {
+			test.Errorf("Stream was not aligned after ignoring %q. Read %q", reply, line)
+		}
+	}
+
+	for _, reply := range []string{"~2\r\n$1\r\na\r\n", "!5\r\nERR\r\n", "|1\r\n+k\r\n+v\r\n"} {
+		tester.verifyCopiedServerResponse(reply, io.ErrUnexpectedEOF)
+		if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString(reply))); err != io.ErrUnexpectedEOF && err != io.EOF {
+			test.Errorf("IgnoreServerResponse should have failed on the truncated %q, got %v", reply, err)
+		}
+	}
+
+	for _, reply := range []string{"|-1\r\n+OK\r\n", "~x\r\n", "~-2\r\n"} {
+		tester.verifyCopiedServerResponse(reply, ERROR_BAD_BULK_FORMAT)
+		if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString(reply))); err == nil {
+			test.Errorf("IgnoreServerResponse should have refused %q", reply)
+		}
+	}
+}
+
+func TestCopyServerResponsesCommandDocs(test *testing.T) {
+	tester := &ProtocolTester{test}
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+
+	// COMMAND DOCS get, as client libraries read it on connect: a map of commands, each a map of docs, whose
+	// arguments are an array of maps
+	argument := "*8\r\n" + bulk("name") + bulk("key") + bulk("type") + bulk("key") +
+		bulk("display_text") + bulk("key") + bulk("key_spec_index") + ":0\r\n"
+	docs := "*12\r\n" + bulk("summary") + bulk("Returns the string value of a key.") + bulk("since") + bulk("1.0.0") +
+		bulk("group") + bulk("string") + bulk("complexity") + bulk("O(1)") + bulk("history") + "*0\r\n" +
+		bulk("arguments") + "*1\r\n" + argument
+	tester.verifyGoodCopyServerResponse("*2\r\n"+bulk("get")+docs, "+OK\r\n")
+
+	// And under RESP3, where the same docs are maps
+	resp3Docs := strings.Replace(strings.Replace(docs, "*12\r\n", "%6\r\n", 1), "*8\r\n", "%4\r\n", 1)
+	tester.verifyGoodCopyServerResponse("%1\r\n"+bulk("get")+resp3Docs, "+OK\r\n")
+
+	// COMMAND INFO get, whose key specs nest a level deeper still
+	keySpec := "*6\r\n" + bulk("flags") + "*2\r\n+RO\r\n+access\r\n" + bulk("begin_search") + "*4\r\n" + bulk("type") +
+		bulk("index") + bulk("spec") + "*2\r\n" + bulk("index") + ":1\r\n" + bulk("find_keys") + "*4\r\n" +
+		bulk("type") + bulk("range") + bulk("spec") + "*6\r\n" + bulk("lastkey") + ":0\r\n" + bulk("keystep") +
+		":1\r\n" + bulk("limit") + ":0\r\n"
+	info := "*1\r\n*10\r\n" + bulk("get") + ":2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n" +
+		"*3\r\n+@read\r\n+@string\r\n+@fast\r\n*0\r\n*1\r\n" + keySpec + "*0\r\n"
+	tester.verifyGoodCopyServerResponse(info, "+OK\r\n")
+
+	// Cut off anywhere, the reply is refused rather than taken for complete
+	for _, reply := range []string{docs, info} {
+		for _, length := range []int{len(reply) / 3, len(reply) / 2, len(reply) - 1} {
+			if err := CopyServerResponses(bufio.NewReader(bytes.NewBufferString(reply[:length])),
+				writer.NewFlexibleWriter(new(bytes.Buffer)), 1, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+				test.Errorf("Expected io.ErrUnexpectedEOF for %q, got %v", reply[:length], err)
+			}
+		}
+	}
+}
+
+func TestCopyServerResponsesMixedElements(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// An EXEC reply where one of the queued commands failed must reach the client intact
+	tester.verifyCopiedServerResponse("*2\r\n$3\r\nabc\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", nil)
+	tester.verifyCopiedServerResponse("*4\r\n+OK\r\n:1\r\n-ERR failed\r\n$-1\r\n", nil)
+}
+
+func TestCopyServerResponsesLongLine(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// Lines that don't fit in the reader's buffer are copied through as they're read
+	long := strings.Repeat("x", BUFFER_SIZE*2)
+	tester.verifyCopiedServerResponse("+"+long+"\r\n", nil)
+	tester.verifyCopiedServerResponse("*2\r\n-ERR "+long+"\r\n:1\r\n", nil)
+	tester.verifyCopiedServerResponse("+"+long+"\n", ERROR_BAD_BULK_FORMAT)
+	tester.verifyCopiedServerResponse("$"+long+"\r\n", ERROR_BAD_BULK_FORMAT)
+	// An element's header that long is refused, rather than cut short and read as a different length
+	padded := strings.Repeat("0", BUFFER_SIZE*2)
+	tester.verifyCopiedServerResponse("*2\r\n$1\r\na\r\n$"+padded+"1\r\nb\r\n", ERROR_BAD_BULK_FORMAT)
+	tester.verifyCopiedServerResponse("*1\r\n*"+padded+"1\r\n:1\r\n", ERROR_BAD_BULK_FORMAT)
+}
+
+func TestCopyServerResponsesBulkLength(test *testing.T) {
+	tester := &ProtocolTester{test}
+	tester.verifyCopiedServerResponse("$0\r\n\r\n", nil)
+	tester.verifyCopiedServerResponse("$\r\n", ERROR_INVALID_INT)
+}
+
+func TestCopyServerResponsesLenientNewlines(test *testing.T) {
+	tester := &ProtocolTester{test}
+	replies := []string{"$3\r\nabc\n", "*2\r\n$1\r\na\n$0\r\n\n", "=8\r\ntxt:abcd\n"}
+
+	// Strict by default
+	for _, reply := range replies {
+		tester.verifyCopiedServerResponse(reply+"+OK\r\n", ERROR_BAD_BULK_FORMAT)
+	}
+
+	SetLenientNewlines(true)
+	defer SetLenientNewlines(false)
+
+	for _, reply := range replies {
+		// The \r is put back, so that what's copied on is well formed
+		w := new(bytes.Buffer)
+		reader := bufio.NewReader(bytes.NewBufferString(reply + "+OK\r\n"))
+		if err := CopyServerResponses(reader, writer.NewFlexibleWriter(w), 1, nil); err != nil {
+			test.Errorf("CopyServerResponses errored on %q: %s", reply, err)
+		} else if expected := strings.Replace(reply, "\n", "\r\n", -1); w.String() != strings.Replace(expected, "\r\r", "\r", -1) {
+			test.Errorf("Expected %q to be copied as %q, got %q", reply, expected, w.String())
+		} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, OK_RESPONSE) {
+			test.Errorf("Stream was not aligned after copying %q. Read %q", reply, line)
+		}
+
+		reader = bufio.NewReader(bytes.NewBufferString(reply + "+OK\r\n"))
+		if err := IgnoreServerResponse(reader); err != nil {
+			test.Errorf("IgnoreServerResponse errored on %q: %s", reply, err)
+		} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, OK_RESPONSE) {
+			test.Errorf("Stream was not aligned after ignoring %q. Read %q", reply, line)
+		}
+	}
+
+	// Even at the very end of the stream
+	w := new(bytes.Buffer)
+	if err := CopyServerResponses(getReader("$1\r\na\n"), writer.NewFlexibleWriter(w), 1, nil); err != nil || w.String() != "$1\r\na\r\n" {
+		test.Errorf("Expected a trailing bare newline to be copied as \\r\\n, got %q %v", w.String(), err)
+	}
+	if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString("$1\r\na\n"))); err != nil {
+		test.Errorf("IgnoreServerResponse errored on a trailing bare newline: %s", err)
+	}
+
+	// Anything else is still refused
+	tester.verifyCopiedServerResponse("$3\r\nabcx\n", ERROR_BAD_BULK_FORMAT)
+	tester.verifyCopiedServerResponse("$3\r\nabc\r", io.ErrUnexpectedEOF)
+}
+
+func TestCopyServerResponsesShortRead(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// The backend went away part way through the value
+	tester.verifyCopiedServerResponse("$10\r\nabcdef", io.ErrUnexpectedEOF)
+	tester.verifyCopiedServerResponse("*2\r\n$3\r\nabc\r\n$10\r\nabcdef", io.ErrUnexpectedEOF)
+	// The value is followed by something other than the trailing newline
+	tester.verifyCopiedServerResponse("$3\r\nabcdef\r\n", ERROR_BAD_BULK_FORMAT)
+
+	if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString("$10\r\nabcdef"))); err != io.ErrUnexpectedEOF {
+		test.Errorf("IgnoreServerResponse should have returned io.ErrUnexpectedEOF on a short value, got %v", err)
+	}
+}
+
+func TestCopyServerResponsesPush(test *testing.T) {
+	tester := &ProtocolTester{test}
+	tester.verifyCopiedServerResponse(">3\r\n$7\r\nmessage\r\n$7\r\nchannel\r\n$5\r\nhello\r\n+OK\r\n", nil)
+
+	// A push arriving ahead of the reply should be copied, and the reply still read
+	w := new(bytes.Buffer)
+	reader := bufio.NewReader(bytes.NewBufferString(">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n$3\r\nbar\r\n:1\r\n"))
+	if err := CopyServerResponses(reader, writer.NewFlexibleWriter(w), 2, nil); err != nil {
+		test.Fatalf("CopyServerResponses errored on an interleaved push: %s", err)
+	}
+
+	expected := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n$3\r\nbar\r\n:1\r\n"
+	if w.String() != expected {
+		test.Fatalf("Did not copy the push and both replies. Expected %q, got %q", expected, w.String())
+	}
+
+	// Pushes already buffered after the last reply are copied too, rather than left for the next client, but the next
+	// reply isn't
+	w.Reset()
+	reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n>2\r\n$10\r\ninvalidate\r\n*-1\r\n>2\r\n$10\r\ninvalidate\r\n*-1\r\n:2\r\n"))
+	if err := CopyServerResponses(reader, writer.NewFlexibleWriter(w), 1, nil); err != nil {
+		test.Fatalf("CopyServerResponses errored on trailing pushes: %s", err)
+	}
+	expected = "+OK\r\n>2\r\n$10\r\ninvalidate\r\n*-1\r\n>2\r\n$10\r\ninvalidate\r\n*-1\r\n"
+	if w.String() != expected {
+		test.Fatalf("Did not copy the trailing pushes. Expected %q, got %q", expected, w.String())
+	}
+	if rest, _ := reader.Peek(reader.Buffered()); string(rest) != ":2\r\n" {
+		test.Fatalf("Expected the next reply to be left unread, got %q", rest)
+	}
+}
+
+func TestCopyServerResponseKind(test *testing.T) {
+	testData := []struct {
+		reply    string
+		expected ReplyKind
+	}{
+		{"+OK\r\n", REPLY_SIMPLE_STRING},
+		{"-MOVED 3999 127.0.0.1:6381\r\n", REPLY_ERROR},
+		{":1\r\n", REPLY_INTEGER},
+		{"$3\r\nfoo\r\n", REPLY_BULK_STRING},
+		{"$-1\r\n", REPLY_NULL},
+		{"*-1\r\n", REPLY_NULL},
+		{"*2\r\n-ERR nested\r\n:1\r\n", REPLY_ARRAY},
+		{"%0\r\n", REPLY_MAP},
+		{"~1\r\n:1\r\n", REPLY_SET},
+		{"!3\r\nERR\r\n", REPLY_ERROR},
+		{"|1\r\n+ttl\r\n:1\r\n-ERR annotated\r\n", REPLY_ERROR},
+		{">2\r\n$10\r\ninvalidate\r\n*-1\r\n", REPLY_PUSH},
+		{"_\r\n", REPLY_NULL},
+		{"-" + strings.Repeat("x", 5000) + "\r\n", REPLY_ERROR},
+	}
+
+	for _, d := range testData {
+		reader := bufio.NewReader(bytes.NewBufferString(d.reply))
+		kind, err := CopyServerResponse(reader, writer.NewFlexibleWriter(new(bytes.Buffer)))
+		if err != nil || kind != d.expected {
+			test.Errorf("Expected %d for %.20q, got %d, %v", d.expected, d.reply, kind, err)
+		}
+		if kind.IsError() != (d.expected == REPLY_ERROR) || kind.IsPush() != (d.expected == REPLY_PUSH) {
+			test.Errorf("Unexpected IsError or IsPush for %.20q", d.reply)
+		}
+	}
+
+	if kind, err := CopyServerResponse(bufio.NewReader(bytes.NewBufferString("")), writer.NewFlexibleWriter(new(bytes.Buffer))); kind != REPLY_UNKNOWN || !errors.Is(err, io.EOF) {
+		test.Errorf("Expected no kind at the end of the stream, got %d, %v", kind, err)
+	}
+}
+
+func TestDiscardBytes(test *testing.T) {
+	source := bufio.NewReaderSize(bytes.NewBufferString(strings.Repeat("x", 10000)+"+OK\r\n"), 16)
+	if err := DiscardBytes(source, 10000); err != nil {
+		test.Fatalf("Unexpected error: %s", err)
+	}
+	if rest, _ := source.ReadString('\n'); rest != "+OK\r\n" {
+		test.Errorf("Expected exactly the given bytes to be discarded, got %q left", rest)
+	}
+
+	if err := DiscardBytes(bufio.NewReader(bytes.NewBufferString("abc")), 5); err != io.ErrUnexpectedEOF {
+		test.Errorf("Expected io.ErrUnexpectedEOF at the end of the stream, got %v", err)
+	}
+	if err := DiscardBytes(bufio.NewReader(bytes.NewBufferString("")), MaxBulkLength()+1); err != ERROR_BULK_TOO_LONG {
+		test.Errorf("Expected ERROR_BULK_TOO_LONG, got %v", err)
+	}
+}
+
+func TestCopyObservedServerResponses(test *testing.T) {
+	replies := "+OK\r\n>2\r\n$10\r\ninvalidate\r\n*-1\r\n-ERR wrong\r\n:1\r\n$1\r\na\r\n"
+	reader := bufio.NewReader(bytes.NewBufferString(replies))
+	w := new(bytes.Buffer)
+
+	var observed []ReplyKind
+	var lines []string
+	err := CopyObservedServerResponses(reader, writer.NewFlexibleWriter(w), 4, nil, func(kind ReplyKind, line []byte) {
+		observed = append(observed, kind)
+		lines = append(lines, string(line))
+	})
+	if err != nil {
+		test.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Push frames are copied, but aren't replies
+	expected := []ReplyKind{REPLY_SIMPLE_STRING, REPLY_ERROR, REPLY_INTEGER, REPLY_BULK_STRING}
+	if len(observed) != len(expected) {
+		test.Fatalf("Expected %v to be observed, got %v", expected, observed)
+	}
+	for i := range expected {
+		if observed[i] != expected[i] {
+			test.Errorf("Expected %v to be observed, got %v", expected, observed)
+		}
+	}
+	if w.String() != replies {
+		test.Errorf("Expected %q to be copied, got %q", replies, w.String())
+	}
+
+	// Only single line replies are passed with their line
+	if expectedLines := []string{"+OK", "-ERR wrong", ":1", ""}; strings.Join(lines, ",") != strings.Join(expectedLines, ",") {
+		test.Errorf("Expected the lines %q to be observed, got %q", expectedLines, lines)
+	}
+}
+
+//Produces an endless stream of the same byte
+type repeatingReader byte
+
+func (r repeatingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+//Counts what is written to it, and remembers the largest single write
+type countingWriter struct {
+	written  int64
+	maxWrite int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return len(p), nil
+}
+
+//Fails every write, like a client that stopped reading until its write deadline passed
+type timedOutWriter struct{}
+
+func (w timedOutWriter) Write(p []byte) (int, error) {
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestCopyServerResponsesFailingSide(test *testing.T) {
+	// A slow client is told apart from a slow server
+	reader := bufio.NewReader(bytes.NewBufferString("$3\r\nabc\r\n"))
+	err := CopyServerResponses(reader, writer.NewFlexibleWriter(timedOutWriter{}), 1, nil)
+	if writeErr, ok := err.(*ClientWriteError); !ok || writeErr.Err != os.ErrDeadlineExceeded {
+		test.Errorf("Expected a ClientWriteError when the client can't be written to, got %v", err)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	err = CopyServerResponses(bufio.NewReader(client), writer.NewFlexibleWriter(new(bytes.Buffer)), 1, nil)
+	if readErr, ok := err.(*BackendReadError); !ok || !errors.Is(readErr, os.ErrDeadlineExceeded) {
+		test.Errorf("Expected a BackendReadError when the server doesn't reply in time, got %v", err)
+	}
+}
+
+func TestCopyServerResponsesLargeValue(test *testing.T) {
+	const size = 50 << 20
+	header := fmt.Sprintf("$%d\r\n", size)
+	reader := bufio.NewReader(io.MultiReader(
+		strings.NewReader(header),
+		io.LimitReader(repeatingReader('x'), size),
+		strings.NewReader("\r\n:1\r\n"),
+	))
+	destination := &countingWriter{}
+	w := writer.NewFlexibleWriter(destination)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := CopyServerResponses(reader, w, 1, nil); err != nil {
+		test.Fatalf("CopyServerResponses errored on a large value: %s", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if expected := int64(len(header) + size + 2); destination.written != expected {
+		test.Fatalf("Expected %d bytes to be copied, got %d", expected, destination.written)
+	}
+	if destination.maxWrite > 2*BUFFER_SIZE || w.Cap() > 4*BUFFER_SIZE {
+		test.Errorf("Expected the value to be streamed through a bounded buffer, wrote up to %d bytes at once through a %d byte buffer",
+			destination.maxWrite, w.Cap())
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		test.Errorf("Expected copying a %d byte value not to allocate in proportion to it, allocated %d bytes", size, allocated)
+	}
+
+	if line, _, err := reader.ReadLine(); err != nil || string(line) != ":1" {
+		test.Errorf("Stream was not aligned after copying a large value. Read %q, %v", line, err)
+	}
+}
+
+func TestIgnoreServerResponse(test *testing.T) {
+	replies := []string{
+		// CLUSTER SLOTS style, with two levels of nesting
+		"*1\r\n*3\r\n:0\r\n:5460\r\n*3\r\n$9\r\n127.0.0.1\r\n:30001\r\n$-1\r\n",
+		// Simple strings and errors as elements, as in EXEC replies
+		"*3\r\n+OK\r\n-WRONGTYPE Operation against a key\r\n$3\r\nabc\r\n",
+		"%1\r\n+key\r\n*1\r\n:1\r\n",
+		"*-1\r\n",
+		"$0\r\n\r\n",
+	}
+
+	for _, reply := range replies {
+		reader := bufio.NewReader(bytes.NewBufferString(reply + "+PONG\r\n"))
+		if err := IgnoreServerResponse(reader); err != nil {
+			test.Errorf("IgnoreServerResponse errored on %q: %s", reply, err)
+			continue
+		}
+
+		line, _, err := reader.ReadLine()
+		if err != nil || !bytes.Equal(line, PONG_RESPONSE) {
+			test.Errorf("Stream was not aligned after ignoring %q. Read %q, %v", reply, line, err)
+		}
+	}
+
+	for _, reply := range []string{"?\r\n", "$3\r\nabcd\r\n", "*x\r\n"} {
+		if err := IgnoreServerResponse(bufio.NewReader(bytes.NewBufferString(reply))); err == nil {
+			test.Errorf("IgnoreServerResponse should have errored on %q", reply)
+		}
+	}
+
+	// Headers longer than the reader's buffer aren't lengths or counts that can be trusted, though simple strings and
+	// errors may be that long
+	long := strings.Repeat("0", BUFFER_SIZE*2)
+	reader := bufio.NewReader(bytes.NewBufferString("*1\r\n$" + long + "1\r\na\r\n"))
+	if err := IgnoreServerResponse(reader); err != ERROR_BAD_BULK_FORMAT {
+		test.Errorf("Expected a long element header to be refused, got %v", err)
+	}
+	reader = bufio.NewReader(bytes.NewBufferString("*1\r\n-ERR " + long + "\r\n+PONG\r\n"))
+	if err := IgnoreServerResponse(reader); err != nil {
+		test.Errorf("IgnoreServerResponse errored on a long error element: %s", err)
+	} else if line, _, _ := reader.ReadLine(); !bytes.Equal(line, PONG_RESPONSE) {
+		test.Errorf("Stream was not aligned after ignoring a long error element. Read %q", line)
+	}
+}
+
+//Bulk payloads larger than BUFFER_SIZE are ignored in chunks.  Each connection has to do so without sharing any
+//scratch space, so run this under -race
+func TestIgnoreServerResponseConcurrently(test *testing.T) {
+	payload := strings.Repeat("x", BUFFER_SIZE*3+1)
+	reply := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n+PONG\r\n", len(payload), payload, len(payload), payload)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				reader := bufio.NewReader(strings.NewReader(reply))
+				if err := IgnoreServerResponse(reader); err != nil {
+					errs <- err
+					return
+				}
+				if line, _, err := reader.ReadLine(); err != nil || !bytes.Equal(line, PONG_RESPONSE) {
+					errs <- fmt.Errorf("stream was not aligned, read %q, %v", line, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		test.Error(err)
+	}
+}
+
 func BenchmarkGoodParseInt(bench *testing.B) {
 	for i := 0; i < bench.N; i++ {
 		ParseInt([]byte("12345"))
@@ -177,23 +829,26 @@ var testDataAllRedisCommands = []struct {
 	{"brpoplpush", false, true}, // source destination timeout - source and destination are keys
 	{"client", false, false},    // dangerous
 	{"cluster", false, false},   // dangerous
-	{"command", false, false},   // shouldn't need it
+	{"command", true, true},     // client libraries read the command table on connect
 	{"config", false, false},    // dangerous
 	{"dbsize", false, false},    // considered dangerous
 	{"debug", false, false},     // dangerous
 	{"decr", true, true},
 	{"decrby", true, true},
 	{"del", true, true},
-	{"discard", false, false}, // dont support transactions
+	{"discard", true, true}, // transaction related
 	{"dump", true, true},
 	{"echo", true, true},
-	{"eval", false, true}, // can operate on several keys
-	{"evalsha", false, true},
-	{"exec", false, false},
+	{"eval", true, true}, // routed by its declared keys
+	{"evalsha", true, true},
+	{"exec", true, true},
 	{"exists", true, true},
 	{"expireat", true, true},
+	{"fcall", true, true}, // routed by its declared keys, like eval
+	{"fcall_ro", true, true},
 	{"flushall", false, true},
 	{"flushdb", false, true},
+	{"function", false, true},
 	{"get", true, true},
 	{"getbit", true, true},
 	{"getrange", true, true},
@@ -232,7 +887,7 @@ var testDataAllRedisCommands = []struct {
 	{"monitor", false, false}, // system related operation - dangerous
 	{"move", false, false},    // moves between dbs, let's not support
 	{"mset", false, true},     // should operate on multiple keys
-	{"multi", false, false},   // transaction related
+	{"multi", true, true},    // transaction related
 	{"object", false, false},  // to inspect internals
 	{"persist", true, true},
 	{"pexpire", true, true},
@@ -280,18 +935,22 @@ var testDataAllRedisCommands = []struct {
 	{"sort", true, true},
 	{"spop", true, true},
 	{"srandmember", true, true},
+	{"spublish", true, true},
 	{"srem", true, true},
+	{"ssubscribe", false, false},
 	{"strlen", true, true},
 	{"subscribe", false, false},
 	{"sunion", false, true},
 	{"sunionstore", false, true},
+	{"sunsubscribe", false, false},
 	{"sync", false, false}, // used for replication
 	{"time", true, true},
 	{"ttl", true, true},
 	{"type", true, true},
 	{"unsubscribe", false, false},
-	{"unwatch", false, false}, // transaction related
-	{"watch", false, false},   // transaction related
+	{"unwatch", true, true},  // transaction related
+	{"wait", false, true},
+	{"watch", true, true},    // transaction related
 	{"zadd", true, true},
 	{"zcard", true, true},
 	{"zcount", true, true},
@@ -318,6 +977,34 @@ var testDataAllRedisCommands = []struct {
 	{"zscan", true, true},
 }
 
+func TestCommandMetricName(test *testing.T) {
+	for _, command := range []string{"get", "hgetall", "zrangebyscore"} {
+		if name := CommandMetricName([]byte(command)); name != command {
+			test.Errorf("Expected %q to be recorded under its own name, got %q", command, name)
+		}
+	}
+
+	for _, command := range []string{"flushall", "notacommand", ""} {
+		if name := CommandMetricName([]byte(command)); name != OTHER_METRIC_COMMAND {
+			test.Errorf("Expected %q to be recorded under %q, got %q", command, OTHER_METRIC_COMMAND, name)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { CommandMetricName([]byte("get")) }); allocs != 0 {
+		test.Errorf("Looking up a command's metric name should not allocate, got %v allocations", allocs)
+	}
+
+	if metric := CommandTimingMetric([]byte("hgetall")); metric != "command.hgetall" {
+		test.Errorf("Expected hgetall to be timed as command.hgetall, got %q", metric)
+	}
+	if metric := CommandTimingMetric([]byte("notacommand")); metric != "command.other" {
+		test.Errorf("Expected notacommand to be timed as command.other, got %q", metric)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { CommandTimingMetric([]byte("get")) }); allocs != 0 {
+		test.Errorf("Looking up a command's timing metric should not allocate, got %v allocations", allocs)
+	}
+}
+
 func TestIsSupportedFunction_NotMultipleKeys(test *testing.T) {
 	for _, command := range testDataAllRedisCommands {
 		bcommand := []byte(command.Command)
@@ -356,7 +1043,6 @@ func TestIsSupportedFunction_MultipleKeys(test *testing.T) {
 		"sinterstore": true,
 		"sunion":      true,
 		"sunionstore": true,
-		"watch":       true,
 		"zinterstore": true,
 		"zunionstore": true,
 	}
@@ -378,10 +1064,241 @@ func TestIsSupportedFunction_MultipleKeys(test *testing.T) {
 	}
 }
 
+func TestIsSupportedFunction_ShortCommands(test *testing.T) {
+	// Prefixes of real commands, that a client could send as commands of their own
+	for _, command := range []string{"", "d", "de", "s", "su", "sc", "scx", "zit", "pub", "b", "w"} {
+		for _, isMultiplexing := range []bool{true, false} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						test.Errorf("IsSupportedFunction(%q) panicked: %v", command, r)
+					}
+				}()
+				IsSupportedFunction([]byte(command), isMultiplexing, true)
+			}()
+		}
+	}
+}
+
+func TestIsSupportedFunction_Transactions(test *testing.T) {
+	// Keys that WATCH can't watch together are refused when it's routed, not by how many there are
+	for _, args := range []string{"*2\r\n$5\r\nwatch\r\n$1\r\na\r\n", "*3\r\n$5\r\nwatch\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"*4\r\n$5\r\nwatch\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"} {
+		command, err := ParseMultibulkCommand([]byte(args))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", args, err)
+		}
+		if err := NewCommandPolicy().CheckCommand(command, true); err != nil {
+			test.Errorf("Expected %q to be supported when multiplexing, got %s", args, err)
+		}
+	}
+
+	// Only the whole name is a transaction command
+	for _, command := range []string{"mu", "mul", "multix", "mux", "wat", "watchx"} {
+		for _, isMultiplexing := range []bool{true, false} {
+			if IsSupportedFunction([]byte(command), isMultiplexing, false) {
+				test.Errorf("Expected %q not to be supported, when multiplexing is %t", command, isMultiplexing)
+			}
+		}
+	}
+}
+
 func BenchmarkIsSupportedFunction(b *testing.B) {
 	slice := []byte("sismember")
+	b.ReportAllocs()
 
 	for i := 0; i < b.N; i++ {
 		IsSupportedFunction(slice, true, true)
 	}
 }
+
+type capturingLogger struct {
+	lines []string
+	infos []string
+}
+
+func (l *capturingLogger) Debugf(format string, a ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+}
+func (l *capturingLogger) Infof(format string, a ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, a...))
+}
+func (l *capturingLogger) Warnf(format string, a ...interface{})  {}
+func (l *capturingLogger) Errorf(format string, a ...interface{}) {}
+
+func TestLogContextFields(test *testing.T) {
+	capture := &capturingLogger{}
+	SetLogger(capture)
+	defer SetLogger(nil)
+
+	logCtx := &LogContext{ConnectionId: 7, RemoteAddr: "10.0.0.1:5555"}
+	reader := bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	if err := CopyServerResponses(reader, writer.NewFlexibleWriter(new(bytes.Buffer)), 2, logCtx); !errors.Is(err, io.EOF) {
+		test.Fatalf("Expected io.EOF from a short read, got %v", err)
+	}
+
+	expected := `msg="readServerResponses: Server closed before responding" conn_id=7 remote=10.0.0.1:5555 read=1 expected=2`
+	if len(capture.lines) != 1 || capture.lines[0] != expected {
+		test.Fatalf("Expected debug line %q, got %q", expected, capture.lines)
+	}
+
+	capture.lines = nil
+	if _, _, err := GetCommand(getReader("*1\r\n$x\r\n"), false, logCtx); err == nil {
+		test.Fatal("Expected a parse error")
+	}
+
+	// ParseInt logs the bad character first, without a connection to tie it to
+	expected = `msg="GetCommand: Could not parse command" conn_id=7 remote=10.0.0.1:5555 err="Did not receive valid int value" buffered=8 prefix=*1`
+	if len(capture.lines) == 0 || capture.lines[len(capture.lines)-1] != expected {
+		test.Fatalf("Expected debug line %q, got %q", expected, capture.lines)
+	}
+
+	// Only the start of the input is logged, so passwords aren't
+	capture.lines = nil
+	for _, input := range []string{"*3\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n$x\r\n", "*5\r\n$5\r\nHELLO\r\n$1\r\n3\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n$x\r\n"} {
+		GetCommand(getReader(input), false, logCtx)
+		GetCommandAndArgs(getReader(input), logCtx)
+	}
+	for _, line := range capture.lines {
+		if strings.Contains(line, "hunter2") {
+			test.Errorf("Expected the password not to be logged, got %q", line)
+		}
+	}
+	if len(capture.lines) < 2 {
+		test.Errorf("Expected the bad commands to be logged, got %q", capture.lines)
+	}
+}
+
+func TestLogContextTracing(test *testing.T) {
+	capture := &capturingLogger{}
+	SetLogger(capture)
+	defer SetLogger(nil)
+
+	var nilCtx *LogContext
+	if nilCtx.Tracing() {
+		test.Fatal("Expected a nil LogContext not to be traced")
+	}
+
+	logCtx := &LogContext{ConnectionId: 7, RemoteAddr: "10.0.0.1:5555"}
+	logCtx.SetTracing(true)
+	reader := bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	if err := CopyServerResponses(reader, writer.NewFlexibleWriter(new(bytes.Buffer)), 2, logCtx); !errors.Is(err, io.EOF) {
+		test.Fatalf("Expected io.EOF from a short read, got %v", err)
+	}
+
+	// A traced connection logs each reply, and its debug logs are written at info level
+	expected := []string{
+		`msg="readServerResponses: Read response" conn_id=7 remote=10.0.0.1:5555 push=false read=1 expected=2`,
+		`msg="readServerResponses: Server closed before responding" conn_id=7 remote=10.0.0.1:5555 read=1 expected=2`,
+	}
+	if len(capture.lines) != 0 || strings.Join(capture.infos, "\n") != strings.Join(expected, "\n") {
+		test.Fatalf("Expected info lines %q, got %q and debug lines %q", expected, capture.infos, capture.lines)
+	}
+
+	capture.infos = nil
+	logCtx.SetTracing(false)
+	reader = bufio.NewReader(bytes.NewBufferString("+OK\r\n"))
+	CopyServerResponses(reader, writer.NewFlexibleWriter(new(bytes.Buffer)), 2, logCtx)
+	if len(capture.infos) != 0 || len(capture.lines) != 1 {
+		test.Fatalf("Expected only the failure at debug level once tracing is off, got %q and %q", capture.infos, capture.lines)
+	}
+}
+
+func TestIsFailoverError(test *testing.T) {
+	for response, expected := range map[string]bool{
+		"-READONLY You can't write against a read only replica.\r\n":  true,
+		"-MASTERDOWN Link with MASTER is down\r\n":                     true,
+		"-ERR unknown command\r\n":                                     false,
+		"+READONLY\r\n":                                                false,
+	} {
+		if IsFailoverError([]byte(response)) != expected {
+			test.Errorf("IsFailoverError(%q) should be %t", response, expected)
+		}
+	}
+}
+
+func TestReadStatusLine(test *testing.T) {
+	long := "+" + strings.Repeat("x", 40)
+
+	testData := []struct {
+		input    string
+		expected string
+		err      error
+	}{
+		{"+OK\r\n", "+OK", nil},
+		{long + "\r\n+OK\r\n", long, nil},
+		// The \r\n straddles the end of the buffer
+		{"+" + strings.Repeat("y", 14) + "\r\n", "+" + strings.Repeat("y", 14), nil},
+		{"", "", io.EOF},
+		// As with ReadLine, the end of the stream ends the line
+		{long, long, nil},
+		{long[:32], long[:32], nil},
+	}
+
+	for _, d := range testData {
+		// Smaller than the long lines, so that they take several reads
+		source := bufio.NewReaderSize(bytes.NewBufferString(d.input), 16)
+		line, err := ReadStatusLine(source)
+		if err != d.err || (err == nil && string(line) != d.expected) {
+			test.Errorf("Expected %q, %v for %q, got %q, %v", d.expected, d.err, d.input, line, err)
+		}
+	}
+
+	// The rest of the stream is left where it was
+	source := bufio.NewReaderSize(bytes.NewBufferString(long+"\r\n+OK\r\n"), 16)
+	ReadStatusLine(source)
+	if line, err := ReadStatusLine(source); err != nil || string(line) != "+OK" {
+		test.Errorf("Expected the next line to be read whole, got %q, %v", line, err)
+	}
+
+	SetMaxBulkLength(16)
+	defer SetMaxBulkLength(DEFAULT_MAX_BULK_LENGTH)
+	if _, err := ReadStatusLine(bufio.NewReaderSize(bytes.NewBufferString(long+"\r\n"), 16)); err != ERROR_BULK_TOO_LONG {
+		test.Errorf("Expected a line over the bulk limit to fail with ERROR_BULK_TOO_LONG, got %v", err)
+	}
+}
+
+func TestIsStatusLine(test *testing.T) {
+	testData := []struct {
+		line     string
+		status   []byte
+		expected bool
+	}{
+		{"+OK", OK_RESPONSE, true},
+		{"+OK ", OK_RESPONSE, true},
+		{"+PONG \t\r", PONG_RESPONSE, true},
+		{"+PONG\r\n", PONG_RESPONSE, true},
+		{"+PONGS", PONG_RESPONSE, false},
+		{"+PONG x", PONG_RESPONSE, false},
+		{" +OK", OK_RESPONSE, false},
+		{"+ok", OK_RESPONSE, false},
+		{"", OK_RESPONSE, false},
+	}
+
+	for _, d := range testData {
+		if IsStatusLine([]byte(d.line), d.status) != d.expected {
+			test.Errorf("IsStatusLine(%q, %q) should be %t", d.line, d.status, d.expected)
+		}
+	}
+}
+
+func TestIsStatusResponse(test *testing.T) {
+	testData := []struct {
+		response string
+		status   []byte
+		expected bool
+	}{
+		{"+OK\r\n", OK_RESPONSE, true},
+		{"+OK", OK_RESPONSE, true},
+		{"+PONG\r\n", PONG_RESPONSE, true},
+		{"+QUEUED\r\n", OK_RESPONSE, false},
+		{"-ERR unknown command\r\n", PONG_RESPONSE, false},
+		{"$4\r\nPONG\r\n", PONG_RESPONSE, false},
+	}
+
+	for _, d := range testData {
+		if IsStatusResponse([]byte(d.response), d.status) != d.expected {
+			test.Errorf("IsStatusResponse(%q, %q) should be %t", d.response, d.status, d.expected)
+		}
+	}
+}
@@ -26,6 +26,7 @@
 package protocol
 
 import (
+	. "github.com/salesforce/rmux/writer"
 	"net"
 	"time"
 )
@@ -38,6 +39,8 @@ type TimedNetReadWriter struct {
 	ReadTimeout time.Duration
 	//Timeout to use for write operations
 	WriteTimeout time.Duration
+	//If set, the timeout to use for the next read only, in place of ReadTimeout
+	nextReadTimeout time.Duration
 }
 
 //Wraps the net.connection's write function with a WriteDeadline
@@ -50,18 +53,47 @@ func (myReadWriter *TimedNetReadWriter) Write(line []byte) (n int, err error) {
 	return
 }
 
+//Whether writes to the net.connection can be gathered into a single writev
+func (myReadWriter *TimedNetReadWriter) CanWriteVectored() bool {
+	return CanWriteVectored(myReadWriter.NetConnection)
+}
+
+//Wraps a vectored write to the net.connection with a WriteDeadline
+func (myReadWriter *TimedNetReadWriter) WriteVectored(buffers *net.Buffers) (n int64, err error) {
+	if myReadWriter.WriteTimeout > 0 {
+		myReadWriter.NetConnection.SetWriteDeadline(time.Now().Add(myReadWriter.WriteTimeout))
+		defer myReadWriter.NetConnection.SetWriteDeadline(time.Time{})
+	}
+	n, err = WriteVectored(myReadWriter.NetConnection, buffers)
+	return
+}
+
 //Wraps the net.connection's read function with a ReadDeadline
+//The deadline comes from the timeout set by SetNextReadDeadline, if any, which is cleared before reading, so that
+//following reads revert to ReadTimeout whether this one succeeds or not
 func (myReadWriter *TimedNetReadWriter) Read(line []byte) (n int, err error) {
-	if myReadWriter.ReadTimeout > 0 {
-		myReadWriter.NetConnection.SetReadDeadline(time.Now().Add(myReadWriter.ReadTimeout))
+	readTimeout := myReadWriter.ReadTimeout
+	if myReadWriter.nextReadTimeout > 0 {
+		readTimeout = myReadWriter.nextReadTimeout
+		myReadWriter.nextReadTimeout = 0
+	}
+
+	if readTimeout > 0 {
+		myReadWriter.NetConnection.SetReadDeadline(time.Now().Add(readTimeout))
 		defer myReadWriter.NetConnection.SetReadDeadline(time.Time{})
 	}
 	n, err = myReadWriter.NetConnection.Read(line)
 	return
 }
 
+//Uses the given timeout for the next read only, in place of ReadTimeout, ex: for the reply to a command that blocks
+//on the server.  A timeout of 0 reverts to ReadTimeout, for when the next read turns out not to be needed
+func (myReadWriter *TimedNetReadWriter) SetNextReadDeadline(timeout time.Duration) {
+	myReadWriter.nextReadTimeout = timeout
+}
+
 //Initializes a TimedNetReadWriter, with the given timeouts
 func NewTimedNetReadWriter(connection net.Conn, readTimeout, writeTimeout time.Duration) (newReadWriter *TimedNetReadWriter) {
-	newReadWriter = &TimedNetReadWriter{connection, readTimeout, writeTimeout}
+	newReadWriter = &TimedNetReadWriter{NetConnection: connection, ReadTimeout: readTimeout, WriteTimeout: writeTimeout}
 	return
 }
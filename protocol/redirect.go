@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+)
+
+var (
+	MOVED_PREFIX = []byte("-MOVED ")
+	ASK_PREFIX   = []byte("-ASK ")
+
+	//Sent before a command that follows an ASK redirect, so that the target node accepts it
+	ASKING_COMMAND = []byte("asking")
+)
+
+//A redis cluster redirect, parsed from a -MOVED or -ASK error reply
+type Redirect struct {
+	//Whether this is a one-off ASK redirect, rather than a MOVED
+	Ask bool
+	//The hash slot of the command's key
+	Slot int
+	//The node to resend the command to, ex: "127.0.0.1:6381"
+	Endpoint string
+}
+
+//Parses a -MOVED or -ASK reply, ex: "-MOVED 3999 127.0.0.1:6381\r\n"
+//Returns false for any other reply
+func ParseRedirect(response []byte) (redirect Redirect, ok bool) {
+	var rest []byte
+	if bytes.HasPrefix(response, MOVED_PREFIX) {
+		rest = response[len(MOVED_PREFIX):]
+	} else if bytes.HasPrefix(response, ASK_PREFIX) {
+		redirect.Ask = true
+		rest = response[len(ASK_PREFIX):]
+	} else {
+		return redirect, false
+	}
+
+	rest = bytes.TrimSuffix(rest, REDIS_NEWLINE)
+	space := bytes.IndexByte(rest, ' ')
+	if space <= 0 || space == len(rest)-1 {
+		return redirect, false
+	}
+
+	slot, err := ParseInt(rest[:space])
+	if err != nil || slot < 0 {
+		return redirect, false
+	}
+
+	redirect.Slot = slot
+	redirect.Endpoint = string(rest[space+1:])
+	return redirect, true
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestParseRedirect(test *testing.T) {
+	testData := []struct {
+		response string
+		ok       bool
+		expected Redirect
+	}{
+		{"-MOVED 3999 127.0.0.1:6381\r\n", true, Redirect{false, 3999, "127.0.0.1:6381"}},
+		{"-ASK 0 redis-2:7000\r\n", true, Redirect{true, 0, "redis-2:7000"}},
+		{"-ERR unknown command\r\n", false, Redirect{}},
+		{"+MOVED 3999 127.0.0.1:6381\r\n", false, Redirect{}},
+		{"-MOVED 3999\r\n", false, Redirect{}},
+		{"-MOVED abc 127.0.0.1:6381\r\n", false, Redirect{}},
+		{"-MOVED 3999 \r\n", false, Redirect{}},
+	}
+
+	for _, d := range testData {
+		redirect, ok := ParseRedirect([]byte(d.response))
+		if ok != d.ok || (ok && redirect != d.expected) {
+			test.Errorf("ParseRedirect(%q) returned %+v, %t. Expected %+v, %t", d.response, redirect, ok, d.expected, d.ok)
+		}
+	}
+}
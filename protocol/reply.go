@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+//The RESP type of a reply, as parsed by ParseReply or copied by CopyServerResponse
+type ReplyKind int
+
+const (
+	REPLY_SIMPLE_STRING ReplyKind = iota
+	REPLY_ERROR
+	REPLY_INTEGER
+	REPLY_BULK_STRING
+	REPLY_ARRAY
+	//A null bulk string ($-1) or null array (*-1), or a RESP3 null (_)
+	REPLY_NULL
+	//RESP3 kinds, which CopyServerResponse returns but ParseReply doesn't parse, other than sets
+	REPLY_MAP
+	REPLY_PUSH
+	REPLY_DOUBLE
+	REPLY_BOOLEAN
+	REPLY_BIG_NUMBER
+	REPLY_SET
+	//An attribute (|), which annotates the reply after it.  Neither CopyServerResponse nor ParseReply return it, since
+	//they return the annotated reply's kind instead
+	REPLY_ATTRIBUTE
+	//A reply that couldn't be read, or whose leading byte isn't a RESP type
+	REPLY_UNKNOWN
+)
+
+//Returns the kind of a reply from its leading byte.  Nulls can't be told apart from their prefix alone, so "$-1" and
+//"*-1" are a REPLY_BULK_STRING and a REPLY_ARRAY here.  Verbatim strings are bulk strings, as ParseReply has them,
+//and blob errors (!) are errors
+func ReplyKindOf(prefix byte) ReplyKind {
+	switch prefix {
+	case '+':
+		return REPLY_SIMPLE_STRING
+	case '-', '!':
+		return REPLY_ERROR
+	case ':':
+		return REPLY_INTEGER
+	case '$', '=':
+		return REPLY_BULK_STRING
+	case '*':
+		return REPLY_ARRAY
+	case '_':
+		return REPLY_NULL
+	case '%':
+		return REPLY_MAP
+	case '>':
+		return REPLY_PUSH
+	case ',':
+		return REPLY_DOUBLE
+	case '#':
+		return REPLY_BOOLEAN
+	case '(':
+		return REPLY_BIG_NUMBER
+	case '~':
+		return REPLY_SET
+	case '|':
+		return REPLY_ATTRIBUTE
+	}
+	return REPLY_UNKNOWN
+}
+
+//Whether the reply is an error, ex: -ERR, -MOVED or -LOADING
+func (kind ReplyKind) IsError() bool {
+	return kind == REPLY_ERROR
+}
+
+//Whether the reply is a push frame, which isn't a reply to any command
+func (kind ReplyKind) IsPush() bool {
+	return kind == REPLY_PUSH
+}
+
+//A structured redis reply
+//Value holds the payload of strings and errors, Integer the value of integers, and Elements the children of arrays
+//and sets
+type Reply struct {
+	Kind     ReplyKind
+	Value    []byte
+	Integer  int
+	Elements []Reply
+}
+
+//Parses a single reply from the source into a Reply tree
+//Nested arrays are parsed into nested Elements.  Attributes are read and dropped, and the reply they annotate returned
+func ParseReply(source *bufio.Reader) (reply Reply, err error) {
+	line, err := readReplyLine(source)
+	if err != nil {
+		return
+	}
+
+	switch line[0] {
+	case '+':
+		reply.Kind = REPLY_SIMPLE_STRING
+		reply.Value = line[1:]
+	case '-':
+		reply.Kind = REPLY_ERROR
+		reply.Value = line[1:]
+	case ':':
+		reply.Kind = REPLY_INTEGER
+		reply.Integer, err = ParseInt(line[1:])
+	case '$', '=', '!':
+		// Verbatim strings keep their txt:/mkd: marker in Value, and blob errors are errors like any other
+		var length int64
+		if length, err = ParseInt64(line[1:]); err != nil {
+			return
+		} else if length < 0 {
+			reply.Kind = REPLY_NULL
+			return
+		} else if err = checkBulkLength(length); err != nil {
+			return
+		}
+
+		reply.Kind = ReplyKindOf(line[0])
+		reply.Value = make([]byte, length+2)
+		if _, err = io.ReadFull(source, reply.Value); err != nil {
+			return
+		}
+
+		if !bytes.HasSuffix(reply.Value, REDIS_NEWLINE) {
+			err = ERROR_BAD_BULK_FORMAT
+			return
+		}
+		reply.Value = reply.Value[:length]
+	case '|':
+		var count int
+		if count, err = ParseInt(line[1:]); err != nil {
+			return
+		} else if count < 0 {
+			err = ERROR_BAD_BULK_FORMAT
+			return
+		}
+
+		// Each of the attribute's entries is a key and a value
+		for i := 0; i < count; i++ {
+			if err = IgnoreServerResponse(source); err == nil {
+				err = IgnoreServerResponse(source)
+			}
+			if err != nil {
+				return
+			}
+		}
+		return ParseReply(source)
+	case '*', '~':
+		var count int
+		if count, err = ParseInt(line[1:]); err != nil {
+			return
+		} else if count < 0 {
+			reply.Kind = REPLY_NULL
+			return
+		}
+
+		// A server may reply with more elements than clients may send, ex: to KEYS *, but no more than a client's
+		// worth are allocated until they're read
+		capacity := count
+		if max := MaxMultibulkLength(); capacity > max {
+			capacity = max
+		}
+
+		reply.Kind = ReplyKindOf(line[0])
+		reply.Elements = make([]Reply, 0, capacity)
+		for i := 0; i < count; i++ {
+			var element Reply
+			if element, err = ParseReply(source); err != nil {
+				return
+			}
+			reply.Elements = append(reply.Elements, element)
+		}
+	default:
+		err = ERROR_BAD_BULK_FORMAT
+	}
+
+	return
+}
+
+//Reads a single \r\n terminated line, and returns a copy of it without the newline
+//Only simple strings and errors may be longer than the source's buffer, up to the longest bulk string accepted.  A
+//length or count header that long is ERROR_BAD_BULK_FORMAT, rather than being read without a bound
+func readReplyLine(source *bufio.Reader) ([]byte, error) {
+	part, err := source.ReadSlice('\n')
+	if err == bufio.ErrBufferFull && isAggregateOrBulk(part[0]) {
+		return nil, ERROR_BAD_BULK_FORMAT
+	}
+
+	// Each part is only valid until the next read, so they're copied
+	line := append([]byte(nil), part...)
+	for err == bufio.ErrBufferFull {
+		part, err = source.ReadSlice('\n')
+		line = append(line, part...)
+		if lengthErr := checkBulkLength(int64(len(line))); lengthErr != nil {
+			return nil, lengthErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ERROR_BAD_BULK_FORMAT
+	}
+
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReply(t *testing.T) {
+	reply, err := ParseReply(getReader("*3\r\n*3\r\n:0\r\n:5460\r\n*2\r\n$9\r\n127.0.0.1\r\n:6379\r\n$-1\r\n*-1\r\n+PONG\r\n"))
+	if err != nil {
+		t.Fatalf("ParseReply errored on a nested array: %s", err)
+	}
+
+	if reply.Kind != REPLY_ARRAY || len(reply.Elements) != 3 {
+		t.Fatalf("Expected a three element array, got %+v", reply)
+	}
+
+	slot := reply.Elements[0]
+	if slot.Kind != REPLY_ARRAY || len(slot.Elements) != 3 || slot.Elements[1].Integer != 5460 {
+		t.Errorf("Nested array was not parsed correctly: %+v", slot)
+	}
+
+	if node := slot.Elements[2]; node.Kind != REPLY_ARRAY || string(node.Elements[0].Value) != "127.0.0.1" {
+		t.Errorf("Doubly nested array was not parsed correctly: %+v", node)
+	}
+
+	if reply.Elements[1].Kind != REPLY_NULL || reply.Elements[2].Kind != REPLY_NULL {
+		t.Errorf("Null bulk strings and arrays should be parsed as nulls: %+v", reply.Elements[1:])
+	}
+
+	testData := []struct {
+		input string
+		kind  ReplyKind
+		value string
+	}{
+		{"+OK\r\n", REPLY_SIMPLE_STRING, "OK"},
+		{"-ERR unknown\r\n", REPLY_ERROR, "ERR unknown"},
+		{"$0\r\n\r\n", REPLY_BULK_STRING, ""},
+		{"$5\r\nhe\r\no\r\n", REPLY_BULK_STRING, "he\r\no"},
+		{"=15\r\ntxt:Some string\r\n", REPLY_BULK_STRING, "txt:Some string"},
+		{"*0\r\n", REPLY_ARRAY, ""},
+		{":-7\r\n", REPLY_INTEGER, ""},
+		{"!8\r\nERR a\r\nb\r\n", REPLY_ERROR, "ERR a\r\nb"},
+		{"~0\r\n", REPLY_SET, ""},
+		{"|1\r\n+ttl\r\n*1\r\n:3600\r\n+OK\r\n", REPLY_SIMPLE_STRING, "OK"},
+	}
+
+	for _, d := range testData {
+		reply, err := ParseReply(getReader(d.input))
+		if err != nil {
+			t.Errorf("ParseReply errored on %q: %s", d.input, err)
+			continue
+		}
+
+		if reply.Kind != d.kind || string(reply.Value) != d.value {
+			t.Errorf("ParseReply(%q) returned %+v", d.input, reply)
+		}
+	}
+
+	set, err := ParseReply(getReader("~2\r\n$1\r\na\r\n:1\r\n"))
+	if err != nil || set.Kind != REPLY_SET || len(set.Elements) != 2 || string(set.Elements[0].Value) != "a" ||
+		set.Elements[1].Integer != 1 {
+		t.Errorf("Set was not parsed correctly: %+v, %v", set, err)
+	}
+
+	for _, input := range []string{"$3\r\nab\r\n", "?\r\n", ":abc\r\n", "+OK\n", "|-1\r\n+OK\r\n", "|1\r\n+k\r\n"} {
+		if _, err := ParseReply(getReader(input)); err == nil {
+			t.Errorf("ParseReply should have errored on %q", input)
+		}
+	}
+}
+
+func TestParseReplyLongLines(t *testing.T) {
+	long := strings.Repeat("x", BUFFER_SIZE*2)
+	for _, input := range []string{"+" + long, "-ERR " + long} {
+		reply, err := ParseReply(getReader(input + "\r\n"))
+		if err != nil || string(reply.Value) != input[1:] {
+			t.Errorf("Expected a line longer than the buffer to be read in full, got %d bytes, %v", len(reply.Value), err)
+		}
+	}
+
+	// Zero padded, so that a header cut short at the end of the buffer would be read as a length of 0
+	padded := strings.Repeat("0", BUFFER_SIZE*2)
+	for _, input := range []string{"*1\r\n$" + padded + "1\r\na\r\n", "*" + padded + "1\r\n:1\r\n"} {
+		if _, err := ParseReply(getReader(input)); err != ERROR_BAD_BULK_FORMAT {
+			t.Errorf("Expected a header longer than the buffer to be refused, got %v", err)
+		}
+	}
+}
@@ -27,6 +27,7 @@ package protocol
 
 import (
 	"bytes"
+	"io"
 )
 
 func ScanResp(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -53,6 +54,10 @@ func ScanResp(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		advance, token, err = ScanError(data, atEOF)
 	case '*':
 		advance, token, err = ScanArray(data, atEOF)
+	case '%':
+		advance, token, err = ScanMap(data, atEOF)
+	case '>':
+		advance, token, err = ScanPush(data, atEOF)
 	default:
 		advance, token, err = ScanInlineString(data, atEOF)
 	}
@@ -121,20 +126,13 @@ func ScanBulkString(data []byte, atEOF bool) (advance int, token []byte, err err
 	}
 
 	advance, token, err = scanNewline(data, atEOF)
-	if err != nil || advance == 0 {
+	if err != nil || advance == 0 || token == nil {
 		return advance, token, err
 	}
 
-	if len(token) < 4 {
-		return 0, nil, nil
-	}
-
-	strLenBytes := token[1 : len(token)-2]
-	if len(strLenBytes) == 0 {
-		return 0, nil, ERROR_COMMAND_PARSE
-	}
-
-	strLen, err := ParseInt(strLenBytes)
+	// A missing length ($\r\n) is a framing error, while $0 is a legitimately empty string
+	// The length is parsed as an int64, so that lengths over 2GiB don't overflow on 32-bit builds
+	strLen, err := ParseInt64(token[1 : len(token)-2])
 	if err != nil {
 		return 0, nil, err
 	}
@@ -144,12 +142,25 @@ func ScanBulkString(data []byte, atEOF bool) (advance int, token []byte, err err
 		return advance, data[:advance], nil
 	}
 
-	if len(data[advance:]) < 2+strLen {
+	// Refused before waiting for the payload, so that an enormous length can't make us buffer without bound
+	if err = checkBulkLength(strLen); err != nil {
+		return 0, nil, err
+	}
+
+	if int64(len(data[advance:])) < 2+strLen {
+		if atEOF {
+			// The stream ended part way through the value
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+
 		// Ask for more if we can't read what we have
 		return 0, nil, nil
 	}
 
-	advance = advance + strLen + 2
+	advance = advance + int(strLen) + 2
+	if data[advance-2] != '\r' || data[advance-1] != '\n' {
+		return 0, nil, ERROR_BAD_BULK_FORMAT
+	}
 	return advance, data[:advance], nil
 }
 
@@ -186,6 +197,23 @@ func ScanInlineString(data []byte, atEOF bool) (advance int, token []byte, err e
 
 // =============== Array ==============
 func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return scanAggregate(data, atEOF, '*', 1)
+}
+
+// =============== Map (RESP3) ==============
+// Maps are framed like arrays, but their count is the number of key/value pairs that follow
+func ScanMap(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return scanAggregate(data, atEOF, '%', 2)
+}
+
+// =============== Push (RESP3) ==============
+// Pushes are out-of-band messages (pub/sub deliveries, invalidations), framed like arrays
+func ScanPush(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return scanAggregate(data, atEOF, '>', 1)
+}
+
+// Scans an aggregate type with the given prefix, whose header count is multiplied by elementsPerCount
+func scanAggregate(data []byte, atEOF bool, prefix byte, elementsPerCount int) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
@@ -194,7 +222,7 @@ func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		return 0, nil, nil
 	}
 
-	if data[0] != '*' {
+	if data[0] != prefix {
 		return 0, nil, ERROR_COMMAND_PARSE
 	}
 
@@ -209,19 +237,17 @@ func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		return 0, nil, nil
 	}
 
-	arrayCountBytes := token[1 : len(token)-2]
-	if len(arrayCountBytes) == 0 {
-		return 0, nil, ERROR_COMMAND_PARSE
-	}
-
-	arrayCount, err := ParseInt(arrayCountBytes)
+	// A malformed count would leave us unable to find the end of the aggregate, so refuse it outright
+	arrayCount, err := ParseInt(token[1 : len(token)-2])
 	if err != nil {
+		return 0, nil, ERROR_BAD_BULK_FORMAT
+	} else if err = checkMultibulkLength(arrayCount); err != nil {
 		return 0, nil, err
 	}
 
 	s := advance
 	rData := data[s:]
-	for i := 0; i < arrayCount; i++ {
+	for i := 0; i < arrayCount*elementsPerCount; i++ {
 		advance, token, err = ScanResp(rData, atEOF)
 		if token == nil || err != nil {
 			if advance == 0 {
@@ -238,4 +264,3 @@ func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
 
 	return s, data[:s], nil
 }
-
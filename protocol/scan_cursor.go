@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"math/bits"
+	"strconv"
+
+	. "github.com/salesforce/rmux/writer"
+)
+
+var (
+	//Error for a SCAN cursor that wasn't handed out by the proxy, when SCAN is fanned out across backends
+	ERR_INVALID_CURSOR = &RecoverableError{"invalid cursor"}
+	//Error for a backend's SCAN cursor that's too large to combine with the index of the backend
+	ERR_CURSOR_OVERFLOW = &RecoverableError{"SCAN cursor is too large to continue across backends"}
+)
+
+//Combines a backend's SCAN cursor with the backend's index, out of the given number of backends, into the cursor that
+//is handed to clients when SCAN is fanned out across backends.  The index is kept in the remainder, so that 0 still
+//starts an iteration from the first backend
+func EncodeScanCursor(index, backends int, cursor uint64) ([]byte, error) {
+	high, low := bits.Mul64(cursor, uint64(backends))
+	combined, carry := bits.Add64(low, uint64(index), 0)
+	if high != 0 || carry != 0 {
+		return nil, ERR_CURSOR_OVERFLOW
+	}
+	return strconv.AppendUint(nil, combined, 10), nil
+}
+
+//Splits a cursor from EncodeScanCursor back into the backend's index, and the backend's cursor
+func DecodeScanCursor(cursor []byte, backends int) (index int, backendCursor uint64, err error) {
+	combined, err := strconv.ParseUint(string(cursor), 10, 64)
+	if err != nil {
+		return 0, 0, ERR_INVALID_CURSOR
+	}
+	return int(combined % uint64(backends)), combined / uint64(backends), nil
+}
+
+//Returns the given SCAN command's arguments, with its cursor replaced by the given one, ready for WriteMultibulk
+func ScanWithCursor(command Command, cursor uint64) [][]byte {
+	args := commandArgs(command)
+	scan := make([][]byte, 0, len(args)+1)
+	scan = append(scan, SCAN_COMMAND, strconv.AppendUint(nil, cursor, 10))
+	if len(args) > 1 {
+		scan = append(scan, args[1:]...)
+	}
+	return scan
+}
+
+//Reads the start of a SCAN reply, up to and including its cursor, and returns the cursor
+//The array of keys that follows is left on the source, so that it can be copied on with CopyServerResponse
+func ReadScanCursor(source *bufio.Reader) (cursor uint64, err error) {
+	line, err := readReplyLine(source)
+	if err != nil {
+		return 0, err
+	} else if string(line) != "*2" {
+		return 0, ERROR_BAD_BULK_FORMAT
+	}
+
+	if line, err = readReplyLine(source); err != nil {
+		return 0, err
+	} else if len(line) == 0 || line[0] != '$' {
+		return 0, ERROR_BAD_BULK_FORMAT
+	}
+
+	length, err := ParseInt(line[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	// The cursor is a number, so it can't hold a newline
+	if line, err = readReplyLine(source); err != nil {
+		return 0, err
+	} else if len(line) != length {
+		return 0, ERROR_BAD_BULK_FORMAT
+	}
+
+	if cursor, err = strconv.ParseUint(string(line), 10, 64); err != nil {
+		return 0, ERROR_BAD_BULK_FORMAT
+	}
+	return cursor, nil
+}
+
+//Writes the start of a SCAN reply, up to and including its cursor.  The array of keys has to be written after it
+func WriteScanCursor(cursor []byte, destination *FlexibleWriter) (err error) {
+	header := appendMultibulkHeader(nil, '*', 2)
+	header = appendMultibulkHeader(header, '$', len(cursor))
+	header = append(append(header, cursor...), REDIS_NEWLINE...)
+	_, err = destination.Write(header)
+	return
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/salesforce/rmux/writer"
+)
+
+func TestScanCursor(test *testing.T) {
+	// Every backend's cursor survives the round trip, along with the backend
+	for _, backends := range []int{1, 2, 3, 7} {
+		for index := 0; index < backends; index++ {
+			for _, cursor := range []uint64{0, 1, 17, 1 << 40} {
+				combined, err := EncodeScanCursor(index, backends, cursor)
+				if err != nil {
+					test.Fatalf("Failed to encode cursor %d of backend %d/%d: %s", cursor, index, backends, err)
+				}
+
+				decodedIndex, decodedCursor, err := DecodeScanCursor(combined, backends)
+				if err != nil || decodedIndex != index || decodedCursor != cursor {
+					test.Errorf("Expected %q to decode to backend %d cursor %d, got %d %d %v", combined, index, cursor,
+						decodedIndex, decodedCursor, err)
+				}
+			}
+		}
+	}
+
+	// An iteration still starts from 0, on the first backend
+	if combined, _ := EncodeScanCursor(0, 3, 0); string(combined) != "0" {
+		test.Errorf("Expected the first backend's starting cursor to be 0, got %q", combined)
+	}
+
+	if _, err := EncodeScanCursor(1, 2, 1<<63); err != ERR_CURSOR_OVERFLOW {
+		test.Errorf("Expected ERR_CURSOR_OVERFLOW, got %v", err)
+	}
+	for _, cursor := range []string{"", "x", "-1", "18446744073709551616"} {
+		if _, _, err := DecodeScanCursor([]byte(cursor), 2); err != ERR_INVALID_CURSOR {
+			test.Errorf("Expected ERR_INVALID_CURSOR for %q, got %v", cursor, err)
+		}
+	}
+}
+
+func TestScanWithCursor(test *testing.T) {
+	command, err := ParseCommand([]byte("*6\r\n$4\r\nSCAN\r\n$2\r\n10\r\n$5\r\nMATCH\r\n$2\r\nk*\r\n$5\r\nCOUNT\r\n$3\r\n100\r\n"))
+	if err != nil {
+		test.Fatalf("Failed to parse the command: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	WriteMultibulk(ScanWithCursor(command, 5), writer.NewFlexibleWriter(buf), true)
+	if expected := "*6\r\n$4\r\nscan\r\n$1\r\n5\r\n$5\r\nMATCH\r\n$2\r\nk*\r\n$5\r\nCOUNT\r\n$3\r\n100\r\n"; buf.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestScanReply(test *testing.T) {
+	tester := &ProtocolTester{test}
+	// A SCAN reply from a single backend is copied through untouched, cursor and keys alike
+	tester.verifyGoodCopyServerResponse("*2\r\n$2\r\n17\r\n*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n", "+OK\r\n")
+	tester.verifyGoodCopyServerResponse("*2\r\n$1\r\n0\r\n*0\r\n", "+OK\r\n")
+
+	source := bufio.NewReader(strings.NewReader("*2\r\n$2\r\n17\r\n*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n"))
+	cursor, err := ReadScanCursor(source)
+	if err != nil || cursor != 17 {
+		test.Fatalf("Expected cursor 17, got %d %v", cursor, err)
+	}
+
+	// The keys are left to be copied after the new cursor
+	buf := new(bytes.Buffer)
+	destination := writer.NewFlexibleWriter(buf)
+	WriteScanCursor([]byte("34"), destination)
+	if _, err := CopyServerResponse(source, destination); err != nil {
+		test.Fatalf("Failed to copy the keys: %s", err)
+	}
+	if expected := "*2\r\n$2\r\n34\r\n*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n"; buf.String() != expected {
+		test.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+
+	for _, reply := range []string{"*3\r\n", "*2\r\n\r\n", "+OK\r\n", "*2\r\n:1\r\n", "*2\r\n$2\r\n1\r\n", "*2\r\n$1\r\nx\r\n"} {
+		if _, err := ReadScanCursor(bufio.NewReader(strings.NewReader(reply))); err != ERROR_BAD_BULK_FORMAT {
+			test.Errorf("Expected ERROR_BAD_BULK_FORMAT for %q, got %v", reply, err)
+		}
+	}
+}
@@ -28,7 +28,12 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestScanResp(t *testing.T) {
@@ -56,6 +61,7 @@ func TestScanResp(t *testing.T) {
 		},
 		{"$-1\r\n$-1\r\n", []string{"$-1\r\n", "$-1\r\n"}},
 		{"*2\r\n$-1\r\n$-1\r\n", []string{"*2\r\n$-1\r\n$-1\r\n"}},
+		{"%1\r\n$5\r\nproto\r\n:3\r\n+OK\r\n", []string{"%1\r\n$5\r\nproto\r\n:3\r\n", "+OK\r\n"}},
 
 		// Check for panic case in testing
 		{"$", []string{}},
@@ -121,3 +127,167 @@ func TestScanNewline(t *testing.T) {
 		}
 	}
 }
+
+func TestScanBulkStringLargeLength(t *testing.T) {
+	// A length over 2GiB must not overflow into a negative (null) length, but wait for the full value, when the
+	// maximum bulk length allows it
+	SetMaxBulkLength(4 * 1024 * 1024 * 1024)
+	defer SetMaxBulkLength(DEFAULT_MAX_BULK_LENGTH)
+
+	advance, token, err := ScanBulkString([]byte("$3000000000\r\nabc"), false)
+	if advance != 0 || token != nil || err != nil {
+		t.Errorf("Expected a request for more data, got advance:%d token:%q err:%v", advance, token, err)
+	}
+}
+
+func TestCommandScannerSplitReads(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n*1\r\n$4\r\nPING\r\nPING\r\n*2\r\n$3\r\nGET\r\n$-1\r\n"
+	expected := []string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n",
+		"*1\r\n$4\r\nPING\r\n",
+		"PING\r\n",
+		"*2\r\n$3\r\nGET\r\n$-1\r\n",
+	}
+
+	// Every read returns a single byte, so each command is split across as many reads as it has bytes
+	s := NewCommandScanner(iotest.OneByteReader(strings.NewReader(input)))
+	scanned := []string{}
+	for s.Scan() {
+		scanned = append(scanned, string(s.Bytes()))
+	}
+
+	if s.Err() != nil {
+		t.Fatalf("Unexpected error scanning commands split across reads: %s", s.Err())
+	}
+	if !reflect.DeepEqual(scanned, expected) {
+		t.Errorf("Expected to scan %q, got %q", expected, scanned)
+	}
+}
+
+func TestCommandScannerErrors(t *testing.T) {
+	testData := []struct {
+		inBytes string
+		err     error
+	}{
+		// The stream ends part way through the command
+		{"*2\r\n$3\r\nGET\r\n$3\r\nke", io.ErrUnexpectedEOF},
+		{"*2\r\n$3\r\nGET\r\n", io.ErrUnexpectedEOF},
+		// An element that isn't a bulk string
+		{"*2\r\n$3\r\nGET\r\n:5\r\n", ERROR_COMMAND_PARSE},
+		{"*1\r\n$3\r\nGETX\r\n", ERROR_BAD_BULK_FORMAT},
+		// Inline commands are refused if multibulks are required
+		{"PING\r\n", ERROR_MULTIBULK_FORMAT_REQUIRED},
+		{"+PING\r\n", ERROR_MULTIBULK_FORMAT_REQUIRED},
+	}
+
+	for _, d := range testData {
+		s := NewCommandScanner(iotest.OneByteReader(strings.NewReader(d.inBytes)))
+		s.RequireMultibulk = true
+		if s.Scan() {
+			t.Errorf("Expected no command to be scanned from %q, got %q", d.inBytes, s.Bytes())
+		}
+		if s.Err() != d.err {
+			t.Errorf("Expected %q to fail with %v, got %v", d.inBytes, d.err, s.Err())
+		}
+	}
+}
+
+//Checks that scanning clients' commands, and parsing what's scanned, never panics, and that commands are scanned the
+//same way however they arrive.  These are what the proxy reads clients' commands with
+//Run with: go test -fuzz=FuzzCommandScanner ./protocol
+func FuzzCommandScanner(f *testing.F) {
+	seeds := []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n*1\r\n$4\r\nping\r\n",
+		"*3\r\n$3\r\nset\r\n$-1\r\n$0\r\n\r\n",
+		"*1\r\n$4\r\nping",
+		"*2\r\n$3\r\nget\r\n$",
+		"*1\r\n$-",
+		"*-\r\n",
+		"*0\r\n",
+		"*1\r\n$0\r\n\r\n",
+		"*1\r\n$3\r\ngetxx",
+		"*2\r\n$3\r\nget\r\n:1\r\n",
+		"*1\r\n$9223372036854775807\r\n",
+		"*1\r\n$2147483647\r\n",
+		"PING\r\n",
+		" GET  key\r\n",
+		"+PING\r\n",
+		"$4\r\nPING\r\n",
+		"\r\n",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed), false)
+		f.Add([]byte(seed), true)
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte, requireMultibulk bool) {
+		commands, err := scanCommands(t, bytes.NewReader(input), requireMultibulk)
+		splitCommands, splitErr := scanCommands(t, iotest.OneByteReader(bytes.NewReader(input)), requireMultibulk)
+		if splitErr != err || !reflect.DeepEqual(splitCommands, commands) {
+			t.Fatalf("Scanning %q returned %q %v whole, but %q %v split", input, commands, err, splitCommands, splitErr)
+		}
+	})
+}
+
+//Scans and parses every command from the reader, and returns what was scanned, along with the scanner's error
+func scanCommands(t *testing.T, r io.Reader, requireMultibulk bool) (commands []string, err error) {
+	s := NewCommandScanner(r)
+	s.RequireMultibulk = requireMultibulk
+	for s.Scan() {
+		token := s.Bytes()
+		if requireMultibulk && token[0] != '*' {
+			t.Fatalf("Scanned %q, which isn't a multibulk, with multibulks required", token)
+		}
+
+		// Only the command's name is lowercased
+		if command, err := ParseCommand(token); err == nil && token[0] == '*' && !bytes.EqualFold(command.GetBuffer(), token) {
+			t.Fatalf("Parsing %q gave a command with the buffer %q", token, command.GetBuffer())
+		}
+		commands = append(commands, string(token))
+	}
+	return commands, s.Err()
+}
+
+func TestCommandScannerLenientNewlines(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\na\n$0\r\n\n*2\r\n$3\r\nGET\r\n$-1\r\n"
+
+	// Strict by default
+	s := NewCommandScanner(strings.NewReader(input))
+	if s.Scan() || s.Err() != ERROR_BAD_BULK_FORMAT {
+		t.Errorf("Expected a bare \\n to be refused by default, got %q %v", s.Bytes(), s.Err())
+	}
+
+	SetLenientNewlines(true)
+	defer SetLenientNewlines(false)
+
+	// The \r is put back, so that what's passed on is well formed
+	expected := []string{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n", "*2\r\n$3\r\nGET\r\n$-1\r\n"}
+	s = NewCommandScanner(iotest.OneByteReader(strings.NewReader(input)))
+	scanned := []string{}
+	for s.Scan() {
+		scanned = append(scanned, string(s.Bytes()))
+	}
+	if s.Err() != nil || !reflect.DeepEqual(scanned, expected) {
+		t.Errorf("Expected to scan %q, got %q %v", expected, scanned, s.Err())
+	}
+
+	// A command that ends with a bare \n is scanned without waiting on whatever the client sends next
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("*1\r\n$4\r\nPING\n"))
+	scannedPing := make(chan string, 1)
+	go func() {
+		s := NewCommandScanner(r)
+		s.Scan()
+		scannedPing <- string(s.Bytes())
+	}()
+	select {
+	case ping := <-scannedPing:
+		if ping != "*1\r\n$4\r\nPING\r\n" {
+			t.Errorf("Expected the PING to be scanned as %q, got %q", "*1\r\n$4\r\nPING\r\n", ping)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for a command that ends with a bare \\n")
+	}
+}
@@ -39,6 +39,15 @@ type RespScanner struct {
 	err   error
 
 	empties int
+
+	// Set for scanning clients' commands, see NewCommandScanner
+	commands bool
+	//Whether a command scanner refuses commands that aren't multibulks, ex: inline commands typed over telnet.  If so,
+	//the first one fails the scan with ERROR_MULTIBULK_FORMAT_REQUIRED, so that binary-safe multibulk traffic is never
+	//mistaken for one.  They're accepted by default.  Set before the first scan
+	RequireMultibulk bool
+	// Decodes the multibulk command being scanned, carrying on from the last read each time more of it arrives
+	decoder CommandDecoder
 }
 
 func NewRespScanner(r io.Reader) *RespScanner {
@@ -48,11 +57,20 @@ func NewRespScanner(r io.Reader) *RespScanner {
 	}
 }
 
+//Returns a scanner for the commands that a client sends.  Multibulk commands are decoded with a CommandDecoder, so
+//one that's split across many reads is decoded from where the last read stopped, rather than being scanned again from
+//its start each time more of it arrives.  Inline commands are accepted too, unless RequireMultibulk is set
+func NewCommandScanner(r io.Reader) *RespScanner {
+	s := NewRespScanner(r)
+	s.commands = true
+	return s
+}
+
 func (s *RespScanner) Scan() bool {
 	for {
 		if s.b.Len() > 0 || s.err != nil {
 			// See if we can get a token with what we already have.
-			advance, token, err := ScanResp(s.b.Bytes(), s.err != nil)
+			advance, token, err := s.scan(s.b.Bytes(), s.err != nil)
 
 			if err != nil {
 				s.setErr(err)
@@ -110,6 +128,39 @@ func (s *RespScanner) Scan() bool {
 	}
 }
 
+//Scans the next token from the data, like ScanResp.  A command scanner decodes multibulk commands with its decoder
+func (s *RespScanner) scan(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if !s.commands || len(data) == 0 {
+		return ScanResp(data, atEOF)
+	} else if data[0] != '*' {
+		if s.RequireMultibulk {
+			return 0, nil, ERROR_MULTIBULK_FORMAT_REQUIRED
+		}
+		return ScanResp(data, atEOF)
+	}
+
+	for {
+		if _, err = s.decoder.Next(data); err == io.EOF {
+			break
+		} else if err == ERROR_NEED_MORE_DATA {
+			if atEOF {
+				// The stream ended part way through the command
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		} else if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	advance, token = s.decoder.Offset(), data[:s.decoder.Offset()]
+	if s.decoder.bareNewline {
+		token = canonicalCommand(token)
+	}
+	s.decoder = CommandDecoder{}
+	return advance, token, nil
+}
+
 func (s *RespScanner) setErr(err error) {
 	if s.err == nil || s.err == io.EOF {
 		s.err = err
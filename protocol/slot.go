@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+)
+
+//The number of hash slots that a redis cluster divides its keys between
+const CLUSTER_SLOTS = 16384
+
+//Lookup table for CRC16-CCITT (XModem): polynomial 0x1021, initial value 0, as redis cluster uses
+var crc16Table = makeCRC16Table(0x1021)
+
+func makeCRC16Table(polynomial uint16) (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ polynomial
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}
+
+//Returns the CRC16-CCITT (XModem) checksum of the given bytes
+func CRC16(b []byte) uint16 {
+	var crc uint16
+	for _, char := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^char]
+	}
+	return crc
+}
+
+//Returns the cluster hash slot that the given key belongs to: CRC16 of the key, mod CLUSTER_SLOTS
+//If the key has a hash tag, only the tag is hashed, so that related keys can be kept in the same slot.  The tag is
+//what's between the first '{' and the first '}' after it, ex: "{user1000}.following" is hashed as "user1000".  A key
+//without a '}' after its first '{', or with nothing between them, is hashed whole
+func KeySlot(key []byte) uint16 {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return CRC16(key) % CLUSTER_SLOTS
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestCRC16(test *testing.T) {
+	// The check value for CRC16-CCITT (XModem), as given in the redis cluster specification
+	if crc := CRC16([]byte("123456789")); crc != 0x31C3 {
+		test.Errorf("Expected CRC16 of 123456789 to be 0x31C3, got %#x", crc)
+	}
+}
+
+func TestKeySlot(test *testing.T) {
+	testData := []struct {
+		key      string
+		expected uint16
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"", 0},
+		// Hash tags: only what's inside the first {...} is hashed
+		{"{foo}bar", 12182},
+		{"zap{bar}", 5061},
+		{"foo{bar}{zap}", 5061},
+		// Empty or unterminated tags fall back to the whole key
+		{"foo{}{bar}", CRC16([]byte("foo{}{bar}")) % CLUSTER_SLOTS},
+		{"{}", CRC16([]byte("{}")) % CLUSTER_SLOTS},
+		{"foo{bar", CRC16([]byte("foo{bar")) % CLUSTER_SLOTS},
+		// The tag ends at the first } after the first {
+		{"foo{{bar}}zap", CRC16([]byte("{bar")) % CLUSTER_SLOTS},
+	}
+
+	for _, d := range testData {
+		if slot := KeySlot([]byte(d.key)); slot != d.expected {
+			test.Errorf("Expected KeySlot(%q) to be %d, got %d", d.key, d.expected, slot)
+		}
+	}
+
+	// The examples from the redis cluster specification: keys sharing a hash tag share a slot
+	following := KeySlot([]byte("{user1000}.following"))
+	if followers := KeySlot([]byte("{user1000}.followers")); followers != following {
+		test.Errorf("Expected {user1000}.following and {user1000}.followers to share a slot, got %d and %d", following, followers)
+	}
+	if user := KeySlot([]byte("user1000")); user != following {
+		test.Errorf("Expected {user1000}.following and user1000 to share a slot, got %d and %d", following, user)
+	}
+}
+
+func BenchmarkKeySlot(b *testing.B) {
+	key := []byte("{user1000}.following")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		KeySlot(key)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+)
+
+//Subcommands of otherwise unsupported commands that are harmless to send through the proxy, keyed by lowercased
+//command and then lowercased subcommand.  Client libraries send these while setting up a connection (ex: CLIENT SETINFO,
+//CLIENT NO-EVICT), and fail to initialize if they're refused.  The rest of CLIENT (ex: KILL, PAUSE) stays refused
+//The CLIENT ones are those the proxy answers itself, rather than sending them on (see IsClientSubcommand)
+var SAFE_SUBCOMMANDS = map[string]map[string]bool{
+	"client": answeredClientSubcommands,
+}
+
+//The CLIENT subcommands that the proxy answers itself, see IsClientSubcommand.  Any other CLIENT subcommand would be
+//sent on to a shared backend connection, so these are the only ones that are safe
+var answeredClientSubcommands = map[string]bool{"getname": true, "no-evict": true, "no-touch": true, "setinfo": true, "setname": true}
+
+var (
+	//Refused for a CLIENT SETNAME whose name redis would refuse
+	ERR_BAD_CLIENT_NAME = &RecoverableError{"Client names cannot contain spaces, newlines or special characters."}
+)
+
+//The longest subcommand that hasSubcommand looks up, so that it can lowercase without allocating
+const maxSubcommandLength = 32
+
+//Returns whether the given subcommand, lowercased, is in subcommands
+func hasSubcommand(subcommands map[string]bool, subcommand []byte) bool {
+	if len(subcommand) > maxSubcommandLength {
+		return false
+	}
+
+	var lowered [maxSubcommandLength]byte
+	lowercased := lowered[:len(subcommand)]
+	copy(lowercased, subcommand)
+	for i, c := range lowercased {
+		if 'A' <= c && c <= 'Z' {
+			lowercased[i] = c + ('a' - 'A')
+		}
+	}
+	return subcommands[string(lowercased)]
+}
+
+//Returns whether the given command is one of SAFE_SUBCOMMANDS.  Other commands cost a single lookup
+func IsSafeSubcommand(command Command) bool {
+	subcommands, ok := SAFE_SUBCOMMANDS[string(command.GetCommand())]
+	if !ok || command.GetArgCount() < 1 {
+		return false
+	}
+	return hasSubcommand(subcommands, command.GetFirstArg())
+}
+
+//Returns whether the given command is a CLIENT subcommand that the proxy answers itself, rather than sending it on
+//Those set or read the state of the client's own connection, but backend connections are shared between clients, so a
+//name or flag set on one would be seen by other clients, and carry over to whichever client uses it next
+func IsClientSubcommand(command Command) bool {
+	return bytes.Equal(command.GetCommand(), CLIENT_COMMAND) && command.GetArgCount() > 0 &&
+		hasSubcommand(answeredClientSubcommands, command.GetFirstArg())
+}
+
+//Answers a CLIENT subcommand that the proxy answers itself (see IsClientSubcommand), for a client whose name is the
+//given one (nil if it has none).  Returns the reply, and the client's name once the command has run
+//Arguments are checked as redis checks them.  NO-EVICT, NO-TOUCH and SETINFO only change what the server does with the
+//connection they're sent on, so they're acknowledged, and not sent anywhere
+func AnswerClientSubcommand(command Command, name []byte) (reply, newName []byte, err error) {
+	args := commandArgs(command)
+	if len(args) == 0 {
+		return nil, name, ERR_BAD_ARGUMENTS
+	}
+
+	switch subcommand := bytes.ToLower(args[0]); string(subcommand) {
+	case "getname":
+		if len(args) != 1 {
+			return nil, name, ERR_BAD_ARGUMENTS
+		} else if name == nil {
+			return ERR_RESPONSE, name, nil
+		}
+		// The line it's written as adds the trailing \r\n
+		return append(appendMultibulkHeader(nil, '$', len(name)), name...), name, nil
+	case "setname":
+		if len(args) != 2 {
+			return nil, name, ERR_BAD_ARGUMENTS
+		}
+		newName, err := parseClientName(args[1])
+		if err != nil {
+			return nil, name, err
+		}
+		return OK_RESPONSE, newName, nil
+	case "no-evict", "no-touch":
+		if len(args) != 2 || !(bytes.EqualFold(args[1], []byte("on")) || bytes.EqualFold(args[1], []byte("off"))) {
+			return nil, name, ERR_BAD_ARGUMENTS
+		}
+		return OK_RESPONSE, name, nil
+	case "setinfo":
+		if len(args) != 3 || !(bytes.EqualFold(args[1], []byte("lib-name")) || bytes.EqualFold(args[1], []byte("lib-ver"))) {
+			return nil, name, ERR_BAD_ARGUMENTS
+		}
+		return OK_RESPONSE, name, nil
+	}
+
+	return nil, name, ERR_BAD_ARGUMENTS
+}
+
+//Checks a client name as redis does, and returns a copy of it, or nil for an empty name, which removes the client's
+func parseClientName(name []byte) ([]byte, error) {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return nil, ERR_BAD_CLIENT_NAME
+		}
+	}
+
+	if len(name) == 0 {
+		return nil, nil
+	}
+	return append([]byte(nil), name...), nil
+}
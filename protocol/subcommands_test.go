@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSafeSubcommand(test *testing.T) {
+	testData := []struct {
+		command  string
+		expected bool
+	}{
+		{"client setinfo lib-name redis-py\r\n", true},
+		{"CLIENT NO-EVICT on\r\n", true},
+		{"*3\r\n$6\r\nclient\r\n$8\r\nNo-Touch\r\n$2\r\non\r\n", true},
+		{"client setname app\r\n", true},
+		{"client getname\r\n", true},
+		{"client kill 127.0.0.1:6379\r\n", false},
+		{"client pause 1000\r\n", false},
+		{"client unpause\r\n", false},
+		{"client\r\n", false},
+		{"client setinfoextra lib-name redis-py\r\n", false},
+		{"client " + strings.Repeat("x", 100) + "\r\n", false},
+		{"config getname\r\n", false},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		if IsSafeSubcommand(command) != d.expected {
+			test.Errorf("Expected IsSafeSubcommand(%q) to be %t", d.command, d.expected)
+		}
+		// The safe CLIENT subcommands are the ones the proxy answers
+		if string(command.GetCommand()) == "client" && IsClientSubcommand(command) != d.expected {
+			test.Errorf("Expected IsClientSubcommand(%q) to be %t", d.command, d.expected)
+		}
+	}
+}
+
+func TestAnswerClientSubcommand(test *testing.T) {
+	testData := []struct {
+		command  string
+		name     string
+		reply    string
+		err      error
+		expected string
+	}{
+		{"client getname\r\n", "", "$-1", nil, ""},
+		{"*2\r\n$6\r\nclient\r\n$7\r\nGETNAME\r\n", "app", "$3\r\napp", nil, "app"},
+		{"client setname worker-1\r\n", "app", "+OK", nil, "worker-1"},
+		{"*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$0\r\n\r\n", "app", "+OK", nil, ""},
+		{"*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$4\r\na pp\r\n", "app", "", ERR_BAD_CLIENT_NAME, "app"},
+		{"client setname\r\n", "app", "", ERR_BAD_ARGUMENTS, "app"},
+		{"client no-evict on\r\n", "app", "+OK", nil, "app"},
+		{"client NO-TOUCH OFF\r\n", "", "+OK", nil, ""},
+		{"client no-touch maybe\r\n", "", "", ERR_BAD_ARGUMENTS, ""},
+		{"client setinfo lib-name redis-py\r\n", "", "+OK", nil, ""},
+		{"client setinfo lib-ver\r\n", "", "", ERR_BAD_ARGUMENTS, ""},
+		{"client setinfo lib-color red\r\n", "", "", ERR_BAD_ARGUMENTS, ""},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+		if !IsClientSubcommand(command) {
+			test.Errorf("Expected %q to be answered by the proxy", d.command)
+			continue
+		}
+
+		var name []byte
+		if d.name != "" {
+			name = []byte(d.name)
+		}
+		reply, newName, err := AnswerClientSubcommand(command, name)
+		if string(reply) != d.reply || err != d.err || string(newName) != d.expected {
+			test.Errorf("Expected %q to reply %q %v, and leave the name %q, got %q %v %q", d.command, d.reply, d.err,
+				d.expected, reply, err, newName)
+		}
+	}
+
+	for _, other := range []string{"client kill 127.0.0.1:6379\r\n", "client\r\n", "config getname\r\n"} {
+		command, err := ParseCommand([]byte(other))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", other, err)
+		}
+		if IsClientSubcommand(command) {
+			test.Errorf("Expected %q not to be answered by the proxy", other)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	//Added to a WAIT's own timeout, so that the server has time to send its reply once the timeout is up
+	WAIT_TIMEOUT_MARGIN = 100 * time.Millisecond
+	//The longest that the reply to a WAIT is waited for.  A WAIT 0 would otherwise pin its connection forever
+	MAX_WAIT_TIMEOUT = 30 * time.Second
+)
+
+var WAIT_COMMAND = []byte("wait")
+
+//Returns how long to wait for the reply to the given command, if it is a WAIT: its timeout argument (in
+//milliseconds) plus WAIT_TIMEOUT_MARGIN, capped at MAX_WAIT_TIMEOUT.  A timeout of 0 blocks forever, so it gets the cap
+//Returns false if the command isn't a WAIT.  A WAIT whose timeout can't be parsed is refused by the server
+//straight away, so it gets just the margin
+func WaitReplyTimeout(command Command) (time.Duration, bool) {
+	if !bytes.Equal(command.GetCommand(), WAIT_COMMAND) {
+		return 0, false
+	}
+
+	args := commandArgs(command)
+	if len(args) != 2 {
+		return WAIT_TIMEOUT_MARGIN, true
+	}
+
+	// Parsed as an int64, so that a timeout past a 32-bit int is still capped rather than taken as unparseable
+	timeout, err := ParseInt64(args[1])
+	if err != nil || timeout < 0 {
+		return WAIT_TIMEOUT_MARGIN, true
+	}
+
+	if timeout == 0 || timeout >= int64(MAX_WAIT_TIMEOUT/time.Millisecond) {
+		return MAX_WAIT_TIMEOUT, true
+	}
+
+	waitTimeout := time.Duration(timeout)*time.Millisecond + WAIT_TIMEOUT_MARGIN
+	if waitTimeout > MAX_WAIT_TIMEOUT {
+		waitTimeout = MAX_WAIT_TIMEOUT
+	}
+	return waitTimeout, true
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitReplyTimeout(test *testing.T) {
+	testData := []struct {
+		command  string
+		ok       bool
+		expected time.Duration
+	}{
+		{"*3\r\n$4\r\nwait\r\n$1\r\n1\r\n$4\r\n1500\r\n", true, 1500*time.Millisecond + WAIT_TIMEOUT_MARGIN},
+		{"*3\r\n$4\r\nWAIT\r\n$1\r\n1\r\n$1\r\n0\r\n", true, MAX_WAIT_TIMEOUT},
+		{"*3\r\n$4\r\nwait\r\n$1\r\n1\r\n$10\r\n9999999999\r\n", true, MAX_WAIT_TIMEOUT},
+		{"*3\r\n$4\r\nwait\r\n$1\r\n1\r\n$3\r\nabc\r\n", true, WAIT_TIMEOUT_MARGIN},
+		{"*2\r\n$4\r\nwait\r\n$1\r\n1\r\n", true, WAIT_TIMEOUT_MARGIN},
+		{"wait 2 250\r\n", true, 250*time.Millisecond + WAIT_TIMEOUT_MARGIN},
+		{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", false, 0},
+	}
+
+	for _, d := range testData {
+		command, err := ParseCommand([]byte(d.command))
+		if err != nil {
+			test.Fatalf("Error parsing %q: %s", d.command, err)
+		}
+
+		timeout, ok := WaitReplyTimeout(command)
+		if ok != d.ok || timeout != d.expected {
+			test.Errorf("WaitReplyTimeout(%q) returned %s, %t. Expected %s, %t", d.command, timeout, ok, d.expected, d.ok)
+		}
+	}
+}
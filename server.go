@@ -28,7 +28,7 @@ package rmux
 import (
 	"fmt"
 	"github.com/salesforce/rmux/connection"
-	"github.com/salesforce/rmux/graphite"
+	"github.com/salesforce/rmux/metrics"
 	. "github.com/salesforce/rmux/log"
 	"github.com/salesforce/rmux/protocol"
 	"io"
@@ -36,6 +36,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -52,6 +53,12 @@ var (
 
 var version string = "dev"
 
+//The default wait before retrying a command that got a -LOADING reply
+const DEFAULT_LOADING_RETRY_DELAY = 100 * time.Millisecond
+
+//The default for how long a client's open transaction may leave its pinned connection unused
+const DEFAULT_MAX_PIN_IDLE = 30 * time.Second
+
 //The main RedisMultiplexer
 //Listens on a specified socket or port, and assigns out queries to any number of connection pools
 //If more than one connection pool is given multi-key operations are blocked
@@ -91,6 +98,52 @@ type RedisMultiplexer struct {
 	infoMutex sync.RWMutex
 	// Whether to failover to another connection pool if the target connection pool is down (in multiplexing mode)
 	Failover bool
+	// Whether to follow redis cluster -MOVED/-ASK redirects, rather than returning them to the client
+	FollowClusterRedirects bool
+	// Decides which commands clients may send.  Can be changed while the multiplexer runs
+	CommandPolicy *protocol.CommandPolicy
+	// How many times a read-only command is retried while its server replies -LOADING.  0 disables retrying
+	LoadingRetries int
+	// How long to wait before each -LOADING retry
+	LoadingRetryDelay time.Duration
+	// If set, pooled backend connections that go unused for this long are disconnected, until they're next needed
+	MaxIdle time.Duration
+	// If set, a client whose open transaction (MULTI or WATCH) leaves its pinned connection unused for this long is
+	// told so and disconnected, which releases the connection.  Otherwise idle transactions could hold every pooled
+	// connection, and leave every other client waiting for one
+	MaxPinIdle time.Duration
+	// If set, how often the bytes read from and written to each pool's server (including the replicas) are reported
+	TrafficReportInterval time.Duration
+	// If set, SCAN is allowed while multiplexing, and runs across every backend in turn.  Its cursor says which backend
+	// an iteration is up to, as well as where in it
+	ScanFanOut bool
+	// If set, backend connections are named "<ClientName>-<pool index>" with CLIENT SETNAME (replicas get an extra
+	// "-replica<index>"), so that they can be attributed in CLIENT LIST
+	ClientName string
+	// If set, called around every command proxied to a backend (including replicas), ex: to record tracing spans
+	TraceHook connection.TraceHook
+	// If set, caps how many backend connections (including replicas') connect to the same server at once, so that a
+	// server recovering from an outage isn't overwhelmed by every connection reconnecting together
+	ConnectLimiter *connection.ConnectLimiter
+	// If set, a backend connection (including replicas') whose last TripThreshold replies were all error replies or
+	// failures isn't used for TripCoolDown, so that a struggling server isn't sent more commands
+	TripThreshold int
+	TripCoolDown time.Duration
+	// If set, no backend is used.  Commands that would be proxied are answered with a multibulk of their command and
+	// arguments instead (see protocol.WriteEcho), so that clients' framing can be tested against the proxy's decoder
+	Echo bool
+	// Whether clients must only send multibulk commands.  If so, a client that sends another kind, ex: an inline command
+	// typed over telnet, is told to use the multibulk format, and disconnected
+	RequireMultibulkCommands bool
+	// If set, decides whether each client that connects over a UNIX socket may use the proxy, by the uid and gid of its
+	// process.  Clients on any other kind of socket aren't checked
+	AuthorizePeer PeerAuthorizer
+	// The remote addresses of the clients being traced, as a map[string]bool, set with TraceClients
+	tracedClients atomic.Value
+	// The credentials from UpdateCredentials, for the cluster nodes that are connected to once started
+	authUser string
+	authPassword string
+	credentialsLock sync.Mutex
 }
 
 //Sub-task that handles the cleanup when a server goes down
@@ -128,10 +181,33 @@ func NewRedisMultiplexer(listenProtocol, listenEndpoint string, poolSize int) (n
 	newRedisMultiplexer.ClientReadTimeout = connection.EXTERN_READ_TIMEOUT
 	newRedisMultiplexer.ClientWriteTimeout = connection.EXTERN_WRITE_TIMEOUT
 	newRedisMultiplexer.infoMutex = sync.RWMutex{}
+	newRedisMultiplexer.CommandPolicy = protocol.NewCommandPolicy()
+	newRedisMultiplexer.LoadingRetryDelay = DEFAULT_LOADING_RETRY_DELAY
+	newRedisMultiplexer.MaxPinIdle = DEFAULT_MAX_PIN_IDLE
 //	Debug("Redis Multiplexer Initialized")
 	return
 }
 
+//Replaces the credentials that every backend connection (including replicas) AUTHs with, without tearing them down
+//Safe to call while the multiplexer runs
+func (this *RedisMultiplexer) UpdateCredentials(user, password string) {
+	this.credentialsLock.Lock()
+	defer this.credentialsLock.Unlock()
+
+	this.authUser = user
+	this.authPassword = password
+	if this.HashRing != nil && this.HashRing.ClusterNodes != nil {
+		this.HashRing.ClusterNodes.UpdateCredentials(user, password)
+	}
+
+	for _, connectionPool := range this.ConnectionCluster {
+		connectionPool.UpdateCredentials(user, password)
+		for _, replica := range connectionPool.Replicas() {
+			replica.UpdateCredentials(user, password)
+		}
+	}
+}
+
 //Adds a connection to the redis multiplexer, for the given protocol and endpoint
 func (this *RedisMultiplexer) AddConnection(remoteProtocol, remoteEndpoint string) {
 	connectionCluster := connection.NewConnectionPool(remoteProtocol, remoteEndpoint, this.PoolSize,
@@ -144,6 +220,34 @@ func (this *RedisMultiplexer) AddConnection(remoteProtocol, remoteEndpoint strin
 	}
 }
 
+//Adds a connection to the redis multiplexer, for the master that the given sentinels monitor under masterName
+//The master is looked up whenever a connection reconnects, so that the pool follows failovers
+func (this *RedisMultiplexer) AddSentinelConnection(sentinels []string, masterName string) {
+	resolver := connection.NewSentinelResolver(sentinels, masterName, this.EndpointConnectTimeout)
+	connectionCluster := connection.NewSentinelConnectionPool(resolver, this.PoolSize,
+		this.EndpointConnectTimeout, this.EndpointReadTimeout, this.EndpointWriteTimeout)
+	this.ConnectionCluster = append(this.ConnectionCluster, connectionCluster)
+	if len(this.ConnectionCluster) == 1 {
+		this.PrimaryConnectionPool = connectionCluster
+	} else {
+		this.multiplexing = true
+	}
+}
+
+//Adds a read replica of an already added connection, that read-only commands may be sent to
+//Replicas must be added before the server is started
+func (this *RedisMultiplexer) AddReplica(masterEndpoint, replicaProtocol, replicaEndpoint string) error {
+	for _, connectionPool := range this.ConnectionCluster {
+		if connectionPool.Endpoint == masterEndpoint {
+			connectionPool.AddReplica(connection.NewConnectionPool(replicaProtocol, replicaEndpoint, this.PoolSize,
+				this.EndpointConnectTimeout, this.EndpointReadTimeout, this.EndpointWriteTimeout))
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Replica %s has no connection %s to replicate", replicaEndpoint, masterEndpoint)
+}
+
 //Counts the number of active endpoints on the server
 func (this *RedisMultiplexer) countActiveConnections() (activeConnections int) {
 	activeConnections = 0
@@ -151,6 +255,11 @@ func (this *RedisMultiplexer) countActiveConnections() (activeConnections int) {
 		if connectionPool.CheckConnectionState() {
 			activeConnections++
 		}
+
+		// Replicas aren't counted as endpoints, but are only read from while they're up
+		for _, replica := range connectionPool.Replicas() {
+			replica.CheckConnectionState()
+		}
 	}
 	return
 }
@@ -168,6 +277,32 @@ func (this *RedisMultiplexer) maintainConnectionStates() {
 	}
 }
 
+//Disconnects pooled connections (including the replicas') that have been idle for longer than MaxIdle
+func (this *RedisMultiplexer) reapIdleConnections() {
+	for this.active {
+		time.Sleep(this.MaxIdle / 2)
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.ReapIdleConnections(this.MaxIdle)
+			for _, replica := range connectionPool.Replicas() {
+				replica.ReapIdleConnections(this.MaxIdle)
+			}
+		}
+	}
+}
+
+//Reports every pool's traffic (including the replicas'), every TrafficReportInterval
+func (this *RedisMultiplexer) reportTraffic() {
+	for this.active {
+		time.Sleep(this.TrafficReportInterval)
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.ReportTraffic()
+			for _, replica := range connectionPool.Replicas() {
+				replica.ReportTraffic()
+			}
+		}
+	}
+}
+
 //Generates the Info response for a multiplexed server
 func (this *RedisMultiplexer) generateMultiplexInfo() {
 	tmpSlice := fmt.Sprintf("rmux_version: %s\r\ngo_version: %s\r\nprocess_id: %d\r\nconnected_clients: %d\r\nactive_endpoints: %d\r\ntotal_endpoints: %d\r\nrole: master\r\n", version, runtime.Version(), os.Getpid(), this.connectionCount, this.activeConnectionCount, len(this.ConnectionCluster))
@@ -178,12 +313,11 @@ func (this *RedisMultiplexer) generateMultiplexInfo() {
 
 //Called when a rmux server is ready to begin accepting connections
 func (this *RedisMultiplexer) Start() (err error) {
-	this.HashRing, err = connection.NewHashRing(this.ConnectionCluster, this.Failover)
-	if err != nil {
-		return err
+	if !this.Echo {
+		if err = this.startBackends(); err != nil {
+			return err
+		}
 	}
-
-	go this.maintainConnectionStates()
 	go this.initializeCleanup()
 	//if graphite.Enabled() {
 	//	go this.GraphiteCheckin()
@@ -196,7 +330,7 @@ func (this *RedisMultiplexer) Start() (err error) {
 			continue
 		}
 //		Debug("Accepted connection.")
-		graphite.Increment("accepted")
+		metrics.Increment("accepted")
 
 		go this.initializeClient(fd)
 	}
@@ -204,6 +338,71 @@ func (this *RedisMultiplexer) Start() (err error) {
 	return
 }
 
+//Configures the connection pools, builds the hash ring over them, and starts maintaining their connections
+func (this *RedisMultiplexer) startBackends() (err error) {
+	if this.ClientName != "" {
+		for i, connectionPool := range this.ConnectionCluster {
+			poolName := fmt.Sprintf("%s-%d", this.ClientName, i)
+			connectionPool.SetClientName(poolName)
+			for j, replica := range connectionPool.Replicas() {
+				replica.SetClientName(fmt.Sprintf("%s-replica%d", poolName, j))
+			}
+		}
+	}
+
+	if this.TraceHook != nil {
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.SetTraceHook(this.TraceHook)
+			for _, replica := range connectionPool.Replicas() {
+				replica.SetTraceHook(this.TraceHook)
+			}
+		}
+	}
+
+	if this.ConnectLimiter != nil {
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.SetConnectLimiter(this.ConnectLimiter)
+			for _, replica := range connectionPool.Replicas() {
+				replica.SetConnectLimiter(this.ConnectLimiter)
+			}
+		}
+	}
+
+	if this.TripThreshold > 0 {
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.SetCircuitBreaker(this.TripThreshold, this.TripCoolDown)
+			for _, replica := range connectionPool.Replicas() {
+				replica.SetCircuitBreaker(this.TripThreshold, this.TripCoolDown)
+			}
+		}
+	}
+
+	this.credentialsLock.Lock()
+	this.HashRing, err = connection.NewHashRing(this.ConnectionCluster, this.Failover)
+	if err != nil {
+		this.credentialsLock.Unlock()
+		return err
+	}
+
+	if this.FollowClusterRedirects {
+		this.HashRing.ClusterNodes = connection.NewClusterNodes(this.PoolSize, this.EndpointConnectTimeout,
+			this.EndpointReadTimeout, this.EndpointWriteTimeout)
+		if this.authPassword != "" {
+			this.HashRing.ClusterNodes.UpdateCredentials(this.authUser, this.authPassword)
+		}
+	}
+	this.credentialsLock.Unlock()
+
+	go this.maintainConnectionStates()
+	if this.MaxIdle > 0 {
+		go this.reapIdleConnections()
+	}
+	if this.TrafficReportInterval > 0 {
+		go this.reportTraffic()
+	}
+	return nil
+}
+
 //Initializes a client's connection to our server.  Sets up our disconnect hooks and then passes the client off for request handling
 func (this *RedisMultiplexer) initializeClient(localConnection net.Conn) {
 	defer func() {
@@ -213,6 +412,13 @@ func (this *RedisMultiplexer) initializeClient(localConnection net.Conn) {
 	//Add the connection to our internal list
 	myClient := NewClient(localConnection, this.ClientReadTimeout, this.ClientWriteTimeout,
 		this.multiplexing, this.HashRing)
+	myClient.Scanner.RequireMultibulk = this.RequireMultibulkCommands
+	myClient.CommandPolicy = this.CommandPolicy
+	myClient.LoadingRetries = this.LoadingRetries
+	myClient.LoadingRetryDelay = this.LoadingRetryDelay
+	if this.ScanFanOut {
+		myClient.ScanPools = this.ConnectionCluster
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -227,9 +433,75 @@ func (this *RedisMultiplexer) initializeClient(localConnection net.Conn) {
 		myClient.Connection.Close()
 	}()
 
+	if this.AuthorizePeer != nil && !this.authorizePeer(myClient) {
+		return
+	}
+
 	this.HandleClientRequests(myClient)
 }
 
+//Checks a client's peer credentials with AuthorizePeer, if it's connected over a UNIX socket
+//A refused client is sent why, and false is returned
+func (this *RedisMultiplexer) authorizePeer(client *Client) bool {
+	credentials, isUnix, err := GetPeerCredentials(client.Connection)
+	if !isUnix {
+		return true
+	}
+
+	if err == nil {
+		err = this.AuthorizePeer(credentials)
+	} else {
+		Error("Could not read the peer credentials of a client: %s", err)
+	}
+
+	if err != nil {
+		metrics.Increment("peer_refused")
+		protocol.WriteError([]byte(err.Error()), client.Writer, true)
+		return false
+	}
+
+	return true
+}
+
+//Turns on tracing for the clients connected from the given addresses, and off for every other client, so that one
+//client's debug logs (its commands, and each reply it's sent) are written without debug logging being on for all
+//An address is either a host, to trace every client from it, or a host and port, ex: "10.0.0.1:5555" to trace one
+//Takes effect from each client's next command.  Safe to call while the multiplexer runs.  Call without any addresses
+//to stop tracing
+func (this *RedisMultiplexer) TraceClients(addresses ...string) {
+	traced := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		traced[address] = true
+	}
+	this.tracedClients.Store(traced)
+}
+
+//Returns the addresses passed to the last TraceClients call, sorted
+func (this *RedisMultiplexer) TracedClients() []string {
+	traced, _ := this.tracedClients.Load().(map[string]bool)
+	addresses := make([]string, 0, len(traced))
+	for address := range traced {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+//Returns whether the client is connected from an address passed to TraceClients
+func (this *RedisMultiplexer) tracesClient(client *Client) bool {
+	traced, _ := this.tracedClients.Load().(map[string]bool)
+	if len(traced) == 0 {
+		return false
+	}
+
+	remoteAddr := client.logContext.RemoteAddr
+	if traced[remoteAddr] {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	return err == nil && traced[host]
+}
+
 //Sends the pre-generated Info response for a multiplexed server
 func (this *RedisMultiplexer) sendMultiplexInfo(myClient *Client) (err error) {
 	this.infoMutex.RLock()
@@ -258,6 +530,8 @@ func (this *RedisMultiplexer) HandleClientRequests(client *Client) {
 //		Debug("Client command handling loop closing")
 		// If the multiplexer goes down, deactivate this client.
 		client.Active = false
+		// A transaction the client left open mustn't be handed to anyone else
+		client.ReleasePinnedConnection()
 	}()
 
 	for this.active && client.Active {
@@ -271,15 +545,30 @@ func (this *RedisMultiplexer) HandleClientRequests(client *Client) {
 			}
 		case <-time.After(time.Second * 1):
 			// Allow heartbeat checks to happen once a second
+			this.expireIdlePin(client)
 		}
 	}
 
 	// TODO defer closing stuff?
 }
 
+//Disconnects the client if its open transaction has left its pinned connection unused for longer than MaxPinIdle
+//The connection is released once the client's loop ends, and the server discards the transaction along with it
+func (this *RedisMultiplexer) expireIdlePin(client *Client) {
+	if this.MaxPinIdle <= 0 || client.PinnedIdleFor() <= this.MaxPinIdle {
+		return
+	}
+
+	Error("Disconnecting a client whose transaction was idle for over %s: %s", this.MaxPinIdle, client.logContext.RemoteAddr)
+	metrics.Increment("transaction_idle")
+	client.FlushError(ERR_TRANSACTION_IDLE)
+	client.Active = false
+}
+
 // This looks a lot like HandleClientRequests above, but will break and flush to redis if there is nothing to read.
 // Will allow it to handle a pipeline of commands without spinning indefinitely.
 func (this *RedisMultiplexer) HandleCommandChunk(client *Client, command protocol.Command) {
+	client.logContext.SetTracing(this.tracesClient(client))
 	this.HandleCommand(client, command)
 
 ChunkLoop:
@@ -301,6 +590,10 @@ ChunkLoop:
 }
 
 func (this *RedisMultiplexer) HandleCommand(client *Client, command protocol.Command) {
+	if client.logContext.Tracing() {
+		client.logContext.Debug("HandleCommand: Received command", F("command", command.GetCommand()), F("args", command.GetArgCount()))
+	}
+
 	if this.multiplexing && bytes.Equal(command.GetCommand(), protocol.INFO_COMMAND) {
 		this.sendMultiplexInfo(client)
 		return
@@ -335,6 +628,12 @@ func (this *RedisMultiplexer) HandleCommand(client *Client, command protocol.Com
 		return
 	}
 
+	if this.Echo {
+		// Answered with what the parser made of it, in place of the backend's reply
+		protocol.WriteEcho(command, client.Writer)
+		return
+	}
+
 	// Otherwise, the command is ready to buffer to the connection.
 	client.Queue(command)
 
@@ -352,19 +651,46 @@ func (this *RedisMultiplexer) HandleError(client *Client, err error) {
 	if err == ERR_QUIT {
 		client.Active = false
 		return
+	} else if writeErr, ok := err.(*protocol.ClientWriteError); ok {
+		// The client didn't keep up with its reply, or went away.  What it was sent stops part way, so it's disconnected
+		Error("Disconnecting a client that couldn't be written to: %s", writeErr.Err)
+		metrics.Increment("client_write_error")
+		client.Active = false
+		return
+	} else if readErr, ok := err.(*protocol.BackendReadError); ok {
+		// The server's connection has already been disconnected.  The client is told in the same way as before
+		metrics.Increment("backend_read_error")
+		this.HandleError(client, readErr.Err)
+		return
+	} else if err == protocol.ERROR_MULTIBULK_FORMAT_REQUIRED {
+		// A client that sent an inline command, when RequireMultibulkCommands is set.  Logged with its address, since metrics can't be labeled by
+		// one without growing without bound.  The rest of its stream is no more likely to be multibulk, so like a
+		// protocol limit, it's told why and disconnected
+		Error("Disconnecting a client that didn't send a multibulk command: %s", client.logContext.RemoteAddr)
+		metrics.Increment("multibulk_format_required")
+		client.FlushError(err)
+		client.Active = false
+		return
+	} else if protocol.IsProtocolLimitError(err) {
+		// The rest of the stream can't be framed, so like redis, reply with the error and disconnect
+		Error("Disconnecting a client that exceeded a protocol limit: %s", err)
+		metrics.Increment("protocol_limit_exceeded")
+		client.FlushError(err)
+		client.Active = false
+		return
 	} else if recErr, ok := err.(*protocol.RecoverableError); ok {
 		// Since we can recover, flush an error to the client
 		Error("Error from server: %s", recErr)
 		client.FlushError(recErr)
 		return
-	} else if err == io.EOF {
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
 		// Stream EOF-ed. Deactivate this client and break out.
 		client.FlushRedisAndRespond()
 		client.Active = false
 		return
 	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 		// We had a read timeout. Let the client know that the connection is down
-		graphite.Increment("nettimeout")
+		metrics.Increment("nettimeout")
 		client.FlushError(ERR_TIMEOUT)
 		return
 	} else {
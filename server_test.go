@@ -27,7 +27,14 @@ package rmux
 
 import (
 	"bufio"
+	"errors"
+	"github.com/salesforce/rmux/connection"
+	"github.com/salesforce/rmux/metrics"
+	"github.com/salesforce/rmux/protocol"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -189,3 +196,444 @@ func TestCountActiveConnections_AllResponses(t *testing.T) {
 		t.Errorf("Server's connection count is wrong: %d instead of 1", connectionCount)
 	}
 }
+
+func TestCommandAllowlist(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	// No backend at all, so a refused command can't have been sent anywhere
+	server.CommandPolicy.SetAllowlist(true)
+	server.CommandPolicy.Allow("get")
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+	client.CommandPolicy = server.CommandPolicy
+
+	replies := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(clientSide).ReadString('\n')
+		replies <- line
+	}()
+
+	command, err := protocol.ParseCommand([]byte("*2\r\n$6\r\ndbsize\r\n$1\r\na\r\n"))
+	if err != nil {
+		t.Fatalf("Error parsing command: %s", err)
+	}
+	server.HandleCommand(client, command)
+	client.Writer.Flush()
+
+	select {
+	case reply := <-replies:
+		if reply != "-ERR command not allowed\r\n" {
+			t.Errorf("Expected a command not allowed error, got %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the reply")
+	}
+}
+
+func TestProtocolLimitDisconnects(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+	client.Active = true
+
+	replies := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(clientSide).ReadString('\n')
+		replies <- line
+	}()
+
+	server.HandleError(client, protocol.ERROR_BULK_TOO_LONG)
+
+	select {
+	case reply := <-replies:
+		if reply != "-ERR Protocol error: invalid bulk length\r\n" {
+			t.Errorf("Expected an invalid bulk length error, got %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the reply")
+	}
+
+	if client.Active {
+		t.Error("Expected the client to be disconnected after exceeding a protocol limit")
+	}
+}
+
+func TestHandleCopyErrors(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+	client.Active = true
+
+	replies := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(clientSide).ReadString('\n')
+		replies <- line
+	}()
+
+	// A server that broke the protocol is reported to the client as before
+	server.HandleError(client, &protocol.BackendReadError{Err: protocol.ERROR_BULK_TOO_LONG})
+
+	select {
+	case reply := <-replies:
+		if reply != "-ERR Protocol error: invalid bulk length\r\n" {
+			t.Errorf("Expected an invalid bulk length error, got %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the reply")
+	}
+
+	// A client that can't be written to is disconnected, without trying to write to it again
+	client.Active = true
+	server.HandleError(client, &protocol.ClientWriteError{Err: io.ErrClosedPipe})
+	if client.Active {
+		t.Error("Expected the client to be disconnected after its reply couldn't be written")
+	}
+}
+
+func TestHandleMultibulkFormatRequired(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	registry := metrics.NewPrometheusRegistry(nil)
+	metrics.SetSink(registry)
+	defer metrics.SetSink(nil)
+
+	// No backend at all, so the multibulk command's reply can only have come from the echo
+	server.Echo = true
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	server.RequireMultibulkCommands = true
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+	client.Scanner.RequireMultibulk = server.RequireMultibulkCommands
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		server.HandleClientRequests(client)
+		serverSide.Close()
+	}()
+
+	// Only multibulks are accepted, so the first inline command is refused, without anything after it being read
+	go clientSide.Write([]byte("*1\r\n$4\r\nping\r\nGET a\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+
+	replies := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(clientSide)
+		reply := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			reply += line
+		}
+		replies <- reply
+	}()
+
+	select {
+	case reply := <-replies:
+		if expected := "+PONG\r\n-ERR unknown command, multibulk format required\r\n"; reply != expected {
+			t.Errorf("Expected the client to be told to use the multibulk format, as %q, got %q", expected, reply)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the client to be disconnected")
+	}
+
+	<-handled
+	if client.Active {
+		t.Error("Expected the client to be disconnected")
+	}
+
+	if exposed := string(registry.Expose()); !strings.Contains(exposed, "rmux_multibulk_format_required_total 1") {
+		t.Errorf("Expected the refusal to be counted, got %s", exposed)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	// No backend at all, so the replies can only have come from the echo
+	server.Echo = true
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+
+	replies := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(clientSide)
+		reply := ""
+		for i := 0; i < 9; i++ {
+			line, _ := reader.ReadString('\n')
+			reply += line
+		}
+		replies <- reply
+	}()
+
+	for _, request := range []string{"*1\r\n$4\r\nping\r\n", "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$4\r\n1\r\n2\r\n"} {
+		command, err := protocol.ParseCommand([]byte(request))
+		if err != nil {
+			t.Fatalf("Error parsing command: %s", err)
+		}
+		server.HandleCommandChunk(client, command)
+	}
+
+	// The proxy still answers what it always answers itself
+	select {
+	case reply := <-replies:
+		if expected := "+PONG\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$4\r\n1\r\n2\r\n"; reply != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the reply")
+	}
+}
+
+func TestAuthorizePeer(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	var checked []PeerCredentials
+	server.AuthorizePeer = func(credentials PeerCredentials) error {
+		checked = append(checked, credentials)
+		return errors.New("uid not allowed")
+	}
+
+	clientSide, err := net.Dial("unix", "/tmp/rmuxTest.sock")
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer clientSide.Close()
+	serverSide, err := server.Listener.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting: %s", err)
+	}
+
+	credentials, isUnix, err := GetPeerCredentials(serverSide)
+	if err != nil || !isUnix {
+		t.Fatalf("Expected peer credentials, got %v, %t", err, isUnix)
+	}
+	if credentials.Uid != uint32(os.Getuid()) || credentials.Gid != uint32(os.Getgid()) || credentials.Pid != int32(os.Getpid()) {
+		t.Fatalf("Expected this process's credentials, got %+v", credentials)
+	}
+
+	// The refused client is told why, and disconnected
+	go server.initializeClient(serverSide)
+	clientSide.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(clientSide)
+	if err != nil || string(reply) != "-ERR uid not allowed\r\n" {
+		t.Fatalf("Expected the refusal and then EOF, got %q, %v", reply, err)
+	}
+	if len(checked) != 1 || checked[0] != credentials {
+		t.Fatalf("Expected the hook to be called with the peer credentials, got %+v", checked)
+	}
+
+	// Anything but a UNIX socket isn't checked
+	pipeServer, pipeClient := net.Pipe()
+	defer pipeClient.Close()
+	if _, isUnix, _ := GetPeerCredentials(pipeServer); isUnix {
+		t.Fatal("Expected a pipe to have no peer credentials")
+	}
+	if !server.authorizePeer(NewClient(pipeServer, time.Second, time.Second, false, nil)) || len(checked) != 1 {
+		t.Fatal("Expected a client that isn't on a UNIX socket to be allowed without a check")
+	}
+}
+
+func TestTraceClients(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	client := NewClient(nil, time.Second, time.Second, false, nil)
+	client.logContext.RemoteAddr = "10.0.0.1:5555"
+
+	testData := []struct {
+		addresses []string
+		expected  bool
+	}{
+		{nil, false},
+		{[]string{"10.0.0.1"}, true},
+		{[]string{"10.0.0.2", "10.0.0.1:5555"}, true},
+		{[]string{"10.0.0.1:5556"}, false},
+		{[]string{}, false},
+	}
+
+	for _, d := range testData {
+		if d.addresses != nil {
+			server.TraceClients(d.addresses...)
+		}
+		if traced := server.tracesClient(client); traced != d.expected {
+			t.Errorf("Expected tracing to be %t for %q, got %t", d.expected, d.addresses, traced)
+		}
+	}
+
+	// Each command chunk picks the setting up
+	server.Echo = true
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go io.Copy(io.Discard, clientSide)
+	client = NewClient(serverSide, time.Second, time.Second, false, nil)
+	client.logContext.RemoteAddr = "10.0.0.1:5555"
+	ping, _ := protocol.ParseCommand([]byte("*1\r\n$4\r\nping\r\n"))
+
+	server.TraceClients("10.0.0.1")
+	server.HandleCommandChunk(client, ping)
+	if !client.logContext.Tracing() {
+		t.Fatal("Expected the client to be traced")
+	}
+	server.TraceClients()
+	server.HandleCommandChunk(client, ping)
+	if client.logContext.Tracing() {
+		t.Fatal("Expected the client to stop being traced")
+	}
+}
+
+func TestInlineCommands(t *testing.T) {
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+
+	// No backend at all, so the replies can only have come from the echo
+	server.Echo = true
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	// Inline commands are accepted by default
+	client := NewClient(serverSide, time.Second, time.Second, false, nil)
+	// Closing the client's side ends the handling, once the stream is read to its end
+	go func() {
+		server.HandleClientRequests(client)
+		serverSide.Close()
+	}()
+
+	go clientSide.Write([]byte("SET a 1\r\n"))
+
+	reader := bufio.NewReader(clientSide)
+	reply := ""
+	for i := 0; i < 7; i++ {
+		clientSide.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading the reply, after %q: %s", reply, err)
+		}
+		reply += line
+	}
+
+	if expected := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"; reply != expected {
+		t.Errorf("Expected the inline command to be echoed as %q, got %q", expected, reply)
+	}
+}
+
+func TestIdleTransactionDisconnects(t *testing.T) {
+	multi := "*1\r\n$5\r\nmulti\r\n"
+
+	backend, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer backend.Close()
+
+	released := make(chan error, 1)
+	go func() {
+		fd, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		buf := make([]byte, len(multi))
+		if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != multi {
+			t.Errorf("Expected %q, got %q", multi, buf)
+			return
+		}
+		fd.Write([]byte("+OK\r\n"))
+
+		// The idle transaction's connection is closed, so that the server discards it
+		fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = fd.Read(make([]byte, 1))
+		released <- err
+	}()
+
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxTest.sock", 1)
+	if err != nil {
+		t.Fatalf("Error creating rmux: %s", err)
+	}
+	defer server.Listener.Close()
+	server.MaxPinIdle = 50 * time.Millisecond
+
+	pool := connection.NewConnectionPool("tcp", backend.Addr().String(), 1, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	hashRing, err := connection.NewHashRing([]*connection.ConnectionPool{pool}, false)
+	if err != nil {
+		t.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	client := NewClient(serverSide, time.Second, time.Second, false, hashRing)
+	handled := make(chan struct{})
+	go func() {
+		server.HandleClientRequests(client)
+		close(handled)
+	}()
+
+	clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+	clientSide.Write([]byte(multi))
+	reader := bufio.NewReader(clientSide)
+	for _, expected := range []string{"+OK\r\n", "-ERR Transaction idle for too long\r\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q and %v", expected, line, err)
+		}
+	}
+
+	<-handled
+	if err := <-released; err != io.EOF {
+		t.Errorf("Expected the pinned connection to be closed, got %v", err)
+	}
+	if pool.Count != 0 {
+		t.Errorf("Expected the pinned connection to be back in its pool, got %d in use", pool.Count)
+	}
+}
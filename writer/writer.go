@@ -28,31 +28,114 @@ package writer
 import (
 	"bytes"
 	"io"
+	"net"
 )
 
 const (
 	defaultFlexibleWriterSize = 64
+	//Default cap on the capacity that a FlexibleWriter keeps after a flush
+	DEFAULT_MAX_BUFFER_SIZE = 64 * 1024
 )
 
 type FlexibleWriter struct {
 	*bytes.Buffer
 	writer io.Writer
+	//Once flushed, a buffer that has grown past this is reallocated at its default size
+	maxBufferSize int
 }
 
-func NewFlexibleWriter(writer io.Writer) *FlexibleWriter {
+//Configures a FlexibleWriter, in NewFlexibleWriter
+type FlexibleWriterOption func(*FlexibleWriter)
+
+//Sets the high-water mark of the writer's buffer: when it has grown past size, it is reallocated at its default size
+//on the next flush that empties it, so that a single huge write doesn't pin memory for the writer's lifetime.
+//Writes larger than size still succeed.  A size of 0 or less never reallocates.  Defaults to DEFAULT_MAX_BUFFER_SIZE
+func WithMaxBufferSize(size int) FlexibleWriterOption {
+	return func(w *FlexibleWriter) {
+		w.maxBufferSize = size
+	}
+}
+
+func NewFlexibleWriter(writer io.Writer, options ...FlexibleWriterOption) *FlexibleWriter {
 	w := &FlexibleWriter{}
 	w.writer = writer
-	buf := make([]byte, 0, defaultFlexibleWriterSize)
-	w.Buffer = bytes.NewBuffer(buf)
+	w.maxBufferSize = DEFAULT_MAX_BUFFER_SIZE
+	w.Buffer = newBuffer()
+	for _, option := range options {
+		option(w)
+	}
 	return w
 }
 
+func newBuffer() *bytes.Buffer {
+	buf := make([]byte, 0, defaultFlexibleWriterSize)
+	return bytes.NewBuffer(buf)
+}
+
 func (this *FlexibleWriter) Flush() (err error) {
 	_, err = this.Buffer.WriteTo(this.writer)
 
+	this.shrink()
+	return
+}
+
+//Reallocates an empty buffer that has grown past maxBufferSize
+func (this *FlexibleWriter) shrink() {
+	if this.maxBufferSize > 0 && this.Len() == 0 && this.Cap() > this.maxBufferSize {
+		this.Buffer = newBuffer()
+	}
+}
+
+//Writes whatever is buffered, followed by the given buffers, and flushes
+//If the underlying writer can gather them (see WriteVectored), they are written with a single writev, without being
+//copied into the buffer.  Otherwise they are copied into the buffer, and flushed with a single Write
+//If the write fails part way, the buffer is still emptied, since there's no telling what was written
+func (this *FlexibleWriter) WriteBuffersAndFlush(buffers net.Buffers) (err error) {
+	if !CanWriteVectored(this.writer) {
+		for _, buffer := range buffers {
+			this.Write(buffer)
+		}
+		return this.Flush()
+	}
+
+	if this.Len() > 0 {
+		buffers = append(net.Buffers{this.Bytes()}, buffers...)
+	}
+
+	_, err = WriteVectored(this.writer, &buffers)
+	this.Reset()
+	this.shrink()
 	return
 }
 
+//Implemented by writers that wrap a connection (with timeouts, or counters), to gather writes into a single writev
+type VectoredWriter interface {
+	//Whether WriteVectored can gather writes on the wrapped connection
+	CanWriteVectored() bool
+	//Writes the buffers to the wrapped connection, as WriteVectored does
+	WriteVectored(buffers *net.Buffers) (n int64, err error)
+}
+
+//Returns whether writes to w can be gathered into a single writev: w must be a TCP or unix socket, or a
+//VectoredWriter wrapping one
+func CanWriteVectored(w io.Writer) bool {
+	switch w := w.(type) {
+	case VectoredWriter:
+		return w.CanWriteVectored()
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+//Writes the buffers to w, gathered into a single writev if CanWriteVectored(w), or one after the other if not
+func WriteVectored(w io.Writer, buffers *net.Buffers) (n int64, err error) {
+	if vectored, ok := w.(VectoredWriter); ok {
+		return vectored.WriteVectored(buffers)
+	}
+	return buffers.WriteTo(w)
+}
+
 func (this *FlexibleWriter) Buffered() int {
 	return this.Len()
 }
@@ -27,6 +27,10 @@ package writer
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"strings"
 	"testing"
 )
@@ -76,3 +80,184 @@ func TestFlexibleWriter_HugeWrite(t *testing.T) {
 		t.Error("Should have flushed after call to Flush()")
 	}
 }
+
+func TestFlexibleWriter_ShrinksAfterFlush(t *testing.T) {
+	b := new(bytes.Buffer)
+	fw := NewFlexibleWriter(b, WithMaxBufferSize(1024))
+
+	// Writes larger than the cap still go through whole
+	hugeWrite := []byte(strings.Repeat("0123456789", 1024))
+	if n, err := fw.Write(hugeWrite); err != nil || n != len(hugeWrite) {
+		t.Fatalf("fw.Write did not write a write larger than the cap. n:%d err:%v", n, err)
+	}
+
+	if err := fw.Flush(); err != nil {
+		t.Fatalf("fw.Flush errored: %s", err)
+	}
+	if !bytes.Equal(hugeWrite, b.Bytes()) {
+		t.Error("Should have flushed the whole write")
+	}
+	if fw.Cap() > 1024 {
+		t.Errorf("Should have reallocated the buffer after flushing. cap:%d", fw.Cap())
+	}
+
+	// The writer is still usable afterwards
+	fw.Write([]byte("after"))
+	fw.Flush()
+	if !bytes.HasSuffix(b.Bytes(), []byte("after")) {
+		t.Error("Should have flushed a write after reallocating")
+	}
+}
+
+func TestFlexibleWriter_DefaultMaxBufferSize(t *testing.T) {
+	fw := NewFlexibleWriter(new(bytes.Buffer))
+	fw.Write(make([]byte, DEFAULT_MAX_BUFFER_SIZE+1))
+	fw.Flush()
+	if fw.Cap() > DEFAULT_MAX_BUFFER_SIZE {
+		t.Errorf("Should have reallocated a buffer past the default cap. cap:%d", fw.Cap())
+	}
+
+	// Without a cap, the buffer is kept
+	fw = NewFlexibleWriter(new(bytes.Buffer), WithMaxBufferSize(0))
+	fw.Write(make([]byte, DEFAULT_MAX_BUFFER_SIZE+1))
+	fw.Flush()
+	if fw.Cap() <= DEFAULT_MAX_BUFFER_SIZE {
+		t.Errorf("Should have kept the buffer without a cap. cap:%d", fw.Cap())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestFlexibleWriter_KeepsUnflushedData(t *testing.T) {
+	fw := NewFlexibleWriter(failingWriter{}, WithMaxBufferSize(16))
+	data := []byte(strings.Repeat("x", 64))
+	fw.Write(data)
+	if err := fw.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+	if !bytes.Equal(fw.Bytes(), data) {
+		t.Error("Should have kept the data that couldn't be flushed")
+	}
+}
+
+//Counts the writes made to the wrapped writer, and gathers vectored ones if vectored is set
+type countingWriter struct {
+	io.Writer
+	vectored bool
+	writes   int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+func (w *countingWriter) CanWriteVectored() bool {
+	return w.vectored
+}
+
+func (w *countingWriter) WriteVectored(buffers *net.Buffers) (int64, error) {
+	w.writes++
+	return WriteVectored(w.Writer, buffers)
+}
+
+func TestFlexibleWriter_WriteBuffersAndFlush(t *testing.T) {
+	for _, vectored := range []bool{true, false} {
+		b := new(bytes.Buffer)
+		w := &countingWriter{Writer: b, vectored: vectored}
+		fw := NewFlexibleWriter(w)
+
+		fw.Write([]byte("buffered "))
+		if err := fw.WriteBuffersAndFlush(net.Buffers{[]byte("first "), []byte("second")}); err != nil {
+			t.Fatalf("fw.WriteBuffersAndFlush errored: %s", err)
+		}
+
+		if b.String() != "buffered first second" {
+			t.Errorf("Should have written the buffered data, then the buffers. vectored:%t got:%q", vectored, b.String())
+		}
+		if w.writes != 1 {
+			t.Errorf("Should have written everything at once. vectored:%t writes:%d", vectored, w.writes)
+		}
+		if fw.Buffered() != 0 {
+			t.Errorf("Should have emptied the buffer. vectored:%t buffered:%d", vectored, fw.Buffered())
+		}
+	}
+}
+
+func TestCanWriteVectored(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer conn.Close()
+
+	if !CanWriteVectored(conn) {
+		t.Error("Should be able to gather writes to a TCP connection")
+	}
+	if !CanWriteVectored(&countingWriter{Writer: conn, vectored: true}) {
+		t.Error("Should be able to gather writes to a VectoredWriter that can")
+	}
+	if CanWriteVectored(new(bytes.Buffer)) {
+		t.Error("Should not be able to gather writes to a buffer")
+	}
+}
+
+//Writes a large array, as a sequence of lines, to a socket, either gathered into vectored writes or copied through
+//the buffer
+func BenchmarkWriteBuffersAndFlush(b *testing.B) {
+	lines := make(net.Buffers, 0, 2048)
+	value := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 1024; i++ {
+		lines = append(lines, []byte("$1024\r\n"), value, []byte("\r\n"))
+	}
+
+	for _, vectored := range []bool{true, false} {
+		name := "copied"
+		if vectored {
+			name = "vectored"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			listener, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				b.Fatalf("Failed to listen: %s", err)
+			}
+			defer listener.Close()
+
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					io.Copy(ioutil.Discard, conn)
+					conn.Close()
+				}
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatalf("Failed to dial: %s", err)
+			}
+			defer conn.Close()
+
+			w := &countingWriter{Writer: conn, vectored: vectored}
+			fw := NewFlexibleWriter(w)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buffers := append(net.Buffers(nil), lines...)
+				if err := fw.WriteBuffersAndFlush(buffers); err != nil {
+					b.Fatalf("fw.WriteBuffersAndFlush errored: %s", err)
+				}
+			}
+		})
+	}
+}